@@ -0,0 +1,166 @@
+package cfsm
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/JoeyEremondi/GoSesh/multiparty"
+)
+
+func TestExploreSafe(test *testing.T) {
+	//A and B play ping-pong forever
+	pingPong := multiparty.RecursiveType{Bind: "X", Body: multiparty.ValueType{Value: multiparty.SingletonValue("int"),
+		ValuePrefix: multiparty.Prefix{P1: "A", P2: "B", PChannel: "b"},
+		ValueNext: multiparty.ValueType{Value: multiparty.SingletonValue("int"),
+			ValuePrefix: multiparty.Prefix{P1: "B", P2: "A", PChannel: "a"},
+			ValueNext:   multiparty.NameType("X")}}}
+	report, err := Analyze(pingPong, Options{})
+	if err != nil {
+		test.Fatal(err)
+	}
+	if !report.Safe() {
+		test.Errorf("Ping-pong should be safe, got %+v", report)
+	}
+}
+
+func TestExploreParallel(test *testing.T) {
+	//A asks B and C in either order, then B answers once both have been asked
+	msg := func(from, to multiparty.Participant, k multiparty.Channel, next multiparty.GlobalType) multiparty.GlobalType {
+		return multiparty.ValueType{Value: multiparty.SingletonValue("int"), ValuePrefix: multiparty.Prefix{P1: from, P2: to, PChannel: k}, ValueNext: next}
+	}
+	gt := multiparty.MakeJoinedParallelType(msg("A", "B", "b", multiparty.EndType{}), msg("A", "C", "c", multiparty.EndType{}),
+		msg("B", "A", "a", multiparty.EndType{}))
+	report, err := Analyze(gt, Options{})
+	if err != nil {
+		test.Fatal(err)
+	}
+	if !report.Safe() {
+		test.Errorf("Parallel requests should be safe, got %+v", report)
+	}
+}
+
+func TestExploreProblems(test *testing.T) {
+	send := func(k multiparty.Channel, next multiparty.LocalType) multiparty.LocalType {
+		return multiparty.LocalSendType{Channel: k, Value: multiparty.SingletonValue("int"), Next: next}
+	}
+	receive := func(k multiparty.Channel, next multiparty.LocalType) multiparty.LocalType {
+		return multiparty.LocalReceiveType{Channel: k, Value: multiparty.SingletonValue("int"), Next: next}
+	}
+	end := multiparty.LocalEndType{}
+
+	cases := []struct {
+		name     string
+		locals   map[multiparty.Participant]multiparty.LocalType
+		kind     ProblemKind
+		schedule []Event
+	}{
+		{"deadlock",
+			map[multiparty.Participant]multiparty.LocalType{
+				"A": receive("a", send("b", end)),
+				"B": receive("b", send("a", end)),
+			},
+			Deadlock, []Event{}},
+		{"orphan",
+			map[multiparty.Participant]multiparty.LocalType{
+				"A": send("b", end),
+				"B": end,
+			},
+			OrphanMessage, []Event{{Participant: "A", Action: multiparty.Action{Kind: multiparty.SendAction, Channel: "b", Value: multiparty.SingletonValue("int")}}}},
+		{"unspecified reception",
+			map[multiparty.Participant]multiparty.LocalType{
+				"A": multiparty.LocalSelectionType{Channel: "b", Branches: map[string]multiparty.LocalType{"quit": end}},
+				"B": multiparty.LocalBranchingType{Channel: "b", Branches: map[string]multiparty.LocalType{"go": end}},
+			},
+			UnspecifiedReception, []Event{{Participant: "A", Action: multiparty.Action{Kind: multiparty.SelectAction, Channel: "b", Label: "quit"}}}},
+	}
+	for _, c := range cases {
+		system, err := NewSystem(c.locals)
+		if err != nil {
+			test.Fatal(err)
+		}
+		report := system.Explore(Options{})
+		if len(report.Problems) == 0 {
+			test.Errorf("%s: no problems found", c.name)
+			continue
+		}
+		problem := report.Problems[0]
+		if problem.Kind != c.kind || !reflect.DeepEqual(problem.Schedule, c.schedule) {
+			test.Errorf("%s: found %s", c.name, problem)
+		}
+	}
+}
+
+func TestSynthesize(test *testing.T) {
+	//A repeatedly sends B numbers, telling C each time whether there will be more
+	tell := func(label string, next multiparty.GlobalType) multiparty.GlobalType {
+		return multiparty.BranchingType{BranchPrefix: multiparty.Prefix{P1: "A", P2: "C", PChannel: "c"},
+			Branches: map[string]multiparty.GlobalType{label: next}}
+	}
+	gt := multiparty.RecursiveType{Bind: "X", Body: multiparty.BranchingType{
+		BranchPrefix: multiparty.Prefix{P1: "A", P2: "B", PChannel: "b"},
+		Branches: map[string]multiparty.GlobalType{
+			"more": multiparty.ValueType{Value: multiparty.SingletonValue("int"), ValuePrefix: multiparty.Prefix{P1: "A", P2: "B", PChannel: "b"},
+				ValueNext: tell("more", multiparty.NameType("X"))},
+			"stop": tell("stop", multiparty.EndType{}),
+		}}}
+	locals := make(map[multiparty.Participant]multiparty.LocalType)
+	for _, p := range gt.Participants() {
+		local, err := gt.Project(p)
+		if err != nil {
+			test.Fatal(err)
+		}
+		locals[p] = local
+	}
+
+	synthesized, err := Synthesize(locals)
+	if err != nil {
+		test.Fatal(err)
+	}
+	for p, local := range locals {
+		projected, err := synthesized.Project(p)
+		if err != nil {
+			test.Fatal(err)
+		}
+		if !projected.EquivalentTo(local) {
+			test.Errorf("Synthesized %s, which projects onto %s as %s instead of %s", synthesized, p, projected, local)
+		}
+	}
+
+	//B expects a string, but is sent a number
+	locals["B"] = multiparty.LocalBranchingType{Channel: "b", Branches: map[string]multiparty.LocalType{
+		"more": multiparty.LocalReceiveType{Channel: "b", Value: multiparty.SingletonValue("string"), Next: multiparty.LocalEndType{}},
+		"stop": multiparty.LocalEndType{},
+	}}
+	if _, err := Synthesize(locals); err == nil {
+		test.Errorf("Synthesis should fail when B receives the wrong sort")
+	}
+}
+
+func TestExport(test *testing.T) {
+	//A sends B a number, and B tells A whether it was right
+	gt := multiparty.ValueType{Value: multiparty.SingletonValue("int"), ValuePrefix: multiparty.Prefix{P1: "A", P2: "B", PChannel: "b"},
+		ValueNext: multiparty.BranchingType{BranchPrefix: multiparty.Prefix{P1: "B", P2: "A", PChannel: "a"},
+			Branches: map[string]multiparty.GlobalType{"right": multiparty.EndType{}, "wrong": multiparty.EndType{}}}}
+	promela, err := ExportPromela(gt, Options{QueueBound: 2})
+	if err != nil {
+		test.Fatal(err)
+	}
+	for _, line := range []string{"mtype = { S_int, L_right, L_wrong };", "chan ch_a = [2] of { mtype };",
+		"active proctype A() {", ":: ch_b!S_int -> goto S1", ":: ch_a?L_wrong -> goto S3", "#define all_done (A@end && B@end)"} {
+		if !strings.Contains(promela, line) {
+			test.Errorf("Expected %q in the Promela model:\n%s", line, promela)
+		}
+	}
+	tla, err := ExportTLA(gt, "Guess", Options{QueueBound: 2})
+	if err != nil {
+		test.Fatal(err)
+	}
+	for _, line := range []string{"---- MODULE Guess ----", "QueueBound == 2", `Labels == {"right", "wrong"}`, `Sorts == {"int"}`,
+		`\/ Send("A", 0, 1, "b", [kind |-> "value", tag |-> "int"])`,
+		`\/ Receive("A", 1, 3, "a", {[kind |-> "label", tag |-> "wrong"]})`} {
+		if !strings.Contains(tla, line) {
+			test.Errorf("Expected %q in the TLA+ specification:\n%s", line, tla)
+		}
+	}
+}
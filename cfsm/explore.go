@@ -0,0 +1,343 @@
+package cfsm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/JoeyEremondi/GoSesh/multiparty"
+)
+
+//Reasonable limits for Options
+const (
+	DefaultQueueBound        = 4
+	DefaultMaxConfigurations = 100000
+)
+
+//Limits on the exploration, which is needed because queues may grow forever.
+//Zero values use the defaults.
+type Options struct {
+	//How many messages may wait on a channel. Sends to a full channel wait until
+	//a message is received, so a problem past this bound may be missed.
+	QueueBound int
+	//How many configurations of the system to visit before giving up
+	MaxConfigurations int
+}
+
+//A system of machines, one for each participant, communicating through
+//a FIFO queue for each channel
+type System struct {
+	//In order of participant
+	Machines []*Machine
+}
+
+//NewSystem builds the machines of the given participants, from their local types
+func NewSystem(locals map[multiparty.Participant]multiparty.LocalType) (*System, error) {
+	participants := make([]multiparty.Participant, 0, len(locals))
+	for p := range locals {
+		participants = append(participants, p)
+	}
+	sort.Slice(participants, func(i, j int) bool { return participants[i] < participants[j] })
+
+	s := &System{Machines: make([]*Machine, 0, len(participants))}
+	for _, p := range participants {
+		m, err := NewMachine(p, locals[p])
+		if err != nil {
+			return nil, err
+		}
+		s.Machines = append(s.Machines, m)
+	}
+	return s, nil
+}
+
+//FromGlobal builds the system of a global type, by projecting it onto each of its participants
+func FromGlobal(gt multiparty.GlobalType) (*System, error) {
+	locals := make(map[multiparty.Participant]multiparty.LocalType)
+	for _, p := range gt.Participants() {
+		local, err := gt.Project(p)
+		if err != nil {
+			return nil, err
+		}
+		locals[p] = local
+	}
+	return NewSystem(locals)
+}
+
+//Analyze explores the system of a global type, see System.Explore
+func Analyze(gt multiparty.GlobalType, opts Options) (Report, error) {
+	s, err := FromGlobal(gt)
+	if err != nil {
+		return Report{}, err
+	}
+	return s.Explore(opts), nil
+}
+
+type ProblemKind int
+
+const (
+	//Some participants are waiting, but nothing can happen
+	Deadlock ProblemKind = iota
+	//Every participant is done, but messages were never received
+	OrphanMessage
+	//A message arrives that its receiver can't handle
+	UnspecifiedReception
+)
+
+func (k ProblemKind) String() string {
+	switch k {
+	case Deadlock:
+		return "deadlock"
+	case OrphanMessage:
+		return "orphan message"
+	case UnspecifiedReception:
+		return "unspecified reception"
+	}
+	return "unknown problem"
+}
+
+//A step of the system: a participant doing an action
+type Event struct {
+	Participant multiparty.Participant
+	Action      multiparty.Action
+}
+
+func (e Event) String() string {
+	return fmt.Sprintf("%s: %s", e.Participant, e.Action)
+}
+
+//A problem found while exploring, with a schedule of events which leads to it
+type Problem struct {
+	Kind ProblemKind
+	//For deadlocks, who is stuck; for unspecified receptions, the receiver
+	Participants []multiparty.Participant
+	Schedule     []Event
+	Reason       string
+}
+
+func (p Problem) String() string {
+	schedule := make([]string, len(p.Schedule))
+	for i, event := range p.Schedule {
+		schedule[i] = event.String()
+	}
+	return fmt.Sprintf("%s after [%s]: %s", p.Kind, strings.Join(schedule, "; "), p.Reason)
+}
+
+//The outcome of exploring a system
+type Report struct {
+	//Each problem is reported once, with the shortest schedule which leads to it
+	Problems []Problem
+	//False if some configurations weren't explored, because of the limits in Options
+	Complete bool
+	//How many configurations were visited
+	Configurations int
+}
+
+//Safe reports whether the whole system was explored without finding any problems
+func (r Report) Safe() bool {
+	return r.Complete && len(r.Problems) == 0
+}
+
+//The state of every machine, and the messages waiting on each channel
+type configuration struct {
+	states []int
+	queues map[multiparty.Channel][]multiparty.Action
+	//How we got here, for building schedules
+	parent int
+	event  Event
+}
+
+func (c *configuration) key() string {
+	channels := make([]string, 0, len(c.queues))
+	for channel := range c.queues {
+		channels = append(channels, string(channel))
+	}
+	sort.Strings(channels)
+	var b strings.Builder
+	fmt.Fprint(&b, c.states)
+	for _, channel := range channels {
+		queue := c.queues[multiparty.Channel(channel)]
+		if len(queue) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "|%q:", channel)
+		for _, message := range queue {
+			fmt.Fprintf(&b, "%q,", message.Format(multiparty.ASCII))
+		}
+	}
+	return b.String()
+}
+
+//Do an event, giving a new configuration
+func (c *configuration) step(index int, machine int, transition Transition, participant multiparty.Participant) *configuration {
+	next := &configuration{states: append([]int(nil), c.states...), queues: make(map[multiparty.Channel][]multiparty.Action),
+		parent: index, event: Event{Participant: participant, Action: transition.Action}}
+	for channel, queue := range c.queues {
+		next.queues[channel] = queue
+	}
+	next.states[machine] = transition.To
+	channel := transition.Action.Channel
+	switch transition.Action.Kind {
+	case multiparty.SendAction, multiparty.SelectAction, multiparty.DelegateAction:
+		queue := c.queues[channel]
+		next.queues[channel] = append(queue[:len(queue):len(queue)], transition.Action)
+	default:
+		next.queues[channel] = c.queues[channel][1:]
+	}
+	return next
+}
+
+//Whether a receiving transition accepts a message
+func accepts(transition Transition, message multiparty.Action) bool {
+	switch transition.Action.Kind {
+	case multiparty.ReceiveAction:
+		return message.Kind == multiparty.SendAction && multiparty.IsValueSubtype(message.Value, transition.Action.Value) &&
+			multiparty.RefinementImplies(message.Refinement, transition.Action.Refinement)
+	case multiparty.BranchAction:
+		return message.Kind == multiparty.SelectAction && message.Label == transition.Action.Label
+	case multiparty.AcceptAction:
+		return message.Kind == multiparty.DelegateAction && message.Session.Participant() == transition.Action.Session.Participant() &&
+			multiparty.IsSubtype(transition.Action.Session, message.Session)
+	}
+	return false
+}
+
+type explorer struct {
+	system   *System
+	opts     Options
+	visited  []*configuration
+	problems []Problem
+	reported map[string]bool
+	complete bool
+}
+
+func (e *explorer) schedule(index int) []Event {
+	ans := make([]Event, 0)
+	for index > 0 {
+		ans = append(ans, e.visited[index].event)
+		index = e.visited[index].parent
+	}
+	for i, j := 0, len(ans)-1; i < j; i, j = i+1, j-1 {
+		ans[i], ans[j] = ans[j], ans[i]
+	}
+	return ans
+}
+
+func (e *explorer) report(index int, kind ProblemKind, participants []multiparty.Participant, reason string) {
+	if e.reported[kind.String()+reason] {
+		return
+	}
+	e.reported[kind.String()+reason] = true
+	e.problems = append(e.problems, Problem{Kind: kind, Participants: participants, Schedule: e.schedule(index), Reason: reason})
+}
+
+//Find the configurations reachable in one step from the visited configuration at index,
+//reporting any problems with it
+func (e *explorer) successors(index int) []*configuration {
+	c := e.visited[index]
+	ans := make([]*configuration, 0)
+	bounded := false
+	for i, m := range e.system.Machines {
+		for _, transition := range m.Transitions[c.states[i]] {
+			queue := c.queues[transition.Action.Channel]
+			switch transition.Action.Kind {
+			case multiparty.SendAction, multiparty.SelectAction, multiparty.DelegateAction:
+				if len(queue) >= e.opts.QueueBound {
+					bounded = true
+					continue
+				}
+				ans = append(ans, c.step(index, i, transition, m.Participant))
+			default:
+				if len(queue) > 0 && accepts(transition, queue[0]) {
+					ans = append(ans, c.step(index, i, transition, m.Participant))
+				}
+			}
+		}
+
+		//A receiver which can't handle the message at the front of a queue it is waiting on
+		transitions := m.Transitions[c.states[i]]
+		checked := make(map[multiparty.Channel]bool)
+		for _, waiting := range transitions {
+			queue := c.queues[waiting.Action.Channel]
+			if !receives(waiting.Action.Kind) || len(queue) == 0 || checked[waiting.Action.Channel] {
+				continue
+			}
+			checked[waiting.Action.Channel] = true
+			handled := false
+			for _, transition := range transitions {
+				handled = handled || transition.Action.Channel == waiting.Action.Channel && accepts(transition, queue[0])
+			}
+			if !handled {
+				e.report(index, UnspecifiedReception, []multiparty.Participant{m.Participant},
+					fmt.Sprintf("%s, but %s arrives", m.describe(c.states[i]), queue[0]))
+			}
+		}
+	}
+	if bounded {
+		e.complete = false
+	}
+	if len(ans) > 0 || bounded {
+		return ans
+	}
+
+	//Nothing can happen: either everyone is done, or we're stuck
+	stuck := make([]multiparty.Participant, 0)
+	waiting := make([]string, 0)
+	for i, m := range e.system.Machines {
+		if !m.Final(c.states[i]) {
+			stuck = append(stuck, m.Participant)
+			waiting = append(waiting, m.describe(c.states[i]))
+		}
+	}
+	if len(stuck) > 0 {
+		e.report(index, Deadlock, stuck, strings.Join(waiting, ", "))
+		return ans
+	}
+	orphans := make([]string, 0)
+	channels := make([]string, 0)
+	for channel := range c.queues {
+		channels = append(channels, string(channel))
+	}
+	sort.Strings(channels)
+	for _, channel := range channels {
+		for _, message := range c.queues[multiparty.Channel(channel)] {
+			orphans = append(orphans, message.String())
+		}
+	}
+	if len(orphans) > 0 {
+		e.report(index, OrphanMessage, nil, fmt.Sprintf("every participant is done, but %s was never received", strings.Join(orphans, ", ")))
+	}
+	return ans
+}
+
+//Explore the configurations the system can reach, breadth first, so that
+//each problem is reported with the shortest schedule which leads to it
+func (s *System) Explore(opts Options) Report {
+	if opts.QueueBound <= 0 {
+		opts.QueueBound = DefaultQueueBound
+	}
+	if opts.MaxConfigurations <= 0 {
+		opts.MaxConfigurations = DefaultMaxConfigurations
+	}
+	initial := &configuration{states: make([]int, len(s.Machines)), queues: make(map[multiparty.Channel][]multiparty.Action)}
+	for i, m := range s.Machines {
+		initial.states[i] = m.Initial
+	}
+
+	e := &explorer{system: s, opts: opts, visited: []*configuration{initial}, reported: make(map[string]bool), complete: true}
+	seen := map[string]bool{initial.key(): true}
+	for index := 0; index < len(e.visited); index++ {
+		for _, next := range e.successors(index) {
+			key := next.key()
+			if seen[key] {
+				continue
+			}
+			if len(e.visited) >= opts.MaxConfigurations {
+				e.complete = false
+				break
+			}
+			seen[key] = true
+			e.visited = append(e.visited, next)
+		}
+	}
+	return Report{Problems: e.problems, Complete: e.complete, Configurations: len(e.visited)}
+}
@@ -0,0 +1,397 @@
+package cfsm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/JoeyEremondi/GoSesh/multiparty"
+)
+
+//A kind of message which can be on a channel, as it appears in an exported model.
+//Models don't carry values, so a message is just a tag saying what was sent.
+type exportedMessage struct {
+	action multiparty.Action
+	//value, label or session
+	kind string
+	//The sorts of a value, a label, or the participant of a delegated session
+	tag string
+	//The name of the message in Promela
+	name string
+}
+
+//What the exported models of a system are made of, with names which are the same in every model
+type exportModel struct {
+	system   *System
+	messages []*exportedMessage
+	byKey    map[string]*exportedMessage
+	//The messages sent on each channel
+	sent     map[multiparty.Channel][]*exportedMessage
+	channels []multiparty.Channel
+	labels   []string
+	sorts    []multiparty.Sort
+	//Names used in Promela
+	names     map[string]bool
+	processes []string
+	queues    map[multiparty.Channel]string
+}
+
+//Identifies a message regardless of its channel, e.g. !<int> or + ok
+func messageKey(a multiparty.Action) string {
+	return strings.TrimPrefix(a.Format(multiparty.ASCII), string(a.Channel))
+}
+
+//Words which Promela reserves, or which the exported model uses itself
+var promelaReserved = map[string]bool{
+	"active": true, "assert": true, "atomic": true, "bit": true, "bool": true, "break": true, "byte": true,
+	"chan": true, "d_step": true, "do": true, "else": true, "empty": true, "enabled": true, "eval": true,
+	"false": true, "fi": true, "for": true, "full": true, "goto": true, "hidden": true, "if": true, "in": true,
+	"init": true, "int": true, "len": true, "mtype": true, "nempty": true, "never": true, "nfull": true,
+	"od": true, "of": true, "pc_value": true, "printf": true, "priority": true, "proctype": true,
+	"provided": true, "run": true, "select": true, "short": true, "skip": true, "timeout": true, "true": true,
+	"typedef": true, "unless": true, "unsigned": true, "xr": true, "xs": true,
+	"end": true, "all_done": true, "no_orphans": true,
+}
+
+//A Promela identifier for name, which no other part of the model uses
+func (x *exportModel) identifier(prefix, name string) string {
+	var b strings.Builder
+	b.WriteString(prefix)
+	underscore := prefix == "" || strings.HasSuffix(prefix, "_")
+	for _, r := range name {
+		if r < 128 && (r == '_' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9') {
+			b.WriteRune(r)
+			underscore = r == '_'
+		} else if !underscore {
+			b.WriteRune('_')
+			underscore = true
+		}
+	}
+	id := strings.TrimSuffix(b.String(), "_")
+	if id == "" || '0' <= id[0] && id[0] <= '9' {
+		id = "_" + id
+	}
+	ans := id
+	for i := 2; x.names[ans] || promelaReserved[ans]; i++ {
+		ans = fmt.Sprintf("%s_%d", id, i)
+	}
+	x.names[ans] = true
+	return ans
+}
+
+func newExportModel(s *System) *exportModel {
+	x := &exportModel{system: s, byKey: make(map[string]*exportedMessage), sent: make(map[multiparty.Channel][]*exportedMessage),
+		names: make(map[string]bool), queues: make(map[multiparty.Channel]string)}
+	tags := make(map[string]bool)
+	labels := make(map[string]bool)
+	sorts := make(map[multiparty.Sort]bool)
+	sentOn := make(map[multiparty.Channel]map[*exportedMessage]bool)
+	for _, m := range s.Machines {
+		x.processes = append(x.processes, x.identifier("", string(m.Participant)))
+		for _, transitions := range m.Transitions {
+			for _, transition := range transitions {
+				a := transition.Action
+				if _, ok := x.queues[a.Channel]; !ok {
+					x.queues[a.Channel] = ""
+					x.channels = append(x.channels, a.Channel)
+				}
+				if a.Label != "" {
+					labels[a.Label] = true
+				}
+				for _, sort := range a.Value {
+					sorts[sort] = true
+				}
+				if receives(a.Kind) {
+					continue
+				}
+				message, ok := x.byKey[messageKey(a)]
+				if !ok {
+					message = &exportedMessage{action: a}
+					switch a.Kind {
+					case multiparty.SendAction:
+						message.kind, message.tag = "value", formatValue(a.Value)
+					case multiparty.SelectAction:
+						message.kind, message.tag = "label", a.Label
+					default:
+						message.kind, message.tag = "session", string(a.Session.Participant())
+					}
+					//Values with different refinements, or sessions of different types, need different tags
+					tag := message.tag
+					for i := 2; tags[message.kind+" "+message.tag]; i++ {
+						message.tag = fmt.Sprintf("%s#%d", tag, i)
+					}
+					tags[message.kind+" "+message.tag] = true
+					x.byKey[messageKey(a)] = message
+					x.messages = append(x.messages, message)
+				}
+				if sentOn[a.Channel] == nil {
+					sentOn[a.Channel] = make(map[*exportedMessage]bool)
+				}
+				if !sentOn[a.Channel][message] {
+					sentOn[a.Channel][message] = true
+					x.sent[a.Channel] = append(x.sent[a.Channel], message)
+				}
+			}
+		}
+	}
+	sort.Slice(x.channels, func(i, j int) bool { return x.channels[i] < x.channels[j] })
+	for _, c := range x.channels {
+		x.queues[c] = x.identifier("ch_", string(c))
+	}
+	prefixes := map[string]string{"value": "S_", "label": "L_", "session": "D_"}
+	for _, message := range x.messages {
+		message.name = x.identifier(prefixes[message.kind], message.tag)
+	}
+	for label := range labels {
+		x.labels = append(x.labels, label)
+	}
+	sort.Strings(x.labels)
+	for sort := range sorts {
+		x.sorts = append(x.sorts, sort)
+	}
+	sort.Slice(x.sorts, func(i, j int) bool { return x.sorts[i] < x.sorts[j] })
+	return x
+}
+
+//The messages which a receiving transition accepts, out of those which are sent on its channel
+func (x *exportModel) accepted(transition Transition) []*exportedMessage {
+	ans := make([]*exportedMessage, 0)
+	for _, message := range x.sent[transition.Action.Channel] {
+		if accepts(transition, message.action) {
+			ans = append(ans, message)
+		}
+	}
+	return ans
+}
+
+func (s *System) queueBound(opts Options) int {
+	if opts.QueueBound <= 0 {
+		return DefaultQueueBound
+	}
+	return opts.QueueBound
+}
+
+//Promela writes the system as a model for the Spin model checker, with a process for each participant
+//and a buffered channel of opts.QueueBound messages for each channel.
+//Messages are tags of an mtype: S_ followed by the sorts of a value, L_ followed by a label,
+//or D_ followed by the participant of a delegated session. Models don't carry values,
+//so refinements are only used to decide which tags a receive accepts.
+//A participant's states are the labels S0, S1, ... of its process, and once it is done it waits at end,
+//so properties can refer to e.g. A@end, as well as to all_done and no_orphans.
+//Spin reports deadlocks as invalid end states, which may also come from sends waiting on a full channel.
+func (s *System) Promela(opts Options) string {
+	x := newExportModel(s)
+	var b strings.Builder
+	b.WriteString("/* Generated by GoSesh */\n\n")
+	if len(x.messages) > 0 {
+		for _, message := range x.messages {
+			fmt.Fprintf(&b, "/* %s: %s %s */\n", message.name, message.kind, message.tag)
+		}
+		names := make([]string, len(x.messages))
+		for i, message := range x.messages {
+			names[i] = message.name
+		}
+		fmt.Fprintf(&b, "mtype = { %s };\n\n", strings.Join(names, ", "))
+	}
+	for _, c := range x.channels {
+		fmt.Fprintf(&b, "chan %s = [%d] of { mtype };\n", x.queues[c], s.queueBound(opts))
+	}
+
+	done := make([]string, len(s.Machines))
+	for i := range s.Machines {
+		done[i] = x.processes[i] + "@end"
+	}
+	empty := make([]string, len(x.channels))
+	for i, c := range x.channels {
+		empty[i] = fmt.Sprintf("len(%s) == 0", x.queues[c])
+	}
+	if len(done) == 0 {
+		done = []string{"true"}
+	}
+	if len(empty) == 0 {
+		empty = []string{"true"}
+	}
+	fmt.Fprintf(&b, "\n#define all_done (%s)\n", strings.Join(done, " && "))
+	fmt.Fprintf(&b, "#define no_orphans (!all_done || %s)\n", strings.Join(empty, " && "))
+
+	for i, m := range s.Machines {
+		fmt.Fprintf(&b, "\nactive proctype %s() {\n", x.processes[i])
+		fmt.Fprintf(&b, "\tgoto S%d;\n", m.Initial)
+		for state, transitions := range m.Transitions {
+			fmt.Fprintf(&b, "S%d: /* %s */\n", state, m.describe(state))
+			if m.Final(state) {
+				b.WriteString("\tgoto end;\n")
+				continue
+			}
+			b.WriteString("\tif\n")
+			options := 0
+			for _, transition := range transitions {
+				queue := x.queues[transition.Action.Channel]
+				if !receives(transition.Action.Kind) {
+					fmt.Fprintf(&b, "\t:: %s!%s -> goto S%d\n", queue, x.byKey[messageKey(transition.Action)].name, transition.To)
+					options++
+					continue
+				}
+				for _, message := range x.accepted(transition) {
+					fmt.Fprintf(&b, "\t:: %s?%s -> goto S%d\n", queue, message.name, transition.To)
+					options++
+				}
+			}
+			if options == 0 {
+				//Nothing that is ever sent can be received here
+				b.WriteString("\t:: false\n")
+			}
+			b.WriteString("\tfi;\n")
+		}
+		b.WriteString("end:\n\tfalse\n}\n")
+	}
+	return b.String()
+}
+
+//A TLA+ string literal
+func tlaString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func (message *exportedMessage) tla() string {
+	return fmt.Sprintf("[kind |-> %s, tag |-> %s]", tlaString(message.kind), tlaString(message.tag))
+}
+
+//A function from each participant to a value, given by f
+func (s *System) tlaRoles(f func(m *Machine) string) string {
+	if len(s.Machines) == 0 {
+		return "[r \\in Roles |-> {}]"
+	}
+	cases := make([]string, len(s.Machines))
+	for i, m := range s.Machines {
+		cases[i] = fmt.Sprintf("r = %s -> %s", tlaString(string(m.Participant)), f(m))
+	}
+	return "[r \\in Roles |-> CASE " + strings.Join(cases, " [] ") + "]"
+}
+
+func tlaSet(elements []string) string {
+	return "{" + strings.Join(elements, ", ") + "}"
+}
+
+//TLA writes the system as a TLA+ specification called module, for the TLC model checker.
+//The variable state maps each participant to the state of its machine, and queues maps each channel
+//to the sequence of messages waiting on it, which are records of a kind (value, label or session)
+//and a tag (the sorts of a value, a label, or the participant of a delegated session).
+//Sorts and Labels enumerate the sorts and labels of the protocol.
+//Models don't carry values, so refinements are only used to decide which messages a receive accepts.
+//Sends wait while opts.QueueBound messages are on their channel. Once every participant is done
+//the system stutters, so TLC only reports a deadlock if someone is stuck, and NoOrphanMessages
+//may be checked as an invariant.
+func (s *System) TLA(module string, opts Options) string {
+	x := newExportModel(s)
+	var b strings.Builder
+	fmt.Fprintf(&b, "---- MODULE %s ----\n", module)
+	b.WriteString("\\* Generated by GoSesh\nEXTENDS Naturals, Sequences\n\n")
+	fmt.Fprintf(&b, "QueueBound == %d\n\n", s.queueBound(opts))
+
+	roles := make([]string, len(s.Machines))
+	for i, m := range s.Machines {
+		roles[i] = tlaString(string(m.Participant))
+	}
+	fmt.Fprintf(&b, "Roles == %s\n", tlaSet(roles))
+	channels := make([]string, len(x.channels))
+	for i, c := range x.channels {
+		channels[i] = tlaString(string(c))
+	}
+	fmt.Fprintf(&b, "Channels == %s\n", tlaSet(channels))
+	sorts := make([]string, len(x.sorts))
+	for i, sort := range x.sorts {
+		sorts[i] = tlaString(string(sort))
+	}
+	fmt.Fprintf(&b, "Sorts == %s\n", tlaSet(sorts))
+	labels := make([]string, len(x.labels))
+	for i, label := range x.labels {
+		labels[i] = tlaString(label)
+	}
+	fmt.Fprintf(&b, "Labels == %s\n", tlaSet(labels))
+	messages := make([]string, len(x.messages))
+	for i, message := range x.messages {
+		messages[i] = message.tla()
+	}
+	fmt.Fprintf(&b, "Messages == %s\n\n", tlaSet(messages))
+
+	fmt.Fprintf(&b, "Initial == %s\n", s.tlaRoles(func(m *Machine) string { return fmt.Sprint(m.Initial) }))
+	fmt.Fprintf(&b, "Final == %s\n\n", s.tlaRoles(func(m *Machine) string {
+		final := make([]string, 0)
+		for state := range m.Transitions {
+			if m.Final(state) {
+				final = append(final, fmt.Sprint(state))
+			}
+		}
+		return tlaSet(final)
+	}))
+
+	b.WriteString(`VARIABLES state, queues
+vars == <<state, queues>>
+
+TypeOK == state \in [Roles -> Nat] /\ queues \in [Channels -> Seq(Messages)]
+
+Init == state = Initial /\ queues = [c \in Channels |-> <<>>]
+
+Send(r, from, to, c, m) ==
+    /\ state[r] = from
+    /\ Len(queues[c]) < QueueBound
+    /\ queues' = [queues EXCEPT ![c] = Append(@, m)]
+    /\ state' = [state EXCEPT ![r] = to]
+
+Receive(r, from, to, c, accepted) ==
+    /\ state[r] = from
+    /\ queues[c] /= <<>>
+    /\ Head(queues[c]) \in accepted
+    /\ queues' = [queues EXCEPT ![c] = Tail(@)]
+    /\ state' = [state EXCEPT ![r] = to]
+
+Done == \A r \in Roles : state[r] \in Final[r]
+
+Next ==
+`)
+	for _, m := range s.Machines {
+		p := tlaString(string(m.Participant))
+		for state, transitions := range m.Transitions {
+			for _, transition := range transitions {
+				a := transition.Action
+				fmt.Fprintf(&b, "    \\* %s: %s\n", m.Participant, a.Format(multiparty.ASCII))
+				if receives(a.Kind) {
+					accepted := make([]string, 0)
+					for _, message := range x.accepted(transition) {
+						accepted = append(accepted, message.tla())
+					}
+					fmt.Fprintf(&b, "    \\/ Receive(%s, %d, %d, %s, %s)\n", p, state, transition.To, tlaString(string(a.Channel)), tlaSet(accepted))
+				} else {
+					fmt.Fprintf(&b, "    \\/ Send(%s, %d, %d, %s, %s)\n", p, state, transition.To, tlaString(string(a.Channel)), x.byKey[messageKey(a)].tla())
+				}
+			}
+		}
+	}
+	b.WriteString(`    \/ Done /\ UNCHANGED vars
+
+Spec == Init /\ [][Next]_vars
+
+NoOrphanMessages == Done => \A c \in Channels : queues[c] = <<>>
+====
+`)
+	return b.String()
+}
+
+//ExportPromela writes the system of a global type as a Promela model, see System.Promela
+func ExportPromela(gt multiparty.GlobalType, opts Options) (string, error) {
+	s, err := FromGlobal(gt)
+	if err != nil {
+		return "", err
+	}
+	return s.Promela(opts), nil
+}
+
+//ExportTLA writes the system of a global type as a TLA+ specification called module, see System.TLA
+func ExportTLA(gt multiparty.GlobalType, module string, opts Options) (string, error) {
+	s, err := FromGlobal(gt)
+	if err != nil {
+		return "", err
+	}
+	return s.TLA(module, opts), nil
+}
@@ -0,0 +1,316 @@
+/**
+* Communicating finite-state machines, for checking that a protocol makes progress.
+*
+* Each participant's local type becomes a finite-state machine, whose transitions
+* send or receive on a channel. The machines of all participants run together,
+* with a FIFO queue of messages for every channel, and we explore the states the
+* system can reach, looking for deadlocks, messages which are never received,
+* and messages which arrive when the receiver can't handle them.
+* The system can also be exported as a Promela or TLA+ model, for checking
+* properties of our own with Spin or TLC.
+ */
+package cfsm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/JoeyEremondi/GoSesh/multiparty"
+)
+
+//A transition of a machine, doing an action and moving to another state
+type Transition struct {
+	Action multiparty.Action
+	To     int
+}
+
+//The finite-state machine of a single participant.
+//Every state either sends, receives, selects or branches on a single channel,
+//or has no transitions, in which case the participant is done.
+//Only a participant doing the parts of a parallel type, or in an interruptible block,
+//has states which may do any of several things.
+type Machine struct {
+	Participant multiparty.Participant
+	Initial     int
+	//The transitions out of each state
+	Transitions [][]Transition
+}
+
+//A state while building a machine. Recursive variables become aliases for the
+//state where their loop starts, which are removed once the machine is built.
+type buildState struct {
+	alias       bool
+	transitions []Transition
+}
+
+type builder struct {
+	states []buildState
+	//The state after each deadline or interruptible block we are building, innermost last.
+	//Machines don't keep time, so the end of a deadline just carries on with what comes after it.
+	exits []int
+}
+
+func (b *builder) add(state buildState) int {
+	b.states = append(b.states, state)
+	return len(b.states) - 1
+}
+
+func sortedLabels(branches map[string]multiparty.LocalType) []string {
+	labels := make([]string, 0, len(branches))
+	for label := range branches {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+func (b *builder) build(lt multiparty.LocalType, env map[multiparty.LocalNameType]int) (int, error) {
+	switch t := lt.(type) {
+	case multiparty.LocalSendType:
+		return b.buildSingle(multiparty.Action{Kind: multiparty.SendAction, Channel: t.Channel, Value: t.Value, Refinement: t.Refinement}, t.Next, env)
+	case multiparty.LocalReceiveType:
+		return b.buildSingle(multiparty.Action{Kind: multiparty.ReceiveAction, Channel: t.Channel, Value: t.Value, Refinement: t.Refinement}, t.Next, env)
+	case multiparty.LocalDelegateType:
+		return b.buildSingle(multiparty.Action{Kind: multiparty.DelegateAction, Channel: t.Channel, Session: t.Session}, t.Next, env)
+	case multiparty.LocalAcceptType:
+		return b.buildSingle(multiparty.Action{Kind: multiparty.AcceptAction, Channel: t.Channel, Session: t.Session}, t.Next, env)
+	case multiparty.LocalSelectionType:
+		return b.buildBranches(multiparty.SelectAction, t.Channel, t.Branches, env)
+	case multiparty.LocalBranchingType:
+		return b.buildBranches(multiparty.BranchAction, t.Channel, t.Branches, env)
+	case multiparty.LocalRecursiveType:
+		alias := b.add(buildState{alias: true})
+		inner := make(map[multiparty.LocalNameType]int)
+		for name, id := range env {
+			inner[name] = id
+		}
+		inner[t.Bind] = alias
+		body, err := b.build(t.Body, inner)
+		b.states[alias].transitions = []Transition{{To: body}}
+		return body, err
+	case multiparty.LocalNameType:
+		id, ok := env[t]
+		if !ok {
+			return 0, fmt.Errorf("free type variable %s", t)
+		}
+		return id, nil
+	case multiparty.LocalDeadlineType:
+		next, err := b.build(t.Next, env)
+		if err != nil {
+			return next, err
+		}
+		b.exits = append(b.exits, next)
+		body, err := b.build(t.Body, env)
+		b.exits = b.exits[:len(b.exits)-1]
+		return body, err
+	case multiparty.LocalInterruptibleType:
+		return b.buildInterruptible(t, env)
+	case multiparty.LocalParallelType:
+		return b.buildParallel(t, env)
+	case multiparty.LocalEndType:
+		if len(b.exits) == 0 {
+			return b.add(buildState{}), nil
+		}
+		return b.exits[len(b.exits)-1], nil
+	case multiparty.ProjectionType:
+		return b.build(t.T, env)
+	}
+	return 0, fmt.Errorf("unsupported local type %T", lt)
+}
+
+func (b *builder) buildSingle(action multiparty.Action, next multiparty.LocalType, env map[multiparty.LocalNameType]int) (int, error) {
+	id := b.add(buildState{})
+	nextId, err := b.build(next, env)
+	b.states[id].transitions = []Transition{{Action: action, To: nextId}}
+	return id, err
+}
+
+func (b *builder) buildBranches(kind multiparty.ActionKind, channel multiparty.Channel, branches map[string]multiparty.LocalType, env map[multiparty.LocalNameType]int) (int, error) {
+	id := b.add(buildState{})
+	transitions := make([]Transition, 0, len(branches))
+	for _, label := range sortedLabels(branches) {
+		next, err := b.build(branches[label], env)
+		if err != nil {
+			return id, err
+		}
+		transitions = append(transitions, Transition{Action: multiparty.Action{Kind: kind, Channel: channel, Label: label}, To: next})
+	}
+	b.states[id].transitions = transitions
+	return id, nil
+}
+
+//The states of the body of an interruptible block can also do its interrupts:
+//the participant raising one may send its label to everyone else in turn instead of sending
+//what comes next, so that nothing it is waiting for is still on its way,
+//and the others may receive it instead of what they are waiting for.
+func (b *builder) buildInterruptible(t multiparty.LocalInterruptibleType, env map[multiparty.LocalNameType]int) (int, error) {
+	next, err := b.build(t.Next, env)
+	if err != nil {
+		return next, err
+	}
+	b.exits = append(b.exits, next)
+	defer func() { b.exits = b.exits[:len(b.exits)-1] }()
+
+	first := len(b.states)
+	body, err := b.build(t.Body, env)
+	if err != nil {
+		return body, err
+	}
+	last := len(b.states)
+
+	for _, interrupt := range t.Interrupts {
+		then, err := b.build(interrupt.Then, env)
+		if err != nil {
+			return then, err
+		}
+		kind := multiparty.BranchAction
+		if interrupt.Raise {
+			kind = multiparty.SelectAction
+		}
+		//Chain the sends of a raised interrupt, from the last one back
+		to := then
+		for i := len(interrupt.Channels) - 1; i > 0; i-- {
+			action := multiparty.Action{Kind: kind, Channel: interrupt.Channels[i], Label: interrupt.Label}
+			to = b.add(buildState{transitions: []Transition{{Action: action, To: to}}})
+		}
+		action := multiparty.Action{Kind: kind, Channel: interrupt.Channels[0], Label: interrupt.Label}
+		for id := first; id < last; id++ {
+			state := b.states[id]
+			if !state.alias && len(state.transitions) > 0 && receives(state.transitions[0].Action.Kind) != interrupt.Raise {
+				b.states[id].transitions = append(state.transitions, Transition{Action: action, To: to})
+			}
+		}
+	}
+	return body, nil
+}
+
+//The parts of a parallel type become a machine each, and we add a state for each pair of their states,
+//which can do whatever either part can do next. Once both parts are done, we carry on with what comes after the join.
+func (b *builder) buildParallel(t multiparty.LocalParallelType, env map[multiparty.LocalNameType]int) (int, error) {
+	next, err := b.build(t.Next, env)
+	if err != nil {
+		return next, err
+	}
+	left, err := NewMachine("", t.Left)
+	if err != nil {
+		return next, err
+	}
+	right, err := NewMachine("", t.Right)
+	if err != nil {
+		return next, err
+	}
+	pairs := make(map[[2]int]int)
+	var pair func(l, r int) int
+	pair = func(l, r int) int {
+		if id, ok := pairs[[2]int{l, r}]; ok {
+			return id
+		}
+		if left.Final(l) && right.Final(r) {
+			id := b.add(buildState{alias: true, transitions: []Transition{{To: next}}})
+			pairs[[2]int{l, r}] = id
+			return id
+		}
+		id := b.add(buildState{})
+		pairs[[2]int{l, r}] = id
+		transitions := make([]Transition, 0)
+		for _, transition := range left.Transitions[l] {
+			transitions = append(transitions, Transition{Action: transition.Action, To: pair(transition.To, r)})
+		}
+		for _, transition := range right.Transitions[r] {
+			transitions = append(transitions, Transition{Action: transition.Action, To: pair(l, transition.To)})
+		}
+		b.states[id].transitions = transitions
+		return id
+	}
+	return pair(left.Initial, right.Initial), nil
+}
+
+//Follow aliases until we reach an actual state, failing on loops which don't communicate
+func (b *builder) resolve(id int) (int, error) {
+	seen := make(map[int]bool)
+	for b.states[id].alias {
+		if seen[id] {
+			return 0, fmt.Errorf("unguarded recursion")
+		}
+		seen[id] = true
+		id = b.states[id].transitions[0].To
+	}
+	return id, nil
+}
+
+//NewMachine builds the finite-state machine of participant p, which behaves as the local type lt
+func NewMachine(p multiparty.Participant, lt multiparty.LocalType) (*Machine, error) {
+	b := &builder{}
+	root, err := b.build(lt, make(map[multiparty.LocalNameType]int))
+	if err != nil {
+		return nil, fmt.Errorf("machine for %s: %v", p, err)
+	}
+
+	//Number the states which aren't aliases
+	numbers := make(map[int]int)
+	for id, state := range b.states {
+		if !state.alias {
+			numbers[id] = len(numbers)
+		}
+	}
+	m := &Machine{Participant: p, Transitions: make([][]Transition, len(numbers))}
+	if root, err = b.resolve(root); err != nil {
+		return nil, fmt.Errorf("machine for %s: %v", p, err)
+	}
+	m.Initial = numbers[root]
+	for id, state := range b.states {
+		if state.alias {
+			continue
+		}
+		transitions := make([]Transition, len(state.transitions))
+		for i, transition := range state.transitions {
+			to, err := b.resolve(transition.To)
+			if err != nil {
+				return nil, fmt.Errorf("machine for %s: %v", p, err)
+			}
+			transitions[i] = Transition{Action: transition.Action, To: numbers[to]}
+		}
+		m.Transitions[numbers[id]] = transitions
+	}
+	return m, nil
+}
+
+//Final reports whether the participant is done in the given state
+func (m *Machine) Final(state int) bool {
+	return len(m.Transitions[state]) == 0
+}
+
+//Describe the sorts of a message: just the sort if there is one, or a tuple
+func formatValue(sorts []multiparty.Sort) string {
+	if len(sorts) == 1 {
+		return string(sorts[0])
+	}
+	names := make([]string, len(sorts))
+	for i, s := range sorts {
+		names[i] = string(s)
+	}
+	return "(" + strings.Join(names, ", ") + ")"
+}
+
+//What the participant is trying to do in the given state
+func (m *Machine) describe(state int) string {
+	transitions := m.Transitions[state]
+	if len(transitions) == 0 {
+		return fmt.Sprintf("%s is done", m.Participant)
+	}
+	action := transitions[0].Action
+	switch action.Kind {
+	case multiparty.SendAction:
+		return fmt.Sprintf("%s waits to send %s on %s", m.Participant, formatValue(action.Value), action.Channel)
+	case multiparty.ReceiveAction:
+		return fmt.Sprintf("%s waits to receive %s on %s", m.Participant, formatValue(action.Value), action.Channel)
+	case multiparty.SelectAction:
+		return fmt.Sprintf("%s waits to select a label on %s", m.Participant, action.Channel)
+	case multiparty.DelegateAction:
+		return fmt.Sprintf("%s waits to delegate %s on %s", m.Participant, action.Session, action.Channel)
+	case multiparty.AcceptAction:
+		return fmt.Sprintf("%s waits to accept %s on %s", m.Participant, action.Session, action.Channel)
+	}
+	return fmt.Sprintf("%s waits to receive a label on %s", m.Participant, action.Channel)
+}
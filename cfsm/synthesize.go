@@ -0,0 +1,180 @@
+package cfsm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/JoeyEremondi/GoSesh/multiparty"
+)
+
+//Builds a global type by running the machines of a system synchronously,
+//so that every send happens together with the receive that matches it
+type synthesizer struct {
+	system *System
+	//The configurations we are currently building the type of
+	onPath map[string]bool
+	//The loops found so far, for configurations which are reached again from inside of themselves
+	names map[string]multiparty.NameType
+	loops int
+}
+
+func receives(kind multiparty.ActionKind) bool {
+	return kind == multiparty.ReceiveAction || kind == multiparty.BranchAction || kind == multiparty.AcceptAction
+}
+
+//Find a participant which can send, and a participant which can receive what it sends.
+//We always pick the first such pair, since any other pair that can go is independent
+//of it, and will still be able to go afterwards.
+func (s *synthesizer) interaction(states []int) (int, int, bool) {
+	for i, sender := range s.system.Machines {
+		sends := sender.Transitions[states[i]]
+		if len(sends) == 0 || receives(sends[0].Action.Kind) {
+			continue
+		}
+		for j, receiver := range s.system.Machines {
+			recvs := receiver.Transitions[states[j]]
+			if i == j || len(recvs) == 0 || recvs[0].Action.Channel != sends[0].Action.Channel {
+				continue
+			}
+			if (sends[0].Action.Kind == multiparty.SendAction && recvs[0].Action.Kind == multiparty.ReceiveAction) ||
+				(sends[0].Action.Kind == multiparty.SelectAction && recvs[0].Action.Kind == multiparty.BranchAction) ||
+				(sends[0].Action.Kind == multiparty.DelegateAction && recvs[0].Action.Kind == multiparty.AcceptAction) {
+				return i, j, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+func (s *synthesizer) synthesize(states []int) (multiparty.GlobalType, error) {
+	key := fmt.Sprint(states)
+	if s.onPath[key] {
+		name, ok := s.names[key]
+		if !ok {
+			s.loops++
+			name = multiparty.NameType(fmt.Sprintf("X%d", s.loops))
+			s.names[key] = name
+		}
+		return name, nil
+	}
+
+	done := true
+	waiting := make([]string, 0)
+	for i, m := range s.system.Machines {
+		if !m.Final(states[i]) {
+			done = false
+			waiting = append(waiting, m.describe(states[i]))
+		}
+	}
+	if done {
+		return multiparty.EndType{}, nil
+	}
+	i, j, ok := s.interaction(states)
+	if !ok {
+		return nil, fmt.Errorf("no participant can communicate: %s", strings.Join(waiting, ", "))
+	}
+
+	s.onPath[key] = true
+	defer delete(s.onPath, key)
+	sender, receiver := s.system.Machines[i], s.system.Machines[j]
+	sends, recvs := sender.Transitions[states[i]], receiver.Transitions[states[j]]
+	prefix := multiparty.Prefix{P1: sender.Participant, P2: receiver.Participant, PChannel: sends[0].Action.Channel}
+	advance := func(send, recv Transition) (multiparty.GlobalType, error) {
+		next := append([]int(nil), states...)
+		next[i], next[j] = send.To, recv.To
+		return s.synthesize(next)
+	}
+
+	var gt multiparty.GlobalType
+	switch sends[0].Action.Kind {
+	case multiparty.DelegateAction:
+		send, recv := sends[0], recvs[0]
+		if !accepts(recv, send.Action) {
+			return nil, fmt.Errorf("%s delegates %s on %s, but %s accepts %s", sender.Participant, send.Action.Session,
+				prefix.PChannel, receiver.Participant, recv.Action.Session)
+		}
+		next, err := advance(send, recv)
+		if err != nil {
+			return nil, err
+		}
+		gt = multiparty.DelegationType{DelegationPrefix: prefix, Session: send.Action.Session, DelegationNext: next}
+	case multiparty.SendAction:
+		send, recv := sends[0], recvs[0]
+		if !multiparty.IsValueSubtype(send.Action.Value, recv.Action.Value) {
+			return nil, fmt.Errorf("%s sends %s on %s, but %s receives %s", sender.Participant, formatValue(send.Action.Value),
+				prefix.PChannel, receiver.Participant, formatValue(recv.Action.Value))
+		}
+		if !multiparty.RefinementImplies(send.Action.Refinement, recv.Action.Refinement) {
+			return nil, fmt.Errorf("%s receives on %s relying on %s, which %s doesn't ensure", receiver.Participant,
+				prefix.PChannel, recv.Action.Refinement, sender.Participant)
+		}
+		next, err := advance(send, recv)
+		if err != nil {
+			return nil, err
+		}
+		gt = multiparty.ValueType{ValuePrefix: prefix, Value: send.Action.Value, Refinement: send.Action.Refinement, ValueNext: next}
+	default:
+		branches := make(map[string]multiparty.GlobalType)
+		for _, send := range sends {
+			var matching *Transition
+			for k := range recvs {
+				if recvs[k].Action.Label == send.Action.Label {
+					matching = &recvs[k]
+				}
+			}
+			if matching == nil {
+				return nil, fmt.Errorf("%s may select label %s on %s, which %s does not handle", sender.Participant,
+					send.Action.Label, prefix.PChannel, receiver.Participant)
+			}
+			next, err := advance(send, *matching)
+			if err != nil {
+				return nil, err
+			}
+			branches[send.Action.Label] = next
+		}
+		gt = multiparty.BranchingType{BranchPrefix: prefix, Branches: branches}
+	}
+
+	if name, ok := s.names[key]; ok {
+		delete(s.names, key)
+		return multiparty.RecursiveType{Bind: name, Body: gt}, nil
+	}
+	return gt, nil
+}
+
+//Synthesize checks that the local types of a set of participants are compatible,
+//and if so, builds the global type which they implement together.
+//
+//The participants are run together synchronously to find the global type. It must be possible
+//to project it onto every participant, and each participant's local type must be a subtype
+//of its projection. The participants must also be free of deadlocks, orphan messages and
+//unspecified receptions when run asynchronously, as far as System.Explore can tell with default Options.
+func Synthesize(locals map[multiparty.Participant]multiparty.LocalType) (multiparty.GlobalType, error) {
+	system, err := NewSystem(locals)
+	if err != nil {
+		return nil, err
+	}
+	s := &synthesizer{system: system, onPath: make(map[string]bool), names: make(map[string]multiparty.NameType)}
+	initial := make([]int, len(system.Machines))
+	for i, m := range system.Machines {
+		initial[i] = m.Initial
+	}
+	gt, err := s.synthesize(initial)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range system.Machines {
+		projected, err := gt.Project(m.Participant)
+		if err != nil {
+			return nil, fmt.Errorf("the synthesized type %s can't be projected: %v", gt, err)
+		}
+		if err := multiparty.CheckSubtype(locals[m.Participant], projected); err != nil {
+			return nil, fmt.Errorf("%s does not implement its part of the synthesized type %s: %v", m.Participant, gt, err)
+		}
+	}
+	if report := system.Explore(Options{}); len(report.Problems) > 0 {
+		return nil, fmt.Errorf("the participants are not compatible: %s", report.Problems[0])
+	}
+	return gt, nil
+}
@@ -6,9 +6,14 @@ capabilities. On top of GoVector's functions, it provides dynamic checking again
 package dynamic
 
 import (
+	"bytes"
+	"encoding/gob"
+	"errors"
 	"fmt"
 	"net"
 	"reflect"
+	"sync"
+	"time"
 
 	"github.com/JoeyEremondi/GoSesh/multiparty"
 	"github.com/arcaneiceman/GoVector/capture"
@@ -19,20 +24,59 @@ import (
 //When network calls are made through the checker, they are checked
 //against its type. It will panic if messages are of the wrong type,
 //if sends and receives are mixed up or to the wrong party,
-//or if sent labels are incorrect.
+//if sent labels are incorrect, if values don't satisfy the refinements on their messages,
+//if something happens after its deadline, or if an interrupt is raised or received where it can't be.
+//The parts of a parallel block may be followed by a checker of their own, see Fork,
+//or by this one, which then keeps track of every state the parts could be in.
 type Checker struct {
-	gv               *govec.GoLog
-	currentType      multiparty.LocalType
-	expectedSortType multiparty.Sort
-	currentLabel     *string
+	gv            *govec.GoLog
+	participant   multiparty.Participant
+	currentType   multiparty.LocalType
+	expectedSorts []multiparty.Sort
+	currentLabel  *string
+	//The values named by refinements of earlier messages, which later refinements may refer to
+	env map[string]interface{}
+	//Set once the session has been delegated to someone else,
+	//after which we may no longer use it
+	handedOff bool
+	//The deadlines and interruptible blocks we are inside of, innermost last
+	scopes []scope
+	//For a part of a parallel block, how many of the scopes are outside of the block,
+	//and so aren't left when the part ends
+	base int
+	//Held while using gv, once the parts of a parallel block share it
+	gvLock *sync.Mutex
+	//The parts of the parallel block we are at, when following them without Fork
+	parts []Checker
+	//Set on a part of a parallel block which has started an action that it hasn't finished yet
+	started bool
+	//Other states we could be in, when more than one part of a parallel block could have done what we've done
+	others []Checker
+	//The label of an interrupt that hasn't been handled yet, if there is one
+	interrupt *string
 	//TODO other stuff handy to have here?
 }
 
+//A deadline or interruptible block we are inside of, and what to do once we are done with it.
+//The handler of an interrupt is neither, and just carries on after the interrupted block.
+type scope struct {
+	//For deadlines, how long we have, and when we first did something inside of it, or zero if we haven't yet
+	within  time.Duration
+	started time.Time
+	//For interruptible blocks, the ways they may be interrupted
+	interrupts []multiparty.LocalInterrupt
+	next       multiparty.LocalType
+}
+
+//Interrupts are sent with this in front of them, so that they can be told apart from other messages
+var interruptMarker = []byte("GoSesh interrupt\x00")
+
 //Create a checker with the given id (participant name)
 //and (local) session type.
 //GoVector logs are stored in ID_LogFile.txt, where ID is the value of id
 func CreateChecker(id string, t multiparty.LocalType) Checker {
-	ret := Checker{govec.Initialize(id, id+"_LogFile.txt"), t, multiparty.Sort("ERROR INITIAL SORT"), nil}
+	ret := Checker{gv: govec.Initialize(id, id+"_LogFile.txt"), participant: multiparty.Participant(id), currentType: t,
+		env: make(map[string]interface{})}
 	//make sure we start with a type we can deal with
 	ret.unfoldIfRecursive()
 	return ret
@@ -47,6 +91,24 @@ func (checker *Checker) unfoldIfRecursive() {
 			checker.currentType = t.UnfoldOneLevel()
 			//Check if there's nested recursion by looping again
 			continue
+		case multiparty.LocalDeadlineType:
+			//The clock starts when we first do something inside of the deadline
+			checker.scopes = append(checker.scopes, scope{within: t.Within, next: t.Next})
+			checker.currentType = t.Body
+			continue
+		case multiparty.LocalInterruptibleType:
+			checker.scopes = append(checker.scopes, scope{interrupts: t.Interrupts, next: t.Next})
+			checker.currentType = t.Body
+			continue
+		case multiparty.LocalEndType:
+			if len(checker.scopes) == checker.base {
+				checker.setExpectedSort()
+				return
+			}
+			//We've done everything the deadline or block covers, so carry on after it
+			checker.currentType = checker.scopes[len(checker.scopes)-1].next
+			checker.scopes = checker.scopes[:len(checker.scopes)-1]
+			continue
 		default:
 			//When we're done, set the sort we're expecting in the next message
 			//if it's a send or receive
@@ -57,15 +119,279 @@ func (checker *Checker) unfoldIfRecursive() {
 }
 
 //Look at the current type, and if it's a send or receive
-//Store sort (message type) in a checker variable
+//Store the sorts (message types) of its values in a checker variable
 func (checker *Checker) setExpectedSort() {
 	switch t := checker.currentType.(type) {
 	//Send and receive: just progress to the "next" type
 	case multiparty.LocalSendType:
-		checker.expectedSortType = t.Value
+		checker.expectedSorts = t.Value
 	case multiparty.LocalReceiveType:
-		checker.expectedSortType = t.Value
+		checker.expectedSorts = t.Value
+	}
+}
+
+//Make sure we may still use the session: we haven't delegated it to someone else,
+//and aren't in the middle of leaving a block which was interrupted
+func (checker *Checker) checkActive(where string) {
+	if checker.handedOff {
+		panic(checker.violation("Tried to do %s after the session was delegated", where))
+	}
+	if checker.interrupt != nil {
+		panic(checker.violation("Tried to do %s before handling interrupt %s", where, *checker.interrupt))
+	}
+}
+
+//Find the innermost interruptible block which we can interrupt, or be interrupted in,
+//with the given label. For interrupts we receive, the channel is the one it came on.
+func (checker *Checker) findInterrupt(label string, raise bool, c multiparty.Channel) (int, multiparty.LocalInterrupt, bool) {
+	for i := len(checker.scopes) - 1; i >= 0; i-- {
+		for _, interrupt := range checker.scopes[i].interrupts {
+			if interrupt.Label == label && interrupt.Raise == raise && (raise || interrupt.Channels[0] == c) {
+				return i, interrupt, true
+			}
+		}
+	}
+	return 0, multiparty.LocalInterrupt{}, false
+}
+
+//Whether we may be interrupted by a message on the given channel
+func (checker *Checker) interruptibleOn(c multiparty.Channel) bool {
+	for _, s := range checker.scopes {
+		for _, interrupt := range s.interrupts {
+			if !interrupt.Raise && interrupt.Channels[0] == c {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//Leave the interrupted block, along with everything inside of it, to do the handler of the interrupt,
+//then carry on after the block
+func (checker *Checker) enterHandler(block int, interrupt multiparty.LocalInterrupt) {
+	next := checker.scopes[block].next
+	checker.scopes = append(checker.scopes[:block], scope{next: next})
+	//Interrupting a block around the parallel block we are a part of leaves the parallel block as well
+	if block < checker.base {
+		checker.base = block
+	}
+	checker.currentType = interrupt.Then
+	checker.currentLabel = nil
+	label := interrupt.Label
+	checker.interrupt = &label
+	checker.unfoldIfRecursive()
+}
+
+//After a read, check whether it was in time, and whether we read an interrupt rather than what we expected.
+//If so, make sure we may be interrupted with it here, and leave the interrupted block.
+func (checker *Checker) checkRead(where string, c multiparty.Channel, b []byte, n int, err error) {
+	if err != nil || n < len(interruptMarker) || !bytes.HasPrefix(b[:n], interruptMarker) {
+		checker.each(middleStep, func(state *Checker) { state.checkReadDeadlines(where, err) })
+		return
+	}
+	var label string
+	checker.withLog(func() { checker.gv.UnpackReceive("Interrupt", b[len(interruptMarker):n], &label) })
+	checker.each(lastStep, func(state *Checker) {
+		state.checkReadDeadlines(where, err)
+		block, interrupt, ok := state.findInterrupt(label, false, c)
+		if !ok {
+			panic(state.violation("Received interrupt %s on %s, which can't interrupt anything here", label, c))
+		}
+		state.enterHandler(block, interrupt)
+	})
+}
+
+//Interrupted reports whether an interruptible block we were in has been interrupted,
+//by us or by someone else, and with which label.
+//The session may not be used again until HandleInterrupt is called,
+//which gives the code of the block the chance to leave it first.
+func (checker *Checker) Interrupted() (string, bool) {
+	var label *string
+	checker.leaves(func(state *Checker) {
+		if label == nil {
+			label = state.interrupt
+		}
+	})
+	if label == nil {
+		return "", false
+	}
+	return *label, true
+}
+
+//HandleInterrupt starts following the handler of the interrupt reported by Interrupted
+func (checker *Checker) HandleInterrupt() {
+	checker.leaves(func(state *Checker) { state.interrupt = nil })
+}
+
+// RaiseInterrupt : Interrupt the innermost interruptible block which we may interrupt with the given label,
+// telling each of the other participants of the block, using the same callbacks as WriteToUDP.
+// An interrupt is raised in place of a send, rather than while waiting to receive something.
+// Afterwards, Interrupted reports the interrupt until it is handled.
+func (checker *Checker) RaiseInterrupt(label string, writeTo func(multiparty.Channel, []byte, *net.UDPAddr) (int, error), addrMaker func(multiparty.Channel) *net.UDPAddr) error {
+	var channels []multiparty.Channel
+	checker.each(wholeStep, func(state *Checker) {
+		state.checkActive("RaiseInterrupt")
+		block, interrupt, ok := state.findInterrupt(label, true, "")
+		if !ok {
+			panic(state.violation("Tried to raise interrupt %s, which can't interrupt anything here", label))
+		}
+		//Anything we were waiting for could still be on its way, and arrive once we've moved on
+		switch state.currentType.(type) {
+		case multiparty.LocalSendType, multiparty.LocalSelectionType, multiparty.LocalDelegateType:
+		default:
+			panic(state.violation("Tried to raise interrupt %s while waiting to receive: interrupts are raised in place of a send", label))
+		}
+		state.checkDeadlines(fmt.Sprintf("RaiseInterrupt %s", label))
+		if channels == nil {
+			channels = interrupt.Channels
+		}
+		state.enterHandler(block, interrupt)
+	})
+	var gvBuffer []byte
+	checker.withLog(func() { gvBuffer = checker.gv.PrepareSend("Interrupt "+label, label) })
+	buf := append(append([]byte{}, interruptMarker...), gvBuffer...)
+	for _, c := range channels {
+		channel := c
+		curriedWrite := func(b []byte, a *net.UDPAddr) (int, error) { return writeTo(channel, b, a) }
+		if _, err := capture.WriteToUDP(curriedWrite, buf, addrMaker(channel)); err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+//Make sure we are still within every deadline we are inside of,
+//and start the clocks of the ones where this is the first thing we do
+func (checker *Checker) checkDeadlines(where string) {
+	now := time.Now()
+	for i := range checker.scopes {
+		d := &checker.scopes[i]
+		if d.within == 0 {
+			continue
+		}
+		if d.started.IsZero() {
+			d.started = now
+		} else if elapsed := now.Sub(d.started); elapsed > d.within {
+			panic(checker.violation("%s happened %s into a deadline of %s", where, elapsed, d.within))
+		}
+	}
+}
+
+//After a read, make sure it happened in time.
+//A read which timed out after a deadline passed means that the message never came in time.
+func (checker *Checker) checkReadDeadlines(where string, err error) {
+	if err == nil {
+		checker.checkDeadlines(where)
+		return
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		if limit, ok := checker.Deadline(); ok && !time.Now().Before(limit) {
+			panic(checker.violation("%s never happened: the deadline passed at %s", where, limit.Format(time.StampMilli)))
+		}
+	}
+}
+
+//Deadline returns the time by which the next action must happen, if there is one,
+//which is the earliest deadline whose clock has started.
+//Use it to set a read deadline on the connection, so that a message which never comes
+//is reported instead of waiting forever.
+func (checker *Checker) Deadline() (time.Time, bool) {
+	var earliest time.Time
+	found := false
+	checker.leaves(func(state *Checker) {
+		for _, d := range state.scopes {
+			if d.within == 0 || d.started.IsZero() {
+				continue
+			}
+			if limit := d.started.Add(d.within); !found || limit.Before(earliest) {
+				earliest = limit
+				found = true
+			}
+		}
+	})
+	return earliest, found
+}
+
+//Make sure the Go types of the values of a message match the sorts we expect,
+//in number and in order
+func (checker *Checker) checkValueTypes(where string, types []string) {
+	if len(types) != len(checker.expectedSorts) {
+		panic(checker.violation("Wrong number of values in %s, given %d expected %d",
+			where, len(types), len(checker.expectedSorts)))
+	}
+	for i, interfaceType := range types {
+		sortType := string(checker.expectedSorts[i])
+		if sortType != interfaceType {
+			panic(checker.violation("Wrong type for value %d in %s, given %s expected %s",
+				i, where, interfaceType, sortType))
+		}
+	}
+}
+
+//Make sure the values of a message satisfy its refinement, if it has one,
+//then remember their names for the refinements of later messages
+func (checker *Checker) checkRefinement(where string, refinement *multiparty.Refinement, values []interface{}) {
+	if refinement == nil {
+		return
+	}
+	holds, err := refinement.Holds(values, checker.env)
+	if err != nil {
+		panic(checker.violation("Could not check refinement in %s: %v", where, err))
+	}
+	if !holds {
+		given := ""
+		for i, name := range refinement.Vars {
+			if name == "" {
+				continue
+			}
+			if given != "" {
+				given += ", "
+			}
+			given += fmt.Sprintf("%s = %#v", name, values[i])
+		}
+		panic(checker.violation("Refinement %s does not hold in %s, given %s", refinement, where, given))
+	}
+	for i, name := range refinement.Vars {
+		if name != "" {
+			checker.env[name] = values[i]
+		}
+	}
+}
+
+//A message with more than one value is sent as a list of values, each encoded separately.
+//Messages with a single value are sent as just that value.
+func encodeValues(values []interface{}) (interface{}, error) {
+	if len(values) == 1 {
+		return values[0], nil
+	}
+	parts := make([][]byte, len(values))
+	for i, value := range values {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+			return nil, err
+		}
+		parts[i] = buf.Bytes()
+	}
+	return parts, nil
+}
+
+func decodeValues(parts [][]byte, unpacks []interface{}) error {
+	if len(parts) != len(unpacks) {
+		return fmt.Errorf("received %d values, expected %d", len(parts), len(unpacks))
+	}
+	for i, part := range parts {
+		if err := gob.NewDecoder(bytes.NewReader(part)).Decode(unpacks[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Describe a violation of the session type, along with the type we were expecting
+//at the time, so that it's clear what the program should have done instead
+func (checker *Checker) violation(format string, args ...interface{}) string {
+	return fmt.Sprintf(format, args...) + "\nCurrent session type:\n" +
+		multiparty.FormatLocal(checker.currentType, multiparty.Unicode)
 }
 
 //After doing something on the network, we advance to the "next" type of our session type
@@ -81,6 +407,12 @@ func (checker *Checker) advanceType() error {
 	case multiparty.LocalReceiveType:
 		checker.currentType = t.Next
 
+	case multiparty.LocalDelegateType:
+		checker.currentType = t.Next
+
+	case multiparty.LocalAcceptType:
+		checker.currentType = t.Next
+
 	//Branch and select: what type we progress to depends on the label that was
 	//sent or received, so we use that to choose the next type
 	case multiparty.LocalBranchingType:
@@ -100,10 +432,10 @@ func (checker *Checker) advanceType() error {
 		}
 
 	case multiparty.LocalEndType:
-		return fmt.Errorf("Tried to keep going after hitting the End type")
+		return errors.New(checker.violation("Tried to keep going after hitting the End type"))
 
 	default:
-		panic("Missing a case for session types! Means recursion probably was improperly removed")
+		return errors.New(checker.violation("Tried to move on from %T, which doesn't send or receive anything", t))
 	}
 	//Finally, unroll any recursion types that we have at the top level
 	checker.unfoldIfRecursive()
@@ -112,165 +444,281 @@ func (checker *Checker) advanceType() error {
 
 //UnpackReceive : Wrapper around GoVector's pack and unpack functions
 //Checks that the current session type is expecting a recieve,
-//and that the message is unpacked into the correct type
-func (checker *Checker) UnpackReceive(mesg string, buf []byte, unpack interface{}) {
+//and that the message is unpacked into the correct types.
+//Pass a pointer for each value of the message, in order.
+func (checker *Checker) UnpackReceive(mesg string, buf []byte, unpacks ...interface{}) {
+	//There's nowhere to unpack a value that isn't given by a pointer
+	for i, unpack := range unpacks {
+		if value := reflect.ValueOf(unpack); value.Kind() != reflect.Ptr || value.IsNil() {
+			panic(checker.violation("Value %d in UnpackReceive should be a non-nil pointer, given %#v", i, unpack))
+		}
+	}
 
 	//Do the GoVector unpack
-	checker.gv.UnpackReceive(mesg, buf, unpack)
-
-	//Make sure we're in a receive or a branch
-	switch t := checker.currentType.(type) {
-	case multiparty.LocalReceiveType:
-		// Check that the interface type is the correct Sort for the send/receive pair
-		interfaceType := reflect.TypeOf(unpack).Elem().String()
-		sortType := reflect.ValueOf(checker.expectedSortType).String()
-
-		if sortType != interfaceType {
-			panic(fmt.Sprintf("Wrong type for message data in UnpackReceive, given %s expected %s",
-				interfaceType, sortType))
+	if len(unpacks) == 1 {
+		checker.withLog(func() { checker.gv.UnpackReceive(mesg, buf, unpacks[0]) })
+	} else {
+		var parts [][]byte
+		checker.withLog(func() { checker.gv.UnpackReceive(mesg, buf, &parts) })
+		if err := decodeValues(parts, unpacks); err != nil {
+			panic(checker.violation("Could not unpack message in UnpackReceive: %v", err))
 		}
-	case multiparty.LocalBranchingType:
-		//Make sure that what was sent was a label (string)
-		//And that it is one of the labels of our current type
-		switch unpackString := unpack.(type) {
-		case *string:
-			_, ok := t.Branches[*unpackString]
-			checker.currentLabel = unpackString
-			if !ok {
-				allBranches := ""
-				for label, _ := range t.Branches {
-					allBranches += label + ", "
-				}
-				panic(fmt.Sprintf(
-					"Received invalid label %s at branching point, should be one of %s",
-					*unpackString, allBranches))
-			}
+	}
 
-		case string:
-			_, ok := t.Branches[unpackString]
-			checker.currentLabel = &unpackString
-			if !ok {
-				allBranches := ""
-				for label, _ := range t.Branches {
-					allBranches += label + ", "
-				}
-				panic(fmt.Sprintf(
-					"Received invalid label %s at branching point, should be one of %s",
-					unpackString, allBranches))
+	checker.each(lastStep, func(state *Checker) {
+		state.checkActive("UnpackReceive")
+
+		//Make sure we're in a receive or a branch
+		switch t := state.currentType.(type) {
+		case multiparty.LocalReceiveType:
+			// Check that the interface types are the correct Sorts for the send/receive pair
+			types := make([]string, len(unpacks))
+			values := make([]interface{}, len(unpacks))
+			for i, unpack := range unpacks {
+				types[i] = reflect.TypeOf(unpack).Elem().String()
+				values[i] = reflect.ValueOf(unpack).Elem().Interface()
 			}
+			state.checkValueTypes("UnpackReceive", types)
+			state.checkRefinement("UnpackReceive", t.Refinement, values)
+		case multiparty.LocalBranchingType:
+			if len(unpacks) != 1 {
+				panic(state.violation("Unpacking %d values at a Branching point. Should be a single label", len(unpacks)))
+			}
+			unpack := unpacks[0]
+			//Make sure that what was sent was a label (string)
+			//And that it is one of the labels of our current type
+			switch unpackString := unpack.(type) {
+			case *string:
+				_, ok := t.Branches[*unpackString]
+				state.currentLabel = unpackString
+				if !ok {
+					allBranches := ""
+					for label, _ := range t.Branches {
+						allBranches += label + ", "
+					}
+					panic(state.violation(
+						"Received invalid label %s at branching point, should be one of %s",
+						*unpackString, allBranches))
+				}
 
-		default:
-			panic("Unpacking data of the wrong type at a Branching point. Should be a string")
-		}
+			default:
+				panic(state.violation("Unpacking data of the wrong type at a Branching point. Should be a string"))
+			}
 
-	case multiparty.LocalSendType:
-		panic("Tried to do receive on send type")
+		case multiparty.LocalSendType:
+			panic(state.violation("Tried to do receive on send type"))
 
-	case multiparty.LocalSelectionType:
-		panic("Tried to do receive on selection type")
+		case multiparty.LocalSelectionType:
+			panic(state.violation("Tried to do receive on selection type"))
 
-	case multiparty.LocalEndType:
-		panic("Tried to do a receive when we should be done communications.")
+		case multiparty.LocalEndType:
+			panic(state.violation("Tried to do a receive when we should be done communications."))
 
-	default:
-		panic(fmt.Sprintf("Unknown type %T in UnpackReceive", t))
-	}
+		default:
+			panic(state.violation("Unknown type %T in UnpackReceive", t))
+		}
 
-	//Now that we're done, advance our type to whatever we do next
-	err := checker.advanceType()
-	if err != nil {
-		panic(err)
-	}
+		//Now that we're done, advance our type to whatever we do next
+		err := state.advanceType()
+		if err != nil {
+			panic(err)
+		}
+	})
 }
 
 // PrepareSend : Prepare a send with GoVector
 // Check that the current session type is expecting a send,
-// and that the given value has the correct type
-func (checker *Checker) PrepareSend(msg string, buf interface{}) []byte {
+// and that the given values have the correct types, in order
+func (checker *Checker) PrepareSend(msg string, bufs ...interface{}) []byte {
 	// Fill the buffer with contents of message
-	gvBuffer := checker.gv.PrepareSend(msg, buf)
-	// Make sure we're in a send or a branch
-	switch t := checker.currentType.(type) {
-	// Check that the interface passed in the correct Sort for the send/receive pair
-	case multiparty.LocalSendType:
-		interfaceType := reflect.TypeOf(buf).String()
-		sortType := reflect.ValueOf(checker.expectedSortType).String()
-
-		if sortType != interfaceType {
-			panic(fmt.Sprintf("Wrong message type in PrepareSend, given %s expected %s", interfaceType, sortType))
-		}
+	message, err := encodeValues(bufs)
+	if err != nil {
+		panic(checker.violation("Could not encode message in PrepareSend: %v", err))
+	}
+	var gvBuffer []byte
+	checker.withLog(func() { gvBuffer = checker.gv.PrepareSend(msg, message) })
+	checker.each(firstStep, func(state *Checker) {
+		state.checkActive("PrepareSend")
+		// Make sure we're in a send or a branch
+		switch t := state.currentType.(type) {
+		// Check that the interfaces passed in are the correct Sorts for the send/receive pair
+		case multiparty.LocalSendType:
+			types := make([]string, len(bufs))
+			for i, buf := range bufs {
+				types[i] = reflect.TypeOf(buf).String()
+			}
+			state.checkValueTypes("PrepareSend", types)
+			state.checkRefinement("PrepareSend", t.Refinement, bufs)
 
-	case multiparty.LocalSelectionType:
-		// Make sure that what was sent was a label (string)
-		// And that it is one of the labels of our current type
-		switch unpackString := buf.(type) {
-		case *string:
-			_, ok := t.Branches[*unpackString]
-			checker.currentLabel = unpackString
-			if !ok {
-				allBranches := ""
-				for label, _ := range t.Branches {
-					allBranches += label + ", "
-				}
-				panic(fmt.Sprintf("Sent invalid label %s at branching point, should be one of %s", *unpackString, allBranches))
+		case multiparty.LocalSelectionType:
+			if len(bufs) != 1 {
+				panic(state.violation("Sending %d values at a Selection point. Should be a single label", len(bufs)))
 			}
+			buf := bufs[0]
+			// Make sure that what was sent was a label (string)
+			// And that it is one of the labels of our current type
+			switch unpackString := buf.(type) {
+			case *string:
+				_, ok := t.Branches[*unpackString]
+				state.currentLabel = unpackString
+				if !ok {
+					allBranches := ""
+					for label, _ := range t.Branches {
+						allBranches += label + ", "
+					}
+					panic(state.violation("Sent invalid label %s at branching point, should be one of %s", *unpackString, allBranches))
+				}
 
-		case string:
-			_, ok := t.Branches[unpackString]
-			checker.currentLabel = &unpackString
-			if !ok {
-				allBranches := ""
-				for label, _ := range t.Branches {
-					allBranches += label + ", "
+			case string:
+				_, ok := t.Branches[unpackString]
+				state.currentLabel = &unpackString
+				if !ok {
+					allBranches := ""
+					for label, _ := range t.Branches {
+						allBranches += label + ", "
+					}
+					panic(state.violation("Sent invalid label %s at branching point, should be one of %s", unpackString, allBranches))
 				}
-				panic(fmt.Sprintf("Sent invalid label %s at branching point, should be one of %s", unpackString, allBranches))
+
+			default:
+				panic(state.violation("Unpacking data of the wrong type at a Selection point. Should be a string"))
 			}
+		case multiparty.LocalReceiveType:
+			panic(state.violation("Tried to do send on receive type"))
 
 		default:
-			panic("Unpacking data of the wrong type at a Selection point. Should be a string")
+			panic(state.violation("Unknown type in PrepareSend %T", t))
 		}
-	case multiparty.LocalReceiveType:
-		panic("Tried to do receive on send type")
+	})
+	return gvBuffer
+}
 
-	default:
-		panic(fmt.Sprintf("Unknown type in PrepareSend %T", t))
-	}
+// PrepareDelegate : Prepare to hand over the session of another checker with GoVector
+// Check that the current session type is expecting a delegation,
+// and that whoever receives it can follow what is left of the delegated session.
+// The delegated checker may not be used afterwards.
+func (checker *Checker) PrepareDelegate(msg string, delegated *Checker) []byte {
+	delegated.checkActive("PrepareDelegate")
+	delegated.checkDelegable()
+	checker.each(firstStep, func(state *Checker) {
+		state.checkActive("PrepareDelegate")
+		t, ok := state.currentType.(multiparty.LocalDelegateType)
+		if !ok {
+			panic(state.violation("Tried to delegate on %T", state.currentType))
+		}
+		if delegated.participant != t.Session.Participant() {
+			panic(state.violation("Delegating the endpoint of %s, expected %s", delegated.participant, t.Session.Participant()))
+		}
+		if err := multiparty.CheckSubtype(t.Session.T, delegated.currentType); err != nil {
+			panic(state.violation("Delegating a session of the wrong type: %v", err))
+		}
+	})
 
+	data, err := multiparty.MarshalLocalType(multiparty.MakeProjectionType(delegated.participant, delegated.currentType))
+	if err != nil {
+		panic(checker.violation("Could not encode delegated session in PrepareDelegate: %v", err))
+	}
+	var gvBuffer []byte
+	checker.withLog(func() { gvBuffer = checker.gv.PrepareSend(msg, data) })
+	delegated.handedOff = true
 	return gvBuffer
+}
+
+// AcceptDelegate : Unpack a session handed over with PrepareDelegate
+// Check that the current session type is expecting to accept a delegation,
+// and that we can follow what is left of the session we are given.
+// Returns a checker for the rest of the delegated session.
+func (checker *Checker) AcceptDelegate(mesg string, buf []byte) Checker {
+	var data []byte
+	checker.withLog(func() { checker.gv.UnpackReceive(mesg, buf, &data) })
+	received, err := multiparty.UnmarshalLocalType(data)
+	if err != nil {
+		panic(checker.violation("Could not decode delegated session in AcceptDelegate: %v", err))
+	}
+
+	var ret *Checker
+	checker.each(lastStep, func(state *Checker) {
+		state.checkActive("AcceptDelegate")
+		t, ok := state.currentType.(multiparty.LocalAcceptType)
+		if !ok {
+			panic(state.violation("Tried to accept a delegation on %T", state.currentType))
+		}
+		session, ok := received.(multiparty.ProjectionType)
+		if !ok || session.Participant() != t.Session.Participant() {
+			panic(state.violation("Accepted an endpoint that isn't for %s", t.Session.Participant()))
+		}
+		if err := multiparty.CheckSubtype(t.Session.T, session.T); err != nil {
+			panic(state.violation("Accepted a session of the wrong type: %v", err))
+		}
+
+		//We continue the session the way we said we would, which the other participants accept
+		if ret == nil {
+			ret = &Checker{gv: state.gv, gvLock: state.gvLock, participant: session.Participant(), currentType: t.Session.T,
+				env: make(map[string]interface{})}
+			ret.unfoldIfRecursive()
+		}
 
+		if err := state.advanceType(); err != nil {
+			panic(err)
+		}
+	})
+	return *ret
+}
+
+//Use the GoVector log, which the parts of a parallel block may be using at the same time
+func (checker *Checker) withLog(f func()) {
+	if checker.gvLock != nil {
+		checker.gvLock.Lock()
+		defer checker.gvLock.Unlock()
+	}
+	f()
 }
 
 //Make sure the given channel matches the channel of the current type
 func (checker *Checker) checkRecvChannel(c multiparty.Channel) {
+	checker.checkActive("a receive")
+	//We may be waiting for an interrupt rather than what comes next
+	if checker.interruptibleOn(c) {
+		return
+	}
 	switch t := checker.currentType.(type) {
 	case multiparty.LocalReceiveType:
 		if t.Channel != c {
-			panic(fmt.Sprintf("Expected to receive on channel %s, but was given %s", t.Channel, c))
+			panic(checker.violation("Expected to receive on channel %s, but was given %s", t.Channel, c))
+		}
+	case multiparty.LocalAcceptType:
+		if t.Channel != c {
+			panic(checker.violation("Expected to receive on channel %s, but was given %s", t.Channel, c))
 		}
 	case multiparty.LocalBranchingType:
 		if t.Channel != c {
-			panic(fmt.Sprintf("Expected to receive on channel %s, but was given %s", t.Channel, c))
+			panic(checker.violation("Expected to receive on channel %s, but was given %s", t.Channel, c))
 		}
 	default:
 		//TODO say what was expected
-		panic(fmt.Sprintf("Cannot do a receive on non-receive localType %T", t))
+		panic(checker.violation("Cannot do a receive on non-receive localType %T", t))
 	}
 }
 
 //Make sure the given channel matches the channel of the current type
 func (checker *Checker) checkSendChannel(c multiparty.Channel) {
+	checker.checkActive("a send")
 	switch t := checker.currentType.(type) {
 	case multiparty.LocalSendType:
 		if t.Channel != c {
-			panic(fmt.Sprintf("Expected to send to channel %s, but was given %s", t.Channel, c))
+			panic(checker.violation("Expected to send to channel %s, but was given %s", t.Channel, c))
+		}
+	case multiparty.LocalDelegateType:
+		if t.Channel != c {
+			panic(checker.violation("Expected to send to channel %s, but was given %s", t.Channel, c))
 		}
 	case multiparty.LocalSelectionType:
 		if t.Channel != c {
-			panic(fmt.Sprintf("Expected to send to channel %s, but was given %s", t.Channel, c))
+			panic(checker.violation("Expected to send to channel %s, but was given %s", t.Channel, c))
 		}
 	default:
 		//TODO say what was expected
-		panic("Cannot do a send on a non-send localType")
+		panic(checker.violation("Cannot do a send on a non-send localType"))
 	}
 }
 
@@ -278,22 +726,26 @@ func (checker *Checker) checkSendChannel(c multiparty.Channel) {
 //The function takes the channel (ip:port) being read from, and a callback which performs the correct network operation
 //from the given channel.
 func (checker *Checker) Read(c multiparty.Channel, read func(multiparty.Channel, []byte) (int, error), b []byte) (int, error) {
-	checker.checkRecvChannel(c)
+	checker.each(firstStep, func(state *Checker) { state.checkRecvChannel(c) })
 
 	curriedRead := func([]byte) (int, error) { return read(c, b) }
-	return capture.Read(curriedRead, b)
+	n, err := capture.Read(curriedRead, b)
+	checker.checkRead(fmt.Sprintf("Read on %s", c), c, b, n, err)
+	return n, err
 }
 
 //A wrapper around the GoVector function of the same name.
 //The function takes the channel (ip:port) being sent to, and a callback which performs the correct network operation
 //from the given channel.
 func (checker *Checker) Write(c multiparty.Channel, write func(c multiparty.Channel, b []byte) (int, error), b []byte) (int, error) {
-	checker.checkSendChannel(c)
-	// Now that we're done, advance our type to whatever we do next
-	err := checker.advanceType()
-	if err != nil {
-		panic(err)
-	}
+	checker.each(lastStep, func(state *Checker) {
+		state.checkSendChannel(c)
+		state.checkDeadlines(fmt.Sprintf("Write on %s", c))
+		// Now that we're done, advance our type to whatever we do next
+		if err := state.advanceType(); err != nil {
+			panic(err)
+		}
+	})
 	curriedWrite := func(b []byte) (int, error) { return write(c, b) }
 	return capture.Write(curriedWrite, b)
 }
@@ -302,22 +754,26 @@ func (checker *Checker) Write(c multiparty.Channel, write func(c multiparty.Chan
 //The function takes the channel (ip:port) being read from, and a callback which performs the correct network operation
 //from the given channel.
 func (checker *Checker) ReadFrom(c multiparty.Channel, readFrom func(multiparty.Channel, []byte) (int, net.Addr, error), b []byte) (int, net.Addr, error) {
-	checker.checkRecvChannel(c)
+	checker.each(firstStep, func(state *Checker) { state.checkRecvChannel(c) })
 
 	curriedRead := func(b []byte) (int, net.Addr, error) { return readFrom(c, b) }
-	return capture.ReadFrom(curriedRead, b)
+	n, addr, err := capture.ReadFrom(curriedRead, b)
+	checker.checkRead(fmt.Sprintf("ReadFrom on %s", c), c, b, n, err)
+	return n, addr, err
 }
 
 //A wrapper around the GoVector function of the same name.
 //The function takes the channel (ip:port) being sent to, and a callback which performs the correct network operation
 //from the given channel.
 func (checker *Checker) WriteTo(c multiparty.Channel, writeTo func(multiparty.Channel, []byte, net.Addr) (int, error), b []byte, addrMaker func(multiparty.Channel) net.Addr) (int, error) {
-	checker.checkSendChannel(c)
-	// Now that we're done, advance our type to whatever we do next
-	err := checker.advanceType()
-	if err != nil {
-		panic(err)
-	}
+	checker.each(lastStep, func(state *Checker) {
+		state.checkSendChannel(c)
+		state.checkDeadlines(fmt.Sprintf("WriteTo on %s", c))
+		// Now that we're done, advance our type to whatever we do next
+		if err := state.advanceType(); err != nil {
+			panic(err)
+		}
+	})
 	curriedWrite := func(b []byte, a net.Addr) (int, error) { return writeTo(c, b, a) }
 	return capture.WriteTo(curriedWrite, b, addrMaker(c))
 }
@@ -326,22 +782,26 @@ func (checker *Checker) WriteTo(c multiparty.Channel, writeTo func(multiparty.Ch
 //The function takes the channel (ip:port) being read from, and a callback which performs the correct network operation
 //from the given channel.
 func (checker *Checker) ReadFromUDP(c multiparty.Channel, readFrom func(multiparty.Channel, []byte) (int, *net.UDPAddr, error), b []byte) (int, *net.UDPAddr, error) {
-	checker.checkRecvChannel(c)
+	checker.each(firstStep, func(state *Checker) { state.checkRecvChannel(c) })
 
 	curriedRead := func(b []byte) (int, *net.UDPAddr, error) { return readFrom(c, b) }
-	return capture.ReadFromUDP(curriedRead, b)
+	n, addr, err := capture.ReadFromUDP(curriedRead, b)
+	checker.checkRead(fmt.Sprintf("ReadFromUDP on %s", c), c, b, n, err)
+	return n, addr, err
 }
 
 //A wrapper around the GoVector function of the same name.
 //The function takes the channel (ip:port) being sent to, and a callback which performs the correct network operation
 //from the given channel.
 func (checker *Checker) WriteToUDP(c multiparty.Channel, writeTo func(multiparty.Channel, []byte, *net.UDPAddr) (int, error), b []byte, addrMaker func(multiparty.Channel) *net.UDPAddr) (int, error) {
-	checker.checkSendChannel(c)
-	// Now that we're done, advance our type to whatever we do next
-	err := checker.advanceType()
-	if err != nil {
-		panic(err)
-	}
+	checker.each(lastStep, func(state *Checker) {
+		state.checkSendChannel(c)
+		state.checkDeadlines(fmt.Sprintf("WriteToUDP on %s", c))
+		// Now that we're done, advance our type to whatever we do next
+		if err := state.advanceType(); err != nil {
+			panic(err)
+		}
+	})
 	curriedWrite := func(b []byte, a *net.UDPAddr) (int, error) { return writeTo(c, b, a) }
 	return capture.WriteToUDP(curriedWrite, b, addrMaker(c))
 }
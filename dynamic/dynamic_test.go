@@ -0,0 +1,386 @@
+package dynamic
+
+import (
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JoeyEremondi/GoSesh/multiparty"
+	"github.com/arcaneiceman/GoVector/govec"
+)
+
+//Run f, returning what it panicked with, if anything
+func recovered(f func()) (ans interface{}) {
+	defer func() { ans = recover() }()
+	f()
+	return nil
+}
+
+func TestEncodeValues(test *testing.T) {
+	//A single value is sent as itself
+	single, err := encodeValues([]interface{}{5})
+	if err != nil || single != 5 {
+		test.Errorf("Encoded a single value as %v: %v", single, err)
+	}
+
+	encoded, err := encodeValues([]interface{}{5, "five", []string{"f", "i", "v", "e"}})
+	if err != nil {
+		test.Fatal(err)
+	}
+	parts := encoded.([][]byte)
+	var (
+		n       int
+		s       string
+		letters []string
+	)
+	if err := decodeValues(parts, []interface{}{&n, &s, &letters}); err != nil {
+		test.Fatal(err)
+	}
+	if n != 5 || s != "five" || !reflect.DeepEqual(letters, []string{"f", "i", "v", "e"}) {
+		test.Errorf("Decoded %v, %v, %v", n, s, letters)
+	}
+
+	//Too few or too many places to unpack into
+	if err := decodeValues(parts, []interface{}{&n, &s}); err == nil {
+		test.Errorf("Decoded 3 values into 2")
+	}
+	if err := decodeValues(parts[:2], []interface{}{&n, &s, &letters}); err == nil {
+		test.Errorf("Decoded 2 values into 3")
+	}
+	//The values must have the sorts they are unpacked into
+	if err := decodeValues(parts, []interface{}{&s, &n, &letters}); err == nil {
+		test.Errorf("Decoded an int as a string, got %q", s)
+	}
+}
+
+func TestUnpackReceivePointers(test *testing.T) {
+	receive := multiparty.LocalReceiveType{Channel: "k", Value: []multiparty.Sort{"int"}, Next: multiparty.LocalEndType{}}
+	var nilInt *int
+	for _, unpack := range []interface{}{5, nilInt, nil} {
+		checker := Checker{participant: "B", currentType: receive, env: make(map[string]interface{})}
+		err := recovered(func() { checker.UnpackReceive("", nil, unpack) })
+		if message, ok := err.(string); !ok || !strings.Contains(message, "non-nil pointer") {
+			test.Errorf("Unpacking into %#v should be a violation, got %v", unpack, err)
+		}
+	}
+}
+
+//A checker for A, logging somewhere that doesn't outlive the test
+func newChecker(test *testing.T, t multiparty.LocalType) Checker {
+	checker := Checker{gv: govec.Initialize("A", filepath.Join(test.TempDir(), "A")), participant: "A", currentType: t,
+		env: make(map[string]interface{})}
+	checker.unfoldIfRecursive()
+	return checker
+}
+
+func send(checker *Checker, c multiparty.Channel, value interface{}) {
+	checker.PrepareSend("", value)
+	checker.Write(c, func(c multiparty.Channel, b []byte) (int, error) { return len(b), nil }, nil)
+}
+
+//Receive a message, which is read and then unpacked into the given pointer
+func receive(checker *Checker, c multiparty.Channel, value interface{}, unpack interface{}) {
+	buf := checker.gv.PrepareSend("", value)
+	checker.Read(c, func(c multiparty.Channel, b []byte) (int, error) { return copy(b, buf), nil }, make([]byte, len(buf)))
+	checker.UnpackReceive("", buf, unpack)
+}
+
+//Read an interrupt instead of what the checker is waiting for
+func readInterrupt(checker *Checker, c multiparty.Channel, label string) {
+	buf := append(append([]byte{}, interruptMarker...), checker.gv.PrepareSend("", label)...)
+	checker.Read(c, func(c multiparty.Channel, b []byte) (int, error) { return copy(b, buf), nil }, make([]byte, len(buf)))
+}
+
+func localSend(c multiparty.Channel, sort multiparty.Sort, next multiparty.LocalType) multiparty.LocalType {
+	return multiparty.LocalSendType{Channel: c, Value: multiparty.SingletonValue(sort), Next: next}
+}
+
+func localReceive(c multiparty.Channel, sort multiparty.Sort, next multiparty.LocalType) multiparty.LocalType {
+	return multiparty.LocalReceiveType{Channel: c, Value: multiparty.SingletonValue(sort), Next: next}
+}
+
+func checkEnd(test *testing.T, checker Checker) {
+	if _, ok := checker.currentType.(multiparty.LocalEndType); !ok || checker.interleaving() {
+		test.Errorf("Expected to be done, at %s", multiparty.FormatLocal(checker.currentType, multiparty.ASCII))
+	}
+}
+
+func TestParallel(test *testing.T) {
+	//A sends twice on k while receiving twice on j, then sends on done
+	end := multiparty.LocalEndType{}
+	parallel := multiparty.LocalParallelType{
+		Left:  localSend("k", "int", localSend("k", "int", end)),
+		Right: localReceive("j", "string", localReceive("j", "string", end)),
+		Next:  localSend("done", "bool", end)}
+	var s string
+
+	//Both parts make progress in turn
+	checker := newChecker(test, parallel)
+	send(&checker, "k", 1)
+	receive(&checker, "j", "a", &s)
+	send(&checker, "k", 2)
+	receive(&checker, "j", "b", &s)
+	send(&checker, "done", true)
+	checkEnd(test, checker)
+
+	//What comes after the block waits for both parts, and neither part may do the other's actions
+	checker = newChecker(test, parallel)
+	if recovered(func() { send(&checker, "done", true) }) == nil {
+		test.Errorf("Sent on done before either part was done")
+	}
+	receive(&checker, "j", "a", &s)
+	receive(&checker, "j", "b", &s)
+	if recovered(func() { send(&checker, "done", true) }) == nil {
+		test.Errorf("Sent on done before the sends on k")
+	}
+	if recovered(func() { send(&checker, "k", "one") }) == nil {
+		test.Errorf("Sent a string on k")
+	}
+	if recovered(func() { receive(&checker, "j", "c", &s) }) == nil {
+		test.Errorf("Received a third time on j")
+	}
+
+	//The parts can be followed by checkers of their own
+	checker = newChecker(test, parallel)
+	left, right := checker.Fork()
+	if recovered(func() { checker.Join(left, right) }) == nil {
+		test.Errorf("Joined the parts before they were done")
+	}
+	receive(&right, "j", "a", &s)
+	send(&left, "k", 1)
+	send(&left, "k", 2)
+	if recovered(func() { send(&left, "j", "b") }) == nil {
+		test.Errorf("Sent on j from the part which receives on it")
+	}
+	receive(&right, "j", "b", &s)
+	checker.Join(left, right)
+	send(&checker, "done", true)
+	checkEnd(test, checker)
+}
+
+func TestParallelScopes(test *testing.T) {
+	end := multiparty.LocalEndType{}
+	parallel := multiparty.LocalParallelType{Left: localSend("k", "int", end), Right: localSend("m", "int", end), Next: end}
+	within := func(limit time.Duration) multiparty.LocalType {
+		return multiparty.LocalDeadlineType{Within: limit, Body: parallel, Next: localSend("done", "bool", end)}
+	}
+
+	//The clock of a deadline around the block starts with the first thing either part does
+	checker := newChecker(test, within(time.Hour))
+	if _, ok := checker.Deadline(); ok {
+		test.Errorf("The deadline started before anything was done")
+	}
+	send(&checker, "m", 1)
+	if _, ok := checker.Deadline(); !ok {
+		test.Errorf("The deadline didn't start with the send on m")
+	}
+	send(&checker, "k", 1)
+	send(&checker, "done", true)
+	checkEnd(test, checker)
+
+	//And either part may be late for it
+	checker = newChecker(test, within(time.Millisecond))
+	send(&checker, "k", 1)
+	time.Sleep(5 * time.Millisecond)
+	if err := recovered(func() { send(&checker, "m", 2) }); err == nil || !strings.Contains(err.(string), "deadline") {
+		test.Errorf("Sent on m after the deadline, got %v", err)
+	}
+
+	//An interrupt of a block around the parallel block leaves both parts, wherever they are
+	interruptible := multiparty.LocalInterruptibleType{
+		Body: multiparty.LocalParallelType{
+			Left:  localSend("k", "int", localSend("k", "int", end)),
+			Right: localReceive("j", "string", end),
+			Next:  end},
+		Interrupts: []multiparty.LocalInterrupt{
+			{Label: "stop", Channels: []multiparty.Channel{"j"}, Then: localSend("done", "bool", end)},
+			{Label: "cancel", Raise: true, Channels: []multiparty.Channel{"k"}, Then: end}},
+		Next: end}
+	checker = newChecker(test, interruptible)
+	send(&checker, "k", 1)
+	readInterrupt(&checker, "j", "stop")
+	if label, ok := checker.Interrupted(); !ok || label != "stop" {
+		test.Errorf("Expected to be interrupted with stop, got %q", label)
+	}
+	checker.HandleInterrupt()
+	if recovered(func() { send(&checker, "k", 2) }) == nil {
+		test.Errorf("Sent on k after the block was interrupted")
+	}
+	send(&checker, "done", true)
+	checkEnd(test, checker)
+
+	checker = newChecker(test, interruptible)
+	writeTo := func(c multiparty.Channel, b []byte, addr *net.UDPAddr) (int, error) { return len(b), nil }
+	addrMaker := func(c multiparty.Channel) *net.UDPAddr { return nil }
+	if err := checker.RaiseInterrupt("cancel", writeTo, addrMaker); err != nil {
+		test.Fatal(err)
+	}
+	checker.HandleInterrupt()
+	checkEnd(test, checker)
+
+	//The same goes for parts followed by checkers of their own
+	checker = newChecker(test, interruptible)
+	left, right := checker.Fork()
+	send(&left, "k", 1)
+	readInterrupt(&right, "j", "stop")
+	checker.Join(left, right)
+	if label, ok := checker.Interrupted(); !ok || label != "stop" {
+		test.Errorf("Expected to be interrupted with stop after the join, got %q", label)
+	}
+	checker.HandleInterrupt()
+	send(&checker, "done", true)
+	checkEnd(test, checker)
+}
+
+func TestDelegation(test *testing.T) {
+	//A hands C's endpoint of another session over to B on d, and B carries on by receiving on k
+	end := multiparty.LocalEndType{}
+	session := multiparty.MakeProjectionType("C", localReceive("k", "int", end))
+	delegator := newChecker(test, multiparty.LocalDelegateType{Channel: "d", Session: session, Next: end})
+	delegated := Checker{gv: delegator.gv, participant: "C", currentType: session.T, env: make(map[string]interface{})}
+
+	//Only C's endpoint may be handed over
+	other := Checker{gv: delegator.gv, participant: "D", currentType: session.T, env: make(map[string]interface{})}
+	if recovered(func() { delegator.PrepareDelegate("", &other) }) == nil {
+		test.Errorf("Delegated the endpoint of D instead of C")
+	}
+
+	buf := delegator.PrepareDelegate("", &delegated)
+	delegator.Write("d", func(c multiparty.Channel, b []byte) (int, error) { return len(b), nil }, buf)
+	checkEnd(test, delegator)
+
+	//A can't use the endpoint once B has it
+	var n int
+	if err := recovered(func() { receive(&delegated, "k", 1, &n) }); err == nil || !strings.Contains(err.(string), "delegated") {
+		test.Errorf("Received on k after delegating the session, got %v", err)
+	}
+
+	acceptor := newChecker(test, multiparty.LocalAcceptType{Channel: "d", Session: session, Next: end})
+	acceptor.Read("d", func(c multiparty.Channel, b []byte) (int, error) { return copy(b, buf), nil }, make([]byte, len(buf)))
+	continued := acceptor.AcceptDelegate("", buf)
+	checkEnd(test, acceptor)
+	if continued.participant != "C" || !continued.currentType.Equals(session.T) {
+		test.Errorf("Accepted the endpoint of %s at %s", continued.participant, multiparty.FormatLocal(continued.currentType, multiparty.ASCII))
+	}
+	if recovered(func() { send(&continued, "k", 1) }) == nil {
+		test.Errorf("Sent on k in a session which receives on it")
+	}
+	receive(&continued, "k", 1, &n)
+	checkEnd(test, continued)
+}
+
+func TestRefinements(test *testing.T) {
+	//A is told an amount, which must be positive, then refunds no more than it
+	positive, _ := multiparty.NewRefinement("positive", "amount > 0", "amount")
+	bounded, _ := multiparty.NewRefinement("bounded", "refund <= amount", "refund")
+	refund := multiparty.LocalReceiveType{Channel: "k", Value: multiparty.SingletonValue("int"), Refinement: &positive,
+		Next: multiparty.LocalSendType{Channel: "j", Value: multiparty.SingletonValue("int"), Refinement: &bounded,
+			Next: multiparty.LocalEndType{}}}
+	var n int
+
+	checker := newChecker(test, refund)
+	receive(&checker, "k", 10, &n)
+	send(&checker, "j", 10)
+	checkEnd(test, checker)
+
+	//Violations say which values they were given, whether received or sent
+	checker = newChecker(test, refund)
+	if err := recovered(func() { receive(&checker, "k", -5, &n) }); err == nil || !strings.Contains(err.(string), "amount = -5") {
+		test.Errorf("Received a negative amount, got %v", err)
+	}
+	//The refund is bounded by the amount received before it
+	checker = newChecker(test, refund)
+	receive(&checker, "k", 10, &n)
+	if err := recovered(func() { send(&checker, "j", 20) }); err == nil || !strings.Contains(err.(string), "refund = 20") {
+		test.Errorf("Refunded more than the amount, got %v", err)
+	}
+
+	//And so is the refund of whoever sent the amount
+	refunded := multiparty.LocalSendType{Channel: "k", Value: multiparty.SingletonValue("int"), Refinement: &positive,
+		Next: multiparty.LocalReceiveType{Channel: "j", Value: multiparty.SingletonValue("int"), Refinement: &bounded,
+			Next: multiparty.LocalEndType{}}}
+	checker = newChecker(test, refunded)
+	if err := recovered(func() { send(&checker, "k", 0) }); err == nil || !strings.Contains(err.(string), "amount = 0") {
+		test.Errorf("Sent an amount of 0, got %v", err)
+	}
+	checker = newChecker(test, refunded)
+	send(&checker, "k", 10)
+	if err := recovered(func() { receive(&checker, "j", 20, &n) }); err == nil || !strings.Contains(err.(string), "refund = 20") {
+		test.Errorf("Received a refund of more than the amount, got %v", err)
+	}
+}
+
+//A read which gave up waiting
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestDeadlines(test *testing.T) {
+	//A asks on k, then must hear back on j within the deadline
+	end := multiparty.LocalEndType{}
+	within := func(limit time.Duration) multiparty.LocalType {
+		return multiparty.LocalDeadlineType{Within: limit, Body: localSend("k", "int", localSend("m", "int", localReceive("j", "int", end))), Next: end}
+	}
+	var n int
+
+	checker := newChecker(test, within(time.Hour))
+	send(&checker, "k", 1)
+	send(&checker, "m", 1)
+	receive(&checker, "j", 1, &n)
+	checkEnd(test, checker)
+
+	//Writing too late is reported
+	checker = newChecker(test, within(time.Millisecond))
+	send(&checker, "k", 1)
+	time.Sleep(5 * time.Millisecond)
+	if err := recovered(func() { send(&checker, "m", 1) }); err == nil || !strings.Contains(err.(string), "deadline") {
+		test.Errorf("Sent on m after the deadline, got %v", err)
+	}
+
+	//So is a read which timed out once the deadline passed, but not one which timed out before it
+	timedOut := func(c multiparty.Channel, b []byte) (int, error) { return 0, timeoutError{} }
+	checker = newChecker(test, within(time.Hour))
+	send(&checker, "k", 1)
+	send(&checker, "m", 1)
+	if err := recovered(func() { checker.Read("j", timedOut, make([]byte, 10)) }); err != nil {
+		test.Errorf("Timed out before the deadline, got %v", err)
+	}
+	checker = newChecker(test, within(5*time.Millisecond))
+	send(&checker, "k", 1)
+	send(&checker, "m", 1)
+	time.Sleep(10 * time.Millisecond)
+	if err := recovered(func() { checker.Read("j", timedOut, make([]byte, 10)) }); err == nil || !strings.Contains(err.(string), "never happened") {
+		test.Errorf("Timed out after the deadline, got %v", err)
+	}
+
+	//The deadline to read by is the earliest one which has started
+	nested := func(outer, inner time.Duration) multiparty.LocalType {
+		return multiparty.LocalDeadlineType{Within: outer,
+			Body: localSend("k", "int", multiparty.LocalDeadlineType{Within: inner, Body: localSend("m", "int", localSend("m", "int", end)), Next: end}),
+			Next: end}
+	}
+	for _, c := range []struct{ outer, inner, earliest time.Duration }{
+		{time.Hour, time.Minute, time.Minute},
+		{time.Minute, time.Hour, time.Minute},
+	} {
+		checker = newChecker(test, nested(c.outer, c.inner))
+		if _, ok := checker.Deadline(); ok {
+			test.Errorf("The deadline started before anything was done")
+		}
+		start := time.Now()
+		send(&checker, "k", 1)
+		if limit, ok := checker.Deadline(); !ok || limit.After(time.Now().Add(c.outer)) {
+			test.Errorf("The outer deadline of %s ends at %s", c.outer, limit)
+		}
+		send(&checker, "m", 1)
+		limit, ok := checker.Deadline()
+		if !ok || limit.Before(start.Add(c.earliest)) || limit.After(time.Now().Add(c.earliest)) {
+			test.Errorf("Within %s and %s, the deadline is %s from now", c.outer, c.inner, time.Until(limit))
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package dynamic
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JoeyEremondi/GoSesh/multiparty"
+)
+
+//How an action is split across calls to the checker, e.g. a read followed by unpacking what was read,
+//so that in a parallel block followed without Fork, the same part does all of it
+type step int
+
+const (
+	//An action done in a single call
+	wholeStep step = iota
+	//The start of an action, which any part that can do it may have started
+	firstStep
+	//More of an action, done by the part which started it
+	middleStep
+	//The end of an action, done by the part which started it
+	lastStep
+)
+
+//Do an action in every state we could be in, by calling action on the checker following
+//the part of the session which does it. A part of a parallel block that isn't followed
+//with Fork may do the action whenever it is ready to, so each part is tried in turn.
+//action panics if it can't be done, the same way the checker reports a violation.
+//Each state in which nothing can do the action is dropped, and if none are left,
+//the action was a violation in all of them.
+func (checker *Checker) each(s step, action func(*Checker)) {
+	var results []Checker
+	var failure interface{}
+	//Two ways of doing the actions so far can end up in the same state,
+	//which only needs to be followed once
+	seen := make(map[string]bool)
+	for _, state := range append([]Checker{*checker}, checker.others...) {
+		state.others = nil
+		next, err := state.interleave(s, action)
+		if failure == nil {
+			failure = err
+		}
+		for _, result := range next {
+			if key := result.key(); !seen[key] {
+				seen[key] = true
+				results = append(results, result)
+			}
+		}
+	}
+	if len(results) == 0 {
+		panic(failure)
+	}
+	*checker = results[0]
+	checker.others = results[1:]
+}
+
+//The states we could be in after doing an action, along with why it couldn't be done if there are none
+func (checker Checker) interleave(s step, action func(*Checker)) ([]Checker, interface{}) {
+	if t, ok := checker.currentType.(multiparty.LocalParallelType); ok && checker.parts == nil && !checker.handedOff {
+		checker.parts = []Checker{checker.forkPart(t.Left), checker.forkPart(t.Right)}
+	}
+	if checker.parts == nil {
+		state := checker.clone()
+		if failure := state.try(action); failure != nil {
+			return nil, failure
+		}
+		return []Checker{state}, nil
+	}
+
+	//An action someone started is finished by the same part
+	tried := []int{0, 1}
+	if s == middleStep || s == lastStep {
+		for i, part := range checker.parts {
+			if part.started {
+				tried = []int{i}
+			}
+		}
+	}
+	var results []Checker
+	var failures []string
+	for _, i := range tried {
+		next, failure := checker.parts[i].interleave(s, action)
+		if failure != nil {
+			failures = append(failures, fmt.Sprint(failure))
+		}
+		for _, part := range next {
+			part.started = s == firstStep || s == middleStep
+			if part.base < len(checker.scopes) {
+				results = append(results, checker.leave(part))
+				continue
+			}
+			state := checker.clone()
+			state.parts[i] = part
+			//The clocks of the deadlines around the block are shared by both parts
+			for j := range state.scopes {
+				state.startClock(j, part.scopes[j].started)
+			}
+			if state.parts[0].done() && state.parts[1].done() {
+				left, right := state.parts[0], state.parts[1]
+				state.parts = nil
+				state.join(left, right)
+			}
+			results = append(results, state)
+		}
+	}
+	if len(results) == 0 {
+		//Each failure says how far its part has got
+		return nil, "No part of the parallel block could do it:\n" + strings.Join(failures, "\n")
+	}
+	return results, nil
+}
+
+//Do an action, reporting what went wrong instead of panicking.
+//Mistakes in the checker itself still panic.
+func (checker *Checker) try(action func(*Checker)) (failure interface{}) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, bug := r.(runtime.Error); bug {
+				panic(r)
+			}
+			failure = r
+		}
+	}()
+	action(checker)
+	return nil
+}
+
+//A copy of the checker which can be changed without changing the original
+func (checker Checker) clone() Checker {
+	env := make(map[string]interface{}, len(checker.env))
+	for name, value := range checker.env {
+		env[name] = value
+	}
+	checker.env = env
+	checker.scopes = append([]scope{}, checker.scopes...)
+	if checker.parts != nil {
+		parts := make([]Checker, len(checker.parts))
+		for i, part := range checker.parts {
+			parts[i] = part.clone()
+		}
+		checker.parts = parts
+	}
+	return checker
+}
+
+//Everything that tells a state apart from the others we could be in.
+//The GoVector log is shared by all of them, so it is left out.
+func (checker Checker) key() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s %v %v %d %v", checker.participant, multiparty.FormatLocal(checker.currentType, multiparty.ASCII),
+		checker.expectedSorts, checker.handedOff, checker.base, checker.started)
+	if checker.currentLabel != nil {
+		fmt.Fprintf(&b, " label %q", *checker.currentLabel)
+	}
+	if checker.interrupt != nil {
+		fmt.Fprintf(&b, " interrupt %q", *checker.interrupt)
+	}
+	names := make([]string, 0, len(checker.env))
+	for name := range checker.env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&b, " %s = %#v", name, checker.env[name])
+	}
+	for _, sc := range checker.scopes {
+		fmt.Fprintf(&b, " scope(%v %d %s", sc.within, sc.started.UnixNano(), multiparty.FormatLocal(sc.next, multiparty.ASCII))
+		for _, interrupt := range sc.interrupts {
+			fmt.Fprintf(&b, " %q %v %v %s", interrupt.Label, interrupt.Raise, interrupt.Channels,
+				multiparty.FormatLocal(interrupt.Then, multiparty.ASCII))
+		}
+		b.WriteString(")")
+	}
+	for _, part := range checker.parts {
+		fmt.Fprintf(&b, " part(%s)", part.key())
+	}
+	return b.String()
+}
+
+//Call f on each checker following a part of the session that we could be in
+func (checker *Checker) leaves(f func(*Checker)) {
+	var visit func(*Checker)
+	visit = func(state *Checker) {
+		if state.parts == nil {
+			f(state)
+			return
+		}
+		for i := range state.parts {
+			visit(&state.parts[i])
+		}
+	}
+	visit(checker)
+	for i := range checker.others {
+		visit(&checker.others[i])
+	}
+}
+
+//Whether we are following the parts of a parallel block ourselves,
+//rather than leaving them to the checkers from Fork
+func (checker *Checker) interleaving() bool {
+	return checker.parts != nil || len(checker.others) != 0
+}
+
+//A checker for a part of the parallel block we are at the start of,
+//with its own copy of what it knows, and of the deadlines it is inside of
+func (checker *Checker) forkPart(lt multiparty.LocalType) Checker {
+	if checker.gvLock == nil {
+		checker.gvLock = &sync.Mutex{}
+	}
+	part := Checker{gv: checker.gv, gvLock: checker.gvLock, participant: checker.participant, currentType: lt,
+		env: checker.env, scopes: checker.scopes, base: len(checker.scopes)}.clone()
+	part.unfoldIfRecursive()
+	return part
+}
+
+//Whether a part of a parallel block has nothing left to do
+func (checker Checker) done() bool {
+	_, end := checker.currentType.(multiparty.LocalEndType)
+	return end && len(checker.scopes) == checker.base && checker.parts == nil
+}
+
+//Carry on with the handler of an interrupt which a part was interrupted with,
+//for a block around the parallel block we are at, leaving the other part behind
+func (checker Checker) leave(part Checker) Checker {
+	state := part.clone()
+	if checker.base < state.base {
+		state.base = checker.base
+	}
+	state.started = false
+	//The clock of a deadline around the interrupted block may have been started by the other part
+	for _, other := range checker.parts {
+		for i := 0; i < len(state.scopes)-1 && i < len(other.scopes); i++ {
+			state.startClock(i, other.scopes[i].started)
+		}
+	}
+	state.unfoldIfRecursive()
+	return state
+}
+
+//Start the clock of the deadline at the given scope, unless it started earlier,
+//along with the copies of it in the parts of the parallel block we are at
+func (checker *Checker) startClock(i int, started time.Time) {
+	if started.IsZero() {
+		return
+	}
+	if d := &checker.scopes[i]; d.started.IsZero() || started.Before(d.started) {
+		d.started = started
+	}
+	for j := range checker.parts {
+		checker.parts[j].startClock(i, started)
+	}
+}
+
+//Carry on after the parallel block we are at, once both parts are done
+func (checker *Checker) join(left, right Checker) {
+	t := checker.currentType.(multiparty.LocalParallelType)
+	for _, part := range []Checker{left, right} {
+		for name, value := range part.env {
+			checker.env[name] = value
+		}
+		//The clock of a deadline started by either part has started for us as well
+		for i := range checker.scopes {
+			checker.startClock(i, part.scopes[i].started)
+		}
+	}
+	checker.currentType = t.Next
+	checker.unfoldIfRecursive()
+}
+
+// Fork : Start the parts of a parallel block
+// Check that the current session type is a parallel block, and return a checker
+// for each of its parts, which may be used at the same time, e.g. from goroutines of their own.
+// Once both parts are done, give them to Join to carry on after the block.
+// A parallel block may instead be followed with this checker alone, doing the actions of its parts
+// in any order, as long as they are done from a single goroutine.
+func (checker *Checker) Fork() (Checker, Checker) {
+	checker.checkActive("Fork")
+	t, ok := checker.currentType.(multiparty.LocalParallelType)
+	if !ok {
+		panic(checker.violation("Tried to start a parallel block on %T", checker.currentType))
+	}
+	if checker.interleaving() {
+		panic(checker.violation("Tried to start a parallel block which is already being followed without Fork"))
+	}
+	return checker.forkPart(t.Left), checker.forkPart(t.Right)
+}
+
+// Join : Carry on after a parallel block, once both of the parts from Fork are done
+// Check that neither part has anything left to do, and then continue with
+// what comes after the block, knowing the values named in either part.
+// If a part was interrupted out of a block around the parallel block instead,
+// carry on with the handler of the interrupt, as that part would have.
+func (checker *Checker) Join(left, right Checker) {
+	checker.checkActive("Join")
+	if _, ok := checker.currentType.(multiparty.LocalParallelType); !ok || checker.interleaving() {
+		panic(checker.violation("Tried to join a parallel block on %T", checker.currentType))
+	}
+	for _, part := range []Checker{left, right} {
+		if part.base < len(checker.scopes) {
+			checker.parts = []Checker{left, right}
+			*checker = checker.leave(part)
+			return
+		}
+	}
+	for _, part := range []*Checker{&left, &right} {
+		part.checkActive("Join")
+		if part.interleaving() || !part.done() {
+			panic(part.violation("Tried to join a part of a parallel block before it was done"))
+		}
+	}
+	checker.join(left, right)
+}
+
+//The checker for the delegated session must know exactly where in the session it is
+func (checker *Checker) checkDelegable() {
+	if checker.interleaving() {
+		panic(checker.violation("Tried to delegate a session in the middle of a parallel block"))
+	}
+}
@@ -14,6 +14,8 @@ import (
 	"go/parser"
 	"go/printer"
 	"go/token"
+	"strings"
+	"unicode"
 
 	"github.com/JoeyEremondi/GoSesh/multiparty"
 	"golang.org/x/tools/go/ast/astutil"
@@ -59,6 +61,11 @@ func modifyMain(n ast.Node) {
 						innerN.Args = innerN.Args[2:]
 
 					}
+					//The parameters of the families stay, so the program instantiates them the same way
+					if pkgIdent.Name == "mockup" && selExpr.Sel.Name == "CreateFamilyStubProgram" {
+						innerN.Fun = &ast.Ident{NamePos: pkgIdent.Pos(), Name: "setFamilyGlobalType", Obj: nil}
+						innerN.Args = innerN.Args[2:]
+					}
 				default:
 					return true
 				}
@@ -74,7 +81,7 @@ func modifyMain(n ast.Node) {
 //Take the map of labels to cases, and find the default (first) label, as well as
 //a string with the stubs for each case
 //Used for both selection and branching.
-func defaultLabelAndCases(branches map[string]multiparty.LocalType) (string, string) {
+func defaultLabelAndCases(branches map[string]multiparty.LocalType, interruptible bool) (string, string) {
 	//Get a default label
 	//And make a case for each possible branch
 	ourLabel := ""
@@ -87,47 +94,110 @@ func defaultLabelAndCases(branches map[string]multiparty.LocalType) (string, str
 	case "%s":
 		%s
 
-			`, label, stub(branchType))
+			`, label, stub(branchType, interruptible))
 	}
 	return ourLabel, caseStrings
 }
 
-//Stubs for each syntactic variant
-func stub(tGeneric multiparty.LocalType) string {
+//Names for the variables holding each value of a message.
+//A message with a single value just uses the name.
+func valueNames(name string, count int) []string {
+	if count == 1 {
+		return []string{name}
+	}
+	ans := make([]string, count)
+	for i := range ans {
+		ans[i] = fmt.Sprintf("%s%d", name, i)
+	}
+	return ans
+}
+
+//After a read inside of an interruptible block, leave the block if what we read was an interrupt
+func interruptCheck(interruptible bool) string {
+	if !interruptible {
+		return ""
+	}
+	return `
+		if _, interrupted := checker.Interrupted(); interrupted {
+			return
+		}`
+}
+
+//Stubs for each syntactic variant.
+//Interruptible is true inside of the body of an interruptible block,
+//which is left by returning from the function it is in.
+func stub(tGeneric multiparty.LocalType, interruptible bool) string {
 	switch t := tGeneric.(type) {
 
 	//////////////////////////////
 	case multiparty.LocalSendType:
-		//Generate a variable for each argument, assigning it the default value
-		//Along with an array that contains them all serialized as strings
-		//assignmentStrings += fmt.Sprintf("sendArgs[%d] = serialize_%s(sendArg_%d)\n", i, sort, i)
+		//Generate a variable for each value of the message, assigning it the default value
+		declarations := ""
+		names := valueNames("sendArg", len(t.Value))
+		for i, sort := range t.Value {
+			declarations += fmt.Sprintf("var %s %s //TODO put a value here\n", names[i], sort)
+		}
+		if t.Refinement != nil && t.Refinement.Expr != "" {
+			declarations += fmt.Sprintf("//TODO the values must satisfy %s\n", t.Refinement)
+		}
 
-		//Serialize each argument, then do the send, and whatever comes after
+		//Serialize the values, then do the send, and whatever comes after
 		return fmt.Sprintf(`
 	if true{
-		var sendArg %s //TODO put a value here
-		sendBuf := checker.PrepareSend("TODO govec send message", sendArg)
+		%s
+		sendBuf := checker.PrepareSend("TODO govec send message", %s)
 		checker.WriteToUDP("%s", writeFun, sendBuf, addrMaker)
 	}
 	%s
-		`, t.Value, t.Channel, stub(t.Next))
+		`, declarations, strings.Join(names, ", "), t.Channel, stub(t.Next, interruptible))
 
 	//////////////////////////////
 	case multiparty.LocalReceiveType:
-		//Generate a variable for each argument, assigning it the default value
-		//Along with an array that contains them all serialized as strings
+		//Generate a variable for each value of the message,
+		//then unpack the message into them
 		assignmentString := ""
-		assignmentString += fmt.Sprintf("var receivedValue %s\n", t.Value)
-		assignmentString += "checker.UnpackReceive(\"TODO unpack message\", recvBuf, &receivedValue)"
+		names := valueNames("receivedValue", len(t.Value))
+		pointers := make([]string, len(names))
+		for i, sort := range t.Value {
+			assignmentString += fmt.Sprintf("var %s %s\n", names[i], sort)
+			pointers[i] = "&" + names[i]
+		}
+		assignmentString += fmt.Sprintf("checker.UnpackReceive(\"TODO unpack message\", recvBuf, %s)", strings.Join(pointers, ", "))
 		//Serialize each argument, then do the send, and whatever comes after
 		return fmt.Sprintf(`
 	if true{
 		recvBuf := make([]byte, 1024)
-		checker.ReadFromUDP("%s", readFun, recvBuf)
+		checker.ReadFromUDP("%s", readFun, recvBuf)%s
 		%s
 	}
 	%s
-		`, t.Channel, assignmentString, stub(t.Next))
+		`, t.Channel, interruptCheck(interruptible), assignmentString, stub(t.Next, interruptible))
+
+	//////////////////////////////
+	case multiparty.LocalDelegateType:
+		//The endpoint we hand over has to come from somewhere: usually a checker
+		//for the other session, made by calling makeCheckerReaderWriter for it
+		return fmt.Sprintf(`
+	if true{
+		var delegatedSession dynamic.Checker //TODO the endpoint for %s
+		sendBuf := checker.PrepareDelegate("TODO govec delegate message", &delegatedSession)
+		checker.WriteToUDP("%s", writeFun, sendBuf, addrMaker)
+	}
+	%s
+		`, t.Session, t.Channel, stub(t.Next, interruptible))
+
+	//////////////////////////////
+	case multiparty.LocalAcceptType:
+		//The checker we get back follows the rest of the delegated session
+		return fmt.Sprintf(`
+	if true{
+		recvBuf := make([]byte, 1024)
+		checker.ReadFromUDP("%s", readFun, recvBuf)%s
+		acceptedSession := checker.AcceptDelegate("TODO accept message", recvBuf)
+		_ = acceptedSession //TODO continue %s with acceptedSession
+	}
+	%s
+		`, t.Channel, interruptCheck(interruptible), t.Session, stub(t.Next, interruptible))
 
 	//////////////////////////////
 	case multiparty.LocalBranchingType:
@@ -135,13 +205,13 @@ func stub(tGeneric multiparty.LocalType) string {
 			panic("Cannot have a Branching with 0 branches")
 		}
 
-		_, caseStrings := defaultLabelAndCases(t.Branches)
+		_, caseStrings := defaultLabelAndCases(t.Branches, interruptible)
 
 		//In our code, set the label value to default, then branch based on the label value
 		return fmt.Sprintf(`
 	if true{
 		ourBuf := make([]byte, 1024)
-		checker.ReadFromUDP("%s", readFun, ourBuf)
+		checker.ReadFromUDP("%s", readFun, ourBuf)%s
 		var receivedLabel string
 		checker.UnpackReceive("TODO Unpack Message", ourBuf, &receivedLabel)
 		switch receivedLabel{
@@ -150,7 +220,7 @@ func stub(tGeneric multiparty.LocalType) string {
 			panic("Invalid label sent at selection choice")
 		}
 	}
-			`, t.Channel, caseStrings)
+			`, t.Channel, interruptCheck(interruptible), caseStrings)
 
 	//////////////////////////////
 	case multiparty.LocalSelectionType:
@@ -158,7 +228,7 @@ func stub(tGeneric multiparty.LocalType) string {
 			panic("Cannot have a Selection with 0 branches")
 		}
 
-		ourLabel, caseStrings := defaultLabelAndCases(t.Branches)
+		ourLabel, caseStrings := defaultLabelAndCases(t.Branches, interruptible)
 
 		//In our code, set the label value to default, then branch based on the label value
 		return fmt.Sprintf(`
@@ -190,16 +260,100 @@ func stub(tGeneric multiparty.LocalType) string {
 	for {
 		%s
 	}
-			`, t.Bind, stub(t.Body))
+			`, t.Bind, stub(t.Body, interruptible))
+
+	//////////////////////////////
+	case multiparty.LocalDeadlineType:
+		//The end of the body returns from the closure, to carry on after the deadline
+		return fmt.Sprintf(`
+	//Everything in here must happen within %s of the first send or receive,
+	//use checker.Deadline() to time out waiting for a message
+	func(){
+		%s
+	}()%s
+	%s
+			`, t.Within, stub(t.Body, interruptible), interruptCheck(interruptible), stub(t.Next, interruptible))
+
+	//////////////////////////////
+	case multiparty.LocalInterruptibleType:
+		//The body is in a function of its own, so that it can be left from anywhere by returning
+		raises := ""
+		handlers := ""
+		for _, interrupt := range t.Interrupts {
+			if interrupt.Raise {
+				raises += fmt.Sprintf(`
+		if false { //TODO when to interrupt the block with %s, in place of one of its sends
+			checker.RaiseInterrupt("%s", writeFun, addrMaker)
+			return
+		}`, interrupt.Label, interrupt.Label)
+			}
+			handlers += fmt.Sprintf(`
+		case "%s":
+			checker.HandleInterrupt()
+			func(){
+				%s
+			}()%s`, interrupt.Label, stub(interrupt.Then, interruptible), interruptCheck(interruptible))
+		}
+		//An interrupt we don't handle is for a block we are inside of
+		outer := `panic("Interrupted with unknown label " + label)`
+		if interruptible {
+			outer = "return"
+		}
+		return fmt.Sprintf(`
+	func(){%s
+		%s
+	}()
+	if label, interrupted := checker.Interrupted(); interrupted {
+		switch label {%s
+		default:
+			%s
+		}
+	}
+	%s
+			`, raises, stub(t.Body, true), handlers, outer, stub(t.Next, interruptible))
+
+	//////////////////////////////
+	case multiparty.LocalParallelType:
+		//Each part runs in a goroutine with a checker of its own, and ends by returning from it.
+		//Projection makes sure that parallel blocks aren't inside of interruptible ones.
+		return fmt.Sprintf(`
+	if true{
+		left, right := checker.Fork()
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func(checker *dynamic.Checker){
+			defer wg.Done()
+			%s
+		}(&left)
+		go func(checker *dynamic.Checker){
+			defer wg.Done()
+			%s
+		}(&right)
+		wg.Wait()
+		checker.Join(left, right)
+	}
+	%s
+			`, stub(t.Left, false), stub(t.Right, false), stub(t.Next, interruptible))
 
 	case multiparty.LocalEndType:
 		return "return"
 	case multiparty.ProjectionType:
-		return stub(t.T)
+		return stub(t.T, interruptible)
 	}
 	panic(fmt.Sprintf("Invalid local type! %T\n", tGeneric))
 }
 
+//The name of the function running a participant,
+//which must be a Go identifier even for members of families like Worker[1]
+func participantMain(part multiparty.Participant) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return '_'
+	}, string(part)) + "_main"
+}
+
 //Generate the program with all the stubs for a global type
 //Includes a LOT of boilerplate code for setting up connections and such
 func generateProgram(t multiparty.GlobalType) string {
@@ -220,21 +374,23 @@ func generateProgram(t multiparty.GlobalType) string {
 		seenParticipants[part] = true
 		participantCases += fmt.Sprintf(`
 if argsWithoutProg[0] == "--%s"{
-	%s_main(argsWithoutProg[1:])
+	%s(argsWithoutProg[1:])
 	return
 }
-			`, part, part)
+			`, part, participantMain(part))
 
 		ourProjection, err := t.Project(part)
 		if err != nil {
 			panic(err)
 		}
 		participantFunctions += fmt.Sprintf(`
-func %s_main(args []string){
+func %s(args []string){
 	checker, addrMaker, readFun, writeFun := makeCheckerReaderWriter("%s")
+	//Not every participant both sends and receives
+	_, _, _ = addrMaker, readFun, writeFun
 	%s
 }
-			`, part, part, stub(ourProjection))
+			`, participantMain(part), part, stub(ourProjection, false))
 	}
 	return fmt.Sprintf(`
 var topGlobalType multiparty.GlobalType
@@ -243,6 +399,12 @@ func setGlobalType(events ...mockup.Event){
 	topGlobalType = mockup.Link(events...)
 }
 
+func setFamilyGlobalType(params map[string]int, events ...mockup.Event){
+	instance, err := multiparty.Instantiate(mockup.Link(events...), params)
+	handleError(err)
+	topGlobalType = instance
+}
+
 
 
 func handleError(e error){
@@ -373,6 +535,15 @@ func FindReceivingChannels(tGeneric multiparty.LocalType, outMap *map[multiparty
 		}
 		return
 
+	case multiparty.LocalDelegateType:
+		FindReceivingChannels(t.Next, outMap)
+		return
+
+	case multiparty.LocalAcceptType:
+		(*outMap)[t.Channel] = true
+		FindReceivingChannels(t.Next, outMap)
+		return
+
 	case multiparty.LocalNameType:
 		return
 
@@ -380,6 +551,28 @@ func FindReceivingChannels(tGeneric multiparty.LocalType, outMap *map[multiparty
 		FindReceivingChannels(t.Body, outMap)
 		return
 
+	case multiparty.LocalDeadlineType:
+		FindReceivingChannels(t.Body, outMap)
+		FindReceivingChannels(t.Next, outMap)
+		return
+
+	case multiparty.LocalInterruptibleType:
+		FindReceivingChannels(t.Body, outMap)
+		for _, interrupt := range t.Interrupts {
+			if !interrupt.Raise {
+				(*outMap)[interrupt.Channels[0]] = true
+			}
+			FindReceivingChannels(interrupt.Then, outMap)
+		}
+		FindReceivingChannels(t.Next, outMap)
+		return
+
+	case multiparty.LocalParallelType:
+		FindReceivingChannels(t.Left, outMap)
+		FindReceivingChannels(t.Right, outMap)
+		FindReceivingChannels(t.Next, outMap)
+		return
+
 	case multiparty.LocalEndType:
 		return
 
@@ -390,3 +583,65 @@ func FindReceivingChannels(tGeneric multiparty.LocalType, outMap *map[multiparty
 	}
 	panic(fmt.Sprintf("Invalid local type! %T\n", tGeneric))
 }
+
+//Whether the given local type has a parallel block, whose stub needs the sync package
+func hasParallel(tGeneric multiparty.LocalType) bool {
+	switch t := tGeneric.(type) {
+
+	case multiparty.LocalSendType:
+		return hasParallel(t.Next)
+
+	case multiparty.LocalReceiveType:
+		return hasParallel(t.Next)
+
+	case multiparty.LocalBranchingType:
+		for _, next := range t.Branches {
+			if hasParallel(next) {
+				return true
+			}
+		}
+		return false
+
+	case multiparty.LocalSelectionType:
+		for _, next := range t.Branches {
+			if hasParallel(next) {
+				return true
+			}
+		}
+		return false
+
+	case multiparty.LocalDelegateType:
+		return hasParallel(t.Next)
+
+	case multiparty.LocalAcceptType:
+		return hasParallel(t.Next)
+
+	case multiparty.LocalNameType:
+		return false
+
+	case multiparty.LocalRecursiveType:
+		return hasParallel(t.Body)
+
+	case multiparty.LocalDeadlineType:
+		return hasParallel(t.Body) || hasParallel(t.Next)
+
+	case multiparty.LocalInterruptibleType:
+		for _, interrupt := range t.Interrupts {
+			if hasParallel(interrupt.Then) {
+				return true
+			}
+		}
+		return hasParallel(t.Body) || hasParallel(t.Next)
+
+	case multiparty.LocalParallelType:
+		return true
+
+	case multiparty.LocalEndType:
+		return false
+
+	case multiparty.ProjectionType:
+		return hasParallel(t.T)
+
+	}
+	panic(fmt.Sprintf("Invalid local type! %T\n", tGeneric))
+}
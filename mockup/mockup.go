@@ -10,6 +10,7 @@ package mockup
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/JoeyEremondi/GoSesh/multiparty"
 )
@@ -26,6 +27,8 @@ type Channel struct {
 type MessageType struct {
 	// In the Session Type theory, this is called a Sort
 	Type string
+	//Optional: a name for the value, so that conditions given to SendWhere can refer to it
+	Name string
 }
 
 //An abstraction of an interaction that can occur between some parties.
@@ -48,14 +51,56 @@ func Case(label string, thenDo ...Event) SwitchCase {
 	return SwitchCase{label: label, thenDo: thenDo}
 }
 
+//Use these to make the interrupts of an Interruptible block
+type InterruptHandler struct {
+	label  string
+	notify []Channel
+	thenDo []Event
+}
+
+//Used to make an interrupt of an Interruptible block: the source of the channels in notify
+//may interrupt the block at any point by sending label on each of them, one for each
+//of the other participants of the block, after which everyone does thenDo.
+func OnInterrupt(label string, notify []Channel, thenDo ...Event) InterruptHandler {
+	return InterruptHandler{label: label, notify: notify, thenDo: thenDo}
+}
+
 /*
 * Pass in the path to the file containing this mockup, the file name to generate,
 * and a list of events forming a mockup.
 * This will create a .go.stub file with the same contents (type definitions)
 * as the input file, with the boilerplate code for a program performing the given events.
+* If some participant can't know which branch of a Switch was taken, the problems
+* are printed and the program exits without writing anything.
  */
 func CreateStubProgram(infile string, outfile string, events ...Event) {
-	root := Link(events...)
+	createStubProgram(infile, outfile, Link(events...))
+}
+
+/*
+* Like CreateStubProgram, for a mockup with families of participants made with Foreach.
+* The families are instantiated with the given values for their parameters, such as N,
+* and there is a stub for each member of each family, e.g. Worker[1] to Worker[N].
+* The generated program instantiates the mockup with the same parameters.
+ */
+func CreateFamilyStubProgram(infile string, outfile string, params map[string]int, events ...Event) {
+	root, err := multiparty.Instantiate(Link(events...), params)
+	if err != nil {
+		fmt.Println("STUB GENERATION ERROR: ", err)
+		os.Exit(1)
+	}
+	createStubProgram(infile, outfile, root)
+}
+
+func createStubProgram(infile string, outfile string, root multiparty.GlobalType) {
+	//Don't generate stubs for a protocol that can't be implemented
+	problems := append(multiparty.CheckChoices(root), multiparty.CheckRefinements(root)...)
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Println("STUB GENERATION ERROR: ", problem)
+		}
+		os.Exit(1)
+	}
 
 	outFile, err := os.Create(outfile + ".go.stub")
 	if err != nil {
@@ -63,14 +108,23 @@ func CreateStubProgram(infile string, outfile string, events ...Event) {
 	}
 	defer outFile.Close()
 
-	initialProgram := modifiedFileString(infile,
+	imports := []string{
 		"github.com/JoeyEremondi/GoSesh/multiparty",
 		"github.com/JoeyEremondi/GoSesh/dynamic",
 		"github.com/JoeyEremondi/GoSesh/mockup",
 		"os",
 		"net",
 		"fmt",
-	)
+	}
+	//Only the stubs of parallel blocks wait on their parts with sync,
+	//and Go won't compile a program which imports it without using it
+	for _, part := range root.Participants() {
+		if projection, err := root.Project(part); err == nil && hasParallel(projection) {
+			imports = append(imports, "sync")
+			break
+		}
+	}
+	initialProgram := modifiedFileString(infile, imports...)
 
 	programLogic := generateProgram(root)
 
@@ -90,15 +144,52 @@ func makePrefix(channel Channel) multiparty.Prefix {
 }
 
 //Send a value of the given type along the given channel.
-func Send(channel Channel, messageType MessageType) Event {
+//Giving more than one type sends a message carrying a value of each type, in order.
+func Send(channel Channel, messageTypes ...MessageType) Event {
+	return sendRefined(channel, "", "", messageTypes)
+}
+
+//Send values of the given types along the given channel, which must satisfy a condition,
+//given as a Go expression such as "amount > 0" or "len(items) <= 100".
+//The condition refers to the values by the Names of their MessageTypes,
+//and may also use values named in earlier messages sent or received by both participants.
+//The dynamic checker evaluates the condition whenever the message is sent or received.
+func SendWhere(channel Channel, name string, condition string, messageTypes ...MessageType) Event {
+	if condition == "" {
+		panic("SendWhere needs a condition, use Send otherwise")
+	}
+	return sendRefined(channel, name, condition, messageTypes)
+}
+
+//The values of a message only need a refinement if they're named, or have a condition
+func sendRefined(channel Channel, name string, condition string, messageTypes []MessageType) Event {
 	prefix := makePrefix(channel)
 
-	sort := multiparty.Sort(messageType.Type)
+	sorts := make([]multiparty.Sort, len(messageTypes))
+	vars := make([]string, len(messageTypes))
+	named := false
+	for i, messageType := range messageTypes {
+		sorts[i] = multiparty.Sort(messageType.Type)
+		vars[i] = messageType.Name
+		if vars[i] != "" {
+			named = true
+		}
+	}
+
+	var refinement *multiparty.Refinement
+	if named || condition != "" {
+		r, err := multiparty.NewRefinement(name, condition, vars...)
+		if err != nil {
+			panic(err)
+		}
+		refinement = &r
+	}
 
 	valueType := func(endType multiparty.GlobalType) multiparty.GlobalType {
 		return multiparty.ValueType{
 			ValuePrefix: prefix,
-			Value:       sort,
+			Value:       sorts,
+			Refinement:  refinement,
 			ValueNext:   endType}
 	}
 
@@ -107,6 +198,22 @@ func Send(channel Channel, messageType MessageType) Event {
 	return send
 }
 
+//Hand over an endpoint of another session along the given channel.
+//The session is the local type of the given participant in that session,
+//saying what the receiver must do with the endpoint once it has it.
+func Delegate(channel Channel, participant string, session multiparty.LocalType) Event {
+	prefix := makePrefix(channel)
+	projection := multiparty.MakeProjectionType(multiparty.Participant(participant), session)
+
+	delegationType := func(endType multiparty.GlobalType) multiparty.GlobalType {
+		return multiparty.DelegationType{
+			DelegationPrefix: prefix,
+			Session:          projection,
+			DelegationNext:   endType}
+	}
+	return Event{wrappedType: delegationType}
+}
+
 //Create an event which performs sends a label on the given channel,
 //then performs the events in the case for whichever label was sent.
 func Switch(channel Channel, branches ...SwitchCase) Event {
@@ -127,6 +234,143 @@ func Switch(channel Channel, branches ...SwitchCase) Event {
 	return Event{wrappedType: retFun}
 }
 
+//Do the given events once for each value of index from from to to inclusive, in order.
+//from and to are Go expressions over the parameters of the protocol, such as "1" and "N",
+//whose values are given to CreateFamilyStubProgram.
+//Name the participants and channels of each iteration with Indexed.
+func Foreach(index string, from string, to string, bodyEvents ...Event) Event {
+	retFun := func(nextType multiparty.GlobalType) multiparty.GlobalType {
+		return multiparty.ForeachType{
+			Index: index,
+			From:  from,
+			To:    to,
+			Body:  Link(bodyEvents...),
+			Next:  nextType}
+	}
+	return Event{wrappedType: retFun}
+}
+
+//Each participant must do its part of the given events within limit of the first thing it does in them,
+//e.g. Within(200*time.Millisecond, Send(request), Send(reply)) makes the reply due 200ms after the request arrives.
+//The checker of a participant reports a violation if it does something too late.
+//The events may not Continue a loop from outside of them, but can contain a whole loop,
+//or be the body of one to limit how long each iteration takes.
+func Within(limit time.Duration, events ...Event) Event {
+	retFun := func(nextType multiparty.GlobalType) multiparty.GlobalType {
+		return multiparty.DeadlineType{
+			Within: limit,
+			Body:   Link(events...),
+			Next:   nextType}
+	}
+	return Event{wrappedType: retFun}
+}
+
+//Create an event which does body, unless it is interrupted in one of the ways given by the handlers,
+//e.g. to let a client cancel a long-running loop. Either way, what comes after is done next.
+//The body may not Continue a loop from outside of it.
+//An interrupt is only noticed by reading from the channel it is sent on,
+//so it is simplest to use a channel its receiver already reads from in the body.
+func Interruptible(body Event, handlers ...InterruptHandler) Event {
+	retFun := func(nextType multiparty.GlobalType) multiparty.GlobalType {
+		interrupts := make([]multiparty.Interrupt, len(handlers))
+		for i, handler := range handlers {
+			notify := make([]multiparty.Prefix, len(handler.notify))
+			for j, channel := range handler.notify {
+				notify[j] = makePrefix(channel)
+			}
+			interrupts[i] = multiparty.Interrupt{Label: handler.label, Notify: notify, Then: Link(handler.thenDo...)}
+		}
+		return multiparty.InterruptibleType{
+			Body:       Link(body),
+			Interrupts: interrupts,
+			Next:       nextType}
+	}
+	return Event{wrappedType: retFun}
+}
+
+//A protocol made with Define, which can be done as part of other mockups with Invoke
+type SubProtocol struct {
+	protocol multiparty.Protocol
+	channels []Channel
+}
+
+//Define a protocol once, such as the vote of a commit protocol, to be done as part of other mockups.
+//Its roles are the sources and destinations of the given channels, which are all the channels its events use.
+//For members of families, like Indexed("Voter", "i"), the role is the family, Voter.
+//The events may not Continue a loop from outside of them.
+func Define(name string, channels []Channel, events ...Event) SubProtocol {
+	roles := make([]multiparty.Participant, 0)
+	names := make([]multiparty.Channel, 0)
+	for _, channel := range channels {
+		for _, member := range []string{channel.Source, channel.Destination} {
+			role, _ := multiparty.Family(member)
+			if !multiparty.ContainsParticipant(multiparty.Participant(role), roles) {
+				roles = append(roles, multiparty.Participant(role))
+			}
+		}
+		if channelName, _ := multiparty.Family(channel.Name); !multiparty.ContainsChannel(multiparty.Channel(channelName), names) {
+			names = append(names, multiparty.Channel(channelName))
+		}
+	}
+	protocol := multiparty.Protocol{Name: name, Roles: roles, Channels: names, Body: Link(events...)}
+	return SubProtocol{protocol: protocol, channels: channels}
+}
+
+//Do the given protocol, with each of its roles played by the participant roles gives for it,
+//and each of its channels by the channel in the same place in channels,
+//which must go between the participants playing the source and destination of the channel it replaces.
+//A member of a family of roles, like Voter[i], is played by the same member of the family playing Voter.
+//The participants just do their parts of the protocol in place, so their stubs are the same
+//as if its events were written out here, but problems found in it say which protocol they are in.
+//Invoking a protocol with the wrong roles or channels panics, so that it's caught when writing the mockup.
+func Invoke(sub SubProtocol, roles map[string]string, channels ...Channel) Event {
+	name := sub.protocol.Name
+	if len(channels) != len(sub.channels) {
+		panic(fmt.Errorf("invoking %s needs %d channels, but was given %d", name, len(sub.channels), len(channels)))
+	}
+	players := make(map[multiparty.Participant]multiparty.Participant)
+	for role, player := range roles {
+		players[multiparty.Participant(role)] = multiparty.Participant(player)
+	}
+	player := func(member string) string {
+		role, index := multiparty.Family(member)
+		return roles[role] + index
+	}
+	renamed := make(map[multiparty.Channel]multiparty.Channel)
+	for i, channel := range sub.channels {
+		if channels[i].Source != player(channel.Source) || channels[i].Destination != player(channel.Destination) {
+			panic(fmt.Errorf("invoking %s with channel %s from %s to %s in place of %s, which goes from %s to %s",
+				name, channels[i].Name, channels[i].Source, channels[i].Destination,
+				channel.Name, player(channel.Source), player(channel.Destination)))
+		}
+		channelName, index := multiparty.Family(channel.Name)
+		given, givenIndex := multiparty.Family(channels[i].Name)
+		if givenIndex != index {
+			panic(fmt.Errorf("invoking %s with channel %s in place of %s, which has a different index", name, channels[i].Name, channel.Name))
+		}
+		if other, ok := renamed[multiparty.Channel(channelName)]; ok && other != multiparty.Channel(given) {
+			panic(fmt.Errorf("invoking %s with both %s and %s in place of %s", name, other, given, channelName))
+		}
+		renamed[multiparty.Channel(channelName)] = multiparty.Channel(given)
+	}
+	invoked, err := sub.protocol.Invoke(players, renamed, multiparty.EndType{})
+	if err != nil {
+		panic(err)
+	}
+	retFun := func(nextType multiparty.GlobalType) multiparty.GlobalType {
+		invocation := invoked.(multiparty.InvocationType)
+		invocation.Next = nextType
+		return invocation
+	}
+	return Event{wrappedType: retFun}
+}
+
+//The name of a member of a family of participants or channels,
+//e.g. Indexed("Worker", "i") is Worker[i], and Indexed("Worker", "i+1") is the next worker
+func Indexed(name string, index string) string {
+	return name + "[" + index + "]"
+}
+
 //Create a named loop, that we can control using Continue() and Break().
 //Note that all branches have an implicit Break() if Continue() is not specified.
 func Loop(label string, bodyEvents ...Event) Event {
@@ -162,24 +406,21 @@ func Continue(label string) Event {
 }
 
 //Create an event corresponding to the given events running in parallel.
-//Because we don't know when a parallel block finished, no events may
-//come after a parallel block.
+//Once all of them are done, they join, and the events after the parallel block happen.
+//The events may not Continue a loop from outside of them, unless nothing comes after the parallel block.
 func Parallel(events ...Event) Event {
 	retFun := func(nextType multiparty.GlobalType) multiparty.GlobalType {
-		switch nextType.(type) {
-		case multiparty.EndType:
-		default:
-			panic("Can't have any events occur after a parallel block.")
-		}
 		if len(events) == 0 {
 			return nextType
-		} else {
-			parSoFar := events[0].wrappedType(nextType)
-			for _, event := range events[1:] {
-				parSoFar = multiparty.MakeParallelType(parSoFar, event.wrappedType(multiparty.EndType{}))
-			}
-			return parSoFar
+		} else if len(events) == 1 {
+			return events[0].wrappedType(nextType)
+		}
+		//The later events are nested parallel blocks, which join before the outermost one does
+		parSoFar := Link(events[len(events)-1])
+		for i := len(events) - 2; i > 0; i-- {
+			parSoFar = multiparty.MakeParallelType(Link(events[i]), parSoFar)
 		}
+		return multiparty.MakeJoinedParallelType(Link(events[0]), parSoFar, nextType)
 	}
 	return Event{wrappedType: retFun}
 }
@@ -0,0 +1,56 @@
+package multiparty
+
+//The kinds of thing a participant can do at a single step of a local type
+type ActionKind int
+
+const (
+	SendAction ActionKind = iota
+	ReceiveAction
+	SelectAction
+	BranchAction
+	DelegateAction
+	AcceptAction
+)
+
+//A single communication done by a participant.
+//Sends and receives have the sorts of their message as the Value, and its Refinement if it has one,
+//selections and branches have a Label, and delegations have the Session handed over.
+type Action struct {
+	Kind       ActionKind
+	Channel    Channel
+	Value      []Sort
+	Refinement *Refinement
+	Label      string
+	Session    ProjectionType
+}
+
+//Render an action in the given notation, in the style of local types,
+//e.g. k!⟨int⟩ or k ⊕ ok
+func (a Action) Format(n Notation) string {
+	p := newTypePrinter(n)
+	sym := p.sym
+	switch a.Kind {
+	case SendAction, ReceiveAction:
+		p.write(string(a.Channel))
+		if a.Kind == SendAction {
+			p.write("!")
+		} else {
+			p.write("?")
+		}
+		p.value(a.Value, a.Refinement)
+		return p.buf.String()
+	case SelectAction:
+		return string(a.Channel) + " " + sym.selection + " " + a.Label
+	case BranchAction:
+		return string(a.Channel) + " " + sym.branching + " " + a.Label
+	case DelegateAction:
+		return string(a.Channel) + "!" + sym.open + sym.open + FormatLocal(a.Session, n) + sym.close + sym.close
+	case AcceptAction:
+		return string(a.Channel) + "?" + sym.open + sym.open + FormatLocal(a.Session, n) + sym.close + sym.close
+	}
+	return "unknown action"
+}
+
+func (a Action) String() string {
+	return a.Format(Unicode)
+}
@@ -0,0 +1,289 @@
+package multiparty
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+//A reasonable number of receives to let a send overtake, for AsyncOptions.Bound
+const DefaultAsyncBound = 8
+
+//Options for CheckAsyncSubtype
+type AsyncOptions struct {
+	//How many receives of the supertype a send of the subtype may be moved in front of.
+	//Asynchronous subtyping is undecidable in general, so once a send would need to be
+	//moved further ahead than this, we give up.
+	//With a bound of 0, this is the same as synchronous subtyping.
+	Bound int
+}
+
+//The outcome of checking asynchronous subtyping
+type AsyncResult struct {
+	Subtype bool
+	//Set when the bound was reached before subtyping could be decided.
+	//Subtype is false, but the types may still be subtypes with a larger bound.
+	Undecided bool
+	//When Subtype is false, the actions taken by the subtype before things went wrong
+	Counterexample []Action
+	//When Subtype is false, what went wrong
+	Reason string
+}
+
+func (r AsyncResult) String() string {
+	if r.Subtype {
+		return "subtype"
+	}
+	trace := make([]string, len(r.Counterexample))
+	for i, action := range r.Counterexample {
+		trace[i] = action.String()
+	}
+	verdict := "not a subtype"
+	if r.Undecided {
+		verdict = "undecided"
+	}
+	return fmt.Sprintf("%s after [%s]: %s", verdict, strings.Join(trace, "; "), r.Reason)
+}
+
+//What remains of the supertype while checking: either a node of its graph,
+//or receives which the subtype has not done yet, because it sent something
+//that came after them in the supertype ahead of time.
+//Leaves of the receives are what is left of the supertype after each of them.
+type residual struct {
+	//Only used when pending is nil
+	node    int
+	pending *localNode
+	//The residual after each label of the pending receive
+	children map[string]*residual
+}
+
+func (r *residual) key() string {
+	if r.pending == nil {
+		return fmt.Sprintf("%d", r.node)
+	}
+	labels := make([]string, 0, len(r.children))
+	for label := range r.children {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	parts := make([]string, len(labels))
+	for i, label := range labels {
+		parts[i] = label + ":" + r.children[label].key()
+	}
+	return fmt.Sprintf("%d(%s,%s,%s){%s}", r.pending.kind, r.pending.channel, joinSorts(r.pending.value),
+		FormatLocal(r.pending.session, ASCII), strings.Join(parts, ","))
+}
+
+//Something went wrong, either because the types aren't subtypes, or because we hit the bound
+type asyncFailure struct {
+	trace     []Action
+	reason    string
+	undecided bool
+}
+
+type asyncChecker struct {
+	sub, super *localGraph
+	bound      int
+	assumed    map[string]bool
+}
+
+//CheckAsyncSubtype reports whether a participant implementing sub may safely be used where one
+//implementing super is expected, when messages are buffered rather than delivered immediately.
+//
+//On top of synchronous subtyping, this allows sub to do a send before some receives which come
+//before that send in super, as long as the send doesn't depend on what is received.
+//For example, a participant can pipeline its requests by sending them all before
+//receiving any of the replies. The check is sound, and bounded by opts.Bound.
+func CheckAsyncSubtype(sub, super LocalType, opts AsyncOptions) AsyncResult {
+	subGraph, err := newLocalGraph(sub)
+	if err != nil {
+		return AsyncResult{Reason: fmt.Sprintf("invalid subtype: %v", err)}
+	}
+	superGraph, err := newLocalGraph(super)
+	if err != nil {
+		return AsyncResult{Reason: fmt.Sprintf("invalid supertype: %v", err)}
+	}
+	checker := asyncChecker{sub: subGraph, super: superGraph, bound: opts.Bound, assumed: make(map[string]bool)}
+	failure := checker.check(subGraph.root, &residual{node: superGraph.root}, make([]Action, 0))
+	if failure == nil {
+		return AsyncResult{Subtype: true}
+	}
+	return AsyncResult{Undecided: failure.undecided, Counterexample: failure.trace, Reason: failure.reason}
+}
+
+func appendAction(trace []Action, action Action) []Action {
+	return append(append(make([]Action, 0, len(trace)+1), trace...), action)
+}
+
+func (c *asyncChecker) fail(trace []Action, format string, args ...interface{}) *asyncFailure {
+	return &asyncFailure{trace: trace, reason: fmt.Sprintf(format, args...)}
+}
+
+//The action done by taking the given edge out of a node
+func edgeAction(node localNode, label string) Action {
+	switch node.kind {
+	case sendNode:
+		return Action{Kind: SendAction, Channel: node.channel, Value: node.value, Refinement: node.refinement}
+	case receiveNode:
+		return Action{Kind: ReceiveAction, Channel: node.channel, Value: node.value, Refinement: node.refinement}
+	case selectNode:
+		return Action{Kind: SelectAction, Channel: node.channel, Label: label}
+	case delegateNode:
+		return Action{Kind: DelegateAction, Channel: node.channel, Session: node.session}
+	case acceptNode:
+		return Action{Kind: AcceptAction, Channel: node.channel, Session: node.session}
+	}
+	return Action{Kind: BranchAction, Channel: node.channel, Label: label}
+}
+
+func (c *asyncChecker) check(sub int, super *residual, trace []Action) *asyncFailure {
+	key := fmt.Sprintf("%d/%s", sub, super.key())
+	if c.assumed[key] {
+		return nil
+	}
+	c.assumed[key] = true
+
+	subNode := c.sub.nodes[sub]
+	switch subNode.kind {
+	case endNode:
+		if super.pending != nil || c.super.nodes[super.node].kind != endNode {
+			return c.fail(trace, "ended, but the supertype still expects to communicate")
+		}
+		return nil
+
+	case receiveNode, branchNode, acceptNode:
+		//Receives can't be done early, so they must match what comes first in the supertype
+		var superNode localNode
+		var children map[string]*residual
+		if super.pending != nil {
+			superNode, children = *super.pending, super.children
+		} else {
+			superNode = c.super.nodes[super.node]
+			children = make(map[string]*residual)
+			for label, next := range superNode.next {
+				children[label] = &residual{node: next}
+			}
+		}
+		if superNode.kind != subNode.kind || superNode.channel != subNode.channel {
+			return c.fail(trace, "does %s, but the supertype expects %s", c.sub.describe(sub), describeNode(superNode))
+		}
+		if subNode.kind == receiveNode && !IsValueSubtype(superNode.value, subNode.value) {
+			return c.fail(trace, "receives %s on %s, but may be sent %s", formatValue(subNode.value), subNode.channel, formatValue(superNode.value))
+		}
+		if subNode.kind == receiveNode && !RefinementImplies(superNode.refinement, subNode.refinement) {
+			return c.fail(trace, "receives on %s relying on %s, which may not hold", subNode.channel, subNode.refinement)
+		}
+		if subNode.kind == acceptNode && !sessionSubtype(subNode.session, superNode.session) {
+			return c.fail(trace, "accepts %s on %s, but may be handed %s", subNode.session, subNode.channel, superNode.session)
+		}
+		for _, label := range sortedEdgeLabels(superNode.next) {
+			if _, ok := subNode.next[label]; !ok {
+				return c.fail(trace, "does not handle label %s on %s", label, subNode.channel)
+			}
+		}
+		for _, label := range sortedEdgeLabels(superNode.next) {
+			if failure := c.check(subNode.next[label], children[label], appendAction(trace, edgeAction(subNode, label))); failure != nil {
+				return failure
+			}
+		}
+		return nil
+
+	case enterNode, leaveNode, interruptNode, forkNode, joinNode:
+		//Deadlines, interruptible blocks and parallel types don't communicate by themselves,
+		//but nothing can be sent ahead across their boundaries
+		if super.pending != nil {
+			return c.fail(trace, "does %s, but the supertype expects %s", c.sub.describe(sub), describeNode(*super.pending))
+		}
+		superNode := c.super.nodes[super.node]
+		if superNode.kind != subNode.kind || superNode.within != subNode.within || !interruptsEqual(superNode.interrupts, subNode.interrupts) {
+			return c.fail(trace, "has %s, but the supertype expects %s", c.sub.describe(sub), describeNode(superNode))
+		}
+		for _, label := range sortedEdgeLabels(subNode.next) {
+			if failure := c.check(subNode.next[label], &residual{node: superNode.next[label]}, trace); failure != nil {
+				return failure
+			}
+		}
+		return nil
+
+	case sendNode, selectNode, delegateNode:
+		for _, label := range sortedEdgeLabels(subNode.next) {
+			nextTrace := appendAction(trace, edgeAction(subNode, label))
+			nextSuper, failure := c.consume(subNode, label, super, 0, trace)
+			if failure != nil {
+				return failure
+			}
+			if failure := c.check(subNode.next[label], nextSuper, nextTrace); failure != nil {
+				return failure
+			}
+		}
+		return nil
+	}
+	return c.fail(trace, "unsupported local type")
+}
+
+//Find the send done by the subtype in the supertype, possibly after some receives,
+//and return what is left of the supertype once that send is taken out.
+//The depth is how many receives the send has overtaken so far.
+func (c *asyncChecker) consume(subNode localNode, label string, super *residual, depth int, trace []Action) (*residual, *asyncFailure) {
+	if super.pending != nil {
+		//The send must be there no matter which way the pending receives go
+		children := make(map[string]*residual)
+		for childLabel, child := range super.children {
+			next, failure := c.consume(subNode, label, child, depth+1, trace)
+			if failure != nil {
+				return nil, failure
+			}
+			children[childLabel] = next
+		}
+		return &residual{pending: super.pending, children: children}, nil
+	}
+
+	superNode := c.super.nodes[super.node]
+	switch superNode.kind {
+	case sendNode, selectNode, delegateNode:
+		if superNode.kind != subNode.kind || superNode.channel != subNode.channel {
+			return nil, c.fail(trace, "does %s, but the supertype expects %s", describeNode(subNode), describeNode(superNode))
+		}
+		if subNode.kind == sendNode && !IsValueSubtype(subNode.value, superNode.value) {
+			return nil, c.fail(trace, "sends %s on %s, but %s is expected", formatValue(subNode.value), subNode.channel, formatValue(superNode.value))
+		}
+		if subNode.kind == sendNode && !RefinementImplies(subNode.refinement, superNode.refinement) {
+			return nil, c.fail(trace, "sends on %s without ensuring %s", subNode.channel, superNode.refinement)
+		}
+		if subNode.kind == delegateNode && !sessionSubtype(superNode.session, subNode.session) {
+			return nil, c.fail(trace, "delegates %s on %s, but %s is expected", subNode.session, subNode.channel, superNode.session)
+		}
+		next, ok := superNode.next[label]
+		if !ok {
+			return nil, c.fail(trace, "may select label %s on %s, which is not expected", label, subNode.channel)
+		}
+		return &residual{node: next}, nil
+
+	case receiveNode, branchNode, acceptNode:
+		//The subtype is sending ahead of this receive
+		if depth >= c.bound {
+			failure := c.fail(trace, "%s would have to be sent ahead of more than %d receives", edgeAction(subNode, label), c.bound)
+			failure.undecided = true
+			return nil, failure
+		}
+		pending := superNode
+		children := make(map[string]*residual)
+		for childLabel, next := range superNode.next {
+			child, failure := c.consume(subNode, label, &residual{node: next}, depth+1, trace)
+			if failure != nil {
+				return nil, failure
+			}
+			children[childLabel] = child
+		}
+		return &residual{pending: &pending, children: children}, nil
+
+	case enterNode, leaveNode, interruptNode, forkNode, joinNode:
+		return nil, c.fail(trace, "does %s ahead of the %s in the supertype", edgeAction(subNode, label), describeNode(superNode))
+	}
+	return nil, c.fail(trace, "does %s, but the supertype has ended", describeNode(subNode))
+}
+
+func describeNode(node localNode) string {
+	g := localGraph{nodes: []localNode{node}}
+	return g.describe(0)
+}
@@ -0,0 +1,245 @@
+package multiparty
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+//Whether a participant is told which branch of a choice was taken
+type knowledge int
+
+const (
+	//The participant doesn't do anything after the choice
+	absent knowledge = iota
+	//The participant's first action is receiving from someone who knows the branch
+	informed
+	//The participant acts before anyone who knows the branch tells it
+	uninformed
+)
+
+//Find out if participant r is told which branch was taken before it does anything,
+//given the set of participants who already know.
+//If not, the reason says what r does instead.
+func firstAction(gt GlobalType, r Participant, known map[Participant]bool) (knowledge, string) {
+	//Handle an interaction, returning true if r was involved
+	interact := func(prefix Prefix) (bool, knowledge, string) {
+		switch {
+		case prefix.P1 == r:
+			return true, uninformed, fmt.Sprintf("it first sends %s", prefix)
+		case prefix.P2 == r && !known[prefix.P1]:
+			return true, uninformed, fmt.Sprintf("it first receives %s, but %s doesn't know the branch either", prefix, prefix.P1)
+		case prefix.P2 == r:
+			return true, informed, ""
+		}
+		return false, absent, ""
+	}
+	//Copy, so that sibling branches don't see each other's knowledge
+	learn := func(prefix Prefix) map[Participant]bool {
+		ans := make(map[Participant]bool)
+		for p := range known {
+			ans[p] = true
+		}
+		if known[prefix.P1] {
+			ans[prefix.P2] = true
+		}
+		return ans
+	}
+
+	switch t := gt.(type) {
+	case ValueType:
+		if involved, k, why := interact(t.ValuePrefix); involved {
+			return k, why
+		}
+		return firstAction(t.ValueNext, r, learn(t.ValuePrefix))
+	case DelegationType:
+		if involved, k, why := interact(t.DelegationPrefix); involved {
+			return k, why
+		}
+		return firstAction(t.DelegationNext, r, learn(t.DelegationPrefix))
+	case BranchingType:
+		if involved, k, why := interact(t.BranchPrefix); involved {
+			return k, why
+		}
+		//r must be told the same way, no matter which way this nested choice goes
+		nextKnown := learn(t.BranchPrefix)
+		results := make(map[knowledge]string)
+		for _, label := range globalLabels(t.Branches) {
+			k, why := firstAction(t.Branches[label], r, nextKnown)
+			if _, seen := results[k]; !seen {
+				results[k] = why
+			}
+		}
+		if why, ok := results[uninformed]; ok {
+			return uninformed, why
+		}
+		if _, ok := results[informed]; ok {
+			if _, ok := results[absent]; ok {
+				return uninformed, fmt.Sprintf("it is only told in some branches of %s", t.BranchPrefix)
+			}
+			return informed, ""
+		}
+		return absent, ""
+	case ParallelType:
+		ka, whyA := firstAction(t.a, r, known)
+		kb, whyB := firstAction(t.b, r, known)
+		if ka == uninformed {
+			return ka, whyA
+		}
+		if kb == uninformed {
+			return kb, whyB
+		}
+		if ka == informed || kb == informed {
+			return informed, ""
+		}
+		return firstAction(t.next, r, known)
+	case RecursiveType:
+		return firstAction(t.Body, r, known)
+	case DeadlineType:
+		return firstAction(sequenceGlobal(t.Body, t.Next), r, known)
+	case InvocationType:
+		return firstAction(sequenceGlobal(t.Body, t.Next), r, known)
+	case InterruptibleType:
+		//Whoever is told about an interrupt is told by the one who raises it,
+		//so it's enough to know what r does when the block isn't interrupted
+		return firstAction(sequenceGlobal(t.Body, t.Next), r, known)
+	case ForeachType:
+		//If the family might be empty, r may act first in what comes after it
+		if k, why := firstAction(t.Body, r, known); k != absent {
+			return k, why
+		}
+		return firstAction(t.Next, r, known)
+	}
+	return absent, ""
+}
+
+func uniqueParticipants(participants []Participant) []Participant {
+	seen := make(map[Participant]bool)
+	ans := make(ParticipantSet, 0, len(participants))
+	for _, p := range participants {
+		if !seen[p] {
+			seen[p] = true
+			ans = append(ans, p)
+		}
+	}
+	sort.Sort(ans)
+	return ans
+}
+
+//Check a single choice, for every participant other than the chooser and receiver
+func checkChoice(t BranchingType, path []Step, diagnostics *[]Diagnostic) {
+	labels := globalLabels(t.Branches)
+	everyone := make([]Participant, 0)
+	for _, branch := range t.Branches {
+		everyone = append(everyone, branch.Participants()...)
+	}
+
+	for _, r := range uniqueParticipants(everyone) {
+		if r == t.BranchPrefix.P1 || r == t.BranchPrefix.P2 {
+			continue
+		}
+		projections := make(map[string]LocalType)
+		projectable := true
+		for _, label := range labels {
+			local, err := t.Branches[label].Project(r)
+			if err != nil {
+				//A problem inside of the branch, which is reported at the choice where it happens
+				projectable = false
+				break
+			}
+			projections[label] = local
+		}
+		if !projectable {
+			continue
+		}
+
+		//Find the branches where r behaves differently than in some other branch
+		differing := make([]string, 0)
+		for _, l1 := range labels {
+			for _, l2 := range labels {
+				if l1 != l2 && !projections[l1].EquivalentTo(projections[l2]) {
+					differing = append(differing, l1)
+					break
+				}
+			}
+		}
+		if len(differing) == 0 {
+			continue
+		}
+
+		known := map[Participant]bool{t.BranchPrefix.P1: true, t.BranchPrefix.P2: true}
+		reported := false
+		for _, label := range differing {
+			k, why := firstAction(t.Branches[label], r, known)
+			if k == absent {
+				why = "it does nothing"
+			}
+			if k != informed {
+				*diagnostics = append(*diagnostics, Diagnostic{Rule: KnowledgeOfChoiceRule, First: t.BranchPrefix,
+					Participant: r, Labels: differing, Path: path,
+					Reason: fmt.Sprintf("%s behaves differently in branches %s, but is never told which was taken: in branch %s, %s",
+						r, strings.Join(differing, ", "), label, why)})
+				reported = true
+				break
+			}
+		}
+		if reported {
+			continue
+		}
+
+		//r is told, but must also be able to tell the branches apart from what it is told
+		merged := projections[labels[0]]
+		for _, label := range labels[1:] {
+			var err error
+			if merged, err = Merge(merged, projections[label]); err != nil {
+				*diagnostics = append(*diagnostics, Diagnostic{Rule: KnowledgeOfChoiceRule, First: t.BranchPrefix,
+					Participant: r, Labels: differing, Path: path,
+					Reason: fmt.Sprintf("%s is told about the choice, but can't tell branches %s apart: %v",
+						r, strings.Join(differing, ", "), err)})
+				break
+			}
+		}
+	}
+}
+
+func checkChoicesInternal(gt GlobalType, path []Step, diagnostics *[]Diagnostic) {
+	switch t := gt.(type) {
+	case ValueType:
+		checkChoicesInternal(t.ValueNext, path, diagnostics)
+	case DelegationType:
+		checkChoicesInternal(t.DelegationNext, path, diagnostics)
+	case BranchingType:
+		checkChoice(t, path, diagnostics)
+		for _, label := range globalLabels(t.Branches) {
+			checkChoicesInternal(t.Branches[label], appendStep(path, Step{Kind: BranchStep, Name: label}), diagnostics)
+		}
+	case ParallelType:
+		checkChoicesInternal(t.a, appendStep(path, Step{Kind: ParallelStep, Name: "left"}), diagnostics)
+		checkChoicesInternal(t.b, appendStep(path, Step{Kind: ParallelStep, Name: "right"}), diagnostics)
+		checkChoicesInternal(t.next, path, diagnostics)
+	case RecursiveType:
+		checkChoicesInternal(t.Body, appendStep(path, Step{Kind: RecursionStep, Name: string(t.Bind)}), diagnostics)
+	case DeadlineType:
+		checkChoicesInternal(sequenceGlobal(t.Body, t.Next), path, diagnostics)
+	case InvocationType:
+		//Whether a choice can be implemented depends on what comes after it, so the body isn't checked alone
+		checkChoicesInternal(sequenceGlobal(t.Body, t.Next), path, diagnostics)
+	case InterruptibleType:
+		for _, alternative := range t.alternatives() {
+			checkChoicesInternal(alternative, path, diagnostics)
+		}
+	case ForeachType:
+		checkChoicesInternal(t.Body, appendStep(path, Step{Kind: ForeachStep, Name: t.Index}), diagnostics)
+		checkChoicesInternal(t.Next, path, diagnostics)
+	}
+}
+
+//CheckChoices finds choices which can't be implemented, because some participant
+//other than the chooser and the receiver of the choice behaves differently depending on
+//which branch was taken, without first being told which branch that was by someone who knows.
+//Each diagnostic names that participant, the choice, and the branches it can't tell apart.
+func CheckChoices(gt GlobalType) []Diagnostic {
+	diagnostics := make([]Diagnostic, 0)
+	checkChoicesInternal(gt, make([]Step, 0, 0), &diagnostics)
+	return diagnostics
+}
@@ -0,0 +1,140 @@
+package multiparty
+
+import (
+	"fmt"
+	"time"
+)
+
+//A deadline on part of a protocol: each participant must do everything it does in Body
+//within Within of its own first action in Body, e.g. B must reply within 200ms of receiving A's request.
+//Body ends where the deadline stops applying, and the protocol carries on with Next.
+type DeadlineType struct {
+	Within time.Duration
+	Body   GlobalType
+	Next   GlobalType
+}
+
+func (t DeadlineType) isWellFormed() bool {
+	return t.Body.isWellFormed() && t.Next.isWellFormed()
+}
+
+func (t DeadlineType) Prefixes() [][]Prefix {
+	return sequenceGlobal(t.Body, t.Next).Prefixes()
+}
+
+func (t DeadlineType) Participants() []Participant {
+	return append(t.Body.Participants(), t.Next.Participants()...)
+}
+
+func (t DeadlineType) channels() ChannelSet {
+	return append(t.Body.channels(), t.Next.channels()...)
+}
+
+//A participant with nothing to do before the deadline doesn't see it
+func (t DeadlineType) Project(p Participant) (LocalType, error) {
+	body, err := t.Body.Project(p)
+	if err != nil {
+		return nil, err
+	}
+	next, err := t.Next.Project(p)
+	if err != nil {
+		return nil, err
+	}
+	if free := FreeVariables(body); len(free) > 0 {
+		return nil, fmt.Errorf("the deadline of %s is left without finishing it, by jumping to %s", t.Within, free[0])
+	}
+	if _, ok := body.(LocalEndType); ok {
+		return next, nil
+	}
+	return LocalDeadlineType{Within: t.Within, Body: body, Next: next}, nil
+}
+
+func (t DeadlineType) equals(g GlobalType) bool {
+	switch g.(type) {
+	case DeadlineType:
+		gt := g.(DeadlineType)
+		return t.Within == gt.Within && t.Body.equals(gt.Body) && t.Next.equals(gt.Next)
+	}
+	return false
+}
+
+//Rename the loop t if it would capture the free variables of next,
+//which is about to be put in place of the end of its body
+func avoidCapture(t RecursiveType, next GlobalType) RecursiveType {
+	free, _ := globalVariables(next)
+	if !free[t.Bind] {
+		return t
+	}
+	bodyFree, bodyBound := globalVariables(t.Body)
+	avoid := make(map[LocalNameType]bool)
+	for _, names := range []map[NameType]bool{free, bodyFree, bodyBound} {
+		for name := range names {
+			avoid[LocalNameType(name)] = true
+		}
+	}
+	fresh := NameType(freshName(LocalNameType(t.Bind), avoid))
+	return RecursiveType{Bind: fresh, Body: substituteGlobal(t.Body, t.Bind, fresh)}
+}
+
+//Put next in place of the end of gt, ignoring deadlines and invocations, for checks which only care about the order of interactions.
+//The parts of a parallel type end where they join, so next comes after the join.
+func sequenceGlobal(gt GlobalType, next GlobalType) GlobalType {
+	switch t := gt.(type) {
+	case ValueType:
+		t.ValueNext = sequenceGlobal(t.ValueNext, next)
+		return t
+	case DelegationType:
+		t.DelegationNext = sequenceGlobal(t.DelegationNext, next)
+		return t
+	case BranchingType:
+		branches := make(map[string]GlobalType)
+		for label, branch := range t.Branches {
+			branches[label] = sequenceGlobal(branch, next)
+		}
+		return BranchingType{BranchPrefix: t.BranchPrefix, Branches: branches}
+	case RecursiveType:
+		t = avoidCapture(t, next)
+		return RecursiveType{Bind: t.Bind, Body: sequenceGlobal(t.Body, next)}
+	case ForeachType:
+		t.Next = sequenceGlobal(t.Next, next)
+		return t
+	case DeadlineType:
+		return sequenceGlobal(t.Body, sequenceGlobal(t.Next, next))
+	case InvocationType:
+		return sequenceGlobal(t.Body, sequenceGlobal(t.Next, next))
+	case InterruptibleType:
+		t.Next = sequenceGlobal(t.Next, next)
+		return t
+	case ParallelType:
+		t.next = sequenceGlobal(t.next, next)
+		return t
+	case EndType:
+		return next
+	}
+	return gt
+}
+
+//Everything done in Body must be done within Within of the first thing done in it,
+//then carry on with Next
+type LocalDeadlineType struct {
+	Within time.Duration
+	Body   LocalType
+	Next   LocalType
+}
+
+func (t LocalDeadlineType) Substitute(u LocalNameType, tsub LocalType) LocalType {
+	return LocalDeadlineType{Within: t.Within, Body: t.Body.Substitute(u, tsub), Next: t.Next.Substitute(u, tsub)}
+}
+
+func (t LocalDeadlineType) EquivalentTo(l LocalType) bool {
+	return equivalent(t, l)
+}
+
+func (t LocalDeadlineType) Equals(l LocalType) bool {
+	switch l.(type) {
+	case LocalDeadlineType:
+		lt := l.(LocalDeadlineType)
+		return t.Within == lt.Within && t.Body.Equals(lt.Body) && t.Next.Equals(lt.Next)
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package multiparty
+
+//A participant hands over its endpoint of another session to someone else,
+//who continues that session in its place (k⟨⟨T@p⟩⟩ in Honda et al. 2008).
+//Session says what is left to do with the endpoint: the local type T of participant p in the other session.
+type DelegationType struct {
+	DelegationPrefix Prefix
+	Session          ProjectionType
+	DelegationNext   GlobalType
+}
+
+//Make the type T@p of participant p's endpoint in a session, for use in delegation
+func MakeProjectionType(p Participant, t LocalType) ProjectionType {
+	return ProjectionType{T: t, participant: p}
+}
+
+//The participant whose endpoint this is
+func (t ProjectionType) Participant() Participant {
+	return t.participant
+}
+
+//Delegated sessions are the same if they are for the same participant,
+//and what is left to do in them is equivalent
+func sessionsEquivalent(a, b ProjectionType) bool {
+	return a.participant == b.participant && a.T.EquivalentTo(b.T)
+}
+
+//Whoever ends up with a delegated endpoint must stand in for its participant,
+//so an owner who will follow sub may be given an endpoint of super if they are for
+//the same participant, and sub is a subtype of what is left to do with the endpoint.
+//This makes accepting covariant in the session, and delegating contravariant.
+func sessionSubtype(sub, super ProjectionType) bool {
+	return sub.participant == super.participant && IsSubtype(sub.T, super.T)
+}
+
+func (t DelegationType) isWellFormed() bool {
+	return t.DelegationNext.isWellFormed()
+}
+
+func (t DelegationType) Prefixes() [][]Prefix {
+	current := append(make([]Prefix, 0, 1), t.DelegationPrefix)
+	ans := append(make([][]Prefix, 0, 1), current)
+	for _, prefix := range t.DelegationNext.Prefixes() {
+		ans = append(ans, append(current, prefix...))
+	}
+	return ans
+}
+
+//The participants of the delegated session belong to that session, not this one
+func (t DelegationType) Participants() []Participant {
+	return append(t.DelegationPrefix.participants(), t.DelegationNext.Participants()...)
+}
+
+func (t DelegationType) Project(p Participant) (LocalType, error) {
+	ans, err := t.DelegationNext.Project(p)
+	if err != nil {
+		return nil, err
+	} else if t.DelegationPrefix.P1 == p {
+		ans = LocalDelegateType{Channel: t.DelegationPrefix.PChannel, Session: t.Session, Next: ans}
+	} else if t.DelegationPrefix.P2 == p {
+		ans = LocalAcceptType{Channel: t.DelegationPrefix.PChannel, Session: t.Session, Next: ans}
+	}
+	return ans, err
+}
+
+func (t DelegationType) equals(g GlobalType) bool {
+	switch g.(type) {
+	case DelegationType:
+		gt := g.(DelegationType)
+		return gt.DelegationPrefix == t.DelegationPrefix && t.Session.Equals(gt.Session) && t.DelegationNext.equals(gt.DelegationNext)
+	}
+	return false
+}
+
+func (t DelegationType) channels() ChannelSet {
+	return append(t.DelegationNext.channels(), t.DelegationPrefix.PChannel)
+}
+
+//Hand over an endpoint of another session on Channel
+type LocalDelegateType struct {
+	Channel Channel
+	Session ProjectionType
+	Next    LocalType
+}
+
+//The delegated session is a different session, so its variables are never ours to substitute
+func (t LocalDelegateType) Substitute(u LocalNameType, tsub LocalType) LocalType {
+	ret := t
+	ret.Next = t.Next.Substitute(u, tsub)
+	return ret
+}
+
+func (t LocalDelegateType) EquivalentTo(l LocalType) bool {
+	return equivalent(t, l)
+}
+
+func (t LocalDelegateType) Equals(l LocalType) bool {
+	switch l.(type) {
+	case LocalDelegateType:
+		lt := l.(LocalDelegateType)
+		return t.Channel == lt.Channel && t.Session.Equals(lt.Session) && t.Next.Equals(lt.Next)
+	}
+	return false
+}
+
+//Receive an endpoint of another session on Channel, and continue that session
+type LocalAcceptType struct {
+	Channel Channel
+	Session ProjectionType
+	Next    LocalType
+}
+
+func (t LocalAcceptType) Substitute(u LocalNameType, tsub LocalType) LocalType {
+	ret := t
+	ret.Next = t.Next.Substitute(u, tsub)
+	return ret
+}
+
+func (t LocalAcceptType) EquivalentTo(l LocalType) bool {
+	return equivalent(t, l)
+}
+
+func (t LocalAcceptType) Equals(l LocalType) bool {
+	switch l.(type) {
+	case LocalAcceptType:
+		lt := l.(LocalAcceptType)
+		return t.Channel == lt.Channel && t.Session.Equals(lt.Session) && t.Next.Equals(lt.Next)
+	}
+	return false
+}
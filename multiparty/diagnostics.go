@@ -0,0 +1,190 @@
+package multiparty
+
+import (
+	"fmt"
+	"strings"
+)
+
+//Which well-formedness condition a diagnostic is about
+type Rule string
+
+const (
+	//Input dependencies: each receive must be ordered after earlier interactions on its channel
+	InputDependencyRule Rule = "input dependency"
+	//Output dependencies: each send must be ordered after earlier interactions on its channel
+	OutputDependencyRule Rule = "output dependency"
+	//The global type could not be projected onto a participant
+	ProjectionRule Rule = "projection"
+	//A participant behaves differently in the branches of a choice without being told which was taken
+	KnowledgeOfChoiceRule Rule = "knowledge of choice"
+	//The condition on the values of a message can't be checked by one of its participants
+	RefinementRule Rule = "refinement"
+)
+
+//The kinds of places in a global type that a path can go through
+type StepKind int
+
+const (
+	BranchStep StepKind = iota
+	RecursionStep
+	ParallelStep
+	ForeachStep
+	InterruptStep
+	InvokeStep
+)
+
+//A single step along the path from the top of a global type to a problem:
+//the label of a branch, the name of a recursive type,
+//the side ("left" or "right") of a parallel type, the index of a family,
+//the label of an interrupt, or the protocol being invoked
+type Step struct {
+	Kind StepKind
+	Name string
+}
+
+func (s Step) String() string {
+	switch s.Kind {
+	case BranchStep:
+		return "branch " + s.Name
+	case RecursionStep:
+		return "rec " + s.Name
+	case ParallelStep:
+		return "par " + s.Name
+	case ForeachStep:
+		return "foreach " + s.Name
+	case InterruptStep:
+		return "interrupt " + s.Name
+	case InvokeStep:
+		return "invoke " + s.Name
+	}
+	return s.Name
+}
+
+//A problem found when checking a global type.
+//For dependency rules, First and Second are the two conflicting prefixes,
+//with First coming before Second in the protocol.
+//For projection failures, Participant is who the type couldn't be projected onto,
+//and First is the prefix of the interaction where projection failed, if there is one.
+//For knowledge of choice, First is the prefix of the choice, Participant is who
+//lacks knowledge of it, and Labels are the branches that participant can't tell apart.
+//For refinements, First is the prefix of the message, and Participant is who can't check its condition.
+type Diagnostic struct {
+	Rule          Rule
+	First, Second Prefix
+	Participant   Participant
+	Labels        []string
+	//Why the rule failed
+	Reason string
+	//How to get from the top of the type to where the problem is
+	Path []Step
+}
+
+func formatPath(path []Step) string {
+	if len(path) == 0 {
+		return "top level"
+	}
+	steps := make([]string, len(path))
+	for i, step := range path {
+		steps[i] = step.String()
+	}
+	return strings.Join(steps, " / ")
+}
+
+func (d Diagnostic) String() string {
+	switch d.Rule {
+	case InputDependencyRule, OutputDependencyRule:
+		return fmt.Sprintf("%s broken between %s and %s at %s: %s",
+			d.Rule, d.First, d.Second, formatPath(d.Path), d.Reason)
+	case ProjectionRule:
+		return fmt.Sprintf("cannot project onto %s at %s: %s", d.Participant, formatPath(d.Path), d.Reason)
+	case KnowledgeOfChoiceRule:
+		return fmt.Sprintf("%s broken for choice %s at %s: %s", d.Rule, d.First, formatPath(d.Path), d.Reason)
+	}
+	return fmt.Sprintf("%s at %s: %s", d.Rule, formatPath(d.Path), d.Reason)
+}
+
+func (d Diagnostic) Error() string {
+	return d.String()
+}
+
+//The same problem can be reached many times, e.g. once for every
+//interleaving of a parallel type, so we only keep the first of each
+func uniqueDiagnostics(diagnostics []Diagnostic) []Diagnostic {
+	seen := make(map[string]bool)
+	ans := make([]Diagnostic, 0, len(diagnostics))
+	for _, d := range diagnostics {
+		key := d.String()
+		if !seen[key] {
+			seen[key] = true
+			ans = append(ans, d)
+		}
+	}
+	return ans
+}
+
+//Find the innermost part of a global type which can't be projected onto p,
+//so that the diagnostic points to the actual problem
+func projectionFailure(gt GlobalType, p Participant, path []Step, err error) Diagnostic {
+	fails := func(t GlobalType) error {
+		_, err := t.Project(p)
+		return err
+	}
+	switch t := gt.(type) {
+	case ValueType:
+		if innerErr := fails(t.ValueNext); innerErr != nil {
+			return projectionFailure(t.ValueNext, p, path, innerErr)
+		}
+	case DelegationType:
+		if innerErr := fails(t.DelegationNext); innerErr != nil {
+			return projectionFailure(t.DelegationNext, p, path, innerErr)
+		}
+	case BranchingType:
+		for _, label := range globalLabels(t.Branches) {
+			if innerErr := fails(t.Branches[label]); innerErr != nil {
+				return projectionFailure(t.Branches[label], p, appendStep(path, Step{Kind: BranchStep, Name: label}), innerErr)
+			}
+		}
+		return Diagnostic{Rule: ProjectionRule, Participant: p, First: t.BranchPrefix, Reason: err.Error(), Path: path}
+	case ParallelType:
+		if innerErr := fails(t.a); innerErr != nil {
+			return projectionFailure(t.a, p, appendStep(path, Step{Kind: ParallelStep, Name: "left"}), innerErr)
+		}
+		if innerErr := fails(t.b); innerErr != nil {
+			return projectionFailure(t.b, p, appendStep(path, Step{Kind: ParallelStep, Name: "right"}), innerErr)
+		}
+		if innerErr := fails(t.next); innerErr != nil {
+			return projectionFailure(t.next, p, path, innerErr)
+		}
+	case RecursiveType:
+		if innerErr := fails(t.Body); innerErr != nil {
+			return projectionFailure(t.Body, p, appendStep(path, Step{Kind: RecursionStep, Name: string(t.Bind)}), innerErr)
+		}
+	case InterruptibleType:
+		if innerErr := fails(t.Body); innerErr != nil {
+			return projectionFailure(t.Body, p, path, innerErr)
+		}
+		for _, i := range t.Interrupts {
+			if innerErr := fails(i.Then); innerErr != nil {
+				return projectionFailure(i.Then, p, appendStep(path, Step{Kind: InterruptStep, Name: i.Label}), innerErr)
+			}
+		}
+		if innerErr := fails(t.Next); innerErr != nil {
+			return projectionFailure(t.Next, p, path, innerErr)
+		}
+	case DeadlineType:
+		if innerErr := fails(t.Body); innerErr != nil {
+			return projectionFailure(t.Body, p, path, innerErr)
+		}
+		if innerErr := fails(t.Next); innerErr != nil {
+			return projectionFailure(t.Next, p, path, innerErr)
+		}
+	case InvocationType:
+		if innerErr := fails(t.Body); innerErr != nil {
+			return projectionFailure(t.Body, p, appendStep(path, Step{Kind: InvokeStep, Name: t.Protocol}), innerErr)
+		}
+		if innerErr := fails(t.Next); innerErr != nil {
+			return projectionFailure(t.Next, p, path, innerErr)
+		}
+	}
+	return Diagnostic{Rule: ProjectionRule, Participant: p, Reason: err.Error(), Path: path}
+}
@@ -0,0 +1,376 @@
+package multiparty
+
+import (
+	"fmt"
+	"strings"
+)
+
+//The kinds of change Diff reports
+type ChangeKind int
+
+const (
+	BranchAdded ChangeKind = iota
+	BranchRemoved
+	SortChanged
+	//The condition on the values of a message changed
+	RefinementChanged
+	//How long a deadline is changed
+	DeadlineChanged
+	ChannelChanged
+	//The participants of an interaction changed, other than by renaming
+	ParticipantChanged
+	//A participant has a new name everywhere in the protocol
+	ParticipantRenamed
+	//Something else was put in place of an interaction, e.g. a choice instead of a value
+	StructureChanged
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case BranchAdded:
+		return "branch added"
+	case BranchRemoved:
+		return "branch removed"
+	case SortChanged:
+		return "sort changed"
+	case RefinementChanged:
+		return "refinement changed"
+	case DeadlineChanged:
+		return "deadline changed"
+	case ChannelChanged:
+		return "channel changed"
+	case ParticipantChanged:
+		return "participant changed"
+	case ParticipantRenamed:
+		return "participant renamed"
+	case StructureChanged:
+		return "structure changed"
+	}
+	return "unknown change"
+}
+
+//A single difference between two versions of a protocol.
+//Old and New describe what is there in each version: a label, sort, channel,
+//participant, or type, depending on the kind of change.
+type Change struct {
+	Kind     ChangeKind
+	Old, New string
+	//Where the change is, in the old version. Empty for renamed participants.
+	Path []Step
+}
+
+func (c Change) String() string {
+	switch c.Kind {
+	case BranchAdded:
+		return fmt.Sprintf("%s: %s %s", formatPath(c.Path), c.Kind, c.New)
+	case BranchRemoved:
+		return fmt.Sprintf("%s: %s %s", formatPath(c.Path), c.Kind, c.Old)
+	case ParticipantRenamed:
+		return fmt.Sprintf("%s: %s to %s", c.Kind, c.Old, c.New)
+	}
+	return fmt.Sprintf("%s: %s from %s to %s", formatPath(c.Path), c.Kind, c.Old, c.New)
+}
+
+//Whether a participant implementing the old version of a protocol
+//still works with participants implementing the new version
+type RoleCompatibility struct {
+	//The name of the participant in the old version, or in the new one if it was added
+	Participant Participant
+	//The name of the participant in the new version, if it was renamed
+	RenamedTo  Participant
+	Compatible bool
+	Reason     string
+}
+
+func (r RoleCompatibility) String() string {
+	name := string(r.Participant)
+	if r.RenamedTo != "" {
+		name = fmt.Sprintf("%s (now %s)", r.Participant, r.RenamedTo)
+	}
+	if r.Compatible {
+		return fmt.Sprintf("%s: compatible", name)
+	}
+	return fmt.Sprintf("%s: incompatible: %s", name, r.Reason)
+}
+
+//The result of comparing two versions of a protocol
+type ProtocolDiff struct {
+	Changes []Change
+	Roles   []RoleCompatibility
+}
+
+//Compatible reports whether every participant of the old version can keep running
+//against the new version, which makes it usable as a gate between versions
+func (d ProtocolDiff) Compatible() bool {
+	for _, role := range d.Roles {
+		if !role.Compatible {
+			return false
+		}
+	}
+	return true
+}
+
+func (d ProtocolDiff) String() string {
+	lines := make([]string, 0, len(d.Changes)+len(d.Roles))
+	for _, change := range d.Changes {
+		lines = append(lines, change.String())
+	}
+	for _, role := range d.Roles {
+		lines = append(lines, role.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+type differ struct {
+	changes []Change
+	//The participants of the new version at the same places as each participant of the old one
+	counterparts map[Participant]map[Participant]bool
+	//Interactions whose participants differ, checked once we know what was renamed
+	moved []movedPrefix
+}
+
+type movedPrefix struct {
+	old, new Prefix
+	path     []Step
+}
+
+func (d *differ) change(kind ChangeKind, old, new string, path []Step) {
+	d.changes = append(d.changes, Change{Kind: kind, Old: old, New: new, Path: path})
+}
+
+func (d *differ) prefix(old, new Prefix, path []Step) {
+	if old.PChannel != new.PChannel {
+		d.change(ChannelChanged, string(old.PChannel), string(new.PChannel), path)
+	}
+	for _, pair := range [][2]Participant{{old.P1, new.P1}, {old.P2, new.P2}} {
+		if d.counterparts[pair[0]] == nil {
+			d.counterparts[pair[0]] = make(map[Participant]bool)
+		}
+		d.counterparts[pair[0]][pair[1]] = true
+	}
+	if old.P1 != new.P1 || old.P2 != new.P2 {
+		d.moved = append(d.moved, movedPrefix{old: old, new: new, path: path})
+	}
+}
+
+func (d *differ) diff(old, new GlobalType, path []Step) {
+	switch to := old.(type) {
+	case ValueType:
+		if tn, ok := new.(ValueType); ok {
+			d.prefix(to.ValuePrefix, tn.ValuePrefix, path)
+			if !sortsEqual(to.Value, tn.Value) {
+				d.change(SortChanged, formatValue(to.Value), formatValue(tn.Value), path)
+			}
+			if !refinementsEqual(to.Refinement, tn.Refinement) {
+				d.change(RefinementChanged, formatRefinement(to.Refinement), formatRefinement(tn.Refinement), path)
+			}
+			d.diff(to.ValueNext, tn.ValueNext, path)
+			return
+		}
+	case DelegationType:
+		if tn, ok := new.(DelegationType); ok {
+			d.prefix(to.DelegationPrefix, tn.DelegationPrefix, path)
+			if !sessionsEquivalent(to.Session, tn.Session) {
+				d.change(SortChanged, FormatLocal(to.Session, ASCII), FormatLocal(tn.Session, ASCII), path)
+			}
+			d.diff(to.DelegationNext, tn.DelegationNext, path)
+			return
+		}
+	case BranchingType:
+		if tn, ok := new.(BranchingType); ok {
+			d.prefix(to.BranchPrefix, tn.BranchPrefix, path)
+			for _, label := range globalLabels(to.Branches) {
+				if _, ok := tn.Branches[label]; !ok {
+					d.change(BranchRemoved, label, "", path)
+				}
+			}
+			for _, label := range globalLabels(tn.Branches) {
+				if _, ok := to.Branches[label]; !ok {
+					d.change(BranchAdded, "", label, path)
+				}
+			}
+			for _, label := range globalLabels(to.Branches) {
+				if branch, ok := tn.Branches[label]; ok {
+					d.diff(to.Branches[label], branch, appendStep(path, Step{Kind: BranchStep, Name: label}))
+				}
+			}
+			return
+		}
+	case ParallelType:
+		if tn, ok := new.(ParallelType); ok {
+			d.diff(to.a, tn.a, appendStep(path, Step{Kind: ParallelStep, Name: "left"}))
+			d.diff(to.b, tn.b, appendStep(path, Step{Kind: ParallelStep, Name: "right"}))
+			d.diff(to.next, tn.next, path)
+			return
+		}
+	case RecursiveType:
+		//The names of recursive types don't matter
+		if tn, ok := new.(RecursiveType); ok {
+			d.diff(to.Body, tn.Body, appendStep(path, Step{Kind: RecursionStep, Name: string(to.Bind)}))
+			return
+		}
+	case DeadlineType:
+		if tn, ok := new.(DeadlineType); ok {
+			if to.Within != tn.Within {
+				d.change(DeadlineChanged, to.Within.String(), tn.Within.String(), path)
+			}
+			d.diff(to.Body, tn.Body, path)
+			d.diff(to.Next, tn.Next, path)
+			return
+		}
+	case InvocationType:
+		if tn, ok := new.(InvocationType); ok && to.Protocol == tn.Protocol {
+			d.diff(to.Body, tn.Body, appendStep(path, Step{Kind: InvokeStep, Name: to.Protocol}))
+			d.diff(to.Next, tn.Next, path)
+			return
+		}
+	case InterruptibleType:
+		if tn, ok := new.(InterruptibleType); ok {
+			d.diff(to.Body, tn.Body, path)
+			//Interrupts are matched up by their labels, like branches
+			oldInterrupts := make(map[string]Interrupt)
+			for _, i := range to.Interrupts {
+				oldInterrupts[i.Label] = i
+			}
+			newInterrupts := make(map[string]Interrupt)
+			for _, i := range tn.Interrupts {
+				newInterrupts[i.Label] = i
+			}
+			for _, i := range to.Interrupts {
+				other, ok := newInterrupts[i.Label]
+				if !ok {
+					d.change(BranchRemoved, i.Label, "", path)
+					continue
+				}
+				inner := appendStep(path, Step{Kind: InterruptStep, Name: i.Label})
+				if len(i.Notify) != len(other.Notify) {
+					d.change(StructureChanged, fmt.Sprint(i.Notify), fmt.Sprint(other.Notify), inner)
+				} else {
+					for j, prefix := range i.Notify {
+						d.prefix(prefix, other.Notify[j], inner)
+					}
+				}
+				d.diff(i.Then, other.Then, inner)
+			}
+			for _, i := range tn.Interrupts {
+				if _, ok := oldInterrupts[i.Label]; !ok {
+					d.change(BranchAdded, "", i.Label, path)
+				}
+			}
+			d.diff(to.Next, tn.Next, path)
+			return
+		}
+	case ForeachType:
+		if tn, ok := new.(ForeachType); ok && to.Index == tn.Index && to.From == tn.From && to.To == tn.To {
+			d.diff(to.Body, tn.Body, appendStep(path, Step{Kind: ForeachStep, Name: to.Index}))
+			d.diff(to.Next, tn.Next, path)
+			return
+		}
+	case NameType:
+		if _, ok := new.(NameType); ok {
+			return
+		}
+	case EndType:
+		if _, ok := new.(EndType); ok {
+			return
+		}
+	}
+	d.change(StructureChanged, FormatGlobal(old, ASCII), FormatGlobal(new, ASCII), path)
+}
+
+//A participant was renamed if it is gone from the new version,
+//and the same new participant is always in its place
+func (d *differ) renames(oldParticipants, newParticipants []Participant) map[Participant]Participant {
+	inOld, inNew := make(map[Participant]bool), make(map[Participant]bool)
+	for _, p := range oldParticipants {
+		inOld[p] = true
+	}
+	for _, p := range newParticipants {
+		inNew[p] = true
+	}
+	ans := make(map[Participant]Participant)
+	for _, p := range oldParticipants {
+		if inNew[p] || len(d.counterparts[p]) != 1 {
+			continue
+		}
+		for q := range d.counterparts[p] {
+			if !inOld[q] {
+				ans[p] = q
+			}
+		}
+	}
+	return ans
+}
+
+//Diff compares two versions of a protocol, reporting what changed,
+//and whether each participant implementing the old version is compatible with the new one.
+//
+//A participant is compatible if its old local type is a subtype of its new one,
+//so it handles every label it can now be sent and only selects labels which are still there.
+//Participants which are only in the new version are compatible, since nothing implements them yet;
+//participants which were removed are not.
+func Diff(old, new GlobalType) ProtocolDiff {
+	d := &differ{changes: make([]Change, 0), counterparts: make(map[Participant]map[Participant]bool)}
+	d.diff(old, new, make([]Step, 0))
+
+	oldParticipants, newParticipants := uniqueParticipants(old.Participants()), uniqueParticipants(new.Participants())
+	renamed := d.renames(oldParticipants, newParticipants)
+	for _, p := range oldParticipants {
+		if q, ok := renamed[p]; ok {
+			d.change(ParticipantRenamed, string(p), string(q), nil)
+		}
+	}
+	rename := func(p Participant) Participant {
+		if q, ok := renamed[p]; ok {
+			return q
+		}
+		return p
+	}
+	for _, moved := range d.moved {
+		if rename(moved.old.P1) != moved.new.P1 || rename(moved.old.P2) != moved.new.P2 {
+			d.change(ParticipantChanged, fmt.Sprintf("%s -> %s", moved.old.P1, moved.old.P2),
+				fmt.Sprintf("%s -> %s", moved.new.P1, moved.new.P2), moved.path)
+		}
+	}
+
+	ans := ProtocolDiff{Changes: d.changes, Roles: make([]RoleCompatibility, 0)}
+	inOld := make(map[Participant]bool)
+	renamedFrom := make(map[Participant]bool)
+	for _, p := range oldParticipants {
+		inOld[p] = true
+		renamedFrom[rename(p)] = true
+	}
+	inNew := make(map[Participant]bool)
+	for _, p := range newParticipants {
+		inNew[p] = true
+	}
+	for _, p := range oldParticipants {
+		role := RoleCompatibility{Participant: p}
+		q := rename(p)
+		if q != p {
+			role.RenamedTo = q
+		}
+		if !inNew[q] {
+			role.Reason = "removed from the protocol"
+			ans.Roles = append(ans.Roles, role)
+			continue
+		}
+		oldLocal, err := old.Project(p)
+		if err != nil {
+			role.Reason = fmt.Sprintf("the old version can't be projected: %v", err)
+		} else if newLocal, err := new.Project(q); err != nil {
+			role.Reason = fmt.Sprintf("the new version can't be projected: %v", err)
+		} else if err := CheckSubtype(oldLocal, newLocal); err != nil {
+			role.Reason = err.Error()
+		} else {
+			role.Compatible = true
+		}
+		ans.Roles = append(ans.Roles, role)
+	}
+	for _, p := range newParticipants {
+		if !inOld[p] && !renamedFrom[p] {
+			ans.Roles = append(ans.Roles, RoleCompatibility{Participant: p, Compatible: true, Reason: "added to the protocol"})
+		}
+	}
+	return ans
+}
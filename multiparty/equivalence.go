@@ -0,0 +1,40 @@
+package multiparty
+
+//Two local types are equivalent if their graphs are bisimilar:
+//they do the same communications in the same order, no matter
+//how their recursion is written down
+func equivalent(a, b LocalType) bool {
+	aGraph, errA := newLocalGraph(a)
+	bGraph, errB := newLocalGraph(b)
+	if errA != nil || errB != nil {
+		//Types with free variables can only be compared syntactically
+		return errA != nil && errB != nil && a.Equals(b) && b.Equals(a)
+	}
+	return bisimilar(aGraph, bGraph, aGraph.root, bGraph.root, make(map[[2]int]bool))
+}
+
+func bisimilar(aGraph, bGraph *localGraph, a, b int, assumed map[[2]int]bool) bool {
+	if assumed[[2]int{a, b}] {
+		return true
+	}
+	assumed[[2]int{a, b}] = true
+
+	aNode, bNode := aGraph.nodes[a], bGraph.nodes[b]
+	if aNode.kind != bNode.kind || aNode.channel != bNode.channel || !sortsEqual(aNode.value, bNode.value) ||
+		!refinementsEqual(aNode.refinement, bNode.refinement) || aNode.within != bNode.within || len(aNode.next) != len(bNode.next) {
+		return false
+	}
+	if aNode.kind == interruptNode && !interruptsEqual(aNode.interrupts, bNode.interrupts) {
+		return false
+	}
+	if (aNode.kind == delegateNode || aNode.kind == acceptNode) && !sessionsEquivalent(aNode.session, bNode.session) {
+		return false
+	}
+	for label, aNext := range aNode.next {
+		bNext, ok := bNode.next[label]
+		if !ok || !bisimilar(aGraph, bGraph, aNext, bNext, assumed) {
+			return false
+		}
+	}
+	return true
+}
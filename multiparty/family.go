@@ -0,0 +1,282 @@
+package multiparty
+
+import (
+	"errors"
+	"fmt"
+	"go/constant"
+	"go/parser"
+	"regexp"
+	"strings"
+)
+
+//A family of interactions, done once for each value of Index from From to To inclusive, in order,
+//then followed by Next. The end of Body is where the next iteration starts.
+//Participants and channels in Body may be indexed by expressions over Index and the parameters
+//of the protocol, in square brackets, like Worker[i] or Worker[i+1].
+//From and To are Go expressions over the parameters, such as 1 and N, which are only known
+//once a session starts, so a type with families must be instantiated before it is projected.
+type ForeachType struct {
+	Index    string
+	From, To string
+	Body     GlobalType
+	Next     GlobalType
+}
+
+var errFamily = errors.New("role families must be instantiated before projection")
+
+func (t ForeachType) isWellFormed() bool {
+	return t.Body.isWellFormed() && t.Next.isWellFormed()
+}
+
+func (t ForeachType) Prefixes() [][]Prefix {
+	return append(t.Body.Prefixes(), t.Next.Prefixes()...)
+}
+
+//The participants as they are written, including indexed ones like Worker[i]
+func (t ForeachType) Participants() []Participant {
+	return append(t.Body.Participants(), t.Next.Participants()...)
+}
+
+func (t ForeachType) channels() ChannelSet {
+	return append(t.Body.channels(), t.Next.channels()...)
+}
+
+//Which participants take part depends on the parameters, so use Instantiate first
+func (t ForeachType) Project(p Participant) (LocalType, error) {
+	return nil, errFamily
+}
+
+func (t ForeachType) equals(g GlobalType) bool {
+	switch g.(type) {
+	case ForeachType:
+		gt := g.(ForeachType)
+		return t.Index == gt.Index && t.From == gt.From && t.To == gt.To && t.Body.equals(gt.Body) && t.Next.equals(gt.Next)
+	}
+	return false
+}
+
+//Evaluate an integer expression, like N or i+1, with the given values for its variables
+func evalIndex(expr string, env map[string]interface{}) (int, error) {
+	parsed, err := parser.ParseExpr(expr)
+	if err != nil {
+		return 0, fmt.Errorf("invalid index %q: %v", expr, err)
+	}
+	c, err := evaluator{env}.constant(parsed)
+	if err != nil {
+		return 0, fmt.Errorf("invalid index %q: %v", expr, err)
+	}
+	if c.Kind() != constant.Int {
+		return 0, fmt.Errorf("index %q is not an integer", expr)
+	}
+	n, exact := constant.Int64Val(c)
+	if !exact {
+		return 0, fmt.Errorf("index %q is too large", expr)
+	}
+	return int(n), nil
+}
+
+var indexPattern = regexp.MustCompile(`\[([^\[\]]*)\]`)
+
+//Replace each index of a name, like the i+1 in Worker[i+1], by its value.
+//Brackets around something other than an expression, like an IPv6 address, are left alone.
+func instantiateName(name string, env map[string]interface{}) (string, error) {
+	var failure error
+	ans := indexPattern.ReplaceAllStringFunc(name, func(index string) string {
+		if _, err := parser.ParseExpr(index[1 : len(index)-1]); err != nil {
+			return index
+		}
+		n, err := evalIndex(index[1:len(index)-1], env)
+		if err != nil && failure == nil {
+			failure = fmt.Errorf("in %s: %v", name, err)
+		}
+		return fmt.Sprintf("[%d]", n)
+	})
+	return ans, failure
+}
+
+func instantiatePrefix(prefix Prefix, env map[string]interface{}) (Prefix, error) {
+	p1, err := instantiateName(string(prefix.P1), env)
+	if err != nil {
+		return prefix, err
+	}
+	p2, err := instantiateName(string(prefix.P2), env)
+	if err != nil {
+		return prefix, err
+	}
+	channel, err := instantiateName(string(prefix.PChannel), env)
+	if err != nil {
+		return prefix, err
+	}
+	return Prefix{P1: Participant(p1), P2: Participant(p2), PChannel: Channel(channel)}, nil
+}
+
+//Instantiate gt with the given values for its parameters, unrolling each family into
+//one copy of its body for each value of its index, and giving each indexed participant
+//and channel the value of its index, e.g. Worker[2].
+//The result has no families, so it can be checked and projected like any other global type.
+func Instantiate(gt GlobalType, params map[string]int) (GlobalType, error) {
+	env := make(map[string]interface{})
+	for name, value := range params {
+		env[name] = value
+	}
+	return instantiate(gt, env, EndType{})
+}
+
+//Instantiate gt, with cont put in place of its end, so that iterations of a family follow each other
+func instantiate(gt GlobalType, env map[string]interface{}, cont GlobalType) (GlobalType, error) {
+	switch t := gt.(type) {
+	case ValueType:
+		prefix, err := instantiatePrefix(t.ValuePrefix, env)
+		if err != nil {
+			return nil, err
+		}
+		next, err := instantiate(t.ValueNext, env, cont)
+		if err != nil {
+			return nil, err
+		}
+		return ValueType{ValuePrefix: prefix, Value: t.Value, Refinement: t.Refinement, ValueNext: next}, nil
+	case DelegationType:
+		prefix, err := instantiatePrefix(t.DelegationPrefix, env)
+		if err != nil {
+			return nil, err
+		}
+		owner, err := instantiateName(string(t.Session.participant), env)
+		if err != nil {
+			return nil, err
+		}
+		next, err := instantiate(t.DelegationNext, env, cont)
+		if err != nil {
+			return nil, err
+		}
+		return DelegationType{DelegationPrefix: prefix, Session: MakeProjectionType(Participant(owner), t.Session.T), DelegationNext: next}, nil
+	case BranchingType:
+		prefix, err := instantiatePrefix(t.BranchPrefix, env)
+		if err != nil {
+			return nil, err
+		}
+		branches := make(map[string]GlobalType)
+		for label, branch := range t.Branches {
+			if branches[label], err = instantiate(branch, env, cont); err != nil {
+				return nil, err
+			}
+		}
+		return BranchingType{BranchPrefix: prefix, Branches: branches}, nil
+	case ParallelType:
+		//The ends of the parts are where they join, not the end of the iteration
+		a, err := instantiate(t.a, env, EndType{})
+		if err != nil {
+			return nil, err
+		}
+		b, err := instantiate(t.b, env, EndType{})
+		if err != nil {
+			return nil, err
+		}
+		next, err := instantiate(t.next, env, cont)
+		if err != nil {
+			return nil, err
+		}
+		return ParallelType{a, b, next}, nil
+	case RecursiveType:
+		//The loop is renamed if it would capture the variables of what follows the iteration
+		t = avoidCapture(t, cont)
+		body, err := instantiate(t.Body, env, cont)
+		if err != nil {
+			return nil, err
+		}
+		return RecursiveType{Bind: t.Bind, Body: body}, nil
+	case DeadlineType:
+		//The end of the body is the end of the deadline, not of the iteration
+		body, err := instantiate(t.Body, env, EndType{})
+		if err != nil {
+			return nil, err
+		}
+		next, err := instantiate(t.Next, env, cont)
+		if err != nil {
+			return nil, err
+		}
+		return DeadlineType{Within: t.Within, Body: body, Next: next}, nil
+	case InvocationType:
+		body, err := instantiate(t.Body, env, EndType{})
+		if err != nil {
+			return nil, err
+		}
+		next, err := instantiate(t.Next, env, cont)
+		if err != nil {
+			return nil, err
+		}
+		return InvocationType{Protocol: t.Protocol, Body: body, Next: next}, nil
+	case InterruptibleType:
+		body, err := instantiate(t.Body, env, EndType{})
+		if err != nil {
+			return nil, err
+		}
+		interrupts := make([]Interrupt, len(t.Interrupts))
+		for i, interrupt := range t.Interrupts {
+			notify := make([]Prefix, len(interrupt.Notify))
+			for j, prefix := range interrupt.Notify {
+				if notify[j], err = instantiatePrefix(prefix, env); err != nil {
+					return nil, err
+				}
+			}
+			then, err := instantiate(interrupt.Then, env, EndType{})
+			if err != nil {
+				return nil, err
+			}
+			interrupts[i] = Interrupt{Label: interrupt.Label, Notify: notify, Then: then}
+		}
+		next, err := instantiate(t.Next, env, cont)
+		if err != nil {
+			return nil, err
+		}
+		return InterruptibleType{Body: body, Interrupts: interrupts, Next: next}, nil
+	case NameType:
+		return t, nil
+	case EndType:
+		return cont, nil
+	case ForeachType:
+		from, err := evalIndex(t.From, env)
+		if err != nil {
+			return nil, err
+		}
+		to, err := evalIndex(t.To, env)
+		if err != nil {
+			return nil, err
+		}
+		//Build the iterations from the last one back, each continuing with the one after it
+		rest, err := instantiate(t.Next, env, cont)
+		if err != nil {
+			return nil, err
+		}
+		for i := to; i >= from; i-- {
+			inner := make(map[string]interface{})
+			for name, value := range env {
+				inner[name] = value
+			}
+			inner[t.Index] = i
+			if rest, err = instantiate(t.Body, inner, rest); err != nil {
+				return nil, err
+			}
+		}
+		return rest, nil
+	}
+	return nil, fmt.Errorf("cannot instantiate global type %T", gt)
+}
+
+//ProjectFamily instantiates gt with the given parameters, then projects it onto each
+//member of the family of participants with the given name, e.g. each Worker[i] for Worker.
+func ProjectFamily(gt GlobalType, family string, params map[string]int) (map[Participant]LocalType, error) {
+	instance, err := Instantiate(gt, params)
+	if err != nil {
+		return nil, err
+	}
+	ans := make(map[Participant]LocalType)
+	for _, p := range instance.Participants() {
+		if _, done := ans[p]; done || !strings.HasPrefix(string(p), family+"[") {
+			continue
+		}
+		if ans[p], err = instance.Project(p); err != nil {
+			return nil, fmt.Errorf("cannot project onto %s: %v", p, err)
+		}
+	}
+	return ans, nil
+}
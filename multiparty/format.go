@@ -0,0 +1,358 @@
+package multiparty
+
+import (
+	"sort"
+	"strings"
+)
+
+//Which symbols to use when formatting session types
+type Notation int
+
+const (
+	//The notation of Honda et al. 2008, e.g. A → B : k⟨int⟩ and μX. k!⟨int⟩; X
+	Unicode Notation = iota
+	//A plain-text fallback, e.g. A -> B : k<int> and rec X. k!<int>; X
+	ASCII
+)
+
+type symbols struct {
+	arrow, open, close, mu, selection, branching, in string
+}
+
+var notationSymbols = map[Notation]symbols{
+	Unicode: {arrow: "→", open: "⟨", close: "⟩", mu: "μ", selection: "⊕", branching: "&", in: "∈"},
+	ASCII:   {arrow: "->", open: "<", close: ">", mu: "rec ", selection: "+", branching: "&", in: "in"},
+}
+
+//Builds up the text of a session type.
+//Branches and recursive bodies are put on their own lines,
+//indented one level more than the enclosing type.
+type typePrinter struct {
+	sym    symbols
+	buf    strings.Builder
+	indent int
+}
+
+func newTypePrinter(n Notation) *typePrinter {
+	sym, ok := notationSymbols[n]
+	if !ok {
+		sym = notationSymbols[Unicode]
+	}
+	return &typePrinter{sym: sym}
+}
+
+func (p *typePrinter) write(strs ...string) {
+	for _, s := range strs {
+		p.buf.WriteString(s)
+	}
+}
+
+func (p *typePrinter) newline() {
+	p.buf.WriteString("\n")
+	p.buf.WriteString(strings.Repeat("  ", p.indent))
+}
+
+//Labels are printed in sorted order, so the same type always prints the same way
+func globalLabels(branches map[string]GlobalType) []string {
+	labels := make([]string, 0, len(branches))
+	for label := range branches {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+func localLabels(branches map[string]LocalType) []string {
+	labels := make([]string, 0, len(branches))
+	for label := range branches {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+//Print "{ label: ..., label: ... }" with one branch per line
+func (p *typePrinter) branches(labels []string, each func(string)) {
+	p.write("{")
+	p.indent++
+	for i, label := range labels {
+		p.newline()
+		p.write(label, ": ")
+		each(label)
+		if i < len(labels)-1 {
+			p.write(",")
+		}
+	}
+	p.indent--
+	p.newline()
+	p.write("}")
+}
+
+func (p *typePrinter) prefix(pre Prefix) {
+	p.write(string(pre.P1), " ", p.sym.arrow, " ", string(pre.P2), " : ", string(pre.PChannel))
+}
+
+func (p *typePrinter) global(gt GlobalType) {
+	switch t := gt.(type) {
+	case ValueType:
+		p.prefix(t.ValuePrefix)
+		p.value(t.Value, t.Refinement)
+		p.write(". ")
+		p.global(t.ValueNext)
+	case DelegationType:
+		p.prefix(t.DelegationPrefix)
+		p.session(t.Session)
+		p.write(". ")
+		p.global(t.DelegationNext)
+	case BranchingType:
+		p.prefix(t.BranchPrefix)
+		p.write(" ")
+		p.branches(globalLabels(t.Branches), func(label string) {
+			p.global(t.Branches[label])
+		})
+	case ParallelType:
+		p.write("(")
+		p.global(t.a)
+		p.write(" | ")
+		p.global(t.b)
+		p.write(")")
+		//e.g. (A → B : k⟨int⟩. end | C → D : k⟨int⟩. end). end, leaving out an end after the join
+		if _, ok := t.next.(EndType); !ok {
+			p.write(". ")
+			p.global(t.next)
+		}
+	case RecursiveType:
+		p.write(p.sym.mu, string(t.Bind), ".")
+		p.indent++
+		p.newline()
+		p.global(t.Body)
+		p.indent--
+	case DeadlineType:
+		p.write("within ", t.Within.String(), " {")
+		p.indent++
+		p.newline()
+		p.global(t.Body)
+		p.indent--
+		p.newline()
+		p.write("}. ")
+		p.global(t.Next)
+	case InvocationType:
+		p.write("invoke ", t.Protocol, " {")
+		p.indent++
+		p.newline()
+		p.global(t.Body)
+		p.indent--
+		p.newline()
+		p.write("}. ")
+		p.global(t.Next)
+	case InterruptibleType:
+		//e.g. interruptible { ... } on cancel from A → B : k { ... }. end
+		p.write("interruptible {")
+		p.indent++
+		p.newline()
+		p.global(t.Body)
+		p.indent--
+		p.newline()
+		for _, i := range t.Interrupts {
+			p.write("} on ", i.Label, " from ")
+			for j, prefix := range i.Notify {
+				if j > 0 {
+					p.write(", ")
+				}
+				p.prefix(prefix)
+			}
+			p.write(" {")
+			p.indent++
+			p.newline()
+			p.global(i.Then)
+			p.indent--
+			p.newline()
+		}
+		p.write("}. ")
+		p.global(t.Next)
+	case ForeachType:
+		//e.g. foreach i ∈ 1..N { Master → Worker[i] : k⟨int⟩. end }. end
+		p.write("foreach ", t.Index, " ", p.sym.in, " ", t.From, "..", t.To, " {")
+		p.indent++
+		p.newline()
+		p.global(t.Body)
+		p.indent--
+		p.newline()
+		p.write("}. ")
+		p.global(t.Next)
+	case NameType:
+		p.write(string(t))
+	case EndType:
+		p.write("end")
+	case nil:
+		p.write("<nil>")
+	default:
+		p.write("<unknown global type>")
+	}
+}
+
+//The sorts of a message, naming its values and followed by the condition on them if it is refined,
+//e.g. ⟨int⟩ or ⟨amount int⟩{positive: amount > 0}
+func (p *typePrinter) value(sorts []Sort, refinement *Refinement) {
+	if refinement == nil || len(refinement.Vars) != len(sorts) {
+		p.write(p.sym.open, joinSorts(sorts), p.sym.close)
+	} else {
+		p.write(p.sym.open)
+		for i, sort := range sorts {
+			if i > 0 {
+				p.write(", ")
+			}
+			if refinement.Vars[i] != "" {
+				p.write(refinement.Vars[i], " ")
+			}
+			p.write(string(sort))
+		}
+		p.write(p.sym.close)
+	}
+	if refinement != nil && refinement.Expr != "" {
+		p.write("{", refinement.String(), "}")
+	}
+}
+
+//A delegated session, in double brackets, e.g. ⟨⟨(k!⟨int⟩; end)@A⟩⟩
+func (p *typePrinter) session(t ProjectionType) {
+	p.write(p.sym.open, p.sym.open)
+	p.local(t)
+	p.write(p.sym.close, p.sym.close)
+}
+
+func (p *typePrinter) local(lt LocalType) {
+	switch t := lt.(type) {
+	case LocalSendType:
+		p.write(string(t.Channel), "!")
+		p.value(t.Value, t.Refinement)
+		p.write("; ")
+		p.local(t.Next)
+	case LocalReceiveType:
+		p.write(string(t.Channel), "?")
+		p.value(t.Value, t.Refinement)
+		p.write("; ")
+		p.local(t.Next)
+	case LocalDelegateType:
+		p.write(string(t.Channel), "!")
+		p.session(t.Session)
+		p.write("; ")
+		p.local(t.Next)
+	case LocalAcceptType:
+		p.write(string(t.Channel), "?")
+		p.session(t.Session)
+		p.write("; ")
+		p.local(t.Next)
+	case LocalSelectionType:
+		p.write(string(t.Channel), " ", p.sym.selection, " ")
+		p.branches(localLabels(t.Branches), func(label string) {
+			p.local(t.Branches[label])
+		})
+	case LocalBranchingType:
+		p.write(string(t.Channel), " ", p.sym.branching, " ")
+		p.branches(localLabels(t.Branches), func(label string) {
+			p.local(t.Branches[label])
+		})
+	case LocalRecursiveType:
+		p.write(p.sym.mu, string(t.Bind), ".")
+		p.indent++
+		p.newline()
+		p.local(t.Body)
+		p.indent--
+	case LocalDeadlineType:
+		p.write("within ", t.Within.String(), " {")
+		p.indent++
+		p.newline()
+		p.local(t.Body)
+		p.indent--
+		p.newline()
+		p.write("}; ")
+		p.local(t.Next)
+	case LocalInterruptibleType:
+		//e.g. interruptible { ... } raise cancel on k { ... }; end
+		p.write("interruptible {")
+		p.indent++
+		p.newline()
+		p.local(t.Body)
+		p.indent--
+		p.newline()
+		for _, i := range t.Interrupts {
+			p.write("} ", formatInterrupt(i), " {")
+			p.indent++
+			p.newline()
+			p.local(i.Then)
+			p.indent--
+			p.newline()
+		}
+		p.write("}; ")
+		p.local(t.Next)
+	case LocalParallelType:
+		p.write("(")
+		p.local(t.Left)
+		p.write(" | ")
+		p.local(t.Right)
+		p.write(")")
+		if _, ok := t.Next.(LocalEndType); !ok {
+			p.write("; ")
+			p.local(t.Next)
+		}
+	case LocalNameType:
+		p.write(string(t))
+	case LocalEndType:
+		p.write("end")
+	case ProjectionType:
+		p.write("(")
+		p.local(t.T)
+		p.write(")@", string(t.participant))
+	case nil:
+		p.write("<nil>")
+	default:
+		p.write("<unknown local type>")
+	}
+}
+
+//Render a global type in the given notation.
+func FormatGlobal(t GlobalType, n Notation) string {
+	p := newTypePrinter(n)
+	p.global(t)
+	return p.buf.String()
+}
+
+//Render a local type in the given notation.
+func FormatLocal(t LocalType, n Notation) string {
+	p := newTypePrinter(n)
+	p.local(t)
+	return p.buf.String()
+}
+
+func (pre Prefix) String() string {
+	p := newTypePrinter(Unicode)
+	p.prefix(pre)
+	return p.buf.String()
+}
+
+func (t ValueType) String() string         { return FormatGlobal(t, Unicode) }
+func (t DelegationType) String() string    { return FormatGlobal(t, Unicode) }
+func (t BranchingType) String() string     { return FormatGlobal(t, Unicode) }
+func (t ParallelType) String() string      { return FormatGlobal(t, Unicode) }
+func (t RecursiveType) String() string     { return FormatGlobal(t, Unicode) }
+func (t ForeachType) String() string       { return FormatGlobal(t, Unicode) }
+func (t DeadlineType) String() string      { return FormatGlobal(t, Unicode) }
+func (t InterruptibleType) String() string { return FormatGlobal(t, Unicode) }
+func (t InvocationType) String() string    { return FormatGlobal(t, Unicode) }
+func (t NameType) String() string          { return FormatGlobal(t, Unicode) }
+func (t EndType) String() string           { return FormatGlobal(t, Unicode) }
+
+func (t ProjectionType) String() string         { return FormatLocal(t, Unicode) }
+func (t LocalSendType) String() string          { return FormatLocal(t, Unicode) }
+func (t LocalReceiveType) String() string       { return FormatLocal(t, Unicode) }
+func (t LocalSelectionType) String() string     { return FormatLocal(t, Unicode) }
+func (t LocalBranchingType) String() string     { return FormatLocal(t, Unicode) }
+func (t LocalNameType) String() string          { return FormatLocal(t, Unicode) }
+func (t LocalRecursiveType) String() string     { return FormatLocal(t, Unicode) }
+func (t LocalEndType) String() string           { return FormatLocal(t, Unicode) }
+func (t LocalDelegateType) String() string      { return FormatLocal(t, Unicode) }
+func (t LocalAcceptType) String() string        { return FormatLocal(t, Unicode) }
+func (t LocalDeadlineType) String() string      { return FormatLocal(t, Unicode) }
+func (t LocalInterruptibleType) String() string { return FormatLocal(t, Unicode) }
+func (t LocalParallelType) String() string      { return FormatLocal(t, Unicode) }
@@ -0,0 +1,324 @@
+package multiparty
+
+import (
+	"fmt"
+	"strings"
+)
+
+//A way of leaving an interruptible block early: the participant raising it tells
+//each of the others in the block with Label, then they all carry on with Then
+type Interrupt struct {
+	Label string
+	//One message from whoever raises the interrupt to each of the other participants of the block
+	Notify []Prefix
+	Then   GlobalType
+}
+
+//The participant who may raise the interrupt
+func (i Interrupt) By() Participant {
+	if len(i.Notify) == 0 {
+		return ""
+	}
+	return i.Notify[0].P1
+}
+
+//How the participant p is told about the interrupt, if it is
+func (i Interrupt) notifies(p Participant) (Prefix, bool) {
+	for _, prefix := range i.Notify {
+		if prefix.P2 == p {
+			return prefix, true
+		}
+	}
+	return Prefix{}, false
+}
+
+//A block of a protocol which its participants may leave at any point, when one of them
+//raises an interrupt, e.g. to cancel a long-running loop.
+//Once Body is done, or the handler of an interrupt is, the protocol carries on with Next.
+type InterruptibleType struct {
+	Body       GlobalType
+	Interrupts []Interrupt
+	Next       GlobalType
+}
+
+func (t InterruptibleType) isWellFormed() bool {
+	labels := make(map[string]bool)
+	for _, i := range t.Interrupts {
+		if i.Label == "" || labels[i.Label] || len(i.Notify) == 0 || !i.Then.isWellFormed() {
+			return false
+		}
+		labels[i.Label] = true
+		for _, prefix := range i.Notify {
+			if prefix.P1 != i.By() {
+				return false
+			}
+		}
+	}
+	return t.Body.isWellFormed() && t.Next.isWellFormed()
+}
+
+//The ways through the block, for checks which only care about the order of interactions:
+//doing all of the body, or being interrupted straight away by each of the interrupts
+func (t InterruptibleType) alternatives() []GlobalType {
+	ans := []GlobalType{sequenceGlobal(t.Body, t.Next)}
+	for _, i := range t.Interrupts {
+		alternative := sequenceGlobal(i.Then, t.Next)
+		for j := len(i.Notify) - 1; j >= 0; j-- {
+			alternative = BranchingType{BranchPrefix: i.Notify[j], Branches: map[string]GlobalType{i.Label: alternative}}
+		}
+		ans = append(ans, alternative)
+	}
+	return ans
+}
+
+func (t InterruptibleType) Prefixes() [][]Prefix {
+	ans := make([][]Prefix, 0)
+	for _, alternative := range t.alternatives() {
+		ans = append(ans, alternative.Prefixes()...)
+	}
+	return ans
+}
+
+func (t InterruptibleType) Participants() []Participant {
+	ans := append(t.Body.Participants(), t.Next.Participants()...)
+	for _, i := range t.Interrupts {
+		for _, prefix := range i.Notify {
+			ans = append(ans, prefix.participants()...)
+		}
+		ans = append(ans, i.Then.Participants()...)
+	}
+	return ans
+}
+
+func (t InterruptibleType) channels() ChannelSet {
+	ans := append(t.Body.channels(), t.Next.channels()...)
+	for _, i := range t.Interrupts {
+		for _, prefix := range i.Notify {
+			ans = append(ans, prefix.PChannel)
+		}
+		ans = append(ans, i.Then.channels()...)
+	}
+	return ans
+}
+
+//Whether the last thing q does on every way through gt is receiving from by,
+//given who sent what q received last, so that nothing by sends can reach q after q is done with gt
+func finishesHearingFrom(gt GlobalType, q, by, last Participant) bool {
+	heard := func(prefix Prefix) Participant {
+		switch q {
+		case prefix.P2:
+			return prefix.P1
+		case prefix.P1:
+			return ""
+		}
+		return last
+	}
+	switch t := gt.(type) {
+	case ValueType:
+		return finishesHearingFrom(t.ValueNext, q, by, heard(t.ValuePrefix))
+	case DelegationType:
+		return finishesHearingFrom(t.DelegationNext, q, by, heard(t.DelegationPrefix))
+	case BranchingType:
+		for _, branch := range t.Branches {
+			if !finishesHearingFrom(branch, q, by, heard(t.BranchPrefix)) {
+				return false
+			}
+		}
+		return true
+	case ParallelType:
+		//q may finish either part last
+		return finishesHearingFrom(sequenceGlobal(t.a, sequenceGlobal(t.b, t.next)), q, by, last) &&
+			finishesHearingFrom(sequenceGlobal(t.b, sequenceGlobal(t.a, t.next)), q, by, last)
+	case RecursiveType:
+		return finishesHearingFrom(t.Body, q, by, last)
+	case DeadlineType:
+		return finishesHearingFrom(sequenceGlobal(t.Body, t.Next), q, by, last)
+	case InvocationType:
+		return finishesHearingFrom(sequenceGlobal(t.Body, t.Next), q, by, last)
+	case InterruptibleType:
+		for _, alternative := range t.alternatives() {
+			if !finishesHearingFrom(alternative, q, by, last) {
+				return false
+			}
+		}
+		return true
+	case EndType:
+		return last == by
+	}
+	//Going around a loop again
+	return true
+}
+
+//Projecting onto a participant of the block, it may raise the interrupts it is the source of,
+//and is told about each of the others.
+//A participant outside of the block doesn't see it, so must do the same whether or not it is interrupted.
+func (t InterruptibleType) Project(p Participant) (LocalType, error) {
+	body, err := t.Body.Project(p)
+	if err != nil {
+		return nil, err
+	}
+	next, err := t.Next.Project(p)
+	if err != nil {
+		return nil, err
+	}
+	if free := FreeVariables(body); len(free) > 0 {
+		return nil, fmt.Errorf("the interruptible block is left without finishing it, by jumping to %s", free[0])
+	}
+	//Each part would have to notice the interrupt by itself
+	if forks(body) {
+		return nil, fmt.Errorf("%s does the parts of a parallel block inside of an interruptible block", p)
+	}
+	inBlock := ContainsParticipant(p, t.Body.Participants())
+
+	interrupts := make([]LocalInterrupt, 0, len(t.Interrupts))
+	for _, i := range t.Interrupts {
+		then, err := i.Then.Project(p)
+		if err != nil {
+			return nil, err
+		}
+		if free := FreeVariables(then); len(free) > 0 {
+			return nil, fmt.Errorf("the handler of %s is left without finishing it, by jumping to %s", i.Label, free[0])
+		}
+		prefix, notified := i.notifies(p)
+		switch {
+		case i.By() == p:
+			if !inBlock {
+				return nil, fmt.Errorf("%s can interrupt the block with %s, but takes no part in it", p, i.Label)
+			}
+			channels := make([]Channel, len(i.Notify))
+			for j, prefix := range i.Notify {
+				channels[j] = prefix.PChannel
+			}
+			interrupts = append(interrupts, LocalInterrupt{Label: i.Label, Raise: true, Channels: channels, Then: then})
+		case inBlock && !notified:
+			return nil, fmt.Errorf("%s takes part in the interruptible block, but isn't told when %s interrupts it with %s", p, i.By(), i.Label)
+		case inBlock:
+			if !finishesHearingFrom(t.Body, p, i.By(), "") {
+				return nil, fmt.Errorf("%s may finish the interruptible block while %s can still interrupt it with %s: "+
+					"the last thing it does in the block must be to receive from %s", p, i.By(), i.Label, i.By())
+			}
+			interrupts = append(interrupts, LocalInterrupt{Label: i.Label, Channels: []Channel{prefix.PChannel}, Then: then})
+		case notified:
+			return nil, fmt.Errorf("%s is told about interrupt %s, but takes no part in the interruptible block", p, i.Label)
+		default:
+			if _, ok := then.(LocalEndType); !ok {
+				return nil, fmt.Errorf("%s does something after the block is interrupted with %s, but is never told about it", p, i.Label)
+			}
+		}
+	}
+	if !inBlock {
+		return next, nil
+	}
+	return LocalInterruptibleType{Body: body, Interrupts: interrupts, Next: next}, nil
+}
+
+func (t InterruptibleType) equals(g GlobalType) bool {
+	switch g.(type) {
+	case InterruptibleType:
+		gt := g.(InterruptibleType)
+		if len(t.Interrupts) != len(gt.Interrupts) {
+			return false
+		}
+		for i, interrupt := range t.Interrupts {
+			other := gt.Interrupts[i]
+			if interrupt.Label != other.Label || len(interrupt.Notify) != len(other.Notify) || !interrupt.Then.equals(other.Then) {
+				return false
+			}
+			for j, prefix := range interrupt.Notify {
+				if prefix != other.Notify[j] {
+					return false
+				}
+			}
+		}
+		return t.Body.equals(gt.Body) && t.Next.equals(gt.Next)
+	}
+	return false
+}
+
+//An interrupt of an interruptible block, as seen by one of its participants.
+//It is raised in place of a send, so that nothing the participant raising it waits for is still on its way,
+//and the others notice it in place of something they receive.
+type LocalInterrupt struct {
+	Label string
+	//Whether we raise the interrupt, telling everyone else on each of Channels,
+	//rather than being told about it on the only one of Channels
+	Raise    bool
+	Channels []Channel
+	Then     LocalType
+}
+
+//Whether two interrupts are raised or caught the same way, regardless of what is done after them
+func interruptHeadsEqual(a, b LocalInterrupt) bool {
+	if a.Label != b.Label || a.Raise != b.Raise || len(a.Channels) != len(b.Channels) {
+		return false
+	}
+	for i, channel := range a.Channels {
+		if channel != b.Channels[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func interruptsEqual(a, b []LocalInterrupt) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !interruptHeadsEqual(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+//e.g. raise cancel on k1, k2 or catch timeout on k3
+func formatInterrupt(i LocalInterrupt) string {
+	channels := make([]string, len(i.Channels))
+	for j, channel := range i.Channels {
+		channels[j] = string(channel)
+	}
+	verb := "catch"
+	if i.Raise {
+		verb = "raise"
+	}
+	return fmt.Sprintf("%s %s on %s", verb, i.Label, strings.Join(channels, ", "))
+}
+
+//Do Body, unless interrupted, in which case do the Then of the interrupt,
+//and after either one carry on with Next
+type LocalInterruptibleType struct {
+	Body       LocalType
+	Interrupts []LocalInterrupt
+	Next       LocalType
+}
+
+func (t LocalInterruptibleType) Substitute(u LocalNameType, tsub LocalType) LocalType {
+	interrupts := make([]LocalInterrupt, len(t.Interrupts))
+	for i, interrupt := range t.Interrupts {
+		interrupt.Then = interrupt.Then.Substitute(u, tsub)
+		interrupts[i] = interrupt
+	}
+	return LocalInterruptibleType{Body: t.Body.Substitute(u, tsub), Interrupts: interrupts, Next: t.Next.Substitute(u, tsub)}
+}
+
+func (t LocalInterruptibleType) EquivalentTo(l LocalType) bool {
+	return equivalent(t, l)
+}
+
+func (t LocalInterruptibleType) Equals(l LocalType) bool {
+	switch l.(type) {
+	case LocalInterruptibleType:
+		lt := l.(LocalInterruptibleType)
+		if !interruptsEqual(t.Interrupts, lt.Interrupts) {
+			return false
+		}
+		for i, interrupt := range t.Interrupts {
+			if !interrupt.Then.Equals(lt.Interrupts[i].Then) {
+				return false
+			}
+		}
+		return t.Body.Equals(lt.Body) && t.Next.Equals(lt.Next)
+	}
+	return false
+}
@@ -0,0 +1,809 @@
+package multiparty
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+//The version of the JSON encoding of session types, which goes up whenever the encoding changes,
+//so that older decoders reject documents they would only partly understand.
+//Documents with a newer version, or with fields we don't know, are rejected when decoding,
+//and so are nodes using kinds or fields which their document's version didn't have yet.
+//Version 2 replaced the single sort of a message with a list of sorts,
+//version 3 added delegations, version 4 refinements, version 5 loops over role families,
+//version 6 deadlines, version 7 interruptible blocks, version 8 let parallel types carry on
+//after their parts join, and added parallel local types, and version 9 added invocations of protocols.
+const JSONVersion = 9
+
+//The oldest version we can still decode
+const oldestJSONVersion = 1
+
+//The top-level JSON document: exactly one of Global or Local is set
+type jsonDocument struct {
+	Version int       `json:"version"`
+	Global  *jsonType `json:"global,omitempty"`
+	Local   *jsonType `json:"local,omitempty"`
+}
+
+//A single node of a global or local type, tagged by its kind.
+//Only the fields relevant to that kind are set.
+type jsonType struct {
+	Kind        string               `json:"kind"`
+	From        Participant          `json:"from,omitempty"`
+	To          Participant          `json:"to,omitempty"`
+	Channel     Channel              `json:"channel,omitempty"`
+	Sorts       []Sort               `json:"sorts,omitempty"`
+	Lower       string               `json:"lower,omitempty"`
+	Upper       string               `json:"upper,omitempty"`
+	Within      string               `json:"within,omitempty"`
+	Refinement  *Refinement          `json:"refinement,omitempty"`
+	Session     *jsonType            `json:"session,omitempty"`
+	Name        string               `json:"name,omitempty"`
+	Participant Participant          `json:"participant,omitempty"`
+	Branches    map[string]*jsonType `json:"branches,omitempty"`
+	Parts       []*jsonType          `json:"parts,omitempty"`
+	Interrupts  []*jsonInterrupt     `json:"interrupts,omitempty"`
+	Body        *jsonType            `json:"body,omitempty"`
+	Next        *jsonType            `json:"next,omitempty"`
+	//Only used by version 1, where each message had a single sort
+	Sort Sort `json:"sort,omitempty"`
+}
+
+//An interrupt of an interruptible block. Global types say who tells whom on which channel,
+//local types whether the interrupt is raised and on which channels.
+type jsonInterrupt struct {
+	Label    string       `json:"label"`
+	Notify   []jsonPrefix `json:"notify,omitempty"`
+	Raise    bool         `json:"raise,omitempty"`
+	Channels []Channel    `json:"channels,omitempty"`
+	Then     *jsonType    `json:"then"`
+}
+
+type jsonPrefix struct {
+	From    Participant `json:"from"`
+	To      Participant `json:"to"`
+	Channel Channel     `json:"channel"`
+}
+
+//Kinds of global type nodes
+const (
+	jsonValue         = "value"
+	jsonDelegation    = "delegation"
+	jsonBranching     = "branching"
+	jsonParallel      = "parallel"
+	jsonRecursive     = "recursive"
+	jsonForeach       = "foreach"
+	jsonDeadline      = "deadline"
+	jsonInterruptible = "interruptible"
+	jsonInvocation    = "invocation"
+	jsonName          = "name"
+	jsonEnd           = "end"
+)
+
+//Kinds of local type nodes, in addition to branching, parallel, recursive, deadline, interruptible, name and end
+const (
+	jsonSend       = "send"
+	jsonReceive    = "receive"
+	jsonDelegate   = "delegate"
+	jsonAccept     = "accept"
+	jsonSelection  = "selection"
+	jsonProjection = "projection"
+)
+
+//Encode a global type as an indented JSON document.
+func MarshalGlobalType(t GlobalType) ([]byte, error) {
+	node, err := globalToJSON(t)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(jsonDocument{Version: JSONVersion, Global: node}, "", "  ")
+}
+
+//Decode a document, bringing its nodes up to the current version of the encoding
+func unmarshalDocument(data []byte) (jsonDocument, error) {
+	var doc jsonDocument
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&doc); err != nil {
+		return doc, err
+	}
+	if doc.Version < oldestJSONVersion || doc.Version > JSONVersion {
+		return doc, fmt.Errorf("unsupported session type encoding version %d, expected at most %d", doc.Version, JSONVersion)
+	}
+	if doc.Global != nil {
+		if err := doc.Global.upgrade(doc.Version, false); err != nil {
+			return doc, err
+		}
+	}
+	if doc.Local != nil {
+		if err := doc.Local.upgrade(doc.Version, true); err != nil {
+			return doc, err
+		}
+	}
+	return doc, nil
+}
+
+//Decode a global type from a JSON document made by MarshalGlobalType.
+func UnmarshalGlobalType(data []byte) (GlobalType, error) {
+	doc, err := unmarshalDocument(data)
+	if err != nil {
+		return nil, err
+	}
+	if doc.Global == nil {
+		return nil, fmt.Errorf("document does not contain a global type")
+	}
+	return globalFromJSON(doc.Global)
+}
+
+//Encode a local type as an indented JSON document.
+func MarshalLocalType(t LocalType) ([]byte, error) {
+	node, err := localToJSON(t)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(jsonDocument{Version: JSONVersion, Local: node}, "", "  ")
+}
+
+//Decode a local type from a JSON document made by MarshalLocalType.
+func UnmarshalLocalType(data []byte) (LocalType, error) {
+	doc, err := unmarshalDocument(data)
+	if err != nil {
+		return nil, err
+	}
+	if doc.Local == nil {
+		return nil, fmt.Errorf("document does not contain a local type")
+	}
+	return localFromJSON(doc.Local)
+}
+
+func globalToJSON(gt GlobalType) (*jsonType, error) {
+	switch t := gt.(type) {
+	case ValueType:
+		next, err := globalToJSON(t.ValueNext)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonType{Kind: jsonValue, From: t.ValuePrefix.P1, To: t.ValuePrefix.P2,
+			Channel: t.ValuePrefix.PChannel, Sorts: t.Value, Refinement: t.Refinement, Next: next}, nil
+	case DelegationType:
+		session, err := localToJSON(t.Session)
+		if err != nil {
+			return nil, err
+		}
+		next, err := globalToJSON(t.DelegationNext)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonType{Kind: jsonDelegation, From: t.DelegationPrefix.P1, To: t.DelegationPrefix.P2,
+			Channel: t.DelegationPrefix.PChannel, Session: session, Next: next}, nil
+	case BranchingType:
+		branches := make(map[string]*jsonType)
+		for label, branch := range t.Branches {
+			node, err := globalToJSON(branch)
+			if err != nil {
+				return nil, err
+			}
+			branches[label] = node
+		}
+		return &jsonType{Kind: jsonBranching, From: t.BranchPrefix.P1, To: t.BranchPrefix.P2,
+			Channel: t.BranchPrefix.PChannel, Branches: branches}, nil
+	case ParallelType:
+		a, err := globalToJSON(t.a)
+		if err != nil {
+			return nil, err
+		}
+		b, err := globalToJSON(t.b)
+		if err != nil {
+			return nil, err
+		}
+		next, err := globalToJSON(t.next)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonType{Kind: jsonParallel, Parts: []*jsonType{a, b}, Next: next}, nil
+	case RecursiveType:
+		body, err := globalToJSON(t.Body)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonType{Kind: jsonRecursive, Name: string(t.Bind), Body: body}, nil
+	case ForeachType:
+		body, err := globalToJSON(t.Body)
+		if err != nil {
+			return nil, err
+		}
+		next, err := globalToJSON(t.Next)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonType{Kind: jsonForeach, Name: t.Index, Lower: t.From, Upper: t.To, Body: body, Next: next}, nil
+	case DeadlineType:
+		body, err := globalToJSON(t.Body)
+		if err != nil {
+			return nil, err
+		}
+		next, err := globalToJSON(t.Next)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonType{Kind: jsonDeadline, Within: t.Within.String(), Body: body, Next: next}, nil
+	case InvocationType:
+		body, err := globalToJSON(t.Body)
+		if err != nil {
+			return nil, err
+		}
+		next, err := globalToJSON(t.Next)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonType{Kind: jsonInvocation, Name: t.Protocol, Body: body, Next: next}, nil
+	case InterruptibleType:
+		body, err := globalToJSON(t.Body)
+		if err != nil {
+			return nil, err
+		}
+		interrupts := make([]*jsonInterrupt, len(t.Interrupts))
+		for i, interrupt := range t.Interrupts {
+			then, err := globalToJSON(interrupt.Then)
+			if err != nil {
+				return nil, err
+			}
+			notify := make([]jsonPrefix, len(interrupt.Notify))
+			for j, prefix := range interrupt.Notify {
+				notify[j] = jsonPrefix{From: prefix.P1, To: prefix.P2, Channel: prefix.PChannel}
+			}
+			interrupts[i] = &jsonInterrupt{Label: interrupt.Label, Notify: notify, Then: then}
+		}
+		next, err := globalToJSON(t.Next)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonType{Kind: jsonInterruptible, Body: body, Interrupts: interrupts, Next: next}, nil
+	case NameType:
+		return &jsonType{Kind: jsonName, Name: string(t)}, nil
+	case EndType:
+		return &jsonType{Kind: jsonEnd}, nil
+	}
+	return nil, fmt.Errorf("cannot encode global type %T", gt)
+}
+
+//Make sure a decoded node has a child where one is required
+func required(node *jsonType, field string, child *jsonType) error {
+	if child == nil {
+		return fmt.Errorf("%s node is missing its %s", node.Kind, field)
+	}
+	return nil
+}
+
+//The sorts of a message
+func (node *jsonType) value() []Sort {
+	if node.Sorts != nil {
+		return node.Sorts
+	}
+	return make([]Sort, 0)
+}
+
+//The version which added each kind of node that version 1 didn't have
+var jsonKindVersions = map[string]int{
+	jsonDelegation:    3,
+	jsonDelegate:      3,
+	jsonAccept:        3,
+	jsonForeach:       5,
+	jsonDeadline:      6,
+	jsonInterruptible: 7,
+	jsonInvocation:    9,
+}
+
+//Check that a node of a global or local type, and the nodes inside of it, only use what the given version
+//of the encoding had, and change what has since been encoded differently to the way it is encoded now
+func (node *jsonType) upgrade(version int, local bool) error {
+	since := jsonKindVersions[node.Kind]
+	if local && node.Kind == jsonParallel {
+		since = 8
+	}
+	if version < since {
+		return fmt.Errorf("%s nodes need version %d of the encoding, but the document has version %d", node.Kind, since, version)
+	}
+	fields := []struct {
+		name  string
+		set   bool
+		since int
+	}{
+		{"sorts", node.Sorts != nil, 2},
+		{"session", node.Session != nil, 3},
+		{"refinement", node.Refinement != nil, 4},
+		{"lower", node.Lower != "", 5},
+		{"upper", node.Upper != "", 5},
+		{"within", node.Within != "", 6},
+		{"interrupts", node.Interrupts != nil, 7},
+	}
+	for _, field := range fields {
+		if field.set && version < field.since {
+			return fmt.Errorf("%s node has a %s, which needs version %d of the encoding, but the document has version %d",
+				node.Kind, field.name, field.since, version)
+		}
+	}
+	if node.Sort != "" {
+		if version >= 2 {
+			return fmt.Errorf("%s node has a sort, which was replaced by sorts in version 2 of the encoding", node.Kind)
+		}
+		node.Sorts = SingletonValue(node.Sort)
+		node.Sort = ""
+	}
+	//Parallel types used to end with their parts
+	if node.Kind == jsonParallel && version < 8 {
+		if node.Next != nil {
+			return fmt.Errorf("parallel node has a next, which needs version 8 of the encoding, but the document has version %d", version)
+		}
+		node.Next = &jsonType{Kind: jsonEnd}
+	}
+
+	if node.Session != nil {
+		if err := node.Session.upgrade(version, true); err != nil {
+			return err
+		}
+	}
+	children := []*jsonType{node.Body, node.Next}
+	children = append(children, node.Parts...)
+	for _, branch := range node.Branches {
+		children = append(children, branch)
+	}
+	for _, interrupt := range node.Interrupts {
+		if interrupt != nil {
+			children = append(children, interrupt.Then)
+		}
+	}
+	for _, child := range children {
+		if child == nil {
+			continue
+		}
+		if err := child.upgrade(version, local); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func globalFromJSON(node *jsonType) (GlobalType, error) {
+	switch node.Kind {
+	case jsonValue:
+		if err := required(node, "next", node.Next); err != nil {
+			return nil, err
+		}
+		next, err := globalFromJSON(node.Next)
+		if err != nil {
+			return nil, err
+		}
+		return ValueType{ValuePrefix: Prefix{P1: node.From, P2: node.To, PChannel: node.Channel},
+			Value: node.value(), Refinement: node.Refinement, ValueNext: next}, nil
+	case jsonDelegation:
+		session, err := sessionFromJSON(node)
+		if err != nil {
+			return nil, err
+		}
+		if err := required(node, "next", node.Next); err != nil {
+			return nil, err
+		}
+		next, err := globalFromJSON(node.Next)
+		if err != nil {
+			return nil, err
+		}
+		return DelegationType{DelegationPrefix: Prefix{P1: node.From, P2: node.To, PChannel: node.Channel},
+			Session: session, DelegationNext: next}, nil
+	case jsonBranching:
+		branches := make(map[string]GlobalType)
+		for label, branch := range node.Branches {
+			if err := required(node, "branch "+label, branch); err != nil {
+				return nil, err
+			}
+			decoded, err := globalFromJSON(branch)
+			if err != nil {
+				return nil, err
+			}
+			branches[label] = decoded
+		}
+		return BranchingType{BranchPrefix: Prefix{P1: node.From, P2: node.To, PChannel: node.Channel},
+			Branches: branches}, nil
+	case jsonParallel:
+		if len(node.Parts) != 2 || node.Parts[0] == nil || node.Parts[1] == nil {
+			return nil, fmt.Errorf("parallel node must have exactly 2 parts, found %d", len(node.Parts))
+		}
+		if err := required(node, "next", node.Next); err != nil {
+			return nil, err
+		}
+		a, err := globalFromJSON(node.Parts[0])
+		if err != nil {
+			return nil, err
+		}
+		b, err := globalFromJSON(node.Parts[1])
+		if err != nil {
+			return nil, err
+		}
+		next, err := globalFromJSON(node.Next)
+		if err != nil {
+			return nil, err
+		}
+		return ParallelType{a, b, next}, nil
+	case jsonRecursive:
+		if err := required(node, "body", node.Body); err != nil {
+			return nil, err
+		}
+		body, err := globalFromJSON(node.Body)
+		if err != nil {
+			return nil, err
+		}
+		return RecursiveType{Bind: NameType(node.Name), Body: body}, nil
+	case jsonForeach:
+		if err := required(node, "body", node.Body); err != nil {
+			return nil, err
+		}
+		if err := required(node, "next", node.Next); err != nil {
+			return nil, err
+		}
+		body, err := globalFromJSON(node.Body)
+		if err != nil {
+			return nil, err
+		}
+		next, err := globalFromJSON(node.Next)
+		if err != nil {
+			return nil, err
+		}
+		return ForeachType{Index: node.Name, From: node.Lower, To: node.Upper, Body: body, Next: next}, nil
+	case jsonDeadline:
+		if err := required(node, "body", node.Body); err != nil {
+			return nil, err
+		}
+		if err := required(node, "next", node.Next); err != nil {
+			return nil, err
+		}
+		within, err := time.ParseDuration(node.Within)
+		if err != nil {
+			return nil, fmt.Errorf("deadline node has an invalid duration: %v", err)
+		}
+		body, err := globalFromJSON(node.Body)
+		if err != nil {
+			return nil, err
+		}
+		next, err := globalFromJSON(node.Next)
+		if err != nil {
+			return nil, err
+		}
+		return DeadlineType{Within: within, Body: body, Next: next}, nil
+	case jsonInvocation:
+		if err := required(node, "body", node.Body); err != nil {
+			return nil, err
+		}
+		if err := required(node, "next", node.Next); err != nil {
+			return nil, err
+		}
+		body, err := globalFromJSON(node.Body)
+		if err != nil {
+			return nil, err
+		}
+		next, err := globalFromJSON(node.Next)
+		if err != nil {
+			return nil, err
+		}
+		return InvocationType{Protocol: node.Name, Body: body, Next: next}, nil
+	case jsonInterruptible:
+		if err := required(node, "body", node.Body); err != nil {
+			return nil, err
+		}
+		if err := required(node, "next", node.Next); err != nil {
+			return nil, err
+		}
+		body, err := globalFromJSON(node.Body)
+		if err != nil {
+			return nil, err
+		}
+		interrupts := make([]Interrupt, len(node.Interrupts))
+		for i, interrupt := range node.Interrupts {
+			if interrupt == nil || interrupt.Then == nil {
+				return nil, fmt.Errorf("interrupt %d of an interruptible node has no handler", i)
+			}
+			then, err := globalFromJSON(interrupt.Then)
+			if err != nil {
+				return nil, err
+			}
+			notify := make([]Prefix, len(interrupt.Notify))
+			for j, prefix := range interrupt.Notify {
+				notify[j] = Prefix{P1: prefix.From, P2: prefix.To, PChannel: prefix.Channel}
+			}
+			interrupts[i] = Interrupt{Label: interrupt.Label, Notify: notify, Then: then}
+		}
+		next, err := globalFromJSON(node.Next)
+		if err != nil {
+			return nil, err
+		}
+		return InterruptibleType{Body: body, Interrupts: interrupts, Next: next}, nil
+	case jsonName:
+		return NameType(node.Name), nil
+	case jsonEnd:
+		return EndType{}, nil
+	}
+	return nil, fmt.Errorf("unknown global type kind %q", node.Kind)
+}
+
+func localBranchesToJSON(branches map[string]LocalType) (map[string]*jsonType, error) {
+	ans := make(map[string]*jsonType)
+	for label, branch := range branches {
+		node, err := localToJSON(branch)
+		if err != nil {
+			return nil, err
+		}
+		ans[label] = node
+	}
+	return ans, nil
+}
+
+func delegationToJSON(kind string, channel Channel, session ProjectionType, next LocalType) (*jsonType, error) {
+	sessionNode, err := localToJSON(session)
+	if err != nil {
+		return nil, err
+	}
+	nextNode, err := localToJSON(next)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonType{Kind: kind, Channel: channel, Session: sessionNode, Next: nextNode}, nil
+}
+
+func localToJSON(lt LocalType) (*jsonType, error) {
+	switch t := lt.(type) {
+	case LocalSendType:
+		next, err := localToJSON(t.Next)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonType{Kind: jsonSend, Channel: t.Channel, Sorts: t.Value, Refinement: t.Refinement, Next: next}, nil
+	case LocalReceiveType:
+		next, err := localToJSON(t.Next)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonType{Kind: jsonReceive, Channel: t.Channel, Sorts: t.Value, Refinement: t.Refinement, Next: next}, nil
+	case LocalDelegateType:
+		return delegationToJSON(jsonDelegate, t.Channel, t.Session, t.Next)
+	case LocalAcceptType:
+		return delegationToJSON(jsonAccept, t.Channel, t.Session, t.Next)
+	case LocalSelectionType:
+		branches, err := localBranchesToJSON(t.Branches)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonType{Kind: jsonSelection, Channel: t.Channel, Branches: branches}, nil
+	case LocalBranchingType:
+		branches, err := localBranchesToJSON(t.Branches)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonType{Kind: jsonBranching, Channel: t.Channel, Branches: branches}, nil
+	case LocalRecursiveType:
+		body, err := localToJSON(t.Body)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonType{Kind: jsonRecursive, Name: string(t.Bind), Body: body}, nil
+	case LocalDeadlineType:
+		body, err := localToJSON(t.Body)
+		if err != nil {
+			return nil, err
+		}
+		next, err := localToJSON(t.Next)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonType{Kind: jsonDeadline, Within: t.Within.String(), Body: body, Next: next}, nil
+	case LocalParallelType:
+		left, err := localToJSON(t.Left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := localToJSON(t.Right)
+		if err != nil {
+			return nil, err
+		}
+		next, err := localToJSON(t.Next)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonType{Kind: jsonParallel, Parts: []*jsonType{left, right}, Next: next}, nil
+	case LocalInterruptibleType:
+		body, err := localToJSON(t.Body)
+		if err != nil {
+			return nil, err
+		}
+		interrupts := make([]*jsonInterrupt, len(t.Interrupts))
+		for i, interrupt := range t.Interrupts {
+			then, err := localToJSON(interrupt.Then)
+			if err != nil {
+				return nil, err
+			}
+			interrupts[i] = &jsonInterrupt{Label: interrupt.Label, Raise: interrupt.Raise, Channels: interrupt.Channels, Then: then}
+		}
+		next, err := localToJSON(t.Next)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonType{Kind: jsonInterruptible, Body: body, Interrupts: interrupts, Next: next}, nil
+	case LocalNameType:
+		return &jsonType{Kind: jsonName, Name: string(t)}, nil
+	case LocalEndType:
+		return &jsonType{Kind: jsonEnd}, nil
+	case ProjectionType:
+		body, err := localToJSON(t.T)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonType{Kind: jsonProjection, Participant: t.participant, Body: body}, nil
+	}
+	return nil, fmt.Errorf("cannot encode local type %T", lt)
+}
+
+//Decode the session of a delegation, which must be a projection
+func sessionFromJSON(node *jsonType) (ProjectionType, error) {
+	if err := required(node, "session", node.Session); err != nil {
+		return ProjectionType{}, err
+	}
+	decoded, err := localFromJSON(node.Session)
+	if err != nil {
+		return ProjectionType{}, err
+	}
+	session, ok := decoded.(ProjectionType)
+	if !ok {
+		return ProjectionType{}, fmt.Errorf("%s node has a session of kind %q, expected %q", node.Kind, node.Session.Kind, jsonProjection)
+	}
+	return session, nil
+}
+
+func localBranchesFromJSON(node *jsonType) (map[string]LocalType, error) {
+	ans := make(map[string]LocalType)
+	for label, branch := range node.Branches {
+		if err := required(node, "branch "+label, branch); err != nil {
+			return nil, err
+		}
+		decoded, err := localFromJSON(branch)
+		if err != nil {
+			return nil, err
+		}
+		ans[label] = decoded
+	}
+	return ans, nil
+}
+
+func localFromJSON(node *jsonType) (LocalType, error) {
+	switch node.Kind {
+	case jsonSend, jsonReceive:
+		if err := required(node, "next", node.Next); err != nil {
+			return nil, err
+		}
+		next, err := localFromJSON(node.Next)
+		if err != nil {
+			return nil, err
+		}
+		if node.Kind == jsonSend {
+			return LocalSendType{Channel: node.Channel, Value: node.value(), Refinement: node.Refinement, Next: next}, nil
+		}
+		return LocalReceiveType{Channel: node.Channel, Value: node.value(), Refinement: node.Refinement, Next: next}, nil
+	case jsonDelegate, jsonAccept:
+		session, err := sessionFromJSON(node)
+		if err != nil {
+			return nil, err
+		}
+		if err := required(node, "next", node.Next); err != nil {
+			return nil, err
+		}
+		next, err := localFromJSON(node.Next)
+		if err != nil {
+			return nil, err
+		}
+		if node.Kind == jsonDelegate {
+			return LocalDelegateType{Channel: node.Channel, Session: session, Next: next}, nil
+		}
+		return LocalAcceptType{Channel: node.Channel, Session: session, Next: next}, nil
+	case jsonSelection:
+		branches, err := localBranchesFromJSON(node)
+		if err != nil {
+			return nil, err
+		}
+		return LocalSelectionType{Channel: node.Channel, Branches: branches}, nil
+	case jsonBranching:
+		branches, err := localBranchesFromJSON(node)
+		if err != nil {
+			return nil, err
+		}
+		return LocalBranchingType{Channel: node.Channel, Branches: branches}, nil
+	case jsonRecursive:
+		if err := required(node, "body", node.Body); err != nil {
+			return nil, err
+		}
+		body, err := localFromJSON(node.Body)
+		if err != nil {
+			return nil, err
+		}
+		return LocalRecursiveType{Bind: LocalNameType(node.Name), Body: body}, nil
+	case jsonDeadline:
+		if err := required(node, "body", node.Body); err != nil {
+			return nil, err
+		}
+		if err := required(node, "next", node.Next); err != nil {
+			return nil, err
+		}
+		within, err := time.ParseDuration(node.Within)
+		if err != nil {
+			return nil, fmt.Errorf("deadline node has an invalid duration: %v", err)
+		}
+		body, err := localFromJSON(node.Body)
+		if err != nil {
+			return nil, err
+		}
+		next, err := localFromJSON(node.Next)
+		if err != nil {
+			return nil, err
+		}
+		return LocalDeadlineType{Within: within, Body: body, Next: next}, nil
+	case jsonInterruptible:
+		if err := required(node, "body", node.Body); err != nil {
+			return nil, err
+		}
+		if err := required(node, "next", node.Next); err != nil {
+			return nil, err
+		}
+		body, err := localFromJSON(node.Body)
+		if err != nil {
+			return nil, err
+		}
+		interrupts := make([]LocalInterrupt, len(node.Interrupts))
+		for i, interrupt := range node.Interrupts {
+			if interrupt == nil || interrupt.Then == nil {
+				return nil, fmt.Errorf("interrupt %d of an interruptible node has no handler", i)
+			}
+			then, err := localFromJSON(interrupt.Then)
+			if err != nil {
+				return nil, err
+			}
+			interrupts[i] = LocalInterrupt{Label: interrupt.Label, Raise: interrupt.Raise, Channels: interrupt.Channels, Then: then}
+		}
+		next, err := localFromJSON(node.Next)
+		if err != nil {
+			return nil, err
+		}
+		return LocalInterruptibleType{Body: body, Interrupts: interrupts, Next: next}, nil
+	case jsonParallel:
+		if len(node.Parts) != 2 || node.Parts[0] == nil || node.Parts[1] == nil {
+			return nil, fmt.Errorf("parallel node must have exactly 2 parts, found %d", len(node.Parts))
+		}
+		if err := required(node, "next", node.Next); err != nil {
+			return nil, err
+		}
+		left, err := localFromJSON(node.Parts[0])
+		if err != nil {
+			return nil, err
+		}
+		right, err := localFromJSON(node.Parts[1])
+		if err != nil {
+			return nil, err
+		}
+		next, err := localFromJSON(node.Next)
+		if err != nil {
+			return nil, err
+		}
+		return LocalParallelType{Left: left, Right: right, Next: next}, nil
+	case jsonName:
+		return LocalNameType(node.Name), nil
+	case jsonEnd:
+		return LocalEndType{}, nil
+	case jsonProjection:
+		if err := required(node, "body", node.Body); err != nil {
+			return nil, err
+		}
+		body, err := localFromJSON(node.Body)
+		if err != nil {
+			return nil, err
+		}
+		return ProjectionType{T: body, participant: node.Participant}, nil
+	}
+	return nil, fmt.Errorf("unknown local type kind %q", node.Kind)
+}
@@ -0,0 +1,263 @@
+package multiparty
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+//Local types are equi-recursive: μX.T is the same type as T with X replaced by μX.T.
+//To compare them, we turn a local type into a graph, where each node is one
+//communication, and recursive variables become edges back to where their loop starts.
+//Two types that only differ by unfolding or by the names of their variables have the same graph.
+
+type nodeKind int
+
+const (
+	sendNode nodeKind = iota
+	receiveNode
+	selectNode
+	branchNode
+	delegateNode
+	acceptNode
+	//The start and end of a deadline, which follow the local type rather than doing anything
+	enterNode
+	leaveNode
+	//The start of an interruptible block, with the body under the empty label
+	//and what to do after each interrupt under its label.
+	//Its end is a leaveNode, like for deadlines.
+	interruptNode
+	//The start of a parallel type, with its parts under left and right, and what comes after the join
+	//under the empty label. The end of each part is a joinNode, which has nothing after it.
+	forkNode
+	joinNode
+	endNode
+	//A recursive variable, before we know which node its loop starts at
+	aliasNode
+)
+
+type localNode struct {
+	kind    nodeKind
+	channel Channel
+	value   []Sort
+	//For sends and receives, the condition on the values, if any
+	refinement *Refinement
+	//For delegations, the session handed over
+	session ProjectionType
+	//For the start of a deadline, how long it is
+	within time.Duration
+	//For the start of an interruptible block, how it may be interrupted
+	interrupts []LocalInterrupt
+	//Sends and receives have their single successor under the empty label,
+	//selections and branches have one successor for each label
+	next map[string]int
+}
+
+type localGraph struct {
+	nodes []localNode
+	root  int
+	//Where to go at the end of each deadline, interruptible block or part of a parallel type we are building,
+	//innermost last
+	exits []graphExit
+}
+
+//What comes after a deadline or interruptible block, with the variables that are bound there.
+//Nothing comes after the end of a part of a parallel type, so next is nil.
+type graphExit struct {
+	next LocalType
+	env  map[LocalNameType]int
+}
+
+func (g *localGraph) add(node localNode) int {
+	g.nodes = append(g.nodes, node)
+	return len(g.nodes) - 1
+}
+
+func (g *localGraph) build(lt LocalType, env map[LocalNameType]int) (int, error) {
+	switch t := lt.(type) {
+	case LocalSendType:
+		id := g.add(localNode{kind: sendNode, channel: t.Channel, value: t.Value, refinement: t.Refinement})
+		next, err := g.build(t.Next, env)
+		g.nodes[id].next = map[string]int{"": next}
+		return id, err
+	case LocalReceiveType:
+		id := g.add(localNode{kind: receiveNode, channel: t.Channel, value: t.Value, refinement: t.Refinement})
+		next, err := g.build(t.Next, env)
+		g.nodes[id].next = map[string]int{"": next}
+		return id, err
+	case LocalDelegateType:
+		id := g.add(localNode{kind: delegateNode, channel: t.Channel, session: t.Session})
+		next, err := g.build(t.Next, env)
+		g.nodes[id].next = map[string]int{"": next}
+		return id, err
+	case LocalAcceptType:
+		id := g.add(localNode{kind: acceptNode, channel: t.Channel, session: t.Session})
+		next, err := g.build(t.Next, env)
+		g.nodes[id].next = map[string]int{"": next}
+		return id, err
+	case LocalSelectionType:
+		return g.buildBranches(selectNode, t.Channel, t.Branches, env)
+	case LocalBranchingType:
+		return g.buildBranches(branchNode, t.Channel, t.Branches, env)
+	case LocalRecursiveType:
+		//The variable stands for wherever the body starts, which we don't know yet
+		alias := g.add(localNode{kind: aliasNode})
+		inner := make(map[LocalNameType]int)
+		for name, id := range env {
+			inner[name] = id
+		}
+		inner[t.Bind] = alias
+		body, err := g.build(t.Body, inner)
+		g.nodes[alias].next = map[string]int{"": body}
+		return body, err
+	case LocalNameType:
+		id, ok := env[t]
+		if !ok {
+			return 0, fmt.Errorf("free type variable %s", t)
+		}
+		return id, nil
+	case LocalDeadlineType:
+		id := g.add(localNode{kind: enterNode, within: t.Within})
+		g.exits = append(g.exits, graphExit{next: t.Next, env: env})
+		body, err := g.build(t.Body, env)
+		g.exits = g.exits[:len(g.exits)-1]
+		g.nodes[id].next = map[string]int{"": body}
+		return id, err
+	case LocalInterruptibleType:
+		id := g.add(localNode{kind: interruptNode, interrupts: t.Interrupts})
+		g.exits = append(g.exits, graphExit{next: t.Next, env: env})
+		defer func() { g.exits = g.exits[:len(g.exits)-1] }()
+		next := make(map[string]int)
+		body, err := g.build(t.Body, env)
+		if err != nil {
+			return id, err
+		}
+		next[""] = body
+		for _, interrupt := range t.Interrupts {
+			if next[interrupt.Label], err = g.build(interrupt.Then, env); err != nil {
+				return id, err
+			}
+		}
+		g.nodes[id].next = next
+		return id, nil
+	case LocalParallelType:
+		id := g.add(localNode{kind: forkNode})
+		next := make(map[string]int)
+		var err error
+		if next[""], err = g.build(t.Next, env); err != nil {
+			return id, err
+		}
+		//The parts can't refer to loops outside of them
+		g.exits = append(g.exits, graphExit{})
+		defer func() { g.exits = g.exits[:len(g.exits)-1] }()
+		if next["left"], err = g.build(t.Left, make(map[LocalNameType]int)); err != nil {
+			return id, err
+		}
+		if next["right"], err = g.build(t.Right, make(map[LocalNameType]int)); err != nil {
+			return id, err
+		}
+		g.nodes[id].next = next
+		return id, nil
+	case LocalEndType:
+		if len(g.exits) == 0 {
+			return g.add(localNode{kind: endNode}), nil
+		}
+		if g.exits[len(g.exits)-1].next == nil {
+			return g.add(localNode{kind: joinNode}), nil
+		}
+		//The end of a deadline or interruptible block: carry on with what comes after it, outside of the deadline
+		id := g.add(localNode{kind: leaveNode})
+		exit := g.exits[len(g.exits)-1]
+		g.exits = g.exits[:len(g.exits)-1]
+		next, err := g.build(exit.next, exit.env)
+		g.exits = append(g.exits, exit)
+		g.nodes[id].next = map[string]int{"": next}
+		return id, err
+	case ProjectionType:
+		return g.build(t.T, env)
+	}
+	return 0, fmt.Errorf("unsupported local type %T", lt)
+}
+
+func (g *localGraph) buildBranches(kind nodeKind, channel Channel, branches map[string]LocalType, env map[LocalNameType]int) (int, error) {
+	id := g.add(localNode{kind: kind, channel: channel})
+	next := make(map[string]int)
+	for label, branch := range branches {
+		branchId, err := g.build(branch, env)
+		if err != nil {
+			return id, err
+		}
+		next[label] = branchId
+	}
+	g.nodes[id].next = next
+	return id, nil
+}
+
+//Follow aliases until we reach an actual communication,
+//failing if we go around a loop without communicating (e.g. μX.X)
+func (g *localGraph) resolve(id int) (int, error) {
+	seen := make(map[int]bool)
+	for g.nodes[id].kind == aliasNode {
+		if seen[id] {
+			return 0, fmt.Errorf("unguarded recursion")
+		}
+		seen[id] = true
+		id = g.nodes[id].next[""]
+	}
+	return id, nil
+}
+
+//Turn a local type into a graph, with every edge pointing directly to a communication
+func newLocalGraph(t LocalType) (*localGraph, error) {
+	g := &localGraph{}
+	root, err := g.build(t, make(map[LocalNameType]int))
+	if err != nil {
+		return nil, err
+	}
+	if g.root, err = g.resolve(root); err != nil {
+		return nil, err
+	}
+	for i := range g.nodes {
+		for label, next := range g.nodes[i].next {
+			if g.nodes[i].next[label], err = g.resolve(next); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return g, nil
+}
+
+func (g *localGraph) describe(id int) string {
+	node := g.nodes[id]
+	switch node.kind {
+	case sendNode:
+		return fmt.Sprintf("send %s on %s", formatValue(node.value), node.channel)
+	case receiveNode:
+		return fmt.Sprintf("receive %s on %s", formatValue(node.value), node.channel)
+	case delegateNode:
+		return fmt.Sprintf("delegate %s on %s", node.session, node.channel)
+	case acceptNode:
+		return fmt.Sprintf("accept %s on %s", node.session, node.channel)
+	case selectNode:
+		return fmt.Sprintf("selection on %s", node.channel)
+	case branchNode:
+		return fmt.Sprintf("branching on %s", node.channel)
+	case enterNode:
+		return fmt.Sprintf("deadline of %s", node.within)
+	case interruptNode:
+		interrupts := make([]string, len(node.interrupts))
+		for i, interrupt := range node.interrupts {
+			interrupts[i] = formatInterrupt(interrupt)
+		}
+		return fmt.Sprintf("interruptible block (%s)", strings.Join(interrupts, ", "))
+	case leaveNode:
+		return "end of block"
+	case forkNode:
+		return "parallel block"
+	case joinNode:
+		return "end of a part of a parallel block"
+	case endNode:
+		return "end"
+	}
+	return "unknown"
+}
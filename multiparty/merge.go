@@ -0,0 +1,158 @@
+package multiparty
+
+import "fmt"
+
+//Merge combines the local types that a participant who is not involved in a choice
+//has in each branch of that choice, using the merge operator of Yoshida et al.
+//
+//Equivalent types merge to themselves. Branching types on the same channel merge
+//into a branching type with the labels of both, merging the types of any shared labels,
+//so a third party may behave differently in each branch as long as it is told
+//which branch was taken by the label it receives.
+//Other types merge if they have the same shape, and their continuations merge.
+func Merge(a, b LocalType) (LocalType, error) {
+	if a.EquivalentTo(b) {
+		return a, nil
+	}
+	switch ta := a.(type) {
+	case LocalBranchingType:
+		if tb, ok := b.(LocalBranchingType); ok && ta.Channel == tb.Channel {
+			branches := make(map[string]LocalType)
+			for label, branch := range ta.Branches {
+				branches[label] = branch
+			}
+			for label, branch := range tb.Branches {
+				if existing, ok := branches[label]; ok {
+					merged, err := Merge(existing, branch)
+					if err != nil {
+						return nil, err
+					}
+					branch = merged
+				}
+				branches[label] = branch
+			}
+			return LocalBranchingType{Channel: ta.Channel, Branches: branches}, nil
+		}
+	case LocalSelectionType:
+		//We can't add labels to a selection: the participant could then choose a branch that
+		//doesn't exist, so the labels must match exactly
+		if tb, ok := b.(LocalSelectionType); ok && ta.Channel == tb.Channel && len(ta.Branches) == len(tb.Branches) {
+			branches := make(map[string]LocalType)
+			for label, branch := range ta.Branches {
+				other, ok := tb.Branches[label]
+				if !ok {
+					return nil, fmt.Errorf("cannot merge selections on %s with different labels", ta.Channel)
+				}
+				merged, err := Merge(branch, other)
+				if err != nil {
+					return nil, err
+				}
+				branches[label] = merged
+			}
+			return LocalSelectionType{Channel: ta.Channel, Branches: branches}, nil
+		}
+	case LocalSendType:
+		if tb, ok := b.(LocalSendType); ok && ta.Channel == tb.Channel && sortsEqual(ta.Value, tb.Value) &&
+			refinementsEqual(ta.Refinement, tb.Refinement) {
+			next, err := Merge(ta.Next, tb.Next)
+			if err != nil {
+				return nil, err
+			}
+			return LocalSendType{Channel: ta.Channel, Value: ta.Value, Refinement: ta.Refinement, Next: next}, nil
+		}
+	case LocalReceiveType:
+		if tb, ok := b.(LocalReceiveType); ok && ta.Channel == tb.Channel && sortsEqual(ta.Value, tb.Value) &&
+			refinementsEqual(ta.Refinement, tb.Refinement) {
+			next, err := Merge(ta.Next, tb.Next)
+			if err != nil {
+				return nil, err
+			}
+			return LocalReceiveType{Channel: ta.Channel, Value: ta.Value, Refinement: ta.Refinement, Next: next}, nil
+		}
+	case LocalDelegateType:
+		if tb, ok := b.(LocalDelegateType); ok && ta.Channel == tb.Channel && sessionsEquivalent(ta.Session, tb.Session) {
+			next, err := Merge(ta.Next, tb.Next)
+			if err != nil {
+				return nil, err
+			}
+			return LocalDelegateType{Channel: ta.Channel, Session: ta.Session, Next: next}, nil
+		}
+	case LocalAcceptType:
+		if tb, ok := b.(LocalAcceptType); ok && ta.Channel == tb.Channel && sessionsEquivalent(ta.Session, tb.Session) {
+			next, err := Merge(ta.Next, tb.Next)
+			if err != nil {
+				return nil, err
+			}
+			return LocalAcceptType{Channel: ta.Channel, Session: ta.Session, Next: next}, nil
+		}
+	case LocalDeadlineType:
+		if tb, ok := b.(LocalDeadlineType); ok && ta.Within == tb.Within {
+			body, err := Merge(ta.Body, tb.Body)
+			if err != nil {
+				return nil, err
+			}
+			next, err := Merge(ta.Next, tb.Next)
+			if err != nil {
+				return nil, err
+			}
+			return LocalDeadlineType{Within: ta.Within, Body: body, Next: next}, nil
+		}
+	case LocalInterruptibleType:
+		if tb, ok := b.(LocalInterruptibleType); ok && interruptsEqual(ta.Interrupts, tb.Interrupts) {
+			body, err := Merge(ta.Body, tb.Body)
+			if err != nil {
+				return nil, err
+			}
+			interrupts := make([]LocalInterrupt, len(ta.Interrupts))
+			for i, interrupt := range ta.Interrupts {
+				if interrupt.Then, err = Merge(interrupt.Then, tb.Interrupts[i].Then); err != nil {
+					return nil, err
+				}
+				interrupts[i] = interrupt
+			}
+			next, err := Merge(ta.Next, tb.Next)
+			if err != nil {
+				return nil, err
+			}
+			return LocalInterruptibleType{Body: body, Interrupts: interrupts, Next: next}, nil
+		}
+	case LocalParallelType:
+		if tb, ok := b.(LocalParallelType); ok {
+			left, err := Merge(ta.Left, tb.Left)
+			if err != nil {
+				return nil, err
+			}
+			right, err := Merge(ta.Right, tb.Right)
+			if err != nil {
+				return nil, err
+			}
+			next, err := Merge(ta.Next, tb.Next)
+			if err != nil {
+				return nil, err
+			}
+			return LocalParallelType{Left: left, Right: right, Next: next}, nil
+		}
+	case LocalRecursiveType:
+		if tb, ok := b.(LocalRecursiveType); ok {
+			//The loops may be named differently, so b's is renamed to a's,
+			//unless a's name is free in b, in which case both get a fresh name
+			bind := ta.Bind
+			aFree, bFree := localFreeVariables(ta.Body), localFreeVariables(tb.Body)
+			if bind != tb.Bind && bFree[bind] {
+				avoid := map[LocalNameType]bool{ta.Bind: true, tb.Bind: true}
+				for _, free := range []map[LocalNameType]bool{aFree, bFree} {
+					for name := range free {
+						avoid[name] = true
+					}
+				}
+				bind = freshName(ta.Bind, avoid)
+			}
+			body, err := Merge(ta.Body.Substitute(ta.Bind, bind), tb.Body.Substitute(tb.Bind, bind))
+			if err != nil {
+				return nil, err
+			}
+			return LocalRecursiveType{Bind: bind, Body: body}, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot merge %s with %s", FormatLocal(a, ASCII), FormatLocal(b, ASCII))
+}
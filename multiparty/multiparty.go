@@ -44,9 +44,12 @@ type Prefix struct {
 	PChannel Channel
 }
 
+//A message carrying an ordered tuple of values, one of each sort in Value.
+//If Refinement is set, the values must also satisfy its condition.
 type ValueType struct {
 	ValuePrefix Prefix
-	Value       Sort
+	Value       []Sort
+	Refinement  *Refinement
 	ValueNext   GlobalType
 }
 
@@ -60,7 +63,8 @@ type RecursiveType struct {
 	Body GlobalType
 }
 
-func contains(p Participant, slice []Participant) bool {
+//Whether p is one of the participants in slice
+func ContainsParticipant(p Participant, slice []Participant) bool {
 	for _, element := range slice {
 		if element == p {
 			return true
@@ -72,12 +76,12 @@ func contains(p Participant, slice []Participant) bool {
 func disjoint(a, b []Participant) bool {
 	// Though this operator could be optimized, we are only dealing with the specification here.
 	for _, x := range a {
-		if contains(x, b) {
+		if ContainsParticipant(x, b) {
 			return false
 		}
 	}
 	for _, x := range b {
-		if contains(x, a) {
+		if ContainsParticipant(x, a) {
 			return false
 		}
 	}
@@ -202,7 +206,41 @@ func SingletonValue(s Sort) []Sort {
 	return ans
 }
 
+func sortsEqual(a, b []Sort) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+//Describe the sorts of a message in prose: just the sort if there is one, or a tuple
+func formatValue(sorts []Sort) string {
+	if len(sorts) == 1 {
+		return string(sorts[0])
+	}
+	return "(" + joinSorts(sorts) + ")"
+}
+
+func joinSorts(sorts []Sort) string {
+	ans := ""
+	for i, sort := range sorts {
+		if i > 0 {
+			ans += ", "
+		}
+		ans += string(sort)
+	}
+	return ans
+}
+
 func (t ValueType) isWellFormed() bool {
+	if t.Refinement != nil && t.Refinement.check(t.Value) != nil {
+		return false
+	}
 	return t.ValueNext.isWellFormed()
 }
 
@@ -224,9 +262,9 @@ func (t ValueType) Project(p Participant) (LocalType, error) {
 	if err != nil {
 		return nil, err
 	} else if t.ValuePrefix.P1 == p {
-		ans = LocalSendType{Channel: t.ValuePrefix.PChannel, Value: t.Value, Next: ans}
+		ans = LocalSendType{Channel: t.ValuePrefix.PChannel, Value: t.Value, Refinement: t.Refinement, Next: ans}
 	} else if t.ValuePrefix.P2 == p {
-		ans = LocalReceiveType{Channel: t.ValuePrefix.PChannel, Value: t.Value, Next: ans}
+		ans = LocalReceiveType{Channel: t.ValuePrefix.PChannel, Value: t.Value, Refinement: t.Refinement, Next: ans}
 	}
 	return ans, err
 }
@@ -235,7 +273,8 @@ func (t ValueType) equals(g GlobalType) bool {
 	switch g.(type) {
 	case ValueType:
 		gt := g.(ValueType)
-		return gt.ValuePrefix == t.ValuePrefix && (gt.Value == t.Value) && t.ValueNext.equals(gt.ValueNext)
+		return gt.ValuePrefix == t.ValuePrefix && sortsEqual(gt.Value, t.Value) && refinementsEqual(gt.Refinement, t.Refinement) &&
+			t.ValueNext.equals(gt.ValueNext)
 	}
 	return false
 }
@@ -292,33 +331,29 @@ func (b BranchingType) Project(p Participant) (LocalType, error) {
 		branches[key] = candidate
 	}
 
-	unique := func(branches map[string]LocalType) bool {
-		var prevValue LocalType
-
-		// preset with first value in the range
-
-		for _, prevValue = range branches {
-			break
-		}
-
-		for _, value := range branches {
-			if !prevValue.Equals(value) {
-				return false
-			}
-		}
-		return true
-	}
-
 	if b.BranchPrefix.P1 == p {
 		return LocalSelectionType{Channel: b.BranchPrefix.PChannel, Branches: branches}, nil
 	} else if b.BranchPrefix.P2 == p {
 		return LocalBranchingType{Channel: b.BranchPrefix.PChannel, Branches: branches}, nil
-	} else if unique(branches) {
-		for _, branch := range branches {
-			return branch, nil
+	}
+
+	//We aren't involved in the choice, so we have to behave the same in every branch,
+	//up to receiving different labels from someone who knows which branch was taken.
+	//Merge in label order, so errors are reported deterministically
+	labels := globalLabels(b.Branches)
+	if len(labels) == 0 {
+		return nil, fmt.Errorf("projection onto %s undefined: choice %s has no branches", p, b.BranchPrefix)
+	}
+	ans := branches[labels[0]]
+	for _, label := range labels[1:] {
+		merged, err := Merge(ans, branches[label])
+		if err != nil {
+			return nil, fmt.Errorf("projection onto %s undefined: it is not told which branch of %s was taken: %v",
+				p, b.BranchPrefix, err)
 		}
+		ans = merged
 	}
-	return nil, errors.New("projection undefined")
+	return ans, nil
 }
 
 func (t BranchingType) equals(g GlobalType) bool {
@@ -335,49 +370,120 @@ func (t BranchingType) equals(g GlobalType) bool {
 	return false
 }
 
+//Two parts of a protocol which happen at the same time, independently of each other.
+//Once both are done, they join, and the protocol carries on with next.
 type ParallelType struct {
 	a, b GlobalType
+	next GlobalType
 }
 
 func MakeParallelType(a GlobalType, b GlobalType) ParallelType {
-	return ParallelType{a, b}
+	return ParallelType{a, b, EndType{}}
+}
+
+//A parallel type whose parts join before carrying on with next
+func MakeJoinedParallelType(a GlobalType, b GlobalType, next GlobalType) ParallelType {
+	return ParallelType{a, b, next}
 }
 
 func (t ParallelType) channels() ChannelSet {
-	return append(t.a.channels(), t.b.channels()...)
+	return append(append(t.a.channels(), t.b.channels()...), t.next.channels()...)
 }
 
+//The ways through either part, and through both of them and then next
 func (t ParallelType) Prefixes() [][]Prefix {
-	return append(t.a.Prefixes(), t.b.Prefixes()...)
+	ans := append(t.a.Prefixes(), t.b.Prefixes()...)
+	for _, first := range completePrefixes(t.a) {
+		for _, second := range completePrefixes(t.b) {
+			for _, rest := range t.next.Prefixes() {
+				ans = append(ans, appendPrefixes(appendPrefixes(first, second...), rest...))
+			}
+		}
+	}
+	return ans
+}
+
+//The ways all the way through gt, which are the prefixes that don't go on to any longer one
+func completePrefixes(gt GlobalType) [][]Prefix {
+	prefixes := gt.Prefixes()
+	ans := make([][]Prefix, 0)
+	for _, prefix := range prefixes {
+		complete := true
+		for _, other := range prefixes {
+			if len(other) > len(prefix) && prefixesEqual(other[:len(prefix)], prefix) {
+				complete = false
+				break
+			}
+		}
+		if complete {
+			ans = append(ans, prefix)
+		}
+	}
+	if len(ans) == 0 {
+		ans = append(ans, []Prefix{})
+	}
+	return ans
+}
+
+func prefixesEqual(a, b []Prefix) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
 }
 
 func (t ParallelType) isWellFormed() bool {
-	return t.a.isWellFormed() && t.b.isWellFormed()
+	return t.a.isWellFormed() && t.b.isWellFormed() && t.next.isWellFormed()
 }
 
 func (t ParallelType) Participants() []Participant {
-	return append(t.a.Participants(), t.b.Participants()...)
+	return append(append(t.a.Participants(), t.b.Participants()...), t.next.Participants()...)
 }
 
+//A participant in both parts does them in parallel, and one in a single part just does that part,
+//either way followed by its part of next.
+//Neither part can be left by continuing a loop from outside of it, unless nothing comes after it.
 func (t ParallelType) Project(p Participant) (LocalType, error) {
-	if contains(p, t.a.Participants()) {
-		if contains(p, t.b.Participants()) {
-			return nil, errors.New("projection undefined")
+	a, err := t.a.Project(p)
+	if err != nil {
+		return nil, err
+	}
+	b, err := t.b.Project(p)
+	if err != nil {
+		return nil, err
+	}
+	next, err := t.next.Project(p)
+	if err != nil {
+		return nil, err
+	}
+	_, last := next.(LocalEndType)
+	inA, inB := ContainsParticipant(p, t.a.Participants()), ContainsParticipant(p, t.b.Participants())
+	for _, part := range []LocalType{a, b} {
+		if free := FreeVariables(part); len(free) > 0 && (!last || inA && inB) {
+			return nil, fmt.Errorf("a parallel block is left without joining it, by jumping to %s", free[0])
 		}
-		return t.a.Project(p)
 	}
-	if contains(p, t.b.Participants()) {
-		return t.b.Project(p)
+	switch {
+	case inA && inB:
+		return LocalParallelType{Left: a, Right: b, Next: next}, nil
+	case inA:
+		return sequenceLocal(a, next), nil
+	case inB:
+		return sequenceLocal(b, next), nil
 	}
-	ans := LocalEndType{}
-	return ans, nil
+	return next, nil
 }
 
 func (t ParallelType) equals(g GlobalType) bool {
 	switch g.(type) {
 	case ParallelType:
 		gt := g.(ParallelType)
-		return t.a.equals(gt.a) && t.b.equals(gt.b)
+		return t.a.equals(gt.a) && t.b.equals(gt.b) && t.next.equals(gt.next)
 	}
 	return false
 }
@@ -474,166 +580,241 @@ func (t EndType) equals(g GlobalType) bool {
 	return false
 }
 
-func linear(original_gt GlobalType) bool {
+//Linear reports whether the given global type satisfies the linearity
+//condition of Honda et al. 2008 (Definition 3.3).
+func Linear(original_gt GlobalType) bool {
 	gt := unfold(original_gt, make(map[NameType]GlobalType))
-	return linearInternal(gt, make([]Prefix, 0, 0))
+	diagnostics := make([]Diagnostic, 0)
+	linearInternal(gt, make([]Prefix, 0, 0), make([]Step, 0, 0), &diagnostics)
+	return len(diagnostics) == 0
 }
 
-//Definition 4.2
-func coherent(original_gt GlobalType) bool {
-	if !linear(original_gt) {
-		return false
-	}
+//Coherent reports whether the given global type is linear and projectable
+//onto each of its participants (Definition 4.2).
+func Coherent(original_gt GlobalType) bool {
+	return len(Check(original_gt)) == 0
+}
+
+//Check a global type for linearity and projectability,
+//returning a diagnostic for each problem found.
+//An empty result means that the type is coherent.
+func Check(original_gt GlobalType) []Diagnostic {
 	gt := unfold(original_gt, make(map[NameType]GlobalType))
-	for _, p := range gt.Participants() {
-		_, err := gt.Project(p)
-		if err != nil {
-			return false
+	diagnostics := make([]Diagnostic, 0)
+	linearInternal(gt, make([]Prefix, 0, 0), make([]Step, 0, 0), &diagnostics)
+	checkRefinements(gt, make(map[Participant]map[string]bool), make([]Step, 0, 0), &diagnostics)
+	diagnostics = uniqueDiagnostics(diagnostics)
+
+	participants := ParticipantSet(gt.Participants())
+	sort.Sort(participants)
+	for i, p := range participants {
+		if i > 0 && participants[i-1] == p {
+			continue
+		}
+		if _, err := gt.Project(p); err != nil {
+			diagnostics = append(diagnostics, projectionFailure(gt, p, make([]Step, 0, 0), err))
 		}
 	}
-	return true
+	return diagnostics
 }
 
-func (n1 Prefix) II(n2 Prefix) bool {
+//The II, IO and OO relations between prefixes, from Honda et al. 2008 (Section 3.3),
+//where n1 is assumed to come before n2.
+//Each returns whether the relation holds, and if it doesn't, why not.
+
+func (n1 Prefix) ii(n2 Prefix) (bool, string) {
 	if n1.P2 != n2.P2 {
-		fmt.Printf("DEP: II doesn't hold. expects equal P2 among %+v and %+v\n", n1, n2)
-		return false
+		return false, "II expects the same receiver"
 	}
-	if n1.PChannel != n2.PChannel && n1.P1 != n2.P1 {
-		//second if condition given on the tech report.
-		return true
-	}
-	fmt.Printf("DEP: II doesn't hold. expects different channels among %+v and %+v\n", n1, n2)
-
-	return false
+	return true, ""
 }
 
-func (n1 Prefix) IO(n2 Prefix) bool {
+func (n1 Prefix) io(n2 Prefix) (bool, string) {
 	if n1.P2 != n2.P1 {
-		fmt.Printf("DEP: IO doesn't hold. expects shared participant among %+v and %+v.\n", n1, n2)
-		return false
+		return false, "IO expects the first receiver to be the second sender"
 	}
-	if n1.PChannel == n2.PChannel {
-		fmt.Printf("DEP: IO doesn't hold. expects different channels on n1P1 and n2P2 for %+v and %+v\n", n1, n2)
-		return false
-	}
-	return true
+	return true, ""
 }
 
-func (n1 Prefix) OO(n2 Prefix) bool {
+func (n1 Prefix) oo(n2 Prefix) (bool, string) {
 	if n1.P1 != n2.P1 {
-		fmt.Printf("DEP: OO doesn't hold. expects same P1 among %+v and %+v.\n", n1, n2)
-		return false
-	}
-	if n1.PChannel != n2.PChannel && n1.P2 != n2.P2 {
-		//extra if confition derived from tech report.
-		//OO holds subject to p1 \neq p2 => k1 \neq k2,
-		// for pfx(n1) = p -> p1: k1 and pfx(n2) = p -> p2 : k2
-		// (Tech report at http://www.doc.ic.ac.uk/~pmalo/research/papers/buffer-communication-analysis.pdf)
-		fmt.Printf("DEP: OO doesn't hold. expects shared channel among %v and %v.\n", n1, n2)
-		return false
+		return false, "OO expects the same sender"
 	}
-	return true
+	return true, ""
 }
 
-func filter_shared_channel(lessthan []Prefix, filter Prefix) []Prefix {
-	ans := make([]Prefix, 0, 0)
-	for _, prefix := range lessthan {
-		if prefix.PChannel == filter.PChannel { //&& prefix != filter{
-			ans = append(ans, prefix)
-		}
-	}
+func (n1 Prefix) II(n2 Prefix) bool {
+	ans, _ := n1.ii(n2)
 	return ans
 }
 
-func linearInternal(gt GlobalType, lessthan []Prefix) bool {
+func (n1 Prefix) IO(n2 Prefix) bool {
+	ans, _ := n1.io(n2)
+	return ans
+}
+
+func (n1 Prefix) OO(n2 Prefix) bool {
+	ans, _ := n1.oo(n2)
+	return ans
+}
+
+func appendPrefixes(prefixes []Prefix, more ...Prefix) []Prefix {
+	return append(append(make([]Prefix, 0, len(prefixes)+len(more)), prefixes...), more...)
+}
+
+func appendStep(path []Step, step Step) []Step {
+	return append(append(make([]Step, 0, len(path)+1), path...), step)
+}
+
+//Check that the prefix of an interaction is correctly ordered
+//with respect to each earlier prefix on the same channel
+func checkDependencies(lessthan []Prefix, prefix Prefix, path []Step, diagnostics *[]Diagnostic) {
+	if d := inputDependency(lessthan, prefix); d != nil {
+		d.Path = path
+		*diagnostics = append(*diagnostics, *d)
+	}
+	if d := outputDependency(lessthan, prefix); d != nil {
+		d.Path = path
+		*diagnostics = append(*diagnostics, *d)
+	}
+}
+
+func linearInternal(gt GlobalType, lessthan []Prefix, path []Step, diagnostics *[]Diagnostic) {
 	/*
 		overall implementation idea:
 		since we already have unwrapped, we only need to locally check and there's a finite amount of nodes to explore (we already removed the cycles via unfold)
 
 		-
 	*/
-	switch gt.(type) {
+	switch t := gt.(type) {
 	case ValueType:
-		t := gt.(ValueType)
-		filtered_lessthan := filter_shared_channel(lessthan, t.ValuePrefix)
-		if !(InputDependency(filtered_lessthan, t.ValuePrefix) && OutputDependency(filtered_lessthan, t.ValuePrefix)) {
-			fmt.Printf("ERROR: Failed to collect dependencies for ValueType %+v\n", t)
-			return false
-		}
-		linearInternal(t.ValueNext, append(lessthan, t.ValuePrefix))
+		checkDependencies(lessthan, t.ValuePrefix, path, diagnostics)
+		linearInternal(t.ValueNext, appendPrefixes(lessthan, t.ValuePrefix), path, diagnostics)
+	case DelegationType:
+		checkDependencies(lessthan, t.DelegationPrefix, path, diagnostics)
+		linearInternal(t.DelegationNext, appendPrefixes(lessthan, t.DelegationPrefix), path, diagnostics)
 	case BranchingType:
-		t := gt.(BranchingType)
-		filtered_lessthan := filter_shared_channel(lessthan, t.BranchPrefix)
-		if !(InputDependency(filtered_lessthan, t.BranchPrefix) &&
-			OutputDependency(filtered_lessthan, t.BranchPrefix)) {
-			fmt.Printf("ERROR: Failed to collect dependencies for BranchingType %+v\n", t)
-			return false
-		}
-		new_lessthan := append(lessthan, t.BranchPrefix)
-		for _, value := range t.Branches {
-			if !linearInternal(value, new_lessthan) {
-				return false
-			}
+		checkDependencies(lessthan, t.BranchPrefix, path, diagnostics)
+		new_lessthan := appendPrefixes(lessthan, t.BranchPrefix)
+		for _, label := range globalLabels(t.Branches) {
+			linearInternal(t.Branches[label], new_lessthan, appendStep(path, Step{Kind: BranchStep, Name: label}), diagnostics)
 		}
 	case ParallelType:
-		t := gt.(ParallelType)
 		for _, prefixes := range t.b.Prefixes() {
-			//fmt.Printf("DEBUG: Checking Parallel linearity with %+v and %+v\n",lessthan, prefixes)
-			if !linearInternal(t.a, append(lessthan, prefixes...)) {
-				return false
-			}
+			linearInternal(t.a, appendPrefixes(lessthan, prefixes...), appendStep(path, Step{Kind: ParallelStep, Name: "left"}), diagnostics)
 		}
 		for _, prefixes := range t.a.Prefixes() {
-			if !linearInternal(t.b, append(lessthan, prefixes...)) {
-				return false
+			linearInternal(t.b, appendPrefixes(lessthan, prefixes...), appendStep(path, Step{Kind: ParallelStep, Name: "right"}), diagnostics)
+		}
+		//What comes after the join may come after anything done in either part
+		for _, first := range completePrefixes(t.a) {
+			for _, second := range completePrefixes(t.b) {
+				linearInternal(t.next, appendPrefixes(appendPrefixes(lessthan, first...), second...), path, diagnostics)
 			}
 		}
 	case RecursiveType:
-		t := gt.(RecursiveType)
-		//fmt.Printf("DEBUG: Entering body of type %+v\n", t)
-		return linearInternal(t.Body, lessthan)
+		linearInternal(t.Body, lessthan, appendStep(path, Step{Kind: RecursionStep, Name: string(t.Bind)}), diagnostics)
+	case DeadlineType:
+		linearInternal(sequenceGlobal(t.Body, t.Next), lessthan, path, diagnostics)
+	case InvocationType:
+		linearInternal(t.Body, lessthan, appendStep(path, Step{Kind: InvokeStep, Name: t.Protocol}), diagnostics)
+		for _, prefixes := range completePrefixes(t.Body) {
+			linearInternal(t.Next, appendPrefixes(lessthan, prefixes...), path, diagnostics)
+		}
+	case InterruptibleType:
+		for _, alternative := range t.alternatives() {
+			linearInternal(alternative, lessthan, path, diagnostics)
+		}
+	case ForeachType:
+		//Only the first iteration, since we don't know how many there are: instantiate the type for a full check
+		linearInternal(t.Body, lessthan, appendStep(path, Step{Kind: ForeachStep, Name: t.Index}), diagnostics)
+		for _, prefixes := range t.Body.Prefixes() {
+			linearInternal(t.Next, appendPrefixes(lessthan, prefixes...), path, diagnostics)
+		}
 	case NameType:
 	case EndType:
 	}
-	return true
 }
 
-func InputDependency(firsts []Prefix, last Prefix) bool {
-	if len(firsts) < 1 {
-		return true
+//Is there a chain firsts[0] ≺ ... ≺ last, where each step is in one of the given relations,
+//and the final step into last is in one of the given final relations?
+func dependencyChain(firsts []Prefix, last Prefix, steps, final []func(Prefix, Prefix) bool) bool {
+	holds := func(relations []func(Prefix, Prefix) bool, n1, n2 Prefix) bool {
+		for _, relation := range relations {
+			if relation(n1, n2) {
+				return true
+			}
+		}
+		return false
 	}
-	for i := 0; i < len(firsts)-1; i++ {
-		if !(firsts[i].II(last) || firsts[i].IO(last)) {
-			fmt.Printf("ERROR: Broke input dependency with %v and %v\n", firsts[i], last)
-			return false
+	//reached[i] means there is a chain from firsts[0] to firsts[i]
+	reached := make([]bool, len(firsts))
+	reached[0] = true
+	for i := 1; i < len(firsts); i++ {
+		for j := 0; j < i && !reached[i]; j++ {
+			reached[i] = reached[j] && holds(steps, firsts[j], firsts[i])
 		}
 	}
-	if !firsts[len(firsts)-1].II(last) {
-		fmt.Printf("Error: Broke input dependency last-II invariant between %v and %v.\n", firsts[len(firsts)-1], last)
-		return false
+	for i := range firsts {
+		if reached[i] && holds(final, firsts[i], last) {
+			return true
+		}
 	}
-	return true
+	return false
 }
 
-func OutputDependency(firsts []Prefix, last Prefix) bool {
-	if len(firsts) < 1 {
-		return true
+//Input dependency: for each earlier prefix on the same channel as last,
+//there must be a chain of II and IO dependencies to last, ending in II
+func inputDependency(firsts []Prefix, last Prefix) *Diagnostic {
+	for i, first := range firsts {
+		if first.PChannel != last.PChannel {
+			continue
+		}
+		if !dependencyChain(firsts[i:], last, []func(Prefix, Prefix) bool{Prefix.II, Prefix.IO}, []func(Prefix, Prefix) bool{Prefix.II}) {
+			_, whyII := first.ii(last)
+			return &Diagnostic{Rule: InputDependencyRule, First: first, Second: last,
+				Reason: "no chain of II and IO dependencies ending in II connects them, and directly " + whyII}
+		}
 	}
-	for _, first := range firsts {
-		if !(first.IO(last) || first.OO(last)) {
-			fmt.Printf("Error: Broke output dependency invariant between %v and %v.\n", first, last)
-			return false
+	return nil
+}
+
+//Output dependency: for each earlier prefix on the same channel as last,
+//there must be a chain of IO and OO dependencies to last
+func outputDependency(firsts []Prefix, last Prefix) *Diagnostic {
+	relations := []func(Prefix, Prefix) bool{Prefix.IO, Prefix.OO}
+	for i, first := range firsts {
+		if first.PChannel != last.PChannel {
+			continue
+		}
+		if !dependencyChain(firsts[i:], last, relations, relations) {
+			_, whyIO := first.io(last)
+			_, whyOO := first.oo(last)
+			return &Diagnostic{Rule: OutputDependencyRule, First: first, Second: last,
+				Reason: "no chain of IO and OO dependencies connects them, and directly " + whyIO + " and " + whyOO}
 		}
 	}
-	return true
+	return nil
+}
+
+//Check the input dependency of last on each of the prefixes which come before it (firsts, in order)
+func InputDependency(firsts []Prefix, last Prefix) bool {
+	return inputDependency(firsts, last) == nil
+}
+
+//Check the output dependency of last on each of the prefixes which come before it (firsts, in order)
+func OutputDependency(firsts []Prefix, last Prefix) bool {
+	return outputDependency(firsts, last) == nil
 }
 
 func unfold(gt GlobalType, env map[NameType]GlobalType) GlobalType {
 	switch gt.(type) {
 	case ValueType:
 		t := gt.(ValueType)
-		return ValueType{ValuePrefix: t.ValuePrefix, Value: t.Value, ValueNext: unfold(t.ValueNext, env)}
+		return ValueType{ValuePrefix: t.ValuePrefix, Value: t.Value, Refinement: t.Refinement, ValueNext: unfold(t.ValueNext, env)}
+	case DelegationType:
+		t := gt.(DelegationType)
+		return DelegationType{DelegationPrefix: t.DelegationPrefix, Session: t.Session, DelegationNext: unfold(t.DelegationNext, env)}
 	case BranchingType:
 		t := gt.(BranchingType)
 		branches := make(map[string]GlobalType)
@@ -643,11 +824,11 @@ func unfold(gt GlobalType, env map[NameType]GlobalType) GlobalType {
 		return BranchingType{BranchPrefix: t.BranchPrefix, Branches: branches}
 	case ParallelType:
 		t := gt.(ParallelType)
-		return ParallelType{a: unfold(t.a, env), b: unfold(t.b, env)}
+		return ParallelType{a: unfold(t.a, env), b: unfold(t.b, env), next: unfold(t.next, env)}
 	case RecursiveType:
 		t := gt.(RecursiveType)
 		if val, ok := env[t.Bind]; ok {
-			if val != t {
+			if !val.equals(t) {
 				//name hiding!
 				old_val := val
 				env[t.Bind] = t
@@ -661,6 +842,22 @@ func unfold(gt GlobalType, env map[NameType]GlobalType) GlobalType {
 		}
 		env[t.Bind] = t
 		return RecursiveType{Bind: t.Bind, Body: unfold(t.Body, env)}
+	case DeadlineType:
+		t := gt.(DeadlineType)
+		return DeadlineType{Within: t.Within, Body: unfold(t.Body, env), Next: unfold(t.Next, env)}
+	case InvocationType:
+		t := gt.(InvocationType)
+		return InvocationType{Protocol: t.Protocol, Body: unfold(t.Body, env), Next: unfold(t.Next, env)}
+	case InterruptibleType:
+		t := gt.(InterruptibleType)
+		interrupts := make([]Interrupt, len(t.Interrupts))
+		for i, interrupt := range t.Interrupts {
+			interrupts[i] = Interrupt{Label: interrupt.Label, Notify: interrupt.Notify, Then: unfold(interrupt.Then, env)}
+		}
+		return InterruptibleType{Body: unfold(t.Body, env), Interrupts: interrupts, Next: unfold(t.Next, env)}
+	case ForeachType:
+		t := gt.(ForeachType)
+		return ForeachType{Index: t.Index, From: t.From, To: t.To, Body: unfold(t.Body, env), Next: unfold(t.Next, env)}
 	case NameType:
 		t := gt.(NameType)
 		if val, ok := env[t]; ok {
@@ -675,8 +872,16 @@ func unfold(gt GlobalType, env map[NameType]GlobalType) GlobalType {
 
 // LOCAL TYPES
 
+//Local types are values: no operation on them changes a type in place,
+//including the maps of branches, so they may be shared between checkers and goroutines.
+//Build a new type instead of changing the Branches of an existing one.
 type LocalType interface {
+	//Syntactic equality
 	Equals(t LocalType) bool
+	//Equality up to unfolding and renaming of recursive types
+	EquivalentTo(t LocalType) bool
+	//Replace the free occurrences of u with t, renaming binders so that
+	//the free variables of t aren't captured
 	Substitute(u LocalNameType, t LocalType) LocalType
 }
 
@@ -692,6 +897,10 @@ func (t ProjectionType) Substitute(u LocalNameType, tsub LocalType) LocalType {
 	return ret
 }
 
+func (t ProjectionType) EquivalentTo(l LocalType) bool {
+	return equivalent(t, l)
+}
+
 func (t ProjectionType) Equals(l LocalType) bool {
 	switch l.(type) {
 	case ProjectionType:
@@ -712,9 +921,10 @@ func findProjection(participant Participant, projections []ProjectionType) (Proj
 }
 
 type LocalSendType struct {
-	Channel Channel
-	Value   Sort
-	Next    LocalType
+	Channel    Channel
+	Value      []Sort
+	Refinement *Refinement
+	Next       LocalType
 }
 
 func (t LocalSendType) Substitute(u LocalNameType, tsub LocalType) LocalType {
@@ -723,19 +933,25 @@ func (t LocalSendType) Substitute(u LocalNameType, tsub LocalType) LocalType {
 	return ret
 }
 
+func (t LocalSendType) EquivalentTo(l LocalType) bool {
+	return equivalent(t, l)
+}
+
 func (t LocalSendType) Equals(l LocalType) bool {
 	switch l.(type) {
 	case LocalSendType:
 		lt := l.(LocalSendType)
-		return t.Channel == lt.Channel && (t.Value == lt.Value) && t.Next.Equals(lt.Next)
+		return t.Channel == lt.Channel && sortsEqual(t.Value, lt.Value) && refinementsEqual(t.Refinement, lt.Refinement) &&
+			t.Next.Equals(lt.Next)
 	}
 	return false
 }
 
 type LocalReceiveType struct {
-	Channel Channel
-	Value   Sort
-	Next    LocalType
+	Channel    Channel
+	Value      []Sort
+	Refinement *Refinement
+	Next       LocalType
 }
 
 func (t LocalReceiveType) Substitute(u LocalNameType, tsub LocalType) LocalType {
@@ -744,11 +960,16 @@ func (t LocalReceiveType) Substitute(u LocalNameType, tsub LocalType) LocalType
 	return ret
 }
 
+func (t LocalReceiveType) EquivalentTo(l LocalType) bool {
+	return equivalent(t, l)
+}
+
 func (t LocalReceiveType) Equals(l LocalType) bool {
 	switch l.(type) {
 	case LocalReceiveType:
 		lt := l.(LocalReceiveType)
-		return t.Channel == lt.Channel && (t.Value == lt.Value) && t.Next.Equals(lt.Next)
+		return t.Channel == lt.Channel && sortsEqual(t.Value, lt.Value) && refinementsEqual(t.Refinement, lt.Refinement) &&
+			t.Next.Equals(lt.Next)
 	}
 	return false
 }
@@ -760,18 +981,24 @@ type LocalSelectionType struct {
 }
 
 func (t LocalSelectionType) Substitute(u LocalNameType, tsub LocalType) LocalType {
-	ret := t
-	for k, branchType := range t.Branches {
-		ret.Branches[k] = branchType.Substitute(u, tsub)
-	}
-	return ret
+	return LocalSelectionType{Channel: t.Channel, Branches: substituteBranches(t.Branches, u, tsub)}
+}
+
+func (t LocalSelectionType) EquivalentTo(l LocalType) bool {
+	return equivalent(t, l)
 }
 
 func (t LocalSelectionType) Equals(l LocalType) bool {
 	switch l.(type) {
 	case LocalSelectionType:
 		lt := l.(LocalSelectionType)
+		if len(t.Branches) != len(lt.Branches) {
+			return false
+		}
 		for k := range t.Branches {
+			if _, ok := lt.Branches[k]; !ok {
+				return false
+			}
 			if !t.Branches[k].Equals(lt.Branches[k]) {
 				return false
 			}
@@ -788,18 +1015,24 @@ type LocalBranchingType struct {
 }
 
 func (t LocalBranchingType) Substitute(u LocalNameType, tsub LocalType) LocalType {
-	ret := t
-	for k, branchType := range t.Branches {
-		ret.Branches[k] = branchType.Substitute(u, tsub)
-	}
-	return ret
+	return LocalBranchingType{Channel: t.Channel, Branches: substituteBranches(t.Branches, u, tsub)}
+}
+
+func (t LocalBranchingType) EquivalentTo(l LocalType) bool {
+	return equivalent(t, l)
 }
 
 func (t LocalBranchingType) Equals(l LocalType) bool {
 	switch l.(type) {
 	case LocalBranchingType:
 		lt := l.(LocalBranchingType)
+		if len(t.Branches) != len(lt.Branches) {
+			return false
+		}
 		for k := range t.Branches {
+			if _, ok := lt.Branches[k]; !ok {
+				return false
+			}
 			if !t.Branches[k].Equals(lt.Branches[k]) {
 				return false
 			}
@@ -818,9 +1051,12 @@ func (t LocalNameType) GoString() string {
 func (t LocalNameType) Substitute(u LocalNameType, tsub LocalType) LocalType {
 	if u == t {
 		return tsub
-	} else {
-		return u
 	}
+	return t
+}
+
+func (t LocalNameType) EquivalentTo(l LocalType) bool {
+	return equivalent(t, l)
 }
 
 func (t LocalNameType) Equals(l LocalType) bool {
@@ -841,15 +1077,29 @@ func (t LocalRecursiveType) UnfoldOneLevel() LocalType {
 }
 
 func (t LocalRecursiveType) Substitute(u LocalNameType, tsub LocalType) LocalType {
-	//Don't substitute if we're shadowing
-	if u == t.Bind {
+	//Don't substitute if we're shadowing, or if there's nothing to substitute
+	bodyFree := localFreeVariables(t.Body)
+	if u == t.Bind || !bodyFree[u] {
 		return t
-	} else {
-		println("SUBBING IN REC")
-		ret := t
-		ret.Body = t.Body.Substitute(u, tsub)
-		return ret
 	}
+	//Rename our binder if it would capture a free variable of tsub
+	bind, body := t.Bind, t.Body
+	if subFree := localFreeVariables(tsub); subFree[bind] {
+		avoid := map[LocalNameType]bool{u: true}
+		for name := range subFree {
+			avoid[name] = true
+		}
+		for name := range bodyFree {
+			avoid[name] = true
+		}
+		bind = freshName(bind, avoid)
+		body = body.Substitute(t.Bind, bind)
+	}
+	return LocalRecursiveType{Bind: bind, Body: body.Substitute(u, tsub)}
+}
+
+func (t LocalRecursiveType) EquivalentTo(l LocalType) bool {
+	return equivalent(t, l)
 }
 
 func (t LocalRecursiveType) Equals(l LocalType) bool {
@@ -867,6 +1117,10 @@ func (t LocalEndType) Substitute(u LocalNameType, tsub LocalType) LocalType {
 	return t
 }
 
+func (t LocalEndType) EquivalentTo(l LocalType) bool {
+	return equivalent(t, l)
+}
+
 func (t LocalEndType) Equals(l LocalType) bool {
 	switch l.(type) {
 	case LocalEndType:
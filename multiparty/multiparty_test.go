@@ -1,5 +1,11 @@
 package multiparty
 
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
 //"github.com/JoeyEremondi/GoSesh/multiparty"
 
 //
@@ -142,7 +148,7 @@ func TestBasicStub(test *testing.T) {
 		Bind: "T",
 		Body: ValueType{
 			ValuePrefix: Prefix{P1: "127.0.0.1:24601", P2: "127.0.0.1:24602", PChannel: "channel"},
-			Value:       "int",
+			Value:       SingletonValue("int"),
 			ValueNext:   BranchingType{BranchPrefix: Prefix{P1: "127.0.0.1:24602", P2: "127.0.0.1:24601", PChannel: "channel"}, Branches: ourMap},
 		}}
 	println("*******************\n\n\n ")
@@ -163,3 +169,1082 @@ func TestBasicStub(test *testing.T) {
 	goodFile.WriteString(string(formatted))
 }
 */
+
+func TestFormat(test *testing.T) {
+	t := RecursiveType{
+		Bind: "T",
+		Body: ValueType{
+			ValuePrefix: Prefix{P1: "A", P2: "B", PChannel: "k"},
+			Value:       SingletonValue("int"),
+			ValueNext: BranchingType{
+				BranchPrefix: Prefix{P1: "B", P2: "A", PChannel: "k'"},
+				Branches: map[string]GlobalType{
+					"isGood": EndType{},
+					"isBad":  NameType("T"),
+				}}}}
+
+	expected := "μT.\n  A → B : k⟨int⟩. B → A : k' {\n    isBad: T,\n    isGood: end\n  }"
+	if t.String() != expected {
+		test.Errorf("Global type printed as\n%s\nexpected\n%s", t, expected)
+	}
+
+	local, err := t.Project("B")
+	if err != nil {
+		test.Fatal(err)
+	}
+	expected = "rec T.\n  k?<int>; k' + {\n    isBad: T,\n    isGood: end\n  }"
+	if FormatLocal(local, ASCII) != expected {
+		test.Errorf("Local type printed as\n%s\nexpected\n%s", FormatLocal(local, ASCII), expected)
+	}
+}
+
+func TestJSONRoundTrip(test *testing.T) {
+	global := RecursiveType{
+		Bind: "T",
+		Body: MakeParallelType(
+			ValueType{
+				ValuePrefix: Prefix{P1: "A", P2: "B", PChannel: "k"},
+				Value:       SingletonValue("[]string"),
+				ValueNext: BranchingType{
+					BranchPrefix: Prefix{P1: "B", P2: "A", PChannel: "k'"},
+					Branches: map[string]GlobalType{
+						"again": NameType("T"),
+						"done":  EndType{},
+					}}},
+			ValueType{
+				ValuePrefix: Prefix{P1: "C", P2: "D", PChannel: "k''"},
+				Value:       SingletonValue("int"),
+				ValueNext:   EndType{}})}
+
+	encoded, err := MarshalGlobalType(global)
+	if err != nil {
+		test.Fatal(err)
+	}
+	decoded, err := UnmarshalGlobalType(encoded)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if !reflect.DeepEqual(global, decoded) {
+		test.Errorf("Global type %s decoded as %s", global, decoded)
+	}
+
+	local := ProjectionType{participant: "A", T: LocalRecursiveType{
+		Bind: "T",
+		Body: LocalSendType{Channel: "k", Value: SingletonValue("int"), Next: LocalReceiveType{Channel: "k'", Value: SingletonValue("bool"),
+			Next: LocalSelectionType{Channel: "k", Branches: map[string]LocalType{
+				"again": LocalNameType("T"),
+				"done": LocalBranchingType{Channel: "k'", Branches: map[string]LocalType{
+					"bye": LocalEndType{},
+				}},
+			}}}}}}
+
+	encoded, err = MarshalLocalType(local)
+	if err != nil {
+		test.Fatal(err)
+	}
+	decodedLocal, err := UnmarshalLocalType(encoded)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if !reflect.DeepEqual(local, decodedLocal) {
+		test.Errorf("Local type %s decoded as %s", local, decodedLocal)
+	}
+
+	if _, err := UnmarshalLocalType([]byte(`{"version": 99, "local": {"kind": "end"}}`)); err == nil {
+		test.Errorf("Decoding an unknown version should fail")
+	}
+
+	//Version 1 documents have a single sort for each message
+	old := `{"version": 1, "local": {"kind": "send", "channel": "k", "sort": "int", "next": {"kind": "end"}}}`
+	decodedLocal, err = UnmarshalLocalType([]byte(old))
+	if err != nil {
+		test.Fatal(err)
+	}
+	expected := LocalSendType{Channel: "k", Value: SingletonValue("int"), Next: LocalEndType{}}
+	if !reflect.DeepEqual(decodedLocal, expected) {
+		test.Errorf("Version 1 document decoded as %s, expected %s", decodedLocal, expected)
+	}
+
+	refined := LocalSendType{Channel: "k", Value: SingletonValue("int"),
+		Refinement: &Refinement{Name: "positive", Vars: []string{"x"}, Expr: "x > 0"}, Next: LocalEndType{}}
+	encoded, err = MarshalLocalType(refined)
+	if err != nil {
+		test.Fatal(err)
+	}
+	decodedLocal, err = UnmarshalLocalType(encoded)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if !reflect.DeepEqual(refined, decodedLocal) {
+		test.Errorf("Local type %s decoded as %s", refined, decodedLocal)
+	}
+
+	//A document may only use what its version had, and nothing we don't know
+	for _, doc := range []string{
+		`{"version": 3, "local": {"kind": "send", "channel": "k", "sorts": ["int"], "refinement": {"Name": "positive", "Vars": ["x"], "Expr": "x > 0"}, "next": {"kind": "end"}}}`,
+		`{"version": 5, "local": {"kind": "deadline", "within": "1s", "body": {"kind": "end"}, "next": {"kind": "end"}}}`,
+		`{"version": 2, "local": {"kind": "send", "channel": "k", "sort": "int", "next": {"kind": "end"}}}`,
+		`{"version": 7, "local": {"kind": "send", "channel": "k", "sorts": ["int"], "priority": 1, "next": {"kind": "end"}}}`,
+	} {
+		if _, err := UnmarshalLocalType([]byte(doc)); err == nil {
+			test.Errorf("Decoding %s should fail", doc)
+		}
+	}
+}
+
+func TestTupleValues(test *testing.T) {
+	payment := ValueType{Value: []Sort{"string", "int"}, ValuePrefix: Prefix{P1: "A", P2: "B", PChannel: "k"}, ValueNext: EndType{}}
+	if payment.String() != "A → B : k⟨string, int⟩. end" {
+		test.Errorf("Printed %s", payment)
+	}
+	local, err := payment.Project("B")
+	if err != nil {
+		test.Fatal(err)
+	}
+	expected := LocalReceiveType{Channel: "k", Value: []Sort{"string", "int"}, Next: LocalEndType{}}
+	if !reflect.DeepEqual(local, expected) {
+		test.Errorf("Projected %s, expected %s", local, expected)
+	}
+
+	//Tuples are subtypes element by element, and must have the same length
+	general := LocalReceiveType{Channel: "k", Value: []Sort{"string", "interface{}"}, Next: LocalEndType{}}
+	single := LocalReceiveType{Channel: "k", Value: SingletonValue("string"), Next: LocalEndType{}}
+	if !IsSubtype(general, local) || IsSubtype(local, general) || IsSubtype(single, local) {
+		test.Errorf("Wrong subtyping between tuples")
+	}
+}
+
+func TestRefinement(test *testing.T) {
+	positive, err := NewRefinement("positive", "amount > 0 && len(items) <= 2", "amount", "items")
+	if err != nil {
+		test.Fatal(err)
+	}
+	holds := func(values ...interface{}) bool {
+		ok, err := positive.Holds(values, nil)
+		if err != nil {
+			test.Fatal(err)
+		}
+		return ok
+	}
+	if !holds(5, []string{"a"}) || holds(-5, []string{"a"}) || holds(uint8(1), []string{"a", "b", "c"}) {
+		test.Errorf("Wrong result for %s", positive)
+	}
+
+	//Refinements may use values named by earlier messages
+	withinBudget := Refinement{Name: "affordable", Vars: []string{"price"}, Expr: "price * 2 <= budget"}
+	if ok, err := withinBudget.Holds([]interface{}{10.5}, map[string]interface{}{"budget": 21}); !ok || err != nil {
+		test.Errorf("%s should hold, got %v", withinBudget, err)
+	}
+	if _, err := withinBudget.Holds([]interface{}{10.5}, nil); err == nil {
+		test.Errorf("%s should fail without a budget", withinBudget)
+	}
+
+	budget := Refinement{Vars: []string{"budget"}}
+	purchase := ValueType{Value: SingletonValue("int"), Refinement: &budget, ValuePrefix: Prefix{P1: "A", P2: "B", PChannel: "k"},
+		ValueNext: ValueType{Value: SingletonValue("float64"), Refinement: &withinBudget, ValuePrefix: Prefix{P1: "B", P2: "C", PChannel: "j"},
+			ValueNext: EndType{}}}
+	if purchase.String() != "A → B : k⟨budget int⟩. B → C : j⟨price float64⟩{affordable: price * 2 <= budget}. end" {
+		test.Errorf("Printed %s", purchase)
+	}
+	//C was never told the budget, so it can't check the price
+	diagnostics := CheckRefinements(purchase)
+	if len(diagnostics) != 1 || diagnostics[0].Participant != "C" || diagnostics[0].Rule != RefinementRule {
+		test.Errorf("Expected C to be unable to check %s, got %v", withinBudget, diagnostics)
+	}
+
+	local, err := purchase.Project("B")
+	if err != nil {
+		test.Fatal(err)
+	}
+	data, err := MarshalLocalType(local)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if decoded, err := UnmarshalLocalType(data); err != nil || !decoded.Equals(local) {
+		test.Errorf("Decoded %v, expected %s: %v", decoded, local, err)
+	}
+
+	//A subtype may ensure more when sending, and rely on less when receiving
+	send := LocalSendType{Channel: "j", Value: SingletonValue("float64"), Refinement: &withinBudget, Next: LocalEndType{}}
+	unrefined := LocalSendType{Channel: "j", Value: SingletonValue("float64"), Next: LocalEndType{}}
+	if !IsSubtype(send, unrefined) || IsSubtype(unrefined, send) {
+		test.Errorf("Wrong subtyping between refined sends")
+	}
+	recv := LocalReceiveType{Channel: "j", Value: SingletonValue("float64"), Refinement: &withinBudget, Next: LocalEndType{}}
+	if !IsSubtype(LocalReceiveType{Channel: "j", Value: SingletonValue("float64"), Next: LocalEndType{}}, recv) {
+		test.Errorf("A receive relying on nothing should be a subtype of one relying on %s", withinBudget)
+	}
+}
+
+func TestForeach(test *testing.T) {
+	//Scatter work to N workers, then gather their results
+	scatter := ForeachType{Index: "i", From: "1", To: "N",
+		Body: ValueType{Value: SingletonValue("int"), ValuePrefix: Prefix{P1: "Master", P2: "Worker[i]", PChannel: "work[i]"}, ValueNext: EndType{}},
+		Next: ForeachType{Index: "i", From: "1", To: "N",
+			Body: ValueType{Value: SingletonValue("int"), ValuePrefix: Prefix{P1: "Worker[i]", P2: "Master", PChannel: "done[i]"}, ValueNext: EndType{}},
+			Next: EndType{}}}
+	if _, err := scatter.Project("Master"); err == nil {
+		test.Errorf("Projected a family before instantiating it")
+	}
+
+	instance, err := Instantiate(scatter, map[string]int{"N": 2})
+	if err != nil {
+		test.Fatal(err)
+	}
+	message := func(from, to Participant, k Channel, next GlobalType) GlobalType {
+		return ValueType{Value: SingletonValue("int"), ValuePrefix: Prefix{P1: from, P2: to, PChannel: k}, ValueNext: next}
+	}
+	expected := message("Master", "Worker[1]", "work[1]", message("Master", "Worker[2]", "work[2]",
+		message("Worker[1]", "Master", "done[1]", message("Worker[2]", "Master", "done[2]", EndType{}))))
+	if !instance.equals(expected) {
+		test.Errorf("Instantiated to %s, expected %s", instance, expected)
+	}
+
+	workers, err := ProjectFamily(scatter, "Worker", map[string]int{"N": 3})
+	if err != nil {
+		test.Fatal(err)
+	}
+	second := LocalReceiveType{Channel: "work[2]", Value: SingletonValue("int"),
+		Next: LocalSendType{Channel: "done[2]", Value: SingletonValue("int"), Next: LocalEndType{}}}
+	if len(workers) != 3 || !workers["Worker[2]"].Equals(second) {
+		test.Errorf("Projected the workers to %v", workers)
+	}
+
+	//Indices may be expressions, e.g. to pass a token around a ring
+	ring := ForeachType{Index: "i", From: "1", To: "N-1",
+		Body: ValueType{Value: SingletonValue("int"), ValuePrefix: Prefix{P1: "Worker[i]", P2: "Worker[i+1]", PChannel: "ring[i+1]"}, ValueNext: EndType{}},
+		Next: EndType{}}
+	instance, err = Instantiate(ring, map[string]int{"N": 3})
+	if err != nil {
+		test.Fatal(err)
+	}
+	if expected := message("Worker[1]", "Worker[2]", "ring[2]", message("Worker[2]", "Worker[3]", "ring[3]", EndType{})); !instance.equals(expected) {
+		test.Errorf("Instantiated to %s, expected %s", instance, expected)
+	}
+	if _, err := Instantiate(ring, nil); err == nil {
+		test.Errorf("Instantiated %s without a value for N", ring)
+	}
+
+	data, err := MarshalGlobalType(scatter)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if decoded, err := UnmarshalGlobalType(data); err != nil || !decoded.equals(scatter) {
+		test.Errorf("Decoded %v, expected %s: %v", decoded, scatter, err)
+	}
+
+	//The loop in the body ends by going around the outer loop,
+	//so it must be renamed not to capture the X after the family
+	retry := ForeachType{Index: "i", From: "1", To: "1",
+		Body: RecursiveType{Bind: "X", Body: BranchingType{BranchPrefix: Prefix{P1: "B", P2: "A", PChannel: "k"},
+			Branches: map[string]GlobalType{"again": NameType("X"), "done": EndType{}}}},
+		Next: NameType("X")}
+	instance, err = Instantiate(RecursiveType{Bind: "X", Body: message("A", "B", "s", retry)}, nil)
+	if err != nil {
+		test.Fatal(err)
+	}
+	inner, ok := instance.(RecursiveType).Body.(ValueType).ValueNext.(RecursiveType)
+	if !ok || inner.Bind == "X" {
+		test.Fatalf("Instantiated %s, which captures X", instance)
+	}
+	branches := inner.Body.(BranchingType).Branches
+	if branches["again"] != inner.Bind || branches["done"] != NameType("X") {
+		test.Errorf("Instantiated %s, expected again to go to %s and done to X", instance, inner.Bind)
+	}
+}
+
+func TestDeadline(test *testing.T) {
+	//B must reply within 200ms of A's request, then A tells C, whenever it likes
+	message := func(from, to Participant, k Channel, next GlobalType) GlobalType {
+		return ValueType{Value: SingletonValue("int"), ValuePrefix: Prefix{P1: from, P2: to, PChannel: k}, ValueNext: next}
+	}
+	timed := DeadlineType{Within: 200 * time.Millisecond,
+		Body: message("A", "B", "request", message("B", "A", "reply", EndType{})),
+		Next: message("A", "C", "done", EndType{})}
+
+	server, err := timed.Project("B")
+	if err != nil {
+		test.Fatal(err)
+	}
+	expected := LocalDeadlineType{Within: 200 * time.Millisecond,
+		Body: LocalReceiveType{Channel: "request", Value: SingletonValue("int"),
+			Next: LocalSendType{Channel: "reply", Value: SingletonValue("int"), Next: LocalEndType{}}},
+		Next: LocalEndType{}}
+	if !server.Equals(expected) {
+		test.Errorf("Projected %s, expected %s", server, expected)
+	}
+	//C has nothing to do before the deadline, so doesn't see it
+	if observer, err := timed.Project("C"); err != nil || !observer.Equals(LocalReceiveType{Channel: "done", Value: SingletonValue("int"), Next: LocalEndType{}}) {
+		test.Errorf("Projected %v for C: %v", observer, err)
+	}
+
+	//A longer deadline might be missed, so it can't stand in for a shorter one
+	relaxed := LocalDeadlineType{Within: time.Second, Body: expected.Body, Next: expected.Next}
+	if server.EquivalentTo(relaxed) || IsSubtype(relaxed, server) {
+		test.Errorf("%s can replace %s", relaxed, server)
+	}
+	if !IsSubtype(server, expected) || !CheckAsyncSubtype(server, expected, AsyncOptions{Bound: DefaultAsyncBound}).Subtype {
+		test.Errorf("%s can't replace itself", server)
+	}
+
+	//Leaving a deadline by jumping back to the start of a loop would never finish it
+	looping := RecursiveType{Bind: "X", Body: DeadlineType{Within: time.Second,
+		Body: message("A", "B", "request", NameType("X")), Next: EndType{}}}
+	if _, err := looping.Project("A"); err == nil {
+		test.Errorf("Projected %s", looping)
+	}
+
+	data, err := MarshalGlobalType(timed)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if decoded, err := UnmarshalGlobalType(data); err != nil || !decoded.equals(timed) {
+		test.Errorf("Decoded %v, expected %s: %v", decoded, timed, err)
+	}
+
+	//A asks B again and again within the deadline, and then the outer loop starts again,
+	//so the inner loop must be renamed not to capture the X after the deadline
+	retry := BranchingType{BranchPrefix: Prefix{P1: "B", P2: "A", PChannel: "reply"},
+		Branches: map[string]GlobalType{"again": NameType("X"), "done": EndType{}}}
+	sequenced := sequenceGlobal(RecursiveType{Bind: "X", Body: message("A", "B", "request", retry)}, NameType("X"))
+	inner, ok := sequenced.(RecursiveType)
+	if !ok || inner.Bind == "X" {
+		test.Fatalf("Sequenced %s, which captures X", sequenced)
+	}
+	branches := inner.Body.(ValueType).ValueNext.(BranchingType).Branches
+	if branches["again"] != inner.Bind || branches["done"] != NameType("X") {
+		test.Errorf("Sequenced %s, expected again to go to %s and done to X", sequenced, inner.Bind)
+	}
+}
+
+func TestInterruptible(test *testing.T) {
+	//A streams data to B until A cancels, after which B acknowledges and A tells C it's done
+	stream := RecursiveType{Bind: "X", Body: ValueType{Value: SingletonValue("int"), ValuePrefix: Prefix{P1: "A", P2: "B", PChannel: "b"},
+		ValueNext: ValueType{Value: SingletonValue("int"), ValuePrefix: Prefix{P1: "B", P2: "A", PChannel: "a"}, ValueNext: NameType("X")}}}
+	cancel := Interrupt{Label: "cancel", Notify: []Prefix{{P1: "A", P2: "B", PChannel: "b"}},
+		Then: ValueType{Value: SingletonValue("bool"), ValuePrefix: Prefix{P1: "B", P2: "A", PChannel: "a"}, ValueNext: EndType{}}}
+	block := InterruptibleType{Body: stream, Interrupts: []Interrupt{cancel},
+		Next: ValueType{Value: SingletonValue("int"), ValuePrefix: Prefix{P1: "A", P2: "C", PChannel: "c"}, ValueNext: EndType{}}}
+
+	receiver, err := block.Project("B")
+	if err != nil {
+		test.Fatal(err)
+	}
+	expected := LocalInterruptibleType{
+		Body: LocalRecursiveType{Bind: "X", Body: LocalReceiveType{Channel: "b", Value: SingletonValue("int"),
+			Next: LocalSendType{Channel: "a", Value: SingletonValue("int"), Next: LocalNameType("X")}}},
+		Interrupts: []LocalInterrupt{{Label: "cancel", Channels: []Channel{"b"},
+			Then: LocalSendType{Channel: "a", Value: SingletonValue("bool"), Next: LocalEndType{}}}},
+		Next: LocalEndType{}}
+	if !receiver.Equals(expected) {
+		test.Errorf("Projected %s, expected %s", receiver, expected)
+	}
+	sender, err := block.Project("A")
+	if err != nil {
+		test.Fatal(err)
+	}
+	if sender.EquivalentTo(receiver) || IsSubtype(sender, receiver) {
+		test.Errorf("Raising an interrupt is the same as catching it")
+	}
+	if !IsSubtype(sender, sender) || !CheckAsyncSubtype(receiver, receiver, AsyncOptions{Bound: DefaultAsyncBound}).Subtype {
+		test.Errorf("%s or %s can't replace itself", sender, receiver)
+	}
+	//C isn't in the block, so just waits for A
+	if observer, err := block.Project("C"); err != nil || !observer.Equals(LocalReceiveType{Channel: "c", Value: SingletonValue("int"), Next: LocalEndType{}}) {
+		test.Errorf("Projected %v for C: %v", observer, err)
+	}
+	if diagnostics := Check(block); len(diagnostics) != 0 {
+		test.Errorf("Found problems with %s: %v", block, diagnostics)
+	}
+
+	//If B could finish the block with a send, A could cancel it after B had already left
+	finite := block
+	finite.Body = ValueType{Value: SingletonValue("int"), ValuePrefix: Prefix{P1: "A", P2: "B", PChannel: "b"},
+		ValueNext: ValueType{Value: SingletonValue("int"), ValuePrefix: Prefix{P1: "B", P2: "A", PChannel: "a"}, ValueNext: EndType{}}}
+	if _, err := finite.Project("B"); err == nil {
+		test.Errorf("Projected %s", finite)
+	}
+	//Everyone in the block must be told
+	untold := block
+	untold.Body = ValueType{Value: SingletonValue("int"), ValuePrefix: Prefix{P1: "A", P2: "D", PChannel: "d"}, ValueNext: stream}
+	if _, err := untold.Project("D"); err == nil {
+		test.Errorf("Projected %s", untold)
+	}
+
+	data, err := MarshalGlobalType(block)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if decoded, err := UnmarshalGlobalType(data); err != nil || !decoded.equals(block) {
+		test.Errorf("Decoded %v, expected %s: %v", decoded, block, err)
+	}
+	data, err = MarshalLocalType(sender)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if decoded, err := UnmarshalLocalType(data); err != nil || !decoded.Equals(sender) {
+		test.Errorf("Decoded %v, expected %s: %v", decoded, sender, err)
+	}
+}
+
+func TestInvoke(test *testing.T) {
+	//The coordinator asks a voter for its vote, which the voter gives back
+	vote := Protocol{Name: "Vote", Roles: []Participant{"Coord", "Voter"}, Channels: []Channel{"ask", "answer"},
+		Body: ValueType{Value: SingletonValue("string"), ValuePrefix: Prefix{P1: "Coord", P2: "Voter", PChannel: "ask"},
+			ValueNext: BranchingType{BranchPrefix: Prefix{P1: "Voter", P2: "Coord", PChannel: "answer"},
+				Branches: map[string]GlobalType{"commit": EndType{}, "abort": EndType{}}}}}
+	ballot := func(voter Participant, k Channel, next GlobalType) GlobalType {
+		ans, err := vote.Invoke(map[Participant]Participant{"Coord": "A", "Voter": voter}, map[Channel]Channel{"ask": k, "answer": "a"}, next)
+		if err != nil {
+			test.Fatal(err)
+		}
+		return ans
+	}
+	both := ballot("B", "b", ballot("C", "c", EndType{}))
+	voteC := ValueType{Value: SingletonValue("string"), ValuePrefix: Prefix{P1: "A", P2: "C", PChannel: "c"},
+		ValueNext: BranchingType{BranchPrefix: Prefix{P1: "C", P2: "A", PChannel: "a"},
+			Branches: map[string]GlobalType{"commit": EndType{}, "abort": EndType{}}}}
+	var expected GlobalType = ValueType{Value: SingletonValue("string"), ValuePrefix: Prefix{P1: "A", P2: "B", PChannel: "b"},
+		ValueNext: BranchingType{BranchPrefix: Prefix{P1: "B", P2: "A", PChannel: "a"},
+			Branches: map[string]GlobalType{"commit": voteC, "abort": voteC}}}
+	if !sequenceGlobal(both, EndType{}).equals(expected) {
+		test.Errorf("Invoked to %s, expected %s", both, expected)
+	}
+	if diagnostics := Check(both); len(diagnostics) != 0 {
+		test.Errorf("Found problems with %s: %v", both, diagnostics)
+	}
+	for _, p := range []Participant{"A", "B", "C"} {
+		invoked, err := both.Project(p)
+		if err != nil {
+			test.Fatal(err)
+		}
+		if written, err := expected.Project(p); err != nil || !invoked.Equals(written) {
+			test.Errorf("Projected onto %s as %s, expected %s: %v", p, invoked, written, err)
+		}
+	}
+	data, err := MarshalGlobalType(both)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if decoded, err := UnmarshalGlobalType(data); err != nil || !decoded.equals(both) {
+		test.Errorf("Decoded %v, expected %s: %v", decoded, both, err)
+	}
+	if _, err := UnmarshalGlobalType([]byte(`{"version": 8, "global": {"kind": "invocation", "name": "Vote", "body": {"kind": "end"}, "next": {"kind": "end"}}}`)); err == nil {
+		test.Errorf("Decoded an invocation from version 8")
+	}
+
+	//A loop of the protocol doesn't capture the invoker's loop of the same name
+	retry := Protocol{Name: "Retry", Roles: []Participant{"P", "Q"}, Channels: []Channel{"q"},
+		Body: RecursiveType{Bind: "X", Body: BranchingType{BranchPrefix: Prefix{P1: "P", P2: "Q", PChannel: "q"},
+			Branches: map[string]GlobalType{"again": NameType("X"), "done": EndType{}}}}}
+	loop, err := retry.Invoke(map[Participant]Participant{"P": "A", "Q": "B"}, map[Channel]Channel{"q": "b"}, NameType("X"))
+	if err != nil {
+		test.Fatal(err)
+	}
+	loop = RecursiveType{Bind: "X", Body: loop}
+	expected = RecursiveType{Bind: "X", Body: RecursiveType{Bind: "X1", Body: BranchingType{BranchPrefix: Prefix{P1: "A", P2: "B", PChannel: "b"},
+		Branches: map[string]GlobalType{"again": NameType("X1"), "done": NameType("X")}}}}
+	if !sequenceGlobal(loop, EndType{}).equals(expected) {
+		test.Errorf("Invoked to %s, expected %s", loop, expected)
+	}
+
+	//Problems in the body of a protocol say which invocation they are in
+	bad := Protocol{Name: "Forward", Roles: []Participant{"P", "Q", "R"}, Channels: []Channel{"q", "r"},
+		Body: BranchingType{BranchPrefix: Prefix{P1: "P", P2: "Q", PChannel: "q"},
+			Branches: map[string]GlobalType{"on": ValueType{Value: SingletonValue("int"), ValuePrefix: Prefix{P1: "Q", P2: "R", PChannel: "r"}, ValueNext: EndType{}},
+				"off": EndType{}}}}
+	forward, err := bad.Invoke(map[Participant]Participant{"P": "A", "Q": "B", "R": "C"}, map[Channel]Channel{"q": "b", "r": "c"}, EndType{})
+	if err != nil {
+		test.Fatal(err)
+	}
+	found := false
+	for _, d := range Check(forward) {
+		if d.Rule == ProjectionRule && d.Participant == "C" && len(d.Path) > 0 && d.Path[0] == (Step{Kind: InvokeStep, Name: "Forward"}) {
+			found = true
+		}
+	}
+	if !found {
+		test.Errorf("Expected C to be unprojectable inside of the invocation of Forward, got %v", Check(forward))
+	}
+
+	//Members of a family of roles are played by the same members of the family playing it
+	scatter := Protocol{Name: "Scatter", Roles: []Participant{"Coord", "Worker"}, Channels: []Channel{"w"},
+		Body: ForeachType{Index: "i", From: "1", To: "N",
+			Body: ValueType{Value: SingletonValue("int"), ValuePrefix: Prefix{P1: "Coord", P2: "Worker[i]", PChannel: "w[i]"}, ValueNext: EndType{}},
+			Next: EndType{}}}
+	family, err := scatter.Invoke(map[Participant]Participant{"Coord": "A", "Worker": "Node"}, map[Channel]Channel{"w": "k"}, EndType{})
+	if err != nil {
+		test.Fatal(err)
+	}
+	instantiated, err := Instantiate(family, map[string]int{"N": 2})
+	if err != nil {
+		test.Fatal(err)
+	}
+	expected = ValueType{Value: SingletonValue("int"), ValuePrefix: Prefix{P1: "A", P2: "Node[1]", PChannel: "k[1]"},
+		ValueNext: ValueType{Value: SingletonValue("int"), ValuePrefix: Prefix{P1: "A", P2: "Node[2]", PChannel: "k[2]"}, ValueNext: EndType{}}}
+	if !sequenceGlobal(instantiated, EndType{}).equals(expected) {
+		test.Errorf("Instantiated to %s, expected %s", instantiated, expected)
+	}
+
+	if _, err := vote.Invoke(map[Participant]Participant{"Coord": "A", "Voter": "A"}, map[Channel]Channel{"ask": "b", "answer": "a"}, EndType{}); err == nil {
+		test.Errorf("Invoked %s with A playing both roles", vote.Name)
+	}
+	if _, err := vote.Invoke(map[Participant]Participant{"Coord": "A"}, map[Channel]Channel{"ask": "b", "answer": "a"}, EndType{}); err == nil {
+		test.Errorf("Invoked %s without a voter", vote.Name)
+	}
+	jump := Protocol{Name: "Jump", Roles: []Participant{"P", "Q"}, Channels: []Channel{"q"},
+		Body: ValueType{Value: SingletonValue("int"), ValuePrefix: Prefix{P1: "P", P2: "Q", PChannel: "q"}, ValueNext: NameType("X")}}
+	if _, err := jump.Invoke(map[Participant]Participant{"P": "A", "Q": "B"}, map[Channel]Channel{"q": "b"}, EndType{}); err == nil {
+		test.Errorf("Invoked %s, which continues a loop it doesn't start", jump.Name)
+	}
+}
+
+func TestParallel(test *testing.T) {
+	//A asks B and C at the same time, and once both have been asked B answers
+	msg := func(from, to Participant, k Channel, sort Sort, next GlobalType) GlobalType {
+		return ValueType{Value: SingletonValue(sort), ValuePrefix: Prefix{P1: from, P2: to, PChannel: k}, ValueNext: next}
+	}
+	gt := MakeJoinedParallelType(msg("A", "B", "b", "int", EndType{}), msg("A", "C", "c", "int", EndType{}), msg("B", "A", "a", "bool", EndType{}))
+	if diagnostics := Check(gt); len(diagnostics) != 0 {
+		test.Errorf("Found problems with %s: %v", gt, diagnostics)
+	}
+
+	//A does both parts, and then what comes after the join
+	projA, err := gt.Project("A")
+	if err != nil {
+		test.Fatal(err)
+	}
+	expectedA := LocalParallelType{Left: LocalSendType{Channel: "b", Value: SingletonValue("int"), Next: LocalEndType{}},
+		Right: LocalSendType{Channel: "c", Value: SingletonValue("int"), Next: LocalEndType{}},
+		Next:  LocalReceiveType{Channel: "a", Value: SingletonValue("bool"), Next: LocalEndType{}}}
+	if !projA.Equals(expectedA) {
+		test.Errorf("Projected %s onto A, expected %s", projA, expectedA)
+	}
+	//B only does one of the parts, so just carries on after it
+	projB, err := gt.Project("B")
+	if err != nil {
+		test.Fatal(err)
+	}
+	expectedB := LocalReceiveType{Channel: "b", Value: SingletonValue("int"), Next: LocalSendType{Channel: "a", Value: SingletonValue("bool"), Next: LocalEndType{}}}
+	if !projB.Equals(expectedB) {
+		test.Errorf("Projected %s onto B, expected %s", projB, expectedB)
+	}
+	if !IsSubtype(expectedA, expectedA) || !expectedA.EquivalentTo(expectedA) {
+		test.Errorf("%s is not a subtype of itself", expectedA)
+	}
+	if IsSubtype(expectedA, expectedA.Next) {
+		test.Errorf("%s is a subtype of %s", expectedA, expectedA.Next)
+	}
+
+	data, err := MarshalGlobalType(gt)
+	if err != nil {
+		test.Fatal(err)
+	}
+	decoded, err := UnmarshalGlobalType(data)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if !decoded.equals(gt) {
+		test.Errorf("Decoded %s, expected %s", decoded, gt)
+	}
+	data, err = MarshalLocalType(expectedA)
+	if err != nil {
+		test.Fatal(err)
+	}
+	decodedLocal, err := UnmarshalLocalType(data)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if !decodedLocal.Equals(expectedA) {
+		test.Errorf("Decoded %s, expected %s", decodedLocal, expectedA)
+	}
+
+	//Before version 8, parallel types ended with their parts, and local types had none
+	old := `{"version": 7, "global": {"kind": "parallel", "parts": [{"kind": "end"}, {"kind": "end"}]}}`
+	decoded, err = UnmarshalGlobalType([]byte(old))
+	if err != nil {
+		test.Fatal(err)
+	}
+	if expected := MakeParallelType(EndType{}, EndType{}); !decoded.equals(expected) {
+		test.Errorf("Decoded %s, expected %s", decoded, expected)
+	}
+	parts := `"parts": [{"kind": "end"}, {"kind": "end"}]`
+	for _, doc := range []string{
+		`{"version": 7, "global": {"kind": "parallel", ` + parts + `, "next": {"kind": "end"}}}`,
+		`{"version": 7, "local": {"kind": "parallel", ` + parts + `, "next": {"kind": "end"}}}`,
+		`{"version": 8, "global": {"kind": "parallel", ` + parts + `}}`,
+		`{"version": 8, "local": {"kind": "parallel", ` + parts + `}}`,
+	} {
+		if _, err := UnmarshalGlobalType([]byte(doc)); err == nil {
+			test.Errorf("Decoding %s should fail", doc)
+		}
+		if _, err := UnmarshalLocalType([]byte(doc)); err == nil {
+			test.Errorf("Decoding %s should fail", doc)
+		}
+	}
+
+	//A can't continue a loop from inside of one part while still doing the other
+	leave := RecursiveType{Bind: "X", Body: MakeJoinedParallelType(msg("A", "B", "b", "int", NameType("X")), msg("A", "C", "c", "int", EndType{}), EndType{})}
+	if _, err := leave.Project("A"); err == nil {
+		test.Errorf("Projected %s onto A, which leaves a parallel block without joining it", leave)
+	}
+}
+
+func TestTraces(test *testing.T) {
+	//A keeps asking B for more until it's done
+	gt := RecursiveType{Bind: "X", Body: BranchingType{BranchPrefix: Prefix{P1: "A", P2: "B", PChannel: "k"},
+		Branches: map[string]GlobalType{
+			"more": ValueType{Value: SingletonValue("int"), ValuePrefix: Prefix{P1: "B", P2: "A", PChannel: "k"}, ValueNext: NameType("X")},
+			"done": EndType{}}}}
+	traces, err := Traces(gt, TraceOptions{MaxLoops: 2})
+	if err != nil {
+		test.Fatal(err)
+	}
+	expected := []string{
+		"A → B : k ⊕ done. end",
+		"A → B : k ⊕ more. B → A : k⟨int⟩. A → B : k ⊕ done. end",
+		"A → B : k ⊕ more. B → A : k⟨int⟩. A → B : k ⊕ more. B → A : k⟨int⟩. ...",
+	}
+	if len(traces) != len(expected) {
+		test.Fatalf("Expected %d traces, got %v", len(expected), traces)
+	}
+	for i, trace := range traces {
+		if trace.String() != expected[i] {
+			test.Errorf("Expected trace %s, got %s", expected[i], trace)
+		}
+	}
+	if traces, err := Traces(gt, TraceOptions{MaxSteps: 1}); err != nil || len(traces) != 2 || traces[1].Complete {
+		test.Errorf("Expected one complete and one cut short trace of a single step, got %v, %v", traces, err)
+	}
+	if _, err := Traces(gt, TraceOptions{}); err == nil {
+		test.Errorf("Enumerated the traces of %s without a limit", gt)
+	}
+
+	//The loop goes back to the state it started in
+	lts, err := NewLTS(gt)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if len(lts.States) != 3 || len(lts.Transitions) != 3 {
+		test.Errorf("Expected 3 states and 3 transitions, got %+v", lts)
+	}
+	for _, transition := range lts.Transitions {
+		if transition.Step.Kind == ValueMessage && transition.To != 0 {
+			test.Errorf("Expected %s to go back to the start, got %+v", transition.Step, transition)
+		}
+	}
+
+	//Each interleaving of a parallel block is a trace of its own
+	msg := func(from, to Participant, k Channel, next GlobalType) GlobalType {
+		return ValueType{Value: SingletonValue("int"), ValuePrefix: Prefix{P1: from, P2: to, PChannel: k}, ValueNext: next}
+	}
+	par := MakeJoinedParallelType(msg("A", "B", "b", EndType{}), msg("A", "C", "c", EndType{}), msg("B", "C", "c", EndType{}))
+	traces, err = Traces(par, TraceOptions{})
+	if err != nil {
+		test.Fatal(err)
+	}
+	if len(traces) != 2 || traces[0].String() != "A → B : b⟨int⟩. A → C : c⟨int⟩. B → C : c⟨int⟩. end" {
+		test.Errorf("Expected both interleavings of %s, got %v", par, traces)
+	}
+}
+
+func TestDelegation(test *testing.T) {
+	//B2 hands its endpoint in the session with the seller over to C, who finishes the purchase
+	rest := MakeProjectionType("B2", LocalSendType{Channel: "s", Value: SingletonValue("string"), Next: LocalEndType{}})
+	handOver := DelegationType{DelegationPrefix: Prefix{P1: "B2", P2: "C", PChannel: "c"}, Session: rest,
+		DelegationNext: ValueType{Value: SingletonValue("bool"), ValuePrefix: Prefix{P1: "C", P2: "B2", PChannel: "b2"}, ValueNext: EndType{}}}
+	if handOver.String() != "B2 → C : c⟨⟨(s!⟨string⟩; end)@B2⟩⟩. C → B2 : b2⟨bool⟩. end" {
+		test.Errorf("Printed %s", handOver)
+	}
+
+	delegator, err := handOver.Project("B2")
+	if err != nil {
+		test.Fatal(err)
+	}
+	expected := LocalDelegateType{Channel: "c", Session: rest,
+		Next: LocalReceiveType{Channel: "b2", Value: SingletonValue("bool"), Next: LocalEndType{}}}
+	if !delegator.Equals(expected) {
+		test.Errorf("Projected %s, expected %s", delegator, expected)
+	}
+	acceptor, err := handOver.Project("C")
+	if err != nil {
+		test.Fatal(err)
+	}
+	if _, ok := acceptor.(LocalAcceptType); !ok {
+		test.Errorf("Projected %s for the receiver of a delegation", acceptor)
+	}
+
+	data, err := MarshalGlobalType(handOver)
+	if err != nil {
+		test.Fatal(err)
+	}
+	decoded, err := UnmarshalGlobalType(data)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if !decoded.equals(handOver) {
+		test.Errorf("Decoded %s, expected %s", decoded, handOver)
+	}
+
+	//Whoever accepts must be able to stand in for B2, so accepting is covariant in the session
+	general := MakeProjectionType("B2", LocalSendType{Channel: "s", Value: SingletonValue("interface{}"), Next: LocalEndType{}})
+	acceptGeneral := LocalAcceptType{Channel: "c", Session: general, Next: LocalEndType{}}
+	acceptSpecific := LocalAcceptType{Channel: "c", Session: rest, Next: LocalEndType{}}
+	if !IsSubtype(acceptSpecific, acceptGeneral) || IsSubtype(acceptGeneral, acceptSpecific) {
+		test.Errorf("Wrong subtyping between accepted sessions")
+	}
+}
+
+func TestCheck(test *testing.T) {
+	//Example of section 4.2, Honda et al. (2008)
+	linearincoherent := BranchingType{
+		BranchPrefix: Prefix{P1: "A", P2: "B", PChannel: "k"},
+		Branches: map[string]GlobalType{
+			"ok": ValueType{Value: SingletonValue("bool"), ValuePrefix: Prefix{P1: "C", P2: "D", PChannel: "k'"},
+				ValueNext: EndType{}},
+			"quit": ValueType{Value: SingletonValue("nat"), ValuePrefix: Prefix{P1: "C", P2: "D", PChannel: "k'"},
+				ValueNext: EndType{}}}}
+
+	if !Linear(linearincoherent) {
+		test.Errorf("Incoherent but linear example should be linear")
+	}
+	diagnostics := Check(linearincoherent)
+	if len(diagnostics) != 2 || diagnostics[0].Rule != ProjectionRule || diagnostics[0].Participant != "C" {
+		test.Errorf("Expected projection onto C and D to fail, got %v", diagnostics)
+	}
+
+	//C's send to B on k can overtake A's, since nothing orders C's send after A's
+	nonlinear := ValueType{Value: SingletonValue("int"), ValuePrefix: Prefix{P1: "A", P2: "B", PChannel: "k"},
+		ValueNext: BranchingType{BranchPrefix: Prefix{P1: "B", P2: "A", PChannel: "j"},
+			Branches: map[string]GlobalType{
+				"go": ValueType{Value: SingletonValue("int"), ValuePrefix: Prefix{P1: "C", P2: "B", PChannel: "k"},
+					ValueNext: EndType{}},
+			}}}
+	diagnostics = Check(nonlinear)
+	found := false
+	for _, d := range diagnostics {
+		found = found || d.Rule == OutputDependencyRule && d.First == nonlinear.ValuePrefix && d.Second.P1 == "C" &&
+			len(d.Path) == 1 && d.Path[0] == (Step{Kind: BranchStep, Name: "go"})
+	}
+	if !found {
+		test.Errorf("Expected an output dependency error in branch go, got %v", diagnostics)
+	}
+}
+
+//Which protocols are linear depends on how strictly the II, IO and OO relations are read.
+//Following Honda et al. 2008, they only constrain participants, and each earlier prefix on a channel
+//needs a chain of them to the later one, so channels may be reused as long as the order is kept.
+func TestLinearVerdicts(test *testing.T) {
+	//Examples in section 3.2 of Honda et al. (2008)
+	simplestreaming := RecursiveType{Bind: "t", Body: ValueType{Value: SingletonValue("bool"), ValuePrefix: Prefix{P1: "DP", P2: "K", PChannel: "d"},
+		ValueNext: ValueType{Value: SingletonValue("bool"), ValuePrefix: Prefix{P1: "KP", P2: "K", PChannel: "k"},
+			ValueNext: ValueType{Value: SingletonValue("bool"), ValuePrefix: Prefix{P1: "K", P2: "C", PChannel: "c"},
+				ValueNext: NameType("t")}}}}
+
+	twobuyerprotocol := ValueType{Value: SingletonValue("bool"), ValuePrefix: Prefix{P1: "B1", P2: "S", PChannel: "s"},
+		ValueNext: ValueType{Value: SingletonValue("nat"), ValuePrefix: Prefix{P1: "S", P2: "B1", PChannel: "b1"},
+			ValueNext: ValueType{Value: SingletonValue("nat"), ValuePrefix: Prefix{P1: "S", P2: "B2", PChannel: "b2"},
+				ValueNext: ValueType{Value: SingletonValue("nat"), ValuePrefix: Prefix{P1: "B1", P2: "B2", PChannel: "b'2"},
+					ValueNext: BranchingType{BranchPrefix: Prefix{P1: "B2", P2: "S", PChannel: "s"},
+						Branches: map[string]GlobalType{
+							"ok": ValueType{Value: SingletonValue("bool"), ValuePrefix: Prefix{P1: "B2", P2: "S", PChannel: "s"},
+								ValueNext: ValueType{Value: SingletonValue("bool"), ValuePrefix: Prefix{P1: "S", P2: "B2", PChannel: "b2"},
+									ValueNext: EndType{}}},
+							"quit": EndType{}}}}}}}
+
+	msg := func(from, to Participant, k Channel, next GlobalType) GlobalType {
+		return ValueType{Value: SingletonValue("int"), ValuePrefix: Prefix{P1: from, P2: to, PChannel: k}, ValueNext: next}
+	}
+
+	cases := []struct {
+		name   string
+		gt     GlobalType
+		linear bool
+	}{
+		{"simple streaming", simplestreaming, true},
+		{"two buyer protocol", twobuyerprotocol, true},
+		{"ping-pong", RecursiveType{Bind: "X", Body: msg("A", "B", "b", msg("B", "A", "a", NameType("X")))}, true},
+		{"same sender twice", msg("A", "B", "k", msg("A", "B", "k", EndType{})), true},
+		{"different channels", msg("A", "B", "k", msg("B", "C", "j", EndType{})), true},
+		//C's send can overtake A's, since nothing orders it after A's
+		{"overtaking sender", msg("A", "B", "k", msg("C", "B", "k", EndType{})), false},
+	}
+	for _, c := range cases {
+		if Linear(c.gt) != c.linear {
+			test.Errorf("%s should be linear: %t, got %v", c.name, c.linear, Check(c.gt))
+		}
+	}
+}
+
+func TestMergeProjection(test *testing.T) {
+	//The auctioneer A tells the bidder B whether its bid was accepted,
+	//and only later tells the observer C the outcome
+	tell := func(label string) GlobalType {
+		return BranchingType{BranchPrefix: Prefix{P1: "A", P2: "C", PChannel: "c"},
+			Branches: map[string]GlobalType{label: ValueType{Value: SingletonValue("int"), ValuePrefix: Prefix{P1: "A", P2: "C", PChannel: "c"}, ValueNext: EndType{}}}}
+	}
+	auction := BranchingType{BranchPrefix: Prefix{P1: "A", P2: "B", PChannel: "b"},
+		Branches: map[string]GlobalType{
+			"accept": tell("won"),
+			"reject": tell("lost"),
+		}}
+
+	local, err := auction.Project("C")
+	if err != nil {
+		test.Fatal(err)
+	}
+	price := LocalReceiveType{Channel: "c", Value: SingletonValue("int"), Next: LocalEndType{}}
+	expected := LocalBranchingType{Channel: "c", Branches: map[string]LocalType{"won": price, "lost": price}}
+	if !reflect.DeepEqual(local, expected) {
+		test.Errorf("Projected %s, expected %s", local, expected)
+	}
+
+	//If C is never told the outcome, but acts differently, projection fails
+	untold := BranchingType{BranchPrefix: Prefix{P1: "A", P2: "B", PChannel: "b"},
+		Branches: map[string]GlobalType{
+			"accept": ValueType{Value: SingletonValue("int"), ValuePrefix: Prefix{P1: "A", P2: "C", PChannel: "c"}, ValueNext: EndType{}},
+			"reject": ValueType{Value: SingletonValue("string"), ValuePrefix: Prefix{P1: "A", P2: "C", PChannel: "c"}, ValueNext: EndType{}},
+		}}
+	if _, err := untold.Project("C"); err == nil {
+		test.Errorf("Projection onto C should fail")
+	}
+
+	//Loops merge whatever they are named, without capturing the variables of outer loops
+	listen := func(bind LocalNameType, label string, next LocalType) LocalType {
+		return LocalRecursiveType{Bind: bind, Body: LocalBranchingType{Channel: "c", Branches: map[string]LocalType{label: next}}}
+	}
+	both := func(bind LocalNameType, lost LocalType) LocalType {
+		return LocalRecursiveType{Bind: bind, Body: LocalBranchingType{Channel: "c",
+			Branches: map[string]LocalType{"won": bind, "lost": lost}}}
+	}
+	cases := []struct {
+		a, b, merged LocalType
+	}{
+		{listen("X", "won", LocalNameType("X")), listen("Y", "lost", LocalNameType("Y")), both("X", LocalNameType("X"))},
+		{listen("X", "won", LocalNameType("X")), listen("Y", "lost", LocalNameType("X")), both("Z", LocalNameType("X"))},
+	}
+	for _, c := range cases {
+		merged, err := Merge(c.a, c.b)
+		if err != nil || !AlphaEquivalent(merged, c.merged) {
+			test.Errorf("Merged %s and %s to %v, expected %s: %v", c.a, c.b, merged, c.merged, err)
+		}
+	}
+}
+
+func TestEquivalence(test *testing.T) {
+	loop := LocalRecursiveType{Bind: "X", Body: LocalSendType{Channel: "k", Value: SingletonValue("int"), Next: LocalNameType("X")}}
+	unfolded := LocalSendType{Channel: "k", Value: SingletonValue("int"), Next: loop}
+	renamed := LocalRecursiveType{Bind: "Y", Body: LocalSendType{Channel: "k", Value: SingletonValue("int"), Next: LocalNameType("Y")}}
+	other := LocalRecursiveType{Bind: "X", Body: LocalSendType{Channel: "k", Value: SingletonValue("string"), Next: LocalNameType("X")}}
+
+	if loop.Equals(unfolded) || loop.Equals(renamed) {
+		test.Errorf("Equals should be syntactic")
+	}
+	if !loop.EquivalentTo(unfolded) || !unfolded.EquivalentTo(loop) {
+		test.Errorf("%s should be equivalent to its unfolding %s", loop, unfolded)
+	}
+	if !loop.EquivalentTo(renamed) {
+		test.Errorf("%s should be equivalent to %s", loop, renamed)
+	}
+	if loop.EquivalentTo(other) {
+		test.Errorf("%s should not be equivalent to %s", loop, other)
+	}
+
+	//C does the same thing in both branches, but the loops are written differently
+	stream := func(bind string) GlobalType {
+		return RecursiveType{Bind: NameType(bind), Body: ValueType{Value: SingletonValue("int"),
+			ValuePrefix: Prefix{P1: "A", P2: "C", PChannel: "c"}, ValueNext: NameType(bind)}}
+	}
+	choice := BranchingType{BranchPrefix: Prefix{P1: "A", P2: "B", PChannel: "b"},
+		Branches: map[string]GlobalType{"left": stream("X"), "right": stream("Y")}}
+	if _, err := choice.Project("C"); err != nil {
+		test.Errorf("Projection onto C should succeed, got %v", err)
+	}
+}
+
+func TestCheckChoices(test *testing.T) {
+	send := func(p1, p2 Participant, k Channel, next GlobalType) GlobalType {
+		return ValueType{Value: SingletonValue("int"), ValuePrefix: Prefix{P1: p1, P2: p2, PChannel: k}, ValueNext: next}
+	}
+	tell := func(p1, p2 Participant, k Channel, label string, next GlobalType) GlobalType {
+		return BranchingType{BranchPrefix: Prefix{P1: p1, P2: p2, PChannel: k}, Branches: map[string]GlobalType{label: next}}
+	}
+
+	//B tells C which branch A chose before C acts
+	good := BranchingType{BranchPrefix: Prefix{P1: "A", P2: "B", PChannel: "b"},
+		Branches: map[string]GlobalType{
+			"left":  tell("B", "C", "c", "left", send("C", "A", "a", EndType{})),
+			"right": tell("B", "C", "c", "right", EndType{}),
+		}}
+	if diagnostics := CheckChoices(good); len(diagnostics) != 0 {
+		test.Errorf("Expected no problems, got %v", diagnostics)
+	}
+
+	//C acts in one branch, and does nothing in the other
+	bad := BranchingType{BranchPrefix: Prefix{P1: "A", P2: "B", PChannel: "b"},
+		Branches: map[string]GlobalType{
+			"left":  send("C", "A", "a", EndType{}),
+			"right": send("B", "A", "a", EndType{}),
+		}}
+	diagnostics := CheckChoices(bad)
+	if len(diagnostics) != 1 || diagnostics[0].Participant != "C" ||
+		!reflect.DeepEqual(diagnostics[0].Labels, []string{"left", "right"}) {
+		test.Errorf("Expected C to lack knowledge of the choice, got %v", diagnostics)
+	}
+}
+
+func TestSubtype(test *testing.T) {
+	loop := LocalRecursiveType{Bind: "X", Body: LocalSelectionType{Channel: "k", Branches: map[string]LocalType{
+		"more": LocalSendType{Channel: "k", Value: SingletonValue("int"), Next: LocalNameType("X")},
+		"done": LocalEndType{},
+	}}}
+	//Only ever selects "more", and unfolds the loop once
+	fewer := LocalSelectionType{Channel: "k", Branches: map[string]LocalType{
+		"more": LocalSendType{Channel: "k", Value: SingletonValue("int"), Next: LocalRecursiveType{Bind: "Y",
+			Body: LocalSelectionType{Channel: "k", Branches: map[string]LocalType{
+				"more": LocalSendType{Channel: "k", Value: SingletonValue("int"), Next: LocalNameType("Y")},
+			}}}},
+	}}
+	if err := CheckSubtype(fewer, loop); err != nil {
+		test.Errorf("Selecting fewer labels should be a subtype: %v", err)
+	}
+	if IsSubtype(loop, fewer) {
+		test.Errorf("Selecting more labels should not be a subtype")
+	}
+
+	offer := func(labels ...string) LocalType {
+		branches := make(map[string]LocalType)
+		for _, label := range labels {
+			branches[label] = LocalReceiveType{Channel: "j", Value: SingletonValue("string"), Next: LocalEndType{}}
+		}
+		return LocalBranchingType{Channel: "k", Branches: branches}
+	}
+	if !IsSubtype(offer("a", "b"), offer("a")) || IsSubtype(offer("a"), offer("a", "b")) {
+		test.Errorf("Offering more labels should be a subtype, and not the other way around")
+	}
+
+	receiveAny := LocalReceiveType{Channel: "k", Value: SingletonValue("interface{}"), Next: LocalEndType{}}
+	receiveInt := LocalReceiveType{Channel: "k", Value: SingletonValue("int"), Next: LocalEndType{}}
+	if !IsSubtype(receiveAny, receiveInt) || IsSubtype(receiveInt, receiveAny) {
+		test.Errorf("Receives should be contravariant in their sort")
+	}
+}
+
+func TestAsyncSubtype(test *testing.T) {
+	send := func(k Channel, next LocalType) LocalType {
+		return LocalSendType{Channel: k, Value: SingletonValue("int"), Next: next}
+	}
+	recv := func(k Channel, next LocalType) LocalType {
+		return LocalReceiveType{Channel: k, Value: SingletonValue("int"), Next: next}
+	}
+
+	//Two requests and replies, either one at a time, or pipelined
+	oneAtATime := send("k", recv("j", send("k", recv("j", LocalEndType{}))))
+	pipelined := send("k", send("k", recv("j", recv("j", LocalEndType{}))))
+
+	if result := CheckAsyncSubtype(pipelined, oneAtATime, AsyncOptions{Bound: 1}); !result.Subtype {
+		test.Errorf("Pipelining should be an asynchronous subtype: %s", result)
+	}
+	if result := CheckAsyncSubtype(pipelined, oneAtATime, AsyncOptions{Bound: 0}); result.Subtype || !result.Undecided {
+		test.Errorf("With a bound of 0, pipelining should be undecided: %s", result)
+	}
+	result := CheckAsyncSubtype(oneAtATime, pipelined, AsyncOptions{Bound: DefaultAsyncBound})
+	if result.Subtype || result.Undecided || len(result.Counterexample) != 1 || result.Counterexample[0].Kind != SendAction {
+		test.Errorf("Receiving before sending should not be a subtype of sending first: %s", result)
+	}
+
+	//Sending ahead in every iteration of a loop
+	server := LocalRecursiveType{Bind: "X", Body: recv("j", send("k", LocalNameType("X")))}
+	eager := LocalRecursiveType{Bind: "Y", Body: send("k", recv("j", LocalNameType("Y")))}
+	if result := CheckAsyncSubtype(eager, server, AsyncOptions{Bound: 1}); !result.Subtype {
+		test.Errorf("Sending ahead in a loop should be an asynchronous subtype: %s", result)
+	}
+}
+
+func TestSubstitute(test *testing.T) {
+	//Substituting into a choice must not change the original, which may be shared
+	choice := LocalSelectionType{Channel: "k", Branches: map[string]LocalType{
+		"more": LocalSendType{Channel: "k", Value: SingletonValue("int"), Next: LocalNameType("X")},
+		"stop": LocalEndType{},
+	}}
+	loop := LocalRecursiveType{Bind: "X", Body: choice}
+	unfolded := loop.UnfoldOneLevel()
+	if !reflect.DeepEqual(choice.Branches["more"], LocalSendType{Channel: "k", Value: SingletonValue("int"), Next: LocalNameType("X")}) {
+		test.Errorf("Unfolding changed the original type to %s", loop)
+	}
+	if !unfolded.EquivalentTo(loop) {
+		test.Errorf("Unfolded %s to %s", loop, unfolded)
+	}
+
+	//Names which don't match are left alone
+	if got := LocalNameType("Y").Substitute("X", LocalEndType{}); got != LocalNameType("Y") {
+		test.Errorf("Substituting X in Y gave %s", got)
+	}
+
+	//The free Y being substituted in must not be captured by the binder Y
+	inner := LocalRecursiveType{Bind: "Y", Body: LocalSendType{Channel: "k", Value: SingletonValue("int"), Next: LocalNameType("X")}}
+	got := inner.Substitute("X", LocalNameType("Y"))
+	expected := LocalRecursiveType{Bind: "Z", Body: LocalSendType{Channel: "k", Value: SingletonValue("int"), Next: LocalNameType("Y")}}
+	if !AlphaEquivalent(got, expected) {
+		test.Errorf("Substituted to %s, expected %s", got, expected)
+	}
+	if free := FreeVariables(got); !reflect.DeepEqual(free, []LocalNameType{"Y"}) {
+		test.Errorf("Free variables of %s are %v", got, free)
+	}
+
+	renamed := LocalRecursiveType{Bind: "Z", Body: LocalSelectionType{Channel: "k", Branches: map[string]LocalType{
+		"more": LocalSendType{Channel: "k", Value: SingletonValue("int"), Next: LocalNameType("Z")},
+		"stop": LocalEndType{},
+	}}}
+	if !AlphaEquivalent(loop, renamed) {
+		test.Errorf("%s should be alpha-equivalent to %s", loop, renamed)
+	}
+	if AlphaEquivalent(loop, unfolded) {
+		test.Errorf("%s should not be alpha-equivalent to its unfolding", loop)
+	}
+}
+
+func TestDiff(test *testing.T) {
+	protocol := func(client Participant, sort Sort, labels ...string) GlobalType {
+		branches := make(map[string]GlobalType)
+		for _, label := range labels {
+			branches[label] = EndType{}
+		}
+		return ValueType{Value: SingletonValue(sort), ValuePrefix: Prefix{P1: client, P2: "S", PChannel: "k"},
+			ValueNext: BranchingType{BranchPrefix: Prefix{P1: "S", P2: client, PChannel: "r"}, Branches: branches}}
+	}
+
+	//The server may now ask the client to retry, and the client was renamed
+	diff := Diff(protocol("A", "int", "ok"), protocol("C", "int", "ok", "retry"))
+	expectedChanges := []Change{
+		{Kind: BranchAdded, New: "retry", Path: []Step{}},
+		{Kind: ParticipantRenamed, Old: "A", New: "C"},
+	}
+	if !reflect.DeepEqual(diff.Changes, expectedChanges) {
+		test.Errorf("Found changes %v, expected %v", diff.Changes, expectedChanges)
+	}
+	if len(diff.Roles) != 2 || diff.Roles[0].Participant != "A" || diff.Roles[0].RenamedTo != "C" ||
+		diff.Roles[0].Compatible || !diff.Roles[1].Compatible {
+		test.Errorf("Found roles %v, expected only the old client to be incompatible", diff.Roles)
+	}
+	if diff.Compatible() {
+		test.Errorf("The new version should not be compatible")
+	}
+
+	//A deployed server may still select the label which was removed
+	diff = Diff(protocol("A", "int", "ok", "retry"), protocol("A", "int", "ok"))
+	if diff.Compatible() || !diff.Roles[0].Compatible || diff.Roles[1].Compatible {
+		test.Errorf("Removing a branch should only break the server, got\n%s", diff)
+	}
+
+	//Renaming alone is compatible
+	diff = Diff(protocol("A", "int", "ok"), protocol("C", "int", "ok"))
+	if !diff.Compatible() {
+		test.Errorf("Renaming should be compatible, got\n%s", diff)
+	}
+
+	diff = Diff(protocol("A", "int", "ok"), protocol("A", "string", "ok"))
+	if len(diff.Changes) != 1 || diff.Changes[0].Kind != SortChanged || diff.Compatible() {
+		test.Errorf("Expected an incompatible sort change, got\n%s", diff)
+	}
+}
@@ -0,0 +1,126 @@
+package multiparty
+
+//Do Left and Right at the same time, in any interleaving,
+//and once both are done carry on with Next
+type LocalParallelType struct {
+	Left, Right LocalType
+	Next        LocalType
+}
+
+func (t LocalParallelType) Substitute(u LocalNameType, tsub LocalType) LocalType {
+	return LocalParallelType{Left: t.Left.Substitute(u, tsub), Right: t.Right.Substitute(u, tsub), Next: t.Next.Substitute(u, tsub)}
+}
+
+func (t LocalParallelType) EquivalentTo(l LocalType) bool {
+	return equivalent(t, l)
+}
+
+func (t LocalParallelType) Equals(l LocalType) bool {
+	switch l.(type) {
+	case LocalParallelType:
+		lt := l.(LocalParallelType)
+		return t.Left.Equals(lt.Left) && t.Right.Equals(lt.Right) && t.Next.Equals(lt.Next)
+	}
+	return false
+}
+
+//Put next in place of the end of lt, for a participant which does one part of a parallel type
+//and then what comes after it. Loops of lt which would capture the variables of next are renamed.
+func sequenceLocal(lt LocalType, next LocalType) LocalType {
+	if _, ok := next.(LocalEndType); ok {
+		return lt
+	}
+	switch t := lt.(type) {
+	case LocalSendType:
+		t.Next = sequenceLocal(t.Next, next)
+		return t
+	case LocalReceiveType:
+		t.Next = sequenceLocal(t.Next, next)
+		return t
+	case LocalDelegateType:
+		t.Next = sequenceLocal(t.Next, next)
+		return t
+	case LocalAcceptType:
+		t.Next = sequenceLocal(t.Next, next)
+		return t
+	case LocalSelectionType:
+		return LocalSelectionType{Channel: t.Channel, Branches: sequenceBranches(t.Branches, next)}
+	case LocalBranchingType:
+		return LocalBranchingType{Channel: t.Channel, Branches: sequenceBranches(t.Branches, next)}
+	case LocalRecursiveType:
+		free := localFreeVariables(next)
+		if !free[t.Bind] {
+			return LocalRecursiveType{Bind: t.Bind, Body: sequenceLocal(t.Body, next)}
+		}
+		avoid := localFreeVariables(t.Body)
+		for name := range free {
+			avoid[name] = true
+		}
+		fresh := freshName(t.Bind, avoid)
+		return LocalRecursiveType{Bind: fresh, Body: sequenceLocal(t.Body.Substitute(t.Bind, fresh), next)}
+	case LocalDeadlineType:
+		t.Next = sequenceLocal(t.Next, next)
+		return t
+	case LocalInterruptibleType:
+		t.Next = sequenceLocal(t.Next, next)
+		return t
+	case LocalParallelType:
+		t.Next = sequenceLocal(t.Next, next)
+		return t
+	case LocalEndType:
+		return next
+	case ProjectionType:
+		return MakeProjectionType(t.participant, sequenceLocal(t.T, next))
+	}
+	return lt
+}
+
+//Whether lt does the parts of a parallel type at some point
+func forks(lt LocalType) bool {
+	switch t := lt.(type) {
+	case LocalSendType:
+		return forks(t.Next)
+	case LocalReceiveType:
+		return forks(t.Next)
+	case LocalDelegateType:
+		return forks(t.Next)
+	case LocalAcceptType:
+		return forks(t.Next)
+	case LocalSelectionType:
+		for _, branch := range t.Branches {
+			if forks(branch) {
+				return true
+			}
+		}
+	case LocalBranchingType:
+		for _, branch := range t.Branches {
+			if forks(branch) {
+				return true
+			}
+		}
+	case LocalRecursiveType:
+		return forks(t.Body)
+	case LocalDeadlineType:
+		return forks(t.Body) || forks(t.Next)
+	case LocalInterruptibleType:
+		for _, interrupt := range t.Interrupts {
+			if forks(interrupt.Then) {
+				return true
+			}
+		}
+		return forks(t.Body) || forks(t.Next)
+	case LocalParallelType:
+		return true
+	case ProjectionType:
+		return forks(t.T)
+	}
+	return false
+}
+
+func sequenceBranches(branches map[string]LocalType, next LocalType) map[string]LocalType {
+	ans := make(map[string]LocalType, len(branches))
+	for label, branch := range branches {
+		ans[label] = sequenceLocal(branch, next)
+	}
+	return ans
+}
@@ -0,0 +1,299 @@
+package multiparty
+
+import (
+	"fmt"
+	"strings"
+)
+
+//A protocol written once, to be invoked from others like a subroutine, e.g. the vote of a commit protocol.
+//Roles are the participants of Body, and Channels its channels, each of which is
+//played by a participant or channel of the invoking protocol.
+type Protocol struct {
+	Name     string
+	Roles    []Participant
+	Channels []Channel
+	Body     GlobalType
+}
+
+//A protocol must say which roles and channels it uses,
+//so that invoking it can't do anything the invoker didn't ask for.
+//A member of a family, like Voter[i], is played by the same member of the family playing Voter.
+func (p Protocol) check() error {
+	if !p.Body.isWellFormed() {
+		return fmt.Errorf("protocol %s is not well formed", p.Name)
+	}
+	for _, role := range p.Body.Participants() {
+		if name, _ := Family(string(role)); !ContainsParticipant(Participant(name), p.Roles) {
+			return fmt.Errorf("protocol %s uses %s, which is not one of its roles", p.Name, role)
+		}
+	}
+	for _, channel := range p.Body.channels() {
+		if name, _ := Family(string(channel)); !ContainsChannel(Channel(name), p.Channels) {
+			return fmt.Errorf("protocol %s uses channel %s, which is not one of its channels", p.Name, channel)
+		}
+	}
+	return nil
+}
+
+//Whether c is one of the channels in slice
+func ContainsChannel(c Channel, slice []Channel) bool {
+	for _, other := range slice {
+		if c == other {
+			return true
+		}
+	}
+	return false
+}
+
+//The family of a member like Worker[i+1], which is Worker, and its index, which is [i+1].
+//Anything else is a family of its own, with no index.
+func Family(name string) (string, string) {
+	if i := strings.Index(name, "["); i > 0 {
+		return name[:i], name[i:]
+	}
+	return name, ""
+}
+
+//Invoke p, with each of its roles and channels played by the given ones, then carry on with next.
+//Each role and channel must be given, and different roles by different participants,
+//so that the invocation does the same interactions as p, between the participants playing its roles.
+//The body of p may have families of roles, whose members are played by the same members of the families
+//playing them, and whose bounds use the same parameters as the invoker.
+//The result is an InvocationType, which is checked and projected the same as the body of p,
+//with the roles and channels replaced, followed by next.
+func (p Protocol) Invoke(roles map[Participant]Participant, channels map[Channel]Channel, next GlobalType) (GlobalType, error) {
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+	players := make(map[Participant]Participant)
+	for _, role := range p.Roles {
+		player, ok := roles[role]
+		if !ok {
+			return nil, fmt.Errorf("invoking %s without saying who plays %s", p.Name, role)
+		}
+		if other, taken := players[player]; taken {
+			return nil, fmt.Errorf("invoking %s with %s playing both %s and %s", p.Name, player, other, role)
+		}
+		players[player] = role
+	}
+	for role := range roles {
+		if !ContainsParticipant(role, p.Roles) {
+			return nil, fmt.Errorf("invoking %s with a player for %s, which is not one of its roles", p.Name, role)
+		}
+	}
+	for _, channel := range p.Channels {
+		if _, ok := channels[channel]; !ok {
+			return nil, fmt.Errorf("invoking %s without saying which channel is %s", p.Name, channel)
+		}
+	}
+	for channel := range channels {
+		if !ContainsChannel(channel, p.Channels) {
+			return nil, fmt.Errorf("invoking %s with channel %s, which is not one of its channels", p.Name, channel)
+		}
+	}
+	body, err := invoke(p.Body, roles, channels, make(map[NameType]bool))
+	if err != nil {
+		return nil, fmt.Errorf("invoking %s: %v", p.Name, err)
+	}
+	return InvocationType{Protocol: p.Name, Body: body, Next: next}, nil
+}
+
+func invokePrefix(prefix Prefix, roles map[Participant]Participant, channels map[Channel]Channel) Prefix {
+	p1, i1 := Family(string(prefix.P1))
+	p2, i2 := Family(string(prefix.P2))
+	c, ic := Family(string(prefix.PChannel))
+	return Prefix{P1: roles[Participant(p1)] + Participant(i1), P2: roles[Participant(p2)] + Participant(i2),
+		PChannel: channels[Channel(c)] + Channel(ic)}
+}
+
+//The names of the loops gt starts or continues
+func loopNames(gt GlobalType, ans map[LocalNameType]bool) {
+	switch t := gt.(type) {
+	case ValueType:
+		loopNames(t.ValueNext, ans)
+	case DelegationType:
+		loopNames(t.DelegationNext, ans)
+	case BranchingType:
+		for _, branch := range t.Branches {
+			loopNames(branch, ans)
+		}
+	case ParallelType:
+		loopNames(t.a, ans)
+		loopNames(t.b, ans)
+		loopNames(t.next, ans)
+	case RecursiveType:
+		ans[LocalNameType(t.Bind)] = true
+		loopNames(t.Body, ans)
+	case ForeachType:
+		loopNames(t.Body, ans)
+		loopNames(t.Next, ans)
+	case DeadlineType:
+		loopNames(t.Body, ans)
+		loopNames(t.Next, ans)
+	case InvocationType:
+		loopNames(t.Body, ans)
+		loopNames(t.Next, ans)
+	case InterruptibleType:
+		loopNames(t.Body, ans)
+		for _, interrupt := range t.Interrupts {
+			loopNames(interrupt.Then, ans)
+		}
+		loopNames(t.Next, ans)
+	case NameType:
+		ans[LocalNameType(t)] = true
+	}
+}
+
+//Replace the roles and channels of gt.
+//bound has the loops gt is inside of, any other loop would be one of the invoker's.
+func invoke(gt GlobalType, roles map[Participant]Participant, channels map[Channel]Channel, bound map[NameType]bool) (GlobalType, error) {
+	switch t := gt.(type) {
+	case ValueType:
+		valueNext, err := invoke(t.ValueNext, roles, channels, bound)
+		if err != nil {
+			return nil, err
+		}
+		return ValueType{ValuePrefix: invokePrefix(t.ValuePrefix, roles, channels), Value: t.Value, Refinement: t.Refinement, ValueNext: valueNext}, nil
+	case DelegationType:
+		//The delegated session is a different one, with its own participants
+		delegationNext, err := invoke(t.DelegationNext, roles, channels, bound)
+		if err != nil {
+			return nil, err
+		}
+		return DelegationType{DelegationPrefix: invokePrefix(t.DelegationPrefix, roles, channels), Session: t.Session, DelegationNext: delegationNext}, nil
+	case BranchingType:
+		branches := make(map[string]GlobalType)
+		for label, branch := range t.Branches {
+			var err error
+			if branches[label], err = invoke(branch, roles, channels, bound); err != nil {
+				return nil, err
+			}
+		}
+		return BranchingType{BranchPrefix: invokePrefix(t.BranchPrefix, roles, channels), Branches: branches}, nil
+	case ParallelType:
+		a, err := invoke(t.a, roles, channels, bound)
+		if err != nil {
+			return nil, err
+		}
+		b, err := invoke(t.b, roles, channels, bound)
+		if err != nil {
+			return nil, err
+		}
+		parallelNext, err := invoke(t.next, roles, channels, bound)
+		if err != nil {
+			return nil, err
+		}
+		return ParallelType{a, b, parallelNext}, nil
+	case RecursiveType:
+		inner := map[NameType]bool{t.Bind: true}
+		for name := range bound {
+			inner[name] = true
+		}
+		body, err := invoke(t.Body, roles, channels, inner)
+		if err != nil {
+			return nil, err
+		}
+		return RecursiveType{Bind: t.Bind, Body: body}, nil
+	case DeadlineType:
+		body, err := invoke(t.Body, roles, channels, bound)
+		if err != nil {
+			return nil, err
+		}
+		deadlineNext, err := invoke(t.Next, roles, channels, bound)
+		if err != nil {
+			return nil, err
+		}
+		return DeadlineType{Within: t.Within, Body: body, Next: deadlineNext}, nil
+	case InterruptibleType:
+		body, err := invoke(t.Body, roles, channels, bound)
+		if err != nil {
+			return nil, err
+		}
+		interrupts := make([]Interrupt, len(t.Interrupts))
+		for i, interrupt := range t.Interrupts {
+			notify := make([]Prefix, len(interrupt.Notify))
+			for j, prefix := range interrupt.Notify {
+				notify[j] = invokePrefix(prefix, roles, channels)
+			}
+			then, err := invoke(interrupt.Then, roles, channels, bound)
+			if err != nil {
+				return nil, err
+			}
+			interrupts[i] = Interrupt{Label: interrupt.Label, Notify: notify, Then: then}
+		}
+		interruptibleNext, err := invoke(t.Next, roles, channels, bound)
+		if err != nil {
+			return nil, err
+		}
+		return InterruptibleType{Body: body, Interrupts: interrupts, Next: interruptibleNext}, nil
+	case ForeachType:
+		body, err := invoke(t.Body, roles, channels, bound)
+		if err != nil {
+			return nil, err
+		}
+		foreachNext, err := invoke(t.Next, roles, channels, bound)
+		if err != nil {
+			return nil, err
+		}
+		return ForeachType{Index: t.Index, From: t.From, To: t.To, Body: body, Next: foreachNext}, nil
+	case InvocationType:
+		body, err := invoke(t.Body, roles, channels, bound)
+		if err != nil {
+			return nil, err
+		}
+		invocationNext, err := invoke(t.Next, roles, channels, bound)
+		if err != nil {
+			return nil, err
+		}
+		return InvocationType{Protocol: t.Protocol, Body: body, Next: invocationNext}, nil
+	case NameType:
+		if !bound[t] {
+			return nil, fmt.Errorf("it continues loop %s, which it doesn't start", t)
+		}
+		return t, nil
+	case EndType:
+		return t, nil
+	}
+	return nil, fmt.Errorf("cannot invoke global type %T", gt)
+}
+
+//An invocation of a protocol: Body is the body of the protocol, with the roles and channels
+//of the invoker, and Next is what the invoker does afterwards.
+//It does the same interactions as Body followed by Next, and keeps the name of the protocol
+//so that diagnostics can say which invocation they are in.
+type InvocationType struct {
+	Protocol string
+	Body     GlobalType
+	Next     GlobalType
+}
+
+func (t InvocationType) isWellFormed() bool {
+	return t.Body.isWellFormed() && t.Next.isWellFormed()
+}
+
+func (t InvocationType) Prefixes() [][]Prefix {
+	return sequenceGlobal(t.Body, t.Next).Prefixes()
+}
+
+func (t InvocationType) Participants() []Participant {
+	return append(t.Body.Participants(), t.Next.Participants()...)
+}
+
+func (t InvocationType) channels() ChannelSet {
+	return append(t.Body.channels(), t.Next.channels()...)
+}
+
+//Each participant does its part of the invocation in place,
+//so its local type is the same as if the body were written out
+func (t InvocationType) Project(p Participant) (LocalType, error) {
+	return sequenceGlobal(t.Body, t.Next).Project(p)
+}
+
+func (t InvocationType) equals(g GlobalType) bool {
+	switch g.(type) {
+	case InvocationType:
+		gt := g.(InvocationType)
+		return t.Protocol == gt.Protocol && t.Body.equals(gt.Body) && t.Next.equals(gt.Next)
+	}
+	return false
+}
@@ -0,0 +1,433 @@
+package multiparty
+
+import (
+	"fmt"
+	"go/ast"
+	"go/constant"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"reflect"
+	"strings"
+)
+
+//A named condition on the values of a message, such as positive: amount > 0.
+//Each value of the message is bound to the variable in Vars at the same position,
+//unless that variable is empty, which leaves the value unnamed,
+//and Expr is a Go expression over those variables, and over any variables bound by
+//earlier messages sent or received by the same participant.
+//An empty Expr always holds, which is useful for naming values to refer to later.
+type Refinement struct {
+	Name string
+	Vars []string
+	Expr string
+}
+
+//Make a refinement, checking that its expression can be parsed
+func NewRefinement(name string, expr string, vars ...string) (Refinement, error) {
+	r := Refinement{Name: name, Vars: vars, Expr: expr}
+	if expr != "" {
+		if _, err := parser.ParseExpr(expr); err != nil {
+			return r, fmt.Errorf("refinement %s: %v", name, err)
+		}
+	}
+	return r, nil
+}
+
+func (r Refinement) String() string {
+	if r.Name == "" {
+		return r.Expr
+	}
+	return r.Name + ": " + r.Expr
+}
+
+//Check that the refinement fits a message with the given sorts
+func (r Refinement) check(sorts []Sort) error {
+	if len(r.Vars) != len(sorts) {
+		return fmt.Errorf("refinement %s names %d values, but the message has %d", r, len(r.Vars), len(sorts))
+	}
+	if r.Expr != "" {
+		if _, err := parser.ParseExpr(r.Expr); err != nil {
+			return fmt.Errorf("refinement %s: %v", r, err)
+		}
+	}
+	return nil
+}
+
+func refinementsEqual(a, b *Refinement) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Name == b.Name && a.Expr == b.Expr && strings.Join(a.Vars, ",") == strings.Join(b.Vars, ",")
+}
+
+//RefinementImplies reports whether every message satisfying a also satisfies b, where nil is no condition.
+//We can't decide this for arbitrary expressions, so it only holds if b has no condition,
+//or both have the same condition over the same variables.
+func RefinementImplies(a, b *Refinement) bool {
+	if b == nil || b.Expr == "" {
+		return true
+	}
+	return a != nil && a.Expr == b.Expr && strings.Join(a.Vars, ",") == strings.Join(b.Vars, ",")
+}
+
+//Describe a refinement which may be missing, for reporting changes
+func formatRefinement(r *Refinement) string {
+	if r == nil || r.Expr == "" {
+		return "none"
+	}
+	return r.String()
+}
+
+//The variables an expression refers to, in the order they first appear
+func expressionVariables(expr ast.Expr, names *[]string) {
+	switch t := expr.(type) {
+	case *ast.ParenExpr:
+		expressionVariables(t.X, names)
+	case *ast.Ident:
+		if t.Name == "true" || t.Name == "false" {
+			return
+		}
+		for _, name := range *names {
+			if name == t.Name {
+				return
+			}
+		}
+		*names = append(*names, t.Name)
+	case *ast.SelectorExpr:
+		expressionVariables(t.X, names)
+	case *ast.CallExpr:
+		//The function is always len, which isn't a variable
+		for _, arg := range t.Args {
+			expressionVariables(arg, names)
+		}
+	case *ast.UnaryExpr:
+		expressionVariables(t.X, names)
+	case *ast.BinaryExpr:
+		expressionVariables(t.X, names)
+		expressionVariables(t.Y, names)
+	}
+}
+
+//CheckRefinements finds conditions on messages which can't be checked: either they don't
+//name each value of their message, or the sender or receiver doesn't know a variable they use.
+func CheckRefinements(gt GlobalType) []Diagnostic {
+	diagnostics := make([]Diagnostic, 0)
+	checkRefinements(gt, make(map[Participant]map[string]bool), make([]Step, 0, 0), &diagnostics)
+	return diagnostics
+}
+
+//Check that each refinement fits its message, and that both the sender and receiver
+//of the message know every variable it refers to, either because it names one of the
+//values of the message, or because they sent or received a message naming it earlier.
+//known has the variables each participant knows so far.
+func checkRefinements(gt GlobalType, known map[Participant]map[string]bool, path []Step, diagnostics *[]Diagnostic) {
+	//Copy, so that sibling branches don't see each other's variables
+	learn := func(prefix Prefix, vars []string) map[Participant]map[string]bool {
+		ans := make(map[Participant]map[string]bool)
+		for p, names := range known {
+			ans[p] = make(map[string]bool)
+			for name := range names {
+				ans[p][name] = true
+			}
+		}
+		for _, p := range prefix.participants() {
+			if ans[p] == nil {
+				ans[p] = make(map[string]bool)
+			}
+			for _, name := range vars {
+				if name != "" {
+					ans[p][name] = true
+				}
+			}
+		}
+		return ans
+	}
+
+	switch t := gt.(type) {
+	case ValueType:
+		if t.Refinement == nil {
+			checkRefinements(t.ValueNext, known, path, diagnostics)
+			return
+		}
+		if err := t.Refinement.check(t.Value); err != nil {
+			*diagnostics = append(*diagnostics, Diagnostic{Rule: RefinementRule, First: t.ValuePrefix, Path: path, Reason: err.Error()})
+		} else if t.Refinement.Expr != "" {
+			expr, _ := parser.ParseExpr(t.Refinement.Expr)
+			names := make([]string, 0)
+			expressionVariables(expr, &names)
+			for _, p := range t.ValuePrefix.participants() {
+				for _, name := range names {
+					if !known[p][name] && !containsString(t.Refinement.Vars, name) {
+						*diagnostics = append(*diagnostics, Diagnostic{Rule: RefinementRule, First: t.ValuePrefix, Participant: p, Path: path,
+							Reason: fmt.Sprintf("%s can't check %s at %s, because it doesn't know %s", p, t.Refinement, t.ValuePrefix, name)})
+					}
+				}
+			}
+		}
+		checkRefinements(t.ValueNext, learn(t.ValuePrefix, t.Refinement.Vars), path, diagnostics)
+	case DelegationType:
+		checkRefinements(t.DelegationNext, known, path, diagnostics)
+	case BranchingType:
+		for _, label := range globalLabels(t.Branches) {
+			checkRefinements(t.Branches[label], known, appendStep(path, Step{Kind: BranchStep, Name: label}), diagnostics)
+		}
+	case ParallelType:
+		checkRefinements(t.a, known, appendStep(path, Step{Kind: ParallelStep, Name: "left"}), diagnostics)
+		checkRefinements(t.b, known, appendStep(path, Step{Kind: ParallelStep, Name: "right"}), diagnostics)
+		//Values named in the parts aren't relied on after the join
+		checkRefinements(t.next, known, path, diagnostics)
+	case RecursiveType:
+		checkRefinements(t.Body, known, appendStep(path, Step{Kind: RecursionStep, Name: string(t.Bind)}), diagnostics)
+	case DeadlineType:
+		checkRefinements(sequenceGlobal(t.Body, t.Next), known, path, diagnostics)
+	case InvocationType:
+		//What comes after may rely on values named in the body, so the body isn't checked alone
+		checkRefinements(sequenceGlobal(t.Body, t.Next), known, path, diagnostics)
+	case InterruptibleType:
+		for _, alternative := range t.alternatives() {
+			checkRefinements(alternative, known, path, diagnostics)
+		}
+	case ForeachType:
+		checkRefinements(t.Body, known, appendStep(path, Step{Kind: ForeachStep, Name: t.Index}), diagnostics)
+		checkRefinements(t.Next, known, path, diagnostics)
+	}
+}
+
+func containsString(strs []string, s string) bool {
+	for _, str := range strs {
+		if str == s {
+			return true
+		}
+	}
+	return false
+}
+
+//Holds evaluates the refinement for a message with the given values,
+//where env has the values of variables bound by earlier messages.
+//It is an error for the expression to refer to an unknown variable, or to not be a boolean.
+func (r Refinement) Holds(values []interface{}, env map[string]interface{}) (bool, error) {
+	if len(values) != len(r.Vars) {
+		return false, fmt.Errorf("refinement %s names %d values, but was given %d", r, len(r.Vars), len(values))
+	}
+	if r.Expr == "" {
+		return true, nil
+	}
+	expr, err := parser.ParseExpr(r.Expr)
+	if err != nil {
+		return false, fmt.Errorf("refinement %s: %v", r, err)
+	}
+	scope := make(map[string]interface{})
+	for name, value := range env {
+		scope[name] = value
+	}
+	for i, name := range r.Vars {
+		if name != "" {
+			scope[name] = values[i]
+		}
+	}
+	result, err := evaluator{scope}.eval(expr)
+	if err != nil {
+		return false, fmt.Errorf("refinement %s: %v", r, err)
+	}
+	c, ok := result.(constant.Value)
+	if !ok || c.Kind() != constant.Bool {
+		return false, fmt.Errorf("refinement %s is not a boolean", r)
+	}
+	return constant.BoolVal(c), nil
+}
+
+//Evaluates Go expressions over the values of variables.
+//Numbers, strings and booleans are constant.Values, so that arithmetic and comparisons
+//work the same no matter which Go types they came from.
+//Anything else, like a slice or a struct, is kept as the Go value.
+type evaluator struct {
+	scope map[string]interface{}
+}
+
+//Turn a Go value into a constant, if it is a number, string or boolean
+func toConstant(value interface{}) interface{} {
+	if c, ok := value.(constant.Value); ok {
+		return c
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return constant.MakeInt64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return constant.MakeUint64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		return constant.MakeFloat64(v.Float())
+	case reflect.String:
+		return constant.MakeString(v.String())
+	case reflect.Bool:
+		return constant.MakeBool(v.Bool())
+	}
+	return value
+}
+
+func isNumber(c constant.Value) bool {
+	return c.Kind() == constant.Int || c.Kind() == constant.Float
+}
+
+func (e evaluator) constant(expr ast.Expr) (constant.Value, error) {
+	value, err := e.eval(expr)
+	if err != nil {
+		return nil, err
+	}
+	c, ok := value.(constant.Value)
+	if !ok {
+		return nil, fmt.Errorf("%s is a %T, not a number, string or boolean", exprString(expr), value)
+	}
+	return c, nil
+}
+
+func (e evaluator) boolean(expr ast.Expr) (bool, error) {
+	c, err := e.constant(expr)
+	if err != nil {
+		return false, err
+	}
+	if c.Kind() != constant.Bool {
+		return false, fmt.Errorf("%s is not a boolean", exprString(expr))
+	}
+	return constant.BoolVal(c), nil
+}
+
+func (e evaluator) eval(expr ast.Expr) (interface{}, error) {
+	switch t := expr.(type) {
+	case *ast.ParenExpr:
+		return e.eval(t.X)
+	case *ast.BasicLit:
+		c := constant.MakeFromLiteral(t.Value, t.Kind, 0)
+		if c.Kind() == constant.Unknown {
+			return nil, fmt.Errorf("invalid literal %s", t.Value)
+		}
+		return c, nil
+	case *ast.Ident:
+		switch t.Name {
+		case "true", "false":
+			return constant.MakeBool(t.Name == "true"), nil
+		}
+		value, ok := e.scope[t.Name]
+		if !ok {
+			return nil, fmt.Errorf("unknown variable %s", t.Name)
+		}
+		return toConstant(value), nil
+	case *ast.SelectorExpr:
+		value, err := e.eval(t.X)
+		if err != nil {
+			return nil, err
+		}
+		v := reflect.ValueOf(value)
+		for v.Kind() == reflect.Ptr && !v.IsNil() {
+			v = v.Elem()
+		}
+		if v.Kind() != reflect.Struct {
+			return nil, fmt.Errorf("%s has no field %s", exprString(t.X), t.Sel.Name)
+		}
+		field := v.FieldByName(t.Sel.Name)
+		if !field.IsValid() || !field.CanInterface() {
+			return nil, fmt.Errorf("%s has no exported field %s", exprString(t.X), t.Sel.Name)
+		}
+		return toConstant(field.Interface()), nil
+	case *ast.CallExpr:
+		if fun, ok := t.Fun.(*ast.Ident); !ok || fun.Name != "len" || len(t.Args) != 1 {
+			return nil, fmt.Errorf("unsupported call %s, only len is allowed", exprString(t))
+		}
+		value, err := e.eval(t.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		if c, ok := value.(constant.Value); ok && c.Kind() == constant.String {
+			return constant.MakeInt64(int64(len(constant.StringVal(c)))), nil
+		}
+		v := reflect.ValueOf(value)
+		switch v.Kind() {
+		case reflect.Array, reflect.Chan, reflect.Map, reflect.Slice:
+			return constant.MakeInt64(int64(v.Len())), nil
+		}
+		return nil, fmt.Errorf("can't take the length of %s", exprString(t.Args[0]))
+	case *ast.UnaryExpr:
+		x, err := e.constant(t.X)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case t.Op == token.NOT && x.Kind() == constant.Bool,
+			(t.Op == token.SUB || t.Op == token.ADD) && isNumber(x):
+			return constant.UnaryOp(t.Op, x, 0), nil
+		}
+		return nil, fmt.Errorf("can't apply %s to %s", t.Op, exprString(t.X))
+	case *ast.BinaryExpr:
+		return e.binary(t)
+	}
+	return nil, fmt.Errorf("unsupported expression %s", exprString(expr))
+}
+
+func (e evaluator) binary(t *ast.BinaryExpr) (interface{}, error) {
+	//Only evaluate the right of && and || when it is needed, so it can rely on the left
+	switch t.Op {
+	case token.LAND, token.LOR:
+		x, err := e.boolean(t.X)
+		if err != nil {
+			return nil, err
+		}
+		if x == (t.Op == token.LOR) {
+			return constant.MakeBool(x), nil
+		}
+		y, err := e.boolean(t.Y)
+		if err != nil {
+			return nil, err
+		}
+		return constant.MakeBool(y), nil
+	}
+
+	x, err := e.constant(t.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := e.constant(t.Y)
+	if err != nil {
+		return nil, err
+	}
+	numbers := isNumber(x) && isNumber(y)
+	if !numbers && x.Kind() != y.Kind() {
+		return nil, fmt.Errorf("can't compare or combine %s and %s", exprString(t.X), exprString(t.Y))
+	}
+	switch t.Op {
+	case token.EQL, token.NEQ:
+		return constant.MakeBool(constant.Compare(x, t.Op, y)), nil
+	case token.LSS, token.LEQ, token.GTR, token.GEQ:
+		if numbers || x.Kind() == constant.String {
+			return constant.MakeBool(constant.Compare(x, t.Op, y)), nil
+		}
+	case token.ADD:
+		if numbers || x.Kind() == constant.String {
+			return constant.BinaryOp(x, t.Op, y), nil
+		}
+	case token.SUB, token.MUL:
+		if numbers {
+			return constant.BinaryOp(x, t.Op, y), nil
+		}
+	case token.QUO, token.REM:
+		if numbers {
+			if constant.Sign(y) == 0 {
+				return nil, fmt.Errorf("division by zero in %s", exprString(t))
+			}
+			if x.Kind() == constant.Int && y.Kind() == constant.Int {
+				if t.Op == token.QUO {
+					return constant.BinaryOp(x, token.QUO_ASSIGN, y), nil
+				}
+				return constant.BinaryOp(x, t.Op, y), nil
+			}
+			if t.Op == token.QUO {
+				return constant.BinaryOp(x, t.Op, y), nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("can't apply %s to %s and %s", t.Op, exprString(t.X), exprString(t.Y))
+}
+
+func exprString(expr ast.Expr) string {
+	return types.ExprString(expr)
+}
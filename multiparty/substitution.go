@@ -0,0 +1,233 @@
+package multiparty
+
+import (
+	"fmt"
+	"sort"
+)
+
+func substituteBranches(branches map[string]LocalType, u LocalNameType, tsub LocalType) map[string]LocalType {
+	ans := make(map[string]LocalType, len(branches))
+	for label, branch := range branches {
+		ans[label] = branch.Substitute(u, tsub)
+	}
+	return ans
+}
+
+//The recursion variables which occur in a local type without being bound by it
+func localFreeVariables(lt LocalType) map[LocalNameType]bool {
+	ans := make(map[LocalNameType]bool)
+	var walk func(lt LocalType, bound map[LocalNameType]int)
+	walk = func(lt LocalType, bound map[LocalNameType]int) {
+		switch t := lt.(type) {
+		case ProjectionType:
+			walk(t.T, bound)
+		case LocalSendType:
+			walk(t.Next, bound)
+		case LocalReceiveType:
+			walk(t.Next, bound)
+		case LocalDelegateType:
+			walk(t.Next, bound)
+		case LocalAcceptType:
+			walk(t.Next, bound)
+		case LocalDeadlineType:
+			walk(t.Body, bound)
+			walk(t.Next, bound)
+		case LocalInterruptibleType:
+			walk(t.Body, bound)
+			for _, interrupt := range t.Interrupts {
+				walk(interrupt.Then, bound)
+			}
+			walk(t.Next, bound)
+		case LocalParallelType:
+			walk(t.Left, bound)
+			walk(t.Right, bound)
+			walk(t.Next, bound)
+		case LocalSelectionType:
+			for _, branch := range t.Branches {
+				walk(branch, bound)
+			}
+		case LocalBranchingType:
+			for _, branch := range t.Branches {
+				walk(branch, bound)
+			}
+		case LocalNameType:
+			if bound[t] == 0 {
+				ans[t] = true
+			}
+		case LocalRecursiveType:
+			bound[t.Bind]++
+			walk(t.Body, bound)
+			bound[t.Bind]--
+		}
+	}
+	walk(lt, make(map[LocalNameType]int))
+	return ans
+}
+
+//The recursion variables which occur in a global type without being bound by it,
+//and the ones which are bound somewhere inside of it
+func globalVariables(gt GlobalType) (map[NameType]bool, map[NameType]bool) {
+	free := make(map[NameType]bool)
+	binders := make(map[NameType]bool)
+	var walk func(gt GlobalType, bound map[NameType]int)
+	walk = func(gt GlobalType, bound map[NameType]int) {
+		switch t := gt.(type) {
+		case ValueType:
+			walk(t.ValueNext, bound)
+		case DelegationType:
+			walk(t.DelegationNext, bound)
+		case BranchingType:
+			for _, branch := range t.Branches {
+				walk(branch, bound)
+			}
+		case ParallelType:
+			walk(t.a, bound)
+			walk(t.b, bound)
+			walk(t.next, bound)
+		case ForeachType:
+			walk(t.Body, bound)
+			walk(t.Next, bound)
+		case DeadlineType:
+			walk(t.Body, bound)
+			walk(t.Next, bound)
+		case InvocationType:
+			walk(t.Body, bound)
+			walk(t.Next, bound)
+		case InterruptibleType:
+			walk(t.Body, bound)
+			for _, interrupt := range t.Interrupts {
+				walk(interrupt.Then, bound)
+			}
+			walk(t.Next, bound)
+		case NameType:
+			if bound[t] == 0 {
+				free[t] = true
+			}
+		case RecursiveType:
+			binders[t.Bind] = true
+			bound[t.Bind]++
+			walk(t.Body, bound)
+			bound[t.Bind]--
+		}
+	}
+	walk(gt, make(map[NameType]int))
+	return free, binders
+}
+
+//FreeVariables returns the recursion variables which occur in lt
+//without being bound by an enclosing recursive type, in sorted order
+func FreeVariables(lt LocalType) []LocalNameType {
+	ans := make([]LocalNameType, 0)
+	for name := range localFreeVariables(lt) {
+		ans = append(ans, name)
+	}
+	sort.Slice(ans, func(i, j int) bool { return ans[i] < ans[j] })
+	return ans
+}
+
+//A variant of name which isn't in avoid
+func freshName(name LocalNameType, avoid map[LocalNameType]bool) LocalNameType {
+	for i := 1; ; i++ {
+		candidate := LocalNameType(fmt.Sprintf("%s%d", name, i))
+		if !avoid[candidate] {
+			return candidate
+		}
+	}
+}
+
+//AlphaEquivalent reports whether a and b are the same local type,
+//up to the names of their recursion variables.
+//Unlike EquivalentTo, recursive types must be unfolded in the same places.
+func AlphaEquivalent(a, b LocalType) bool {
+	return alphaEquivalent(a, b, make([]LocalNameType, 0), make([]LocalNameType, 0))
+}
+
+//A bound variable is identified by how far out its binder is,
+//so the binders of a and b are kept in matching stacks
+func alphaEquivalent(a, b LocalType, aBound, bBound []LocalNameType) bool {
+	switch ta := a.(type) {
+	case ProjectionType:
+		tb, ok := b.(ProjectionType)
+		return ok && ta.participant == tb.participant && alphaEquivalent(ta.T, tb.T, aBound, bBound)
+	case LocalSendType:
+		tb, ok := b.(LocalSendType)
+		return ok && ta.Channel == tb.Channel && sortsEqual(ta.Value, tb.Value) && refinementsEqual(ta.Refinement, tb.Refinement) &&
+			alphaEquivalent(ta.Next, tb.Next, aBound, bBound)
+	case LocalReceiveType:
+		tb, ok := b.(LocalReceiveType)
+		return ok && ta.Channel == tb.Channel && sortsEqual(ta.Value, tb.Value) && refinementsEqual(ta.Refinement, tb.Refinement) &&
+			alphaEquivalent(ta.Next, tb.Next, aBound, bBound)
+	case LocalDeadlineType:
+		tb, ok := b.(LocalDeadlineType)
+		return ok && ta.Within == tb.Within && alphaEquivalent(ta.Body, tb.Body, aBound, bBound) && alphaEquivalent(ta.Next, tb.Next, aBound, bBound)
+	case LocalInterruptibleType:
+		tb, ok := b.(LocalInterruptibleType)
+		if !ok || !interruptsEqual(ta.Interrupts, tb.Interrupts) {
+			return false
+		}
+		for i, interrupt := range ta.Interrupts {
+			if !alphaEquivalent(interrupt.Then, tb.Interrupts[i].Then, aBound, bBound) {
+				return false
+			}
+		}
+		return alphaEquivalent(ta.Body, tb.Body, aBound, bBound) && alphaEquivalent(ta.Next, tb.Next, aBound, bBound)
+	case LocalParallelType:
+		tb, ok := b.(LocalParallelType)
+		return ok && alphaEquivalent(ta.Left, tb.Left, aBound, bBound) && alphaEquivalent(ta.Right, tb.Right, aBound, bBound) &&
+			alphaEquivalent(ta.Next, tb.Next, aBound, bBound)
+	case LocalDelegateType:
+		//The delegated sessions are closed, so their variables are compared on their own
+		tb, ok := b.(LocalDelegateType)
+		return ok && ta.Channel == tb.Channel && AlphaEquivalent(ta.Session, tb.Session) && alphaEquivalent(ta.Next, tb.Next, aBound, bBound)
+	case LocalAcceptType:
+		tb, ok := b.(LocalAcceptType)
+		return ok && ta.Channel == tb.Channel && AlphaEquivalent(ta.Session, tb.Session) && alphaEquivalent(ta.Next, tb.Next, aBound, bBound)
+	case LocalSelectionType:
+		tb, ok := b.(LocalSelectionType)
+		return ok && ta.Channel == tb.Channel && alphaEquivalentBranches(ta.Branches, tb.Branches, aBound, bBound)
+	case LocalBranchingType:
+		tb, ok := b.(LocalBranchingType)
+		return ok && ta.Channel == tb.Channel && alphaEquivalentBranches(ta.Branches, tb.Branches, aBound, bBound)
+	case LocalNameType:
+		tb, ok := b.(LocalNameType)
+		if !ok {
+			return false
+		}
+		aIndex, bIndex := bindingIndex(ta, aBound), bindingIndex(tb, bBound)
+		if aIndex < 0 && bIndex < 0 {
+			return ta == tb
+		}
+		return aIndex == bIndex
+	case LocalRecursiveType:
+		tb, ok := b.(LocalRecursiveType)
+		return ok && alphaEquivalent(ta.Body, tb.Body, append(aBound[:len(aBound):len(aBound)], ta.Bind),
+			append(bBound[:len(bBound):len(bBound)], tb.Bind))
+	case LocalEndType:
+		_, ok := b.(LocalEndType)
+		return ok
+	}
+	return false
+}
+
+func alphaEquivalentBranches(a, b map[string]LocalType, aBound, bBound []LocalNameType) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for label, branch := range a {
+		other, ok := b[label]
+		if !ok || !alphaEquivalent(branch, other, aBound, bBound) {
+			return false
+		}
+	}
+	return true
+}
+
+//How many binders out the innermost binding of name is, or -1 if it is free
+func bindingIndex(name LocalNameType, bound []LocalNameType) int {
+	for i := len(bound) - 1; i >= 0; i-- {
+		if bound[i] == name {
+			return len(bound) - 1 - i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,146 @@
+package multiparty
+
+import (
+	"fmt"
+	"sort"
+)
+
+//IsSortSubtype reports whether a value of sort a may be used where sort b is expected.
+//Sorts are Go types, so this only holds if they are the same type,
+//or if b is the empty interface.
+func IsSortSubtype(a, b Sort) bool {
+	return a == b || b == "interface{}" || b == "any"
+}
+
+//IsValueSubtype reports whether a message carrying values of the sorts in a
+//may be used where one carrying the sorts in b is expected.
+//They must have the same number of values, and each sort must be a subtype of the expected one.
+func IsValueSubtype(a, b []Sort) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !IsSortSubtype(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+//IsSubtype reports whether a participant implementing the local type sub
+//may safely be used where one implementing super is expected,
+//using the synchronous session subtyping of Gay and Hole.
+func IsSubtype(sub, super LocalType) bool {
+	return CheckSubtype(sub, super) == nil
+}
+
+//CheckSubtype is like IsSubtype, but explains why sub is not a subtype of super.
+//
+//A subtype may select fewer labels and offer more labels in branches,
+//may send a more specific sort, and may receive a more general sort.
+//It may also add conditions to what it sends, and drop conditions on what it receives.
+//Recursive types are compared up to unfolding.
+func CheckSubtype(sub, super LocalType) error {
+	subGraph, err := newLocalGraph(sub)
+	if err != nil {
+		return fmt.Errorf("invalid subtype: %v", err)
+	}
+	superGraph, err := newLocalGraph(super)
+	if err != nil {
+		return fmt.Errorf("invalid supertype: %v", err)
+	}
+	//Subtyping is coinductive: once we have started comparing a pair of nodes,
+	//we assume it holds, so that comparing loops terminates
+	assumed := make(map[[2]int]bool)
+	return synchronousSubtype(subGraph, superGraph, subGraph.root, superGraph.root, assumed)
+}
+
+func sortedEdgeLabels(next map[string]int) []string {
+	labels := make([]string, 0, len(next))
+	for label := range next {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+func synchronousSubtype(subGraph, superGraph *localGraph, sub, super int, assumed map[[2]int]bool) error {
+	if assumed[[2]int{sub, super}] {
+		return nil
+	}
+	assumed[[2]int{sub, super}] = true
+
+	subNode, superNode := subGraph.nodes[sub], superGraph.nodes[super]
+	if subNode.kind != superNode.kind || subNode.channel != superNode.channel {
+		return fmt.Errorf("expected %s, found %s", superGraph.describe(super), subGraph.describe(sub))
+	}
+	switch subNode.kind {
+	case sendNode:
+		//We may send something more specific than expected
+		if !IsValueSubtype(subNode.value, superNode.value) {
+			return fmt.Errorf("sends %s on %s, but %s is expected", formatValue(subNode.value), subNode.channel, formatValue(superNode.value))
+		}
+		//Every value we send must satisfy the condition expected on it
+		if !RefinementImplies(subNode.refinement, superNode.refinement) {
+			return fmt.Errorf("sends on %s without ensuring %s", subNode.channel, superNode.refinement)
+		}
+	case receiveNode:
+		//We must be able to receive anything we may be sent
+		if !IsValueSubtype(superNode.value, subNode.value) {
+			return fmt.Errorf("receives %s on %s, but may be sent %s", formatValue(subNode.value), subNode.channel, formatValue(superNode.value))
+		}
+		//We may only rely on conditions that every value we may be sent satisfies
+		if !RefinementImplies(superNode.refinement, subNode.refinement) {
+			return fmt.Errorf("receives on %s relying on %s, which may not hold", subNode.channel, subNode.refinement)
+		}
+	case delegateNode:
+		//The new owner will follow the expected session, which must be able to stand in for ours
+		if !sessionSubtype(superNode.session, subNode.session) {
+			return fmt.Errorf("delegates %s on %s, but %s is expected", subNode.session, subNode.channel, superNode.session)
+		}
+	case acceptNode:
+		//We must be able to stand in for any endpoint we may be handed
+		if !sessionSubtype(subNode.session, superNode.session) {
+			return fmt.Errorf("accepts %s on %s, but may be handed %s", subNode.session, subNode.channel, superNode.session)
+		}
+	case enterNode:
+		//A longer deadline could be missed, and a shorter one could rush the other participants
+		if subNode.within != superNode.within {
+			return fmt.Errorf("has a deadline of %s, but %s is expected", subNode.within, superNode.within)
+		}
+	case interruptNode:
+		//Interrupts are all or nothing: everyone in the block must agree on how it may be interrupted
+		if !interruptsEqual(subNode.interrupts, superNode.interrupts) {
+			return fmt.Errorf("has %s, but %s is expected", subGraph.describe(sub), superGraph.describe(super))
+		}
+	case selectNode:
+		//We may only choose labels that the other side offers
+		for _, label := range sortedEdgeLabels(subNode.next) {
+			if _, ok := superNode.next[label]; !ok {
+				return fmt.Errorf("may select label %s on %s, which is not expected", label, subNode.channel)
+			}
+		}
+	case branchNode:
+		//We must handle every label we may be sent
+		for _, label := range sortedEdgeLabels(superNode.next) {
+			if _, ok := subNode.next[label]; !ok {
+				return fmt.Errorf("does not handle label %s on %s", label, subNode.channel)
+			}
+		}
+	}
+
+	//Compare the continuations the two types have in common
+	for _, label := range sortedEdgeLabels(subNode.next) {
+		superNext, ok := superNode.next[label]
+		if !ok {
+			continue
+		}
+		if err := synchronousSubtype(subGraph, superGraph, subNode.next[label], superNext, assumed); err != nil {
+			if label != "" {
+				return fmt.Errorf("in branch %s: %v", label, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,395 @@
+package multiparty
+
+import (
+	"fmt"
+	"strings"
+)
+
+//The kinds of message a global type can send at a single step
+type MessageKind int
+
+const (
+	ValueMessage MessageKind = iota
+	LabelMessage
+	DelegationMessage
+	InterruptMessage
+)
+
+//A single step of a global trace: one message of the protocol, annotated with the prefix it is sent on.
+//Values have the sorts of the message, choices and interrupts have a Label,
+//and delegations have the Session handed over.
+//An interrupt is raised by telling each of the other participants of its block at once,
+//so its step has every message it sends in Notify, the first of which is Prefix.
+type TraceStep struct {
+	Kind    MessageKind
+	Prefix  Prefix
+	Value   []Sort
+	Label   string
+	Session ProjectionType
+	Notify  []Prefix
+}
+
+//Render a step in the given notation, in the style of global types,
+//e.g. A → B : k⟨int⟩ or A → B : k ⊕ ok
+func (s TraceStep) Format(n Notation) string {
+	p := newTypePrinter(n)
+	switch s.Kind {
+	case ValueMessage:
+		p.prefix(s.Prefix)
+		p.value(s.Value, nil)
+	case LabelMessage:
+		p.prefix(s.Prefix)
+		p.write(" ", p.sym.selection, " ", s.Label)
+	case DelegationMessage:
+		p.prefix(s.Prefix)
+		p.session(s.Session)
+	case InterruptMessage:
+		p.write("on ", s.Label, " from ")
+		for i, prefix := range s.Notify {
+			if i > 0 {
+				p.write(", ")
+			}
+			p.prefix(prefix)
+		}
+	}
+	return p.buf.String()
+}
+
+func (s TraceStep) String() string {
+	return s.Format(Unicode)
+}
+
+//The steps of one run of a protocol, in order
+type Trace struct {
+	Steps []TraceStep
+	//Whether the protocol ends after the steps, rather than the trace being cut short by a limit
+	Complete bool
+}
+
+//Render a trace in the given notation, e.g. A → B : k⟨int⟩. B → A : k ⊕ ok. end,
+//with ... in place of the end of a trace which was cut short
+func (t Trace) Format(n Notation) string {
+	steps := make([]string, 0, len(t.Steps)+1)
+	for _, step := range t.Steps {
+		steps = append(steps, step.Format(n))
+	}
+	if t.Complete {
+		steps = append(steps, "end")
+	} else {
+		steps = append(steps, "...")
+	}
+	return strings.Join(steps, ". ")
+}
+
+func (t Trace) String() string {
+	return t.Format(Unicode)
+}
+
+//The labelled transition system of a global type.
+//Its states are what is left of the protocol after some of its steps,
+//the first of which is the whole protocol, with its loops unfolded as far as needed
+//to see their first steps. Each transition does one step from one state to another.
+type LTS struct {
+	States      []GlobalType
+	Transitions []Transition
+}
+
+//A step from the state From of an LTS to the state To
+type Transition struct {
+	From, To int
+	Step     TraceStep
+}
+
+//NewLTS unfolds gt into its labelled transition system.
+//Role families must be instantiated first.
+//Interrupts may be raised at any state of their block, before it ends.
+func NewLTS(gt GlobalType) (LTS, error) {
+	start, _, err := settle(gt)
+	if err != nil {
+		return LTS{}, err
+	}
+	lts := LTS{States: []GlobalType{start}}
+	for from := 0; from < len(lts.States); from++ {
+		moves, err := movesOf(lts.States[from])
+		if err != nil {
+			return LTS{}, err
+		}
+		for _, m := range moves {
+			to := -1
+			for i, state := range lts.States {
+				if state.equals(m.next) {
+					to = i
+					break
+				}
+			}
+			if to < 0 {
+				to = len(lts.States)
+				lts.States = append(lts.States, m.next)
+			}
+			lts.Transitions = append(lts.Transitions, Transition{From: from, To: to, Step: m.step})
+		}
+	}
+	return lts, nil
+}
+
+//How far to follow a protocol when enumerating its traces
+type TraceOptions struct {
+	//How many steps a trace may have, or zero for no limit
+	MaxSteps int
+	//How many times a trace may start the body of each loop, or zero for no limit
+	MaxLoops int
+}
+
+//Traces enumerates the different traces of gt, each of which either runs until the protocol ends
+//or stops at one of the limits in opts. A protocol with loops needs at least one of the limits.
+//Interleavings of parallel blocks are different traces, unless they do the same steps.
+func Traces(gt GlobalType, opts TraceOptions) ([]Trace, error) {
+	if opts.MaxSteps == 0 && opts.MaxLoops == 0 {
+		loops := make(map[LocalNameType]bool)
+		loopNames(gt, loops)
+		if len(loops) != 0 {
+			return nil, fmt.Errorf("the protocol has loops, so its traces need a limit on their steps or loops")
+		}
+	}
+	start, loops, err := settle(gt)
+	if err != nil {
+		return nil, err
+	}
+	var traces []Trace
+	seen := make(map[string]bool)
+	add := func(trace Trace) {
+		if key := trace.String(); !seen[key] {
+			seen[key] = true
+			traces = append(traces, trace)
+		}
+	}
+	var enumerate func(state GlobalType, steps []TraceStep, started map[NameType]int) error
+	enumerate = func(state GlobalType, steps []TraceStep, started map[NameType]int) error {
+		moves, err := movesOf(state)
+		if err != nil {
+			return err
+		}
+		if len(moves) == 0 {
+			add(Trace{Steps: steps, Complete: true})
+			return nil
+		}
+		if opts.MaxSteps != 0 && len(steps) >= opts.MaxSteps {
+			add(Trace{Steps: steps})
+			return nil
+		}
+		for _, m := range moves {
+			next := append(append([]TraceStep{}, steps...), m.step)
+			//The step finishes an iteration of a loop, but the next one starts too many
+			counts, ok := startLoops(started, m.loops, opts.MaxLoops)
+			if !ok {
+				add(Trace{Steps: next})
+				continue
+			}
+			if err := enumerate(m.next, next, counts); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	counts, ok := startLoops(make(map[NameType]int), loops, opts.MaxLoops)
+	if !ok {
+		return []Trace{{}}, nil
+	}
+	if err := enumerate(start, nil, counts); err != nil {
+		return nil, err
+	}
+	return traces, nil
+}
+
+//Count the loops started by a step, or say that one of them was started too many times
+func startLoops(started map[NameType]int, loops []NameType, max int) (map[NameType]int, bool) {
+	counts := make(map[NameType]int, len(started))
+	for name, count := range started {
+		counts[name] = count
+	}
+	for _, name := range loops {
+		counts[name]++
+		if max != 0 && counts[name] > max {
+			return nil, false
+		}
+	}
+	return counts, true
+}
+
+//A step a state can do, what is left afterwards, and the loops started on the way there
+type move struct {
+	step  TraceStep
+	next  GlobalType
+	loops []NameType
+}
+
+//Do everything at the start of gt which doesn't send a message:
+//start loops, enter deadlines, join parallel blocks whose parts are done,
+//and leave interruptible blocks whose body is done.
+//Returns what is left, which is end or starts with a step, and the loops started.
+func settle(gt GlobalType) (GlobalType, []NameType, error) {
+	return settleUnfolding(gt, make(map[NameType]bool))
+}
+
+//unfolding has the loops started since the last step, which can't be started again before another step
+func settleUnfolding(gt GlobalType, unfolding map[NameType]bool) (GlobalType, []NameType, error) {
+	settle := func(gt GlobalType) (GlobalType, []NameType, error) {
+		return settleUnfolding(gt, unfolding)
+	}
+	switch t := gt.(type) {
+	case RecursiveType:
+		if unfolding[t.Bind] {
+			return nil, nil, fmt.Errorf("loop %s starts again without doing anything", t.Bind)
+		}
+		unfolding[t.Bind] = true
+		ans, loops, err := settle(substituteGlobal(t.Body, t.Bind, t))
+		delete(unfolding, t.Bind)
+		return ans, append([]NameType{t.Bind}, loops...), err
+	case DeadlineType:
+		return settle(sequenceGlobal(t.Body, t.Next))
+	case InvocationType:
+		return settle(sequenceGlobal(t.Body, t.Next))
+	case ParallelType:
+		a, aLoops, err := settle(t.a)
+		if err != nil {
+			return nil, nil, err
+		}
+		b, bLoops, err := settle(t.b)
+		if err != nil {
+			return nil, nil, err
+		}
+		loops := append(aLoops, bLoops...)
+		_, aDone := a.(EndType)
+		_, bDone := b.(EndType)
+		if aDone && bDone {
+			next, nextLoops, err := settle(t.next)
+			return next, append(loops, nextLoops...), err
+		}
+		return ParallelType{a, b, t.next}, loops, nil
+	case InterruptibleType:
+		body, loops, err := settle(t.Body)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, done := body.(EndType); done {
+			next, nextLoops, err := settle(t.Next)
+			return next, append(loops, nextLoops...), err
+		}
+		return InterruptibleType{Body: body, Interrupts: t.Interrupts, Next: t.Next}, loops, nil
+	case ForeachType:
+		return nil, nil, fmt.Errorf("cannot follow the steps of role family %s, instantiate it first", t.Index)
+	case NameType:
+		return nil, nil, fmt.Errorf("continues loop %s, which it isn't inside of", t)
+	}
+	return gt, nil, nil
+}
+
+//The steps a settled state can do
+func movesOf(gt GlobalType) ([]move, error) {
+	var moves []move
+	//Settling a state again doesn't start any loops, only whatever comes after a block it leaves
+	then := func(step TraceStep, next GlobalType, loops []NameType) error {
+		settled, more, err := settle(next)
+		if err != nil {
+			return err
+		}
+		moves = append(moves, move{step: step, next: settled, loops: append(loops, more...)})
+		return nil
+	}
+	switch t := gt.(type) {
+	case ValueType:
+		return moves, then(TraceStep{Kind: ValueMessage, Prefix: t.ValuePrefix, Value: t.Value}, t.ValueNext, nil)
+	case DelegationType:
+		return moves, then(TraceStep{Kind: DelegationMessage, Prefix: t.DelegationPrefix, Session: t.Session}, t.DelegationNext, nil)
+	case BranchingType:
+		for _, label := range globalLabels(t.Branches) {
+			if err := then(TraceStep{Kind: LabelMessage, Prefix: t.BranchPrefix, Label: label}, t.Branches[label], nil); err != nil {
+				return nil, err
+			}
+		}
+	case ParallelType:
+		for _, side := range []bool{true, false} {
+			part, other := t.a, t.b
+			if !side {
+				part, other = t.b, t.a
+			}
+			partMoves, err := movesOf(part)
+			if err != nil {
+				return nil, err
+			}
+			for _, m := range partMoves {
+				next := ParallelType{m.next, other, t.next}
+				if !side {
+					next = ParallelType{other, m.next, t.next}
+				}
+				if err := then(m.step, next, m.loops); err != nil {
+					return nil, err
+				}
+			}
+		}
+	case InterruptibleType:
+		bodyMoves, err := movesOf(t.Body)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range bodyMoves {
+			if err := then(m.step, InterruptibleType{Body: m.next, Interrupts: t.Interrupts, Next: t.Next}, m.loops); err != nil {
+				return nil, err
+			}
+		}
+		for _, interrupt := range t.Interrupts {
+			step := TraceStep{Kind: InterruptMessage, Label: interrupt.Label, Notify: interrupt.Notify}
+			if len(interrupt.Notify) != 0 {
+				step.Prefix = interrupt.Notify[0]
+			}
+			if err := then(step, sequenceGlobal(interrupt.Then, t.Next), nil); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return moves, nil
+}
+
+//Replace the free occurrences of name in gt with sub, which must not have free variables of its own
+func substituteGlobal(gt GlobalType, name NameType, sub GlobalType) GlobalType {
+	switch t := gt.(type) {
+	case ValueType:
+		t.ValueNext = substituteGlobal(t.ValueNext, name, sub)
+		return t
+	case DelegationType:
+		t.DelegationNext = substituteGlobal(t.DelegationNext, name, sub)
+		return t
+	case BranchingType:
+		branches := make(map[string]GlobalType, len(t.Branches))
+		for label, branch := range t.Branches {
+			branches[label] = substituteGlobal(branch, name, sub)
+		}
+		return BranchingType{BranchPrefix: t.BranchPrefix, Branches: branches}
+	case ParallelType:
+		return ParallelType{substituteGlobal(t.a, name, sub), substituteGlobal(t.b, name, sub), substituteGlobal(t.next, name, sub)}
+	case RecursiveType:
+		if t.Bind == name {
+			return t
+		}
+		return RecursiveType{Bind: t.Bind, Body: substituteGlobal(t.Body, name, sub)}
+	case DeadlineType:
+		return DeadlineType{Within: t.Within, Body: substituteGlobal(t.Body, name, sub), Next: substituteGlobal(t.Next, name, sub)}
+	case InvocationType:
+		return InvocationType{Protocol: t.Protocol, Body: substituteGlobal(t.Body, name, sub), Next: substituteGlobal(t.Next, name, sub)}
+	case InterruptibleType:
+		interrupts := make([]Interrupt, len(t.Interrupts))
+		for i, interrupt := range t.Interrupts {
+			interrupts[i] = Interrupt{Label: interrupt.Label, Notify: interrupt.Notify, Then: substituteGlobal(interrupt.Then, name, sub)}
+		}
+		return InterruptibleType{Body: substituteGlobal(t.Body, name, sub), Interrupts: interrupts, Next: substituteGlobal(t.Next, name, sub)}
+	case ForeachType:
+		t.Body = substituteGlobal(t.Body, name, sub)
+		t.Next = substituteGlobal(t.Next, name, sub)
+		return t
+	case NameType:
+		if t == name {
+			return sub
+		}
+	}
+	return gt
+}
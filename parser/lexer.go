@@ -0,0 +1,279 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+//The kinds of token produced by the lexer
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokSort
+	tokArrow
+	tokColon
+	tokSemi
+	tokComma
+	tokLBrace
+	tokRBrace
+)
+
+func (k tokenKind) String() string {
+	switch k {
+	case tokEOF:
+		return "end of file"
+	case tokIdent:
+		return "identifier"
+	case tokString:
+		return "string"
+	case tokSort:
+		return "sort"
+	case tokArrow:
+		return "\"->\""
+	case tokColon:
+		return "\":\""
+	case tokSemi:
+		return "\";\""
+	case tokComma:
+		return "\",\""
+	case tokLBrace:
+		return "\"{\""
+	case tokRBrace:
+		return "\"}\""
+	}
+	return "unknown token"
+}
+
+//Position of a token in a protocol file.
+//Lines and columns both start at 1, and columns count characters, not bytes.
+type Position struct {
+	Filename string
+	Line     int
+	Column   int
+}
+
+func (p Position) String() string {
+	if p.Filename == "" {
+		return fmt.Sprintf("%d:%d", p.Line, p.Column)
+	}
+	return fmt.Sprintf("%s:%d:%d", p.Filename, p.Line, p.Column)
+}
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  Position
+	//For sorts, each of the comma-separated sorts in text
+	sorts []string
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokIdent, tokString:
+		return fmt.Sprintf("%s %q", t.kind, t.text)
+	case tokSort:
+		return fmt.Sprintf("sort <%s>", t.text)
+	}
+	return t.kind.String()
+}
+
+//Turns the source of a protocol file into tokens, one at a time.
+type lexer struct {
+	src  string
+	off  int
+	line int
+	col  int
+	file string
+}
+
+func newLexer(filename string, src string) *lexer {
+	return &lexer{src: src, line: 1, col: 1, file: filename}
+}
+
+func (l *lexer) pos() Position {
+	return Position{Filename: l.file, Line: l.line, Column: l.col}
+}
+
+func (l *lexer) peekRune() rune {
+	if l.off >= len(l.src) {
+		return -1
+	}
+	r, _ := utf8.DecodeRuneInString(l.src[l.off:])
+	return r
+}
+
+func (l *lexer) nextRune() rune {
+	if l.off >= len(l.src) {
+		return -1
+	}
+	r, size := utf8.DecodeRuneInString(l.src[l.off:])
+	l.off += size
+	if r == '\n' {
+		l.line++
+		l.col = 1
+	} else {
+		l.col++
+	}
+	return r
+}
+
+//Skip whitespace, line comments and block comments
+func (l *lexer) skipSpace() error {
+	for {
+		switch {
+		case l.off >= len(l.src):
+			return nil
+		case unicode.IsSpace(l.peekRune()):
+			l.nextRune()
+		case strings.HasPrefix(l.src[l.off:], "//"):
+			for l.off < len(l.src) && l.peekRune() != '\n' {
+				l.nextRune()
+			}
+		case strings.HasPrefix(l.src[l.off:], "/*"):
+			start := l.pos()
+			l.nextRune()
+			l.nextRune()
+			for !strings.HasPrefix(l.src[l.off:], "*/") {
+				if l.off >= len(l.src) {
+					return &Error{Pos: start, Msg: "comment not terminated"}
+				}
+				l.nextRune()
+			}
+			l.nextRune()
+			l.nextRune()
+		default:
+			return nil
+		}
+	}
+}
+
+func isIdentStart(r rune) bool {
+	return r == '_' || unicode.IsLetter(r)
+}
+
+func isIdentPart(r rune) bool {
+	//Primes are allowed so that names from the paper (k', b'2) can be used as is
+	return isIdentStart(r) || unicode.IsDigit(r) || r == '\''
+}
+
+func (l *lexer) next() (token, error) {
+	if err := l.skipSpace(); err != nil {
+		return token{}, err
+	}
+	start := l.pos()
+	r := l.peekRune()
+	switch {
+	case r == -1:
+		return token{kind: tokEOF, pos: start}, nil
+	case isIdentStart(r):
+		begin := l.off
+		for isIdentPart(l.peekRune()) {
+			l.nextRune()
+		}
+		return token{kind: tokIdent, text: l.src[begin:l.off], pos: start}, nil
+	case r == '"':
+		return l.lexString(start)
+	case r == '<':
+		return l.lexSort(start)
+	case r == '-':
+		l.nextRune()
+		if l.peekRune() != '>' {
+			return token{}, &Error{Pos: start, Msg: "expected \"->\""}
+		}
+		l.nextRune()
+		return token{kind: tokArrow, text: "->", pos: start}, nil
+	}
+
+	l.nextRune()
+	switch r {
+	case ':':
+		return token{kind: tokColon, text: ":", pos: start}, nil
+	case ';':
+		return token{kind: tokSemi, text: ";", pos: start}, nil
+	case ',':
+		return token{kind: tokComma, text: ",", pos: start}, nil
+	case '{':
+		return token{kind: tokLBrace, text: "{", pos: start}, nil
+	case '}':
+		return token{kind: tokRBrace, text: "}", pos: start}, nil
+	}
+	return token{}, &Error{Pos: start, Msg: fmt.Sprintf("unexpected character %q", r)}
+}
+
+//Strings are used for names which aren't identifiers, like ip:port channels
+func (l *lexer) lexString(start Position) (token, error) {
+	l.nextRune()
+	var text strings.Builder
+	for {
+		r := l.nextRune()
+		switch r {
+		case -1, '\n':
+			return token{}, &Error{Pos: start, Msg: "string not terminated"}
+		case '\\':
+			escaped := l.nextRune()
+			if escaped != '"' && escaped != '\\' {
+				return token{}, &Error{Pos: start, Msg: fmt.Sprintf("unknown escape sequence \\%c", escaped)}
+			}
+			text.WriteRune(escaped)
+		case '"':
+			if text.Len() == 0 {
+				return token{}, &Error{Pos: start, Msg: "empty name"}
+			}
+			return token{kind: tokString, text: text.String(), pos: start}, nil
+		default:
+			text.WriteRune(r)
+		}
+	}
+}
+
+//Sorts are the Go types of messages, so we take everything up to the closing >
+//verbatim, only keeping track of brackets so that e.g. map[string]int works.
+//A message may carry several values, whose sorts are separated by commas, e.g. <string, int>
+func (l *lexer) lexSort(start Position) (token, error) {
+	l.nextRune()
+	begin := l.off
+	partBegin := l.off
+	depth := 0
+	sorts := make([]string, 0, 1)
+	endPart := func() error {
+		part := strings.TrimSpace(l.src[partBegin:l.off])
+		if part == "" {
+			return &Error{Pos: start, Msg: "empty sort"}
+		}
+		sorts = append(sorts, part)
+		return nil
+	}
+	for {
+		r := l.peekRune()
+		switch r {
+		case -1:
+			return token{}, &Error{Pos: start, Msg: "sort not terminated, expected \">\""}
+		case '[', '(', '{':
+			depth++
+		case ']', ')', '}':
+			depth--
+		case ',':
+			if depth <= 0 {
+				if err := endPart(); err != nil {
+					return token{}, err
+				}
+				partBegin = l.off + 1
+			}
+		case '>':
+			if depth <= 0 {
+				if err := endPart(); err != nil {
+					return token{}, err
+				}
+				text := strings.TrimSpace(l.src[begin:l.off])
+				l.nextRune()
+				return token{kind: tokSort, text: text, pos: start, sorts: sorts}, nil
+			}
+		}
+		l.nextRune()
+	}
+}
@@ -0,0 +1,449 @@
+/**
+* A parser for a small text syntax describing global session types,
+* so that protocols can be written and reviewed without writing Go code
+* against the mockup DSL.
+*
+* A protocol file is a list of optional declarations, followed by the body:
+*
+*	// Declarations are optional, but if any roles (channels) are declared,
+*	// then using an undeclared role (channel) is an error
+*	role A, B, C;
+*	channel k, "127.0.0.1:24601";
+*
+*	A -> B : k <int>;                 // A sends an int to B along k
+*	B -> A : k <string, int>;         // B sends a string and an int together
+*	rec X {                           // a loop named X
+*		choice B -> A : k {           // B chooses a label and sends it to A
+*			again { continue X; }
+*			done { }
+*		}
+*	}
+*	par { A -> C : k <string>; } and { B -> C : k <bool>; }
+*
+* Statements in a sequence are run one after the other, exactly as the events
+* of a mockup: whatever follows a choice happens after every branch, whatever
+* follows a loop happens once the loop body finishes without continuing, and
+* whatever follows a parallel block happens once all of its blocks are done.
+* A loop can't be named the same as a loop it is inside of.
+* Names which are not identifiers, such as ip:port channels, are written as strings.
+ */
+package parser
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/JoeyEremondi/GoSesh/multiparty"
+)
+
+//An error in a protocol file, along with where it happened
+type Error struct {
+	Pos Position
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Pos, e.Msg)
+}
+
+//A parsed statement is waiting for whatever it "does next",
+//just like the events of a mockup
+type statement func(multiparty.GlobalType) multiparty.GlobalType
+
+type parser struct {
+	lex *lexer
+	tok token
+
+	//nil when nothing was declared, in which case any name is allowed
+	roles    map[string]bool
+	channels map[string]bool
+
+	//The names of the loops we are currently inside of
+	loops []string
+}
+
+//Parse the given protocol source into a global session type.
+//The filename is only used for error messages.
+//Errors are of type *Error, and point to the line and column where parsing failed.
+func Parse(filename string, src string) (multiparty.GlobalType, error) {
+	p := &parser{lex: newLexer(filename, src)}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	if err := p.parseDeclarations(); err != nil {
+		return nil, err
+	}
+	body, err := p.parseSequence(tokEOF)
+	if err != nil {
+		return nil, err
+	}
+	return link(body, multiparty.EndType{}), nil
+}
+
+//Read the given file and parse its contents into a global session type.
+func ParseFile(filename string) (multiparty.GlobalType, error) {
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(filename, string(src))
+}
+
+//Sequence the statements, starting from the back
+func link(statements []statement, next multiparty.GlobalType) multiparty.GlobalType {
+	current := next
+	for i := len(statements) - 1; i >= 0; i-- {
+		current = statements[i](current)
+	}
+	return current
+}
+
+func (p *parser) advance() error {
+	tok, err := p.lex.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *parser) errorf(pos Position, format string, args ...interface{}) error {
+	return &Error{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) expect(kind tokenKind) (token, error) {
+	tok := p.tok
+	if tok.kind != kind {
+		return tok, p.errorf(tok.pos, "expected %s, found %s", kind, tok)
+	}
+	return tok, p.advance()
+}
+
+func (p *parser) isKeyword(word string) bool {
+	return p.tok.kind == tokIdent && p.tok.text == word
+}
+
+//A name is either an identifier or a string
+func (p *parser) parseName(what string) (token, error) {
+	tok := p.tok
+	if tok.kind != tokIdent && tok.kind != tokString {
+		return tok, p.errorf(tok.pos, "expected %s name, found %s", what, tok)
+	}
+	return tok, p.advance()
+}
+
+func (p *parser) parseNameList(what string) ([]token, error) {
+	names := make([]token, 0, 1)
+	for {
+		name, err := p.parseName(what)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		if p.tok.kind != tokComma {
+			break
+		}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+	_, err := p.expect(tokSemi)
+	return names, err
+}
+
+func (p *parser) parseDeclarations() error {
+	for p.isKeyword("role") || p.isKeyword("channel") {
+		keyword := p.tok.text
+		if err := p.advance(); err != nil {
+			return err
+		}
+		names, err := p.parseNameList(keyword)
+		if err != nil {
+			return err
+		}
+		declared := &p.roles
+		if keyword == "channel" {
+			declared = &p.channels
+		}
+		if *declared == nil {
+			*declared = make(map[string]bool)
+		}
+		for _, name := range names {
+			if (*declared)[name.text] {
+				return p.errorf(name.pos, "%s %q declared twice", keyword, name.text)
+			}
+			(*declared)[name.text] = true
+		}
+	}
+	return nil
+}
+
+//Parse statements until we see the given closing token, which is not consumed
+func (p *parser) parseSequence(end tokenKind) ([]statement, error) {
+	statements := make([]statement, 0)
+	//Set once we see a statement that nothing may come after
+	var finalPos *Position
+	var finalWhat string
+	for p.tok.kind != end {
+		if p.tok.kind == tokEOF {
+			return nil, p.errorf(p.tok.pos, "expected %s, found %s", end, p.tok)
+		}
+		if finalPos != nil {
+			return nil, p.errorf(p.tok.pos, "statement after %s at %s can never be reached", finalWhat, *finalPos)
+		}
+		if p.isKeyword("role") || p.isKeyword("channel") {
+			return nil, p.errorf(p.tok.pos, "declarations must come before the protocol body")
+		}
+		start := p.tok
+		stmt, err := p.parseStatement()
+		if err != nil {
+			return nil, err
+		}
+		statements = append(statements, stmt)
+		if start.kind == tokIdent {
+			switch start.text {
+			case "continue", "end":
+				finalPos, finalWhat = &start.pos, start.text
+			}
+		}
+	}
+	return statements, nil
+}
+
+func (p *parser) parseStatement() (statement, error) {
+	if p.tok.kind == tokIdent {
+		switch p.tok.text {
+		case "choice":
+			return p.parseChoice()
+		case "rec":
+			return p.parseRec()
+		case "continue":
+			return p.parseContinue()
+		case "par":
+			return p.parsePar()
+		case "end":
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			_, err := p.expect(tokSemi)
+			return func(multiparty.GlobalType) multiparty.GlobalType {
+				return multiparty.EndType{}
+			}, err
+		}
+	}
+	return p.parseInteraction()
+}
+
+func (p *parser) parseRole() (multiparty.Participant, error) {
+	name, err := p.parseName("role")
+	if err != nil {
+		return "", err
+	}
+	if p.roles != nil && !p.roles[name.text] {
+		return "", p.errorf(name.pos, "undeclared role %q", name.text)
+	}
+	return multiparty.Participant(name.text), nil
+}
+
+func (p *parser) parseChannel() (multiparty.Channel, error) {
+	name, err := p.parseName("channel")
+	if err != nil {
+		return "", err
+	}
+	if p.channels != nil && !p.channels[name.text] {
+		return "", p.errorf(name.pos, "undeclared channel %q", name.text)
+	}
+	return multiparty.Channel(name.text), nil
+}
+
+//Parse A -> B : k
+func (p *parser) parsePrefix() (multiparty.Prefix, error) {
+	start := p.tok.pos
+	var prefix multiparty.Prefix
+	var err error
+	if prefix.P1, err = p.parseRole(); err != nil {
+		return prefix, err
+	}
+	if _, err = p.expect(tokArrow); err != nil {
+		return prefix, err
+	}
+	if prefix.P2, err = p.parseRole(); err != nil {
+		return prefix, err
+	}
+	if _, err = p.expect(tokColon); err != nil {
+		return prefix, err
+	}
+	if prefix.PChannel, err = p.parseChannel(); err != nil {
+		return prefix, err
+	}
+	if prefix.P1 == prefix.P2 {
+		return prefix, p.errorf(start, "role %q cannot send a message to itself", prefix.P1)
+	}
+	return prefix, nil
+}
+
+//Parse A -> B : k <sort, ...>;
+func (p *parser) parseInteraction() (statement, error) {
+	prefix, err := p.parsePrefix()
+	if err != nil {
+		return nil, err
+	}
+	sortTok, err := p.expect(tokSort)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.expect(tokSemi); err != nil {
+		return nil, err
+	}
+	value := make([]multiparty.Sort, len(sortTok.sorts))
+	for i, sort := range sortTok.sorts {
+		value[i] = multiparty.Sort(sort)
+	}
+	return func(next multiparty.GlobalType) multiparty.GlobalType {
+		return multiparty.ValueType{ValuePrefix: prefix, Value: value, ValueNext: next}
+	}, nil
+}
+
+//Parse choice A -> B : k { label { ... } ... }
+func (p *parser) parseChoice() (statement, error) {
+	choiceTok := p.tok
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	prefix, err := p.parsePrefix()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.expect(tokLBrace); err != nil {
+		return nil, err
+	}
+	branches := make(map[string][]statement)
+	for p.tok.kind != tokRBrace {
+		label, err := p.parseName("label")
+		if err != nil {
+			return nil, err
+		}
+		if _, seen := branches[label.text]; seen {
+			return nil, p.errorf(label.pos, "duplicate label %q in choice", label.text)
+		}
+		if _, err := p.expect(tokLBrace); err != nil {
+			return nil, err
+		}
+		body, err := p.parseSequence(tokRBrace)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		branches[label.text] = body
+	}
+	if len(branches) == 0 {
+		return nil, p.errorf(choiceTok.pos, "choice must have at least one branch")
+	}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	return func(next multiparty.GlobalType) multiparty.GlobalType {
+		branchMap := make(map[string]multiparty.GlobalType)
+		for label, body := range branches {
+			branchMap[label] = link(body, next)
+		}
+		return multiparty.BranchingType{BranchPrefix: prefix, Branches: branchMap}
+	}, nil
+}
+
+//Parse rec X { ... }
+func (p *parser) parseRec() (statement, error) {
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	name, err := p.expect(tokIdent)
+	if err != nil {
+		return nil, err
+	}
+	//What follows the inner loop would be inside of it, so continue X there couldn't reach the outer one
+	for _, loop := range p.loops {
+		if loop == name.text {
+			return nil, p.errorf(name.pos, "loop %s is already inside a loop named %s", name.text, name.text)
+		}
+	}
+	if _, err := p.expect(tokLBrace); err != nil {
+		return nil, err
+	}
+	p.loops = append(p.loops, name.text)
+	body, err := p.parseSequence(tokRBrace)
+	if err != nil {
+		return nil, err
+	}
+	p.loops = p.loops[:len(p.loops)-1]
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	bind := multiparty.NameType(name.text)
+	return func(next multiparty.GlobalType) multiparty.GlobalType {
+		return multiparty.RecursiveType{Bind: bind, Body: link(body, next)}
+	}, nil
+}
+
+//Parse continue X;
+func (p *parser) parseContinue() (statement, error) {
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	name, err := p.expect(tokIdent)
+	if err != nil {
+		return nil, err
+	}
+	inScope := false
+	for _, loop := range p.loops {
+		inScope = inScope || loop == name.text
+	}
+	if !inScope {
+		return nil, p.errorf(name.pos, "continue %s is not inside a loop named %s", name.text, name.text)
+	}
+	if _, err := p.expect(tokSemi); err != nil {
+		return nil, err
+	}
+	return func(multiparty.GlobalType) multiparty.GlobalType {
+		return multiparty.NameType(name.text)
+	}, nil
+}
+
+//Parse par { ... } and { ... } ...
+func (p *parser) parsePar() (statement, error) {
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	blocks := make([][]statement, 0, 2)
+	for {
+		if _, err := p.expect(tokLBrace); err != nil {
+			return nil, err
+		}
+		body, err := p.parseSequence(tokRBrace)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, body)
+		if !p.isKeyword("and") {
+			break
+		}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+	return func(next multiparty.GlobalType) multiparty.GlobalType {
+		//The blocks join before whatever follows the parallel block
+		if len(blocks) == 1 {
+			return link(blocks[0], next)
+		}
+		parSoFar := link(blocks[len(blocks)-1], multiparty.EndType{})
+		for i := len(blocks) - 2; i > 0; i-- {
+			parSoFar = multiparty.MakeParallelType(link(blocks[i], multiparty.EndType{}), parSoFar)
+		}
+		return multiparty.MakeJoinedParallelType(link(blocks[0], multiparty.EndType{}), parSoFar, next)
+	}, nil
+}
@@ -0,0 +1,142 @@
+package parser
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/JoeyEremondi/GoSesh/multiparty"
+)
+
+func TestParseLoopUntilGood(test *testing.T) {
+	src := `
+	// The loopUntilGood example
+	role A, B;
+	channel "127.0.0.1:24601", "127.0.0.1:24602";
+
+	rec testLoop {
+		A -> B : "127.0.0.1:24602" <int>;
+		choice B -> A : "127.0.0.1:24601" {
+			intIsBad { continue testLoop; }
+			intIsGood { }
+		}
+	}
+	`
+	expected := multiparty.RecursiveType{
+		Bind: "testLoop",
+		Body: multiparty.ValueType{
+			ValuePrefix: multiparty.Prefix{P1: "A", P2: "B", PChannel: "127.0.0.1:24602"},
+			Value:       multiparty.SingletonValue("int"),
+			ValueNext: multiparty.BranchingType{
+				BranchPrefix: multiparty.Prefix{P1: "B", P2: "A", PChannel: "127.0.0.1:24601"},
+				Branches: map[string]multiparty.GlobalType{
+					"intIsBad":  multiparty.NameType("testLoop"),
+					"intIsGood": multiparty.EndType{},
+				}}}}
+
+	actual, err := Parse("loop.sesh", src)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		test.Errorf("Parsed %+v, expected %+v", actual, expected)
+	}
+}
+
+func TestParseSequenceAfterChoice(test *testing.T) {
+	src := `
+	choice A -> B : k {
+		ok { B -> C : k' <map[string]int>; }
+		quit { }
+	}
+	A -> C : k <bool>;
+	`
+	done := multiparty.ValueType{
+		ValuePrefix: multiparty.Prefix{P1: "A", P2: "C", PChannel: "k"},
+		Value:       multiparty.SingletonValue("bool"),
+		ValueNext:   multiparty.EndType{}}
+	expected := multiparty.BranchingType{
+		BranchPrefix: multiparty.Prefix{P1: "A", P2: "B", PChannel: "k"},
+		Branches: map[string]multiparty.GlobalType{
+			"ok": multiparty.ValueType{
+				ValuePrefix: multiparty.Prefix{P1: "B", P2: "C", PChannel: "k'"},
+				Value:       multiparty.SingletonValue("map[string]int"),
+				ValueNext:   done},
+			"quit": done,
+		}}
+
+	actual, err := Parse("", src)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		test.Errorf("Parsed %+v, expected %+v", actual, expected)
+	}
+}
+
+func TestParseSequenceAfterPar(test *testing.T) {
+	src := `
+	par { A -> B : k <int>; } and { A -> C : k' <int>; }
+	B -> A : k <bool>;
+	`
+	msg := func(p1, p2 multiparty.Participant, k multiparty.Channel, sort multiparty.Sort, next multiparty.GlobalType) multiparty.GlobalType {
+		return multiparty.ValueType{
+			ValuePrefix: multiparty.Prefix{P1: p1, P2: p2, PChannel: k},
+			Value:       multiparty.SingletonValue(sort),
+			ValueNext:   next}
+	}
+	expected := multiparty.MakeJoinedParallelType(
+		msg("A", "B", "k", "int", multiparty.EndType{}),
+		msg("A", "C", "k'", "int", multiparty.EndType{}),
+		msg("B", "A", "k", "bool", multiparty.EndType{}))
+
+	actual, err := Parse("", src)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		test.Errorf("Parsed %+v, expected %+v", actual, expected)
+	}
+}
+
+func TestParseTuple(test *testing.T) {
+	actual, err := Parse("", "A -> B : k <string, map[string]int, func(int, int) bool>;")
+	if err != nil {
+		test.Fatal(err)
+	}
+	expected := multiparty.ValueType{
+		ValuePrefix: multiparty.Prefix{P1: "A", P2: "B", PChannel: "k"},
+		Value:       []multiparty.Sort{"string", "map[string]int", "func(int, int) bool"},
+		ValueNext:   multiparty.EndType{}}
+	if !reflect.DeepEqual(actual, expected) {
+		test.Errorf("Parsed %+v, expected %+v", actual, expected)
+	}
+}
+
+func TestParseErrors(test *testing.T) {
+	cases := []struct {
+		src          string
+		line, column int
+	}{
+		{"A -> B : k <int>\nB -> A : k <int>;", 2, 1},
+		{"role A, B;\nA -> C : k <int>;", 2, 6},
+		{"rec X {\n  continue Y;\n}", 2, 12},
+		{"A -> A : k <int>;", 1, 1},
+		{"continue X;", 1, 10},
+		{"rec X { continue X; A -> B : k <int>; }", 1, 21},
+		{"choice A -> B : k { ok { } ok { } }", 1, 28},
+		{"A -> B : k <int;", 1, 12},
+		{"A -> B : k <int, >;", 1, 12},
+		{"rec X {\n  A -> B : s <int>;\n  rec X { choice B -> A : k { again { continue X; } done { } } }\n  continue X;\n}", 3, 7},
+	}
+	for _, c := range cases {
+		_, err := Parse("", c.src)
+		parseErr, ok := err.(*Error)
+		if !ok {
+			test.Errorf("Expected a parse error for %q, got %v", c.src, err)
+			continue
+		}
+		if parseErr.Pos.Line != c.line || parseErr.Pos.Column != c.column {
+			test.Errorf("Error %q for %q should be at %d:%d", parseErr, c.src, c.line, c.column)
+		}
+	}
+}
@@ -7,9 +7,16 @@ package test
  */
 
 import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/JoeyEremondi/GoSesh/mockup"
+	"github.com/JoeyEremondi/GoSesh/multiparty"
 )
 
 func TestSend(test *testing.T) {
@@ -39,3 +46,167 @@ func TestLocalBranchingType(test *testing.T) {
 	localBranchingType := mockup.Branch(channel, EventMap)
 	test.Log(localBranchingType)
 }*/
+
+func TestInvoke(test *testing.T) {
+	toVoter := mockup.Channel{Name: "voter", Source: "Coord", Destination: "Voter"}
+	toCoord := mockup.Channel{Name: "coord", Source: "Voter", Destination: "Coord"}
+	vote := mockup.Define("Vote", []mockup.Channel{toVoter, toCoord},
+		mockup.Send(toVoter, mockup.MessageType{Type: "string"}),
+		mockup.Send(toCoord, mockup.MessageType{Type: "bool"}))
+
+	aToB := mockup.Channel{Name: "b", Source: "A", Destination: "B"}
+	bToA := mockup.Channel{Name: "a", Source: "B", Destination: "A"}
+	events := []mockup.Event{
+		mockup.Invoke(vote, map[string]string{"Coord": "A", "Voter": "B"}, aToB, bToA),
+		mockup.Send(aToB, mockup.MessageType{Type: "int"})}
+	written := []mockup.Event{
+		mockup.Send(aToB, mockup.MessageType{Type: "string"}),
+		mockup.Send(bToA, mockup.MessageType{Type: "bool"}),
+		mockup.Send(aToB, mockup.MessageType{Type: "int"})}
+
+	//Each participant does its part of the invocation in place
+	for _, p := range []multiparty.Participant{"A", "B"} {
+		invoked, err := mockup.Link(events...).Project(p)
+		if err != nil {
+			test.Fatal(err)
+		}
+		if expected, err := mockup.Link(written...).Project(p); err != nil || !invoked.Equals(expected) {
+			test.Errorf("Projected onto %s as %s, expected %s: %v", p, invoked, expected, err)
+		}
+	}
+
+	//So the stubs are the same as if the events were written out
+	dir := test.TempDir()
+	infile := filepath.Join(dir, "vote.go")
+	if err := ioutil.WriteFile(infile, []byte("package main\n\nfunc main() {}\n"), 0644); err != nil {
+		test.Fatal(err)
+	}
+	stubs := func(name string, events ...mockup.Event) []string {
+		mockup.CreateStubProgram(infile, filepath.Join(dir, name), events...)
+		data, err := ioutil.ReadFile(filepath.Join(dir, name+".go.stub"))
+		if err != nil {
+			test.Fatal(err)
+		}
+		//The participants are written in no particular order
+		lines := strings.Split(string(data), "\n")
+		sort.Strings(lines)
+		return lines
+	}
+	if invoked, expected := stubs("invoked", events...), stubs("written", written...); strings.Join(invoked, "\n") != strings.Join(expected, "\n") {
+		test.Errorf("Generated different stubs for the invocation of %s", "Vote")
+	}
+
+	if !panics(func() { mockup.Invoke(vote, map[string]string{"Coord": "A", "Voter": "B"}, aToB) }) {
+		test.Errorf("Invoked Vote with only one channel")
+	}
+	if !panics(func() { mockup.Invoke(vote, map[string]string{"Coord": "A", "Voter": "B"}, bToA, aToB) }) {
+		test.Errorf("Invoked Vote with its channels swapped")
+	}
+}
+
+//Whether f panics, as the mockup functions do when they're used wrongly
+func panics(f func()) (ans bool) {
+	defer func() { ans = recover() != nil }()
+	f()
+	return false
+}
+
+func TestSendWhere(test *testing.T) {
+	channel := mockup.Channel{Name: "k", Source: "A", Destination: "B"}
+	gt := mockup.Link(mockup.SendWhere(channel, "positive", "amount > 0",
+		mockup.MessageType{Type: "string"}, mockup.MessageType{Name: "amount", Type: "int"}, mockup.MessageType{Type: "bool"}))
+	if printed := multiparty.FormatGlobal(gt, multiparty.ASCII); printed != "A -> B : k<string, amount int, bool>{positive: amount > 0}. end" {
+		test.Errorf("Printed %s", printed)
+	}
+
+	//The unnamed values are left out, rather than bound over each other
+	refinement := gt.(multiparty.ValueType).Refinement
+	if refinement.Vars[0] != "" || refinement.Vars[1] != "amount" || refinement.Vars[2] != "" {
+		test.Errorf("Named %v", refinement.Vars)
+	}
+	env := map[string]interface{}{}
+	if ok, err := refinement.Holds([]interface{}{"a", 5, true}, env); !ok || err != nil {
+		test.Errorf("%s should hold, got %v", refinement, err)
+	}
+	if ok, _ := refinement.Holds([]interface{}{"a", -5, true}, env); ok {
+		test.Errorf("%s should not hold for a negative amount", refinement)
+	}
+	if diagnostics := multiparty.CheckRefinements(gt); len(diagnostics) != 0 {
+		test.Errorf("Unexpected diagnostics %v", diagnostics)
+	}
+}
+
+//The mockups of a program with and without a parallel block, whose stubs should both compile
+const sequentialMockup = `package main
+
+import "github.com/JoeyEremondi/GoSesh/mockup"
+
+func main() {
+	toB := mockup.Channel{Name: "b", Source: "A", Destination: "B"}
+	toC := mockup.Channel{Name: "c", Source: "B", Destination: "C"}
+	mockup.CreateStubProgram("in", "out",
+		mockup.Send(toB, mockup.MessageType{Type: "int"}),
+		mockup.Send(toC, mockup.MessageType{Type: "int"}))
+}
+`
+
+const parallelMockup = `package main
+
+import "github.com/JoeyEremondi/GoSesh/mockup"
+
+func main() {
+	toB := mockup.Channel{Name: "b", Source: "A", Destination: "B"}
+	toC := mockup.Channel{Name: "c", Source: "A", Destination: "C"}
+	mockup.CreateStubProgram("in", "out",
+		mockup.Parallel(
+			mockup.Send(toB, mockup.MessageType{Type: "int"}),
+			mockup.Send(toC, mockup.MessageType{Type: "int"})))
+}
+`
+
+func TestStubsBuild(test *testing.T) {
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		test.Skip("no go tool to build the stubs with")
+	}
+	toB := mockup.Channel{Name: "b", Source: "A", Destination: "B"}
+	cases := []struct {
+		name   string
+		source string
+		events []mockup.Event
+	}{
+		{"sequential", sequentialMockup, []mockup.Event{
+			mockup.Send(toB, mockup.MessageType{Type: "int"}),
+			mockup.Send(mockup.Channel{Name: "c", Source: "B", Destination: "C"}, mockup.MessageType{Type: "int"})}},
+		{"parallel", parallelMockup, []mockup.Event{mockup.Parallel(
+			mockup.Send(toB, mockup.MessageType{Type: "int"}),
+			mockup.Send(mockup.Channel{Name: "c", Source: "A", Destination: "C"}, mockup.MessageType{Type: "int"}))}},
+	}
+	for _, c := range cases {
+		//The stub has to be inside of this module to find its imports,
+		//and the underscore keeps it out of ./...
+		dir, err := ioutil.TempDir(".", "_"+c.name)
+		if err != nil {
+			test.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		infile := filepath.Join(dir, "mockup.go")
+		if err := ioutil.WriteFile(infile, []byte(c.source), 0644); err != nil {
+			test.Fatal(err)
+		}
+		mockup.CreateStubProgram(infile, filepath.Join(dir, "stub"), c.events...)
+		data, err := ioutil.ReadFile(filepath.Join(dir, "stub.go.stub"))
+		if err != nil {
+			test.Fatal(err)
+		}
+		//Replace the mockup with its stub, so there's only one main
+		if err := ioutil.WriteFile(infile, data, 0644); err != nil {
+			test.Fatal(err)
+		}
+		build := exec.Command(goTool, "build", "-o", os.DevNull, ".")
+		build.Dir = dir
+		if out, err := build.CombinedOutput(); err != nil {
+			test.Errorf("The %s stub doesn't build: %v\n%s", c.name, err, out)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+/**
+* Random traces of a single role, for property-based testing of the code playing it.
+*
+* A Generator walks the finite-state machine of a role's local type, picking
+* what to do next at random, to produce sequences of sends, receives, selections
+* and branches which conform to the protocol. It can also produce traces which
+* deliberately violate it, by changing one of their actions to use the wrong
+* channel, sort or label, or by ending before the role is done.
+*
+* Traces can be made from a *rand.Rand, e.g. for testing/quick with Values,
+* or from a slice of bytes, e.g. for go test -fuzz with ValidFromBytes.
+ */
+package tracegen
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+
+	"github.com/JoeyEremondi/GoSesh/cfsm"
+	"github.com/JoeyEremondi/GoSesh/multiparty"
+)
+
+//How a violating trace was made from a conforming one
+type Mutation int
+
+const (
+	NoMutation Mutation = iota
+	//An action on a channel the role can't use at that point
+	WrongChannel
+	//A send or receive of a value with a sort the role can't use at that point
+	WrongSort
+	//A selection or branch with a label the role can't use at that point
+	WrongLabel
+	//The trace ends while the role still has something to do
+	PrematureEnd
+)
+
+func (m Mutation) String() string {
+	switch m {
+	case NoMutation:
+		return "no mutation"
+	case WrongChannel:
+		return "wrong channel"
+	case WrongSort:
+		return "wrong sort"
+	case WrongLabel:
+		return "wrong label"
+	case PrematureEnd:
+		return "premature end"
+	}
+	return "unknown mutation"
+}
+
+//The actions of a single role, in order
+type Trace struct {
+	Participant multiparty.Participant
+	Actions     []multiparty.Action
+	//Whether the role is done after the actions, rather than the trace stopping at the generator's limit.
+	//A trace ending prematurely is also complete, as it claims the role is done.
+	Complete bool
+	//For violating traces, how the trace was changed, and the index of the first action
+	//which is wrong, or the number of actions for a premature end
+	Mutation Mutation
+	At       int
+}
+
+func (t Trace) String() string {
+	actions := ""
+	for _, action := range t.Actions {
+		actions += action.String() + "; "
+	}
+	if t.Complete {
+		actions += "end"
+	} else {
+		actions += "..."
+	}
+	if t.Mutation != NoMutation {
+		return fmt.Sprintf("%s: %s (%s at %d)", t.Participant, actions, t.Mutation, t.At)
+	}
+	return fmt.Sprintf("%s: %s", t.Participant, actions)
+}
+
+//Makes random traces of a role
+type Generator struct {
+	machine *cfsm.Machine
+	//How many actions a trace may have before it stops, even if the role isn't done
+	MaxLength int
+	//What the role uses anywhere, to pick wrong ones from
+	channels []multiparty.Channel
+	sorts    []multiparty.Sort
+	labels   []string
+}
+
+//Sorts to use for wrong values, besides the ones the role uses itself
+var otherSorts = []multiparty.Sort{"int", "string", "bool", "float64", "[]byte"}
+
+//NewGenerator makes traces of participant p, which behaves as the local type lt,
+//of at most maxLength actions
+func NewGenerator(p multiparty.Participant, lt multiparty.LocalType, maxLength int) (*Generator, error) {
+	m, err := cfsm.NewMachine(p, lt)
+	if err != nil {
+		return nil, err
+	}
+	g := &Generator{machine: m, MaxLength: maxLength}
+	channels := make(map[multiparty.Channel]bool)
+	sorts := make(map[multiparty.Sort]bool)
+	labels := make(map[string]bool)
+	for _, sort := range otherSorts {
+		sorts[sort] = true
+	}
+	for _, transitions := range m.Transitions {
+		for _, transition := range transitions {
+			channels[transition.Action.Channel] = true
+			for _, sort := range transition.Action.Value {
+				sorts[sort] = true
+			}
+			if transition.Action.Label != "" {
+				labels[transition.Action.Label] = true
+			}
+		}
+	}
+	for c := range channels {
+		g.channels = append(g.channels, c)
+	}
+	for s := range sorts {
+		g.sorts = append(g.sorts, s)
+	}
+	for l := range labels {
+		g.labels = append(g.labels, l)
+	}
+	//Sorted so that the same choices always give the same trace
+	sort.Slice(g.channels, func(i, j int) bool { return g.channels[i] < g.channels[j] })
+	sort.Slice(g.sorts, func(i, j int) bool { return g.sorts[i] < g.sorts[j] })
+	sort.Strings(g.labels)
+	return g, nil
+}
+
+//ForProtocol makes a generator for each participant of gt, of traces of at most maxLength actions
+func ForProtocol(gt multiparty.GlobalType, maxLength int) (map[multiparty.Participant]*Generator, error) {
+	ans := make(map[multiparty.Participant]*Generator)
+	for _, p := range gt.Participants() {
+		lt, err := gt.Project(p)
+		if err != nil {
+			return nil, err
+		}
+		if ans[p], err = NewGenerator(p, lt, maxLength); err != nil {
+			return nil, err
+		}
+	}
+	return ans, nil
+}
+
+//Where the random choices of a trace come from
+type chooser interface {
+	//A number from 0 to n-1, or false if there are no more choices to make
+	choose(n int) (int, bool)
+}
+
+type randChooser struct {
+	r *rand.Rand
+}
+
+func (c randChooser) choose(n int) (int, bool) {
+	return c.r.Intn(n), true
+}
+
+//Each choice uses up one byte, so that a fuzzer changing the bytes changes the choices
+type byteChooser struct {
+	data []byte
+}
+
+func (c *byteChooser) choose(n int) (int, bool) {
+	if len(c.data) == 0 {
+		return 0, false
+	}
+	b := c.data[0]
+	c.data = c.data[1:]
+	return int(b) % n, true
+}
+
+//A conforming trace
+func (g *Generator) walk(c chooser) Trace {
+	trace := Trace{Participant: g.machine.Participant}
+	state := g.machine.Initial
+	for len(trace.Actions) < g.MaxLength && !g.machine.Final(state) {
+		transitions := g.machine.Transitions[state]
+		i, ok := c.choose(len(transitions))
+		if !ok {
+			break
+		}
+		trace.Actions = append(trace.Actions, transitions[i].Action)
+		state = transitions[i].To
+	}
+	trace.Complete = g.machine.Final(state)
+	return trace
+}
+
+//Valid makes a random trace which conforms to the role's local type
+func (g *Generator) Valid(r *rand.Rand) Trace {
+	return g.walk(randChooser{r})
+}
+
+//ValidFromBytes makes a trace which conforms to the role's local type, with each byte of data
+//choosing what to do next, stopping once data runs out
+func (g *Generator) ValidFromBytes(data []byte) Trace {
+	return g.walk(&byteChooser{data})
+}
+
+//Violating makes a random trace which doesn't conform to the role's local type,
+//which is a conforming trace with one of its actions changed, or cut short.
+//Returns false if the role does nothing, so that there is nothing to change.
+func (g *Generator) Violating(r *rand.Rand) (Trace, bool) {
+	return g.violate(randChooser{r})
+}
+
+//ViolatingFromBytes makes a trace which doesn't conform to the role's local type,
+//with the bytes of data choosing the conforming trace and then how to change it
+func (g *Generator) ViolatingFromBytes(data []byte) (Trace, bool) {
+	return g.violate(&byteChooser{data})
+}
+
+func (g *Generator) violate(c chooser) (Trace, bool) {
+	trace := g.walk(c)
+	//The same actions might get the role to another state, where a change is fine after all,
+	//so each candidate is checked against the whole local type
+	candidates := make(map[Mutation][]Trace)
+	for at, action := range trace.Actions {
+		for _, mutation := range []Mutation{WrongChannel, WrongSort, WrongLabel} {
+			for _, wrong := range g.mutate(action, mutation) {
+				candidate := Trace{Participant: trace.Participant,
+					Actions:  append(append([]multiparty.Action{}, trace.Actions[:at]...), wrong),
+					Mutation: mutation, At: at}
+				if g.Conforms(candidate) != nil {
+					candidates[mutation] = append(candidates[mutation], candidate)
+				}
+			}
+		}
+	}
+	for at := 0; at <= len(trace.Actions); at++ {
+		candidate := Trace{Participant: trace.Participant, Actions: trace.Actions[:at:at],
+			Complete: true, Mutation: PrematureEnd, At: at}
+		if g.Conforms(candidate) != nil {
+			candidates[PrematureEnd] = append(candidates[PrematureEnd], candidate)
+		}
+	}
+
+	//Pick the kind of mutation first, so that each kind is as likely as any other.
+	//Once there are no more choices, the first one will do.
+	var mutations []Mutation
+	for _, mutation := range []Mutation{WrongChannel, WrongSort, WrongLabel, PrematureEnd} {
+		if len(candidates[mutation]) != 0 {
+			mutations = append(mutations, mutation)
+		}
+	}
+	if len(mutations) == 0 {
+		return Trace{}, false
+	}
+	i, _ := c.choose(len(mutations))
+	mutated := candidates[mutations[i]]
+	j, _ := c.choose(len(mutated))
+	return mutated[j], true
+}
+
+//The ways of changing an action with the given mutation
+func (g *Generator) mutate(action multiparty.Action, mutation Mutation) []multiparty.Action {
+	var ans []multiparty.Action
+	switch mutation {
+	case WrongChannel:
+		for _, c := range append(g.channels, action.Channel+"'") {
+			if c != action.Channel {
+				wrong := action
+				wrong.Channel = c
+				ans = append(ans, wrong)
+			}
+		}
+	case WrongSort:
+		if action.Kind != multiparty.SendAction && action.Kind != multiparty.ReceiveAction {
+			return nil
+		}
+		for i, original := range action.Value {
+			for _, s := range g.sorts {
+				if s != original {
+					wrong := action
+					wrong.Value = append([]multiparty.Sort{}, action.Value...)
+					wrong.Value[i] = s
+					ans = append(ans, wrong)
+				}
+			}
+		}
+	case WrongLabel:
+		if action.Kind != multiparty.SelectAction && action.Kind != multiparty.BranchAction {
+			return nil
+		}
+		for _, l := range append(g.labels, action.Label+"'") {
+			if l != action.Label {
+				wrong := action
+				wrong.Label = l
+				ans = append(ans, wrong)
+			}
+		}
+	}
+	return ans
+}
+
+//Actions are the same if they communicate the same way, whatever the conditions on their values
+func sameAction(a, b multiparty.Action) bool {
+	if a.Kind != b.Kind || a.Channel != b.Channel || a.Label != b.Label || len(a.Value) != len(b.Value) {
+		return false
+	}
+	for i := range a.Value {
+		if a.Value[i] != b.Value[i] {
+			return false
+		}
+	}
+	if a.Kind == multiparty.DelegateAction || a.Kind == multiparty.AcceptAction {
+		return a.Session.Participant() == b.Session.Participant() && a.Session.T.Equals(b.Session.T)
+	}
+	return true
+}
+
+//Conforms checks whether the trace is something the role may do:
+//each of its actions must be one the role can do after the ones before it,
+//and if the trace is complete, the role must be done at the end of it.
+func (g *Generator) Conforms(trace Trace) error {
+	//The same actions can lead to different states, e.g. when the parts of a parallel type do the same thing
+	states := map[int]bool{g.machine.Initial: true}
+	for i, action := range trace.Actions {
+		next := make(map[int]bool)
+		for state := range states {
+			for _, transition := range g.machine.Transitions[state] {
+				if sameAction(transition.Action, action) {
+					next[transition.To] = true
+				}
+			}
+		}
+		if len(next) == 0 {
+			return fmt.Errorf("%s can't do %s after %d actions", g.machine.Participant, action, i)
+		}
+		states = next
+	}
+	if trace.Complete {
+		for state := range states {
+			if g.machine.Final(state) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s isn't done after %d actions", g.machine.Participant, len(trace.Actions))
+	}
+	return nil
+}
+
+//Values fills the arguments of a function tested with testing/quick with traces of the role,
+//which are conforming traces, or violating ones if violating is true.
+//Use it as the Values of a quick.Config, for functions whose arguments are all Traces.
+func (g *Generator) Values(violating bool) func([]reflect.Value, *rand.Rand) {
+	return func(args []reflect.Value, r *rand.Rand) {
+		for i := range args {
+			trace := g.Valid(r)
+			if violating {
+				var ok bool
+				if trace, ok = g.Violating(r); !ok {
+					panic(fmt.Sprintf("%s does nothing, so no trace of it can be violating", g.machine.Participant))
+				}
+			}
+			args[i] = reflect.ValueOf(trace)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package tracegen
+
+import (
+	"testing"
+	"testing/quick"
+
+	"github.com/JoeyEremondi/GoSesh/multiparty"
+)
+
+//A asks B to vote, and keeps asking until B commits or aborts
+func voteProtocol() multiparty.GlobalType {
+	return multiparty.RecursiveType{Bind: "X", Body: multiparty.ValueType{Value: multiparty.SingletonValue("string"),
+		ValuePrefix: multiparty.Prefix{P1: "A", P2: "B", PChannel: "b"},
+		ValueNext: multiparty.BranchingType{BranchPrefix: multiparty.Prefix{P1: "B", P2: "A", PChannel: "a"},
+			Branches: map[string]multiparty.GlobalType{
+				"commit": multiparty.ValueType{Value: multiparty.SingletonValue("bool"),
+					ValuePrefix: multiparty.Prefix{P1: "A", P2: "B", PChannel: "b"}, ValueNext: multiparty.EndType{}},
+				"abort": multiparty.EndType{},
+				"retry": multiparty.NameType("X")}}}}
+}
+
+func TestGenerators(test *testing.T) {
+	generators, err := ForProtocol(voteProtocol(), 10)
+	if err != nil {
+		test.Fatal(err)
+	}
+	for p, g := range generators {
+		conforms := func(trace Trace) bool {
+			return trace.Participant == p && g.Conforms(trace) == nil
+		}
+		if err := quick.Check(conforms, &quick.Config{Values: g.Values(false)}); err != nil {
+			test.Errorf("Generated a trace of %s which doesn't conform: %v", p, err)
+		}
+		violates := func(trace Trace) bool {
+			return trace.Mutation != NoMutation && g.Conforms(trace) != nil
+		}
+		if err := quick.Check(violates, &quick.Config{Values: g.Values(true)}); err != nil {
+			test.Errorf("Generated a violating trace of %s which conforms: %v", p, err)
+		}
+	}
+
+	//With the same choices, A asks, B retries, A asks again, and B commits
+	g := generators["A"]
+	trace := g.ValidFromBytes([]byte{0, 2, 0, 1, 0})
+	expected := "A: b!⟨string⟩; a & retry; b!⟨string⟩; a & commit; b!⟨bool⟩; end"
+	if trace.String() != expected {
+		test.Errorf("Expected %s, got %s", expected, trace)
+	}
+	if err := g.Conforms(Trace{Actions: trace.Actions[:2], Complete: true}); err == nil {
+		test.Errorf("%s conforms, even though A isn't done", trace)
+	}
+}
+
+func FuzzGenerators(f *testing.F) {
+	generators, err := ForProtocol(voteProtocol(), 20)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add([]byte{0, 2, 0, 1, 0})
+	f.Add([]byte{})
+	f.Fuzz(func(test *testing.T, data []byte) {
+		for p, g := range generators {
+			if trace := g.ValidFromBytes(data); g.Conforms(trace) != nil {
+				test.Errorf("Generated a trace of %s which doesn't conform: %s", p, trace)
+			}
+			if trace, ok := g.ViolatingFromBytes(data); ok && g.Conforms(trace) == nil {
+				test.Errorf("Generated a violating trace of %s which conforms: %s", p, trace)
+			}
+		}
+	})
+}